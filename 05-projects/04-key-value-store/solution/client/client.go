@@ -0,0 +1,174 @@
+// Package client talks to the KV server over RESP. A Client is safe for
+// concurrent use: each command borrows a connection from a bounded pool
+// and returns it once the reply has been read.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+const (
+	DefaultPoolSize            = 10
+	DefaultDialTimeout         = 5 * time.Second
+	DefaultReadTimeout         = 3 * time.Second
+	DefaultWriteTimeout        = 3 * time.Second
+	DefaultIdleTimeout         = 5 * time.Minute
+	DefaultHealthCheckInterval = time.Minute
+)
+
+var (
+	// ErrNil is returned when the server replies with a null, e.g. for GET
+	// of a missing key.
+	ErrNil = errors.New("client: nil reply")
+
+	ErrClosed      = errors.New("client: closed")
+	ErrPoolTimeout = errors.New("client: timed out waiting for a connection")
+)
+
+// Error is an error reply from the server, such as
+// "WRONGTYPE Operation against a key holding the wrong kind of value".
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+type Config struct {
+	Addr string
+
+	// Username and Password are sent with AUTH on every new connection,
+	// if Password is set. Without a Username they are the default user's.
+	Username string
+	Password string
+
+	// PoolSize is the most connections the client keeps open. Commands
+	// wait for one to become free once they are all in use.
+	PoolSize int
+	// PoolTimeout is how long a command waits for a free connection
+	// before failing with ErrPoolTimeout. The default is ReadTimeout plus
+	// a second.
+	PoolTimeout time.Duration
+
+	DialTimeout time.Duration
+	// ReadTimeout and WriteTimeout bound each round trip on top of any
+	// deadline of the command's context.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout is how long a connection may sit unused in the pool
+	// before it is closed.
+	IdleTimeout time.Duration
+	// HealthCheckInterval is how long a connection may sit unused before
+	// it is checked with a PING on its next use, so a connection the
+	// server has dropped isn't handed to a command.
+	HealthCheckInterval time.Duration
+}
+
+// Client is a pool of connections to one server, or with NewCluster a
+// pool per node of a cluster.
+type Client struct {
+	cfg     Config
+	pool    *pool
+	cluster *cluster // set by NewCluster, instead of pool
+}
+
+// New creates a client for cfg.Addr. Connections are dialed on demand.
+func New(cfg Config) *Client {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = DefaultPoolSize
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = DefaultReadTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = DefaultWriteTimeout
+	}
+	if cfg.PoolTimeout == 0 {
+		cfg.PoolTimeout = cfg.ReadTimeout + time.Second
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.HealthCheckInterval == 0 {
+		cfg.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	return &Client{cfg: cfg, pool: newPool(cfg)}
+}
+
+// Close closes every connection. Commands running at the time fail.
+func (c *Client) Close() error {
+	if c.cluster != nil {
+		return c.cluster.close()
+	}
+	return c.pool.close()
+}
+
+// Stats returns the pool's counters.
+func (c *Client) Stats() PoolStats {
+	if c.cluster != nil {
+		return c.cluster.stats()
+	}
+	return c.pool.stats()
+}
+
+// Do sends a command and returns its reply. An error reply is returned as
+// an Error, alongside the reply itself.
+func (c *Client) Do(ctx context.Context, args ...string) (protocol.Value, error) {
+	replies, err := c.roundTrip(ctx, [][]string{args})
+	if err != nil {
+		return protocol.Value{}, err
+	}
+	return replies[0], replyError(replies[0])
+}
+
+// roundTrip sends cmds on one connection and reads a reply to each.
+func (c *Client) roundTrip(ctx context.Context, cmds [][]string) ([]protocol.Value, error) {
+	return c.roundTripTimeout(ctx, cmds, c.cfg.ReadTimeout)
+}
+
+// roundTripTimeout is roundTrip with its own read timeout, 0 for none.
+func (c *Client) roundTripTimeout(ctx context.Context, cmds [][]string, readTimeout time.Duration) ([]protocol.Value, error) {
+	if c.cluster != nil {
+		return c.cluster.roundTrip(ctx, cmds, readTimeout)
+	}
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := cn.roundTrip(ctx, cmds, readTimeout, c.cfg.WriteTimeout)
+	c.pool.put(cn)
+	return replies, err
+}
+
+// authenticate sends AUTH on a new connection if cfg has a password.
+func authenticate(ctx context.Context, cn *conn, cfg Config) error {
+	if cfg.Password == "" {
+		return nil
+	}
+	args := []string{"AUTH", cfg.Password}
+	if cfg.Username != "" {
+		args = []string{"AUTH", cfg.Username, cfg.Password}
+	}
+	replies, err := cn.roundTrip(ctx, [][]string{args}, cfg.ReadTimeout, cfg.WriteTimeout)
+	if err != nil {
+		return err
+	}
+	return replyError(replies[0])
+}
+
+func replyError(v protocol.Value) error {
+	if v.IsError() {
+		return Error(v.Str)
+	}
+	return nil
+}
+
+func unexpected(v protocol.Value, want string) error {
+	return fmt.Errorf("%w: expected %s reply, got %q", protocol.ErrProtocol, want, byte(v.Type))
+}
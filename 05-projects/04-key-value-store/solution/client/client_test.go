@@ -0,0 +1,392 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/server"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs the server in-process and returns a client for it.
+func startServer(t *testing.T, cfg Config) *Client {
+	t.Helper()
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(filepath.Join(t.TempDir(), "test.wal"))
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := server.New(protocol.NewHandler(kvStore, wal))
+	go srv.Serve(listener)
+
+	cfg.Addr = listener.Addr().String()
+	c := New(cfg)
+	t.Cleanup(func() {
+		c.Close()
+		srv.Close()
+		wal.Close()
+	})
+	return c
+}
+
+func TestClient_Strings(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	require.NoError(t, c.Ping(ctx))
+	require.NoError(t, c.Set(ctx, "key", "hello world\r\n"))
+	val, err := c.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\r\n", val)
+
+	_, err = c.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNil)
+
+	ok, err := c.SetArgs(ctx, "key", "v2", SetOptions{Condition: SetIfAbsent})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = c.SetArgs(ctx, "key", "v2", SetOptions{Condition: SetIfPresent, TTL: time.Minute})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ttl, err := c.TTL(ctx, "key")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, ttl, float64(time.Second))
+
+	ok, err = c.SetNX(ctx, "fresh", "1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	old, err := c.GetSet(ctx, "fresh", "10")
+	require.NoError(t, err)
+	assert.Equal(t, "1", old)
+
+	n, err := c.Incr(ctx, "fresh")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	n, err = c.DecrBy(ctx, "fresh", 20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-9), n)
+
+	// Error replies come back as Error
+	_, err = c.LPush(ctx, "fresh", "x")
+	var replyErr Error
+	require.ErrorAs(t, err, &replyErr)
+	assert.Contains(t, string(replyErr), "WRONGTYPE")
+}
+
+func TestClient_Keys(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, c.Set(ctx, "user:"+strconv.Itoa(i), "v"))
+	}
+	require.NoError(t, c.Set(ctx, "other", "v"))
+
+	n, err := c.Exists(ctx, "user:1", "user:2", "nope")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	keys, err := c.Keys(ctx, "user:1*")
+	require.NoError(t, err)
+	assert.Len(t, keys, 11)
+
+	var scanned []string
+	var cursor uint64
+	for {
+		var batch []string
+		batch, cursor, err = c.Scan(ctx, cursor, "user:*", 10)
+		require.NoError(t, err)
+		scanned = append(scanned, batch...)
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Len(t, scanned, 50)
+
+	typ, err := c.Type(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, "string", typ)
+
+	ok, err := c.Expire(ctx, "other", 1500*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = c.Persist(ctx, "other")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ttl, err := c.TTL(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, NoExpiry, ttl)
+	_, err = c.TTL(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNil)
+
+	ok, err = c.ExpireAt(ctx, "other", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	n, err = c.Del(ctx, "user:1", "user:2", "other")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestClient_Collections(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	n, err := c.RPush(ctx, "list", "a", "b", "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	_, err = c.LPush(ctx, "list", "z")
+	require.NoError(t, err)
+	head, err := c.LPop(ctx, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "z", head)
+	popped, err := c.LPopCount(ctx, "list", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, popped)
+	rest, err := c.LRange(ctx, "list", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, rest)
+	tail, err := c.RPop(ctx, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "c", tail)
+	length, err := c.LLen(ctx, "list")
+	require.NoError(t, err)
+	assert.Zero(t, length)
+
+	_, err = c.HSet(ctx, "hash", "f1", "v1", "f2", "v2")
+	require.NoError(t, err)
+	v, err := c.HGet(ctx, "hash", "f2")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", v)
+	all, err := c.HGetAll(ctx, "hash")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, all)
+	n, err = c.HDel(ctx, "hash", "f1", "nope")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	_, err = c.SAdd(ctx, "s1", "a", "b", "c")
+	require.NoError(t, err)
+	_, err = c.SAdd(ctx, "s2", "b", "c", "d")
+	require.NoError(t, err)
+	inter, err := c.SInter(ctx, "s1", "s2")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"b", "c"}, inter)
+	_, err = c.SRem(ctx, "s1", "a")
+	require.NoError(t, err)
+	members, err := c.SMembers(ctx, "s1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"b", "c"}, members)
+
+	_, err = c.ZAdd(ctx, "z", Z{Score: 2, Member: "two"}, Z{Score: 1.5, Member: "one"}, Z{Score: 3, Member: "three"})
+	require.NoError(t, err)
+	ranked, err := c.ZRange(ctx, "z", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one", "two", "three"}, ranked)
+	scored, err := c.ZRangeWithScores(ctx, "z", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Z{{Score: 1.5, Member: "one"}}, scored)
+	byScore, err := c.ZRangeByScore(ctx, "z", "(1.5", "+inf")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"two", "three"}, byScore)
+	rank, err := c.ZRank(ctx, "z", "three")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rank)
+	_, err = c.ZRank(ctx, "z", "four")
+	assert.ErrorIs(t, err, ErrNil)
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	p := c.Pipeline()
+	for i := 0; i < 100; i++ {
+		p.Do("SET", "key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	p.Do("GET", "key42")
+	assert.Equal(t, 101, p.Len())
+
+	replies, err := p.Exec(ctx)
+	require.NoError(t, err)
+	require.Len(t, replies, 101)
+	assert.Equal(t, "OK", replies[0].Str)
+	assert.Equal(t, "42", replies[100].Str)
+	assert.Equal(t, 0, p.Len(), "Exec empties the pipeline")
+	assert.Equal(t, uint64(1), c.Stats().Misses, "one connection for the whole pipeline")
+
+	// An error reply doesn't stop the commands after it
+	p.Do("INCR", "key1")
+	p.Do("LPUSH", "key1", "x")
+	p.Do("INCR", "key1")
+	replies, err = p.Exec(ctx)
+	var replyErr Error
+	require.ErrorAs(t, err, &replyErr)
+	require.Len(t, replies, 3)
+	assert.Equal(t, int64(3), replies[2].Int)
+}
+
+func TestClient_TxPipeline(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	tx := c.TxPipeline()
+	tx.Do("INCR", "counter")
+	tx.Do("INCR", "counter")
+	tx.Do("GET", "counter")
+	replies, err := tx.Exec(ctx)
+	require.NoError(t, err)
+	require.Len(t, replies, 3)
+	assert.Equal(t, "2", replies[2].Str)
+
+	tx.Do("INCR", "counter")
+	tx.Do("NOSUCHCOMMAND")
+	_, err = tx.Exec(ctx)
+	var replyErr Error
+	require.ErrorAs(t, err, &replyErr)
+	assert.Contains(t, string(replyErr), "EXECABORT")
+
+	val, err := c.Get(ctx, "counter")
+	require.NoError(t, err)
+	assert.Equal(t, "2", val, "an aborted transaction runs nothing")
+}
+
+func TestClient_BlockingPop(t *testing.T) {
+	// Waiting longer than the read timeout is fine
+	c := startServer(t, Config{ReadTimeout: 20 * time.Millisecond})
+	ctx := context.Background()
+
+	time.AfterFunc(50*time.Millisecond, func() { c.RPush(ctx, "jobs", "job") })
+	key, value, err := c.BRPop(ctx, 0, "other", "jobs")
+	require.NoError(t, err)
+	assert.Equal(t, "jobs", key)
+	assert.Equal(t, "job", value)
+
+	_, _, err = c.BLPop(ctx, 30*time.Millisecond, "jobs")
+	assert.ErrorIs(t, err, ErrNil)
+}
+
+func TestClient_PubSub(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	ps, err := c.Subscribe(ctx, "news", "sport")
+	require.NoError(t, err)
+	defer ps.Close()
+	require.NoError(t, ps.PSubscribe(ctx, "log.*"))
+
+	// Wait for the pattern subscription to be registered
+	require.Eventually(t, func() bool {
+		n, err := c.Publish(ctx, "log.info", "ready")
+		return err == nil && n == 1
+	}, time.Second, 5*time.Millisecond)
+	msg, err := ps.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Message{Pattern: "log.*", Channel: "log.info", Payload: "ready"}, msg)
+
+	n, err := c.Publish(ctx, "sport", "goal")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	msg, err = ps.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Message{Channel: "sport", Payload: "goal"}, msg)
+
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = ps.Receive(short)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// silentServer accepts connections and never replies.
+func silentServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClient_ContextEndsCommand(t *testing.T) {
+	c := New(Config{Addr: silentServer(t), ReadTimeout: time.Minute})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Get(ctx, "key")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = c.Get(ctx, "key")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	assert.Equal(t, 0, c.Stats().TotalConns, "a connection with a reply pending is closed")
+}
+
+func TestClient_ReadTimeout(t *testing.T) {
+	c := New(Config{Addr: silentServer(t), ReadTimeout: 20 * time.Millisecond})
+	defer c.Close()
+
+	_, err := c.Get(context.Background(), "key")
+	var ne net.Error
+	require.True(t, errors.As(err, &ne), "got %v", err)
+	assert.True(t, ne.Timeout())
+}
+
+func TestClient_Auth(t *testing.T) {
+	admin := startServer(t, Config{})
+	ctx := context.Background()
+	_, err := admin.Do(ctx, "ACL", "SETUSER", "app", "on", ">pw", "+@all", "~*")
+	require.NoError(t, err)
+	_, err = admin.Do(ctx, "ACL", "SETUSER", "default", ">secret")
+	require.NoError(t, err)
+
+	for _, cfg := range []Config{
+		{Addr: admin.cfg.Addr, Password: "secret"},
+		{Addr: admin.cfg.Addr, Username: "app", Password: "pw"},
+	} {
+		c := New(cfg)
+		require.NoError(t, c.Set(ctx, "key", "value"), cfg.Username)
+		ps, err := c.Subscribe(ctx, "news")
+		require.NoError(t, err, cfg.Username)
+		ps.Close()
+		c.Close()
+	}
+
+	c := New(Config{Addr: admin.cfg.Addr, Password: "wrong"})
+	defer c.Close()
+	err = c.Ping(ctx)
+	assert.ErrorContains(t, err, "WRONGPASS")
+	assert.Equal(t, 0, c.Stats().TotalConns, "connections that fail to authenticate are closed")
+	_, err = c.Subscribe(ctx, "news")
+	assert.ErrorContains(t, err, "WRONGPASS")
+
+	anonymous := New(Config{Addr: admin.cfg.Addr})
+	defer anonymous.Close()
+	assert.ErrorContains(t, anonymous.Ping(ctx), "NOAUTH")
+}
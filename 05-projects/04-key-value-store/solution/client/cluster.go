@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// DefaultMaxRedirects is how many MOVED or ASK redirections a command
+// follows before its last reply is returned.
+const DefaultMaxRedirects = 5
+
+type ClusterConfig struct {
+	// Addrs are nodes to learn the cluster's slots from. Any node will do.
+	Addrs []string
+	// MaxRedirects is how many redirections a command follows.
+	MaxRedirects int
+
+	// Config applies to the connections to every node; its Addr is
+	// ignored.
+	Config
+}
+
+// cluster routes commands to the nodes of a cluster by the hash slots of
+// their keys, and keeps a client per node. Its map of slots to nodes is
+// loaded with CLUSTER SLOTS when the client is first used, and then
+// corrected by the MOVED replies of nodes that no longer own a slot.
+type cluster struct {
+	cfg ClusterConfig
+
+	mu     sync.RWMutex
+	nodes  map[string]*Client // by address
+	slots  []string           // address of each slot's node, nil until loaded
+	closed bool
+}
+
+// NewCluster creates a client for the cluster that includes the nodes at
+// cfg.Addrs. Commands go to the node that owns their keys' slot; commands
+// without keys, such as PING or KEYS, go to any one node. Subscriptions
+// are made with the first node of cfg.Addrs.
+//
+// Every command of a transaction must use keys in one slot. Otherwise the
+// commands of a pipeline may go to different nodes, and those redirected
+// run after the rest of the pipeline.
+func NewCluster(cfg ClusterConfig) *Client {
+	if cfg.MaxRedirects <= 0 {
+		cfg.MaxRedirects = DefaultMaxRedirects
+	}
+	if len(cfg.Addrs) > 0 {
+		cfg.Config.Addr = cfg.Addrs[0]
+	}
+	c := New(cfg.Config)
+	c.pool = nil
+	c.cluster = &cluster{cfg: cfg, nodes: make(map[string]*Client)}
+	return c
+}
+
+// node returns the client for the node at addr.
+func (cl *cluster) node(addr string) (*Client, error) {
+	cl.mu.RLock()
+	n, ok := cl.nodes[addr]
+	closed := cl.closed
+	cl.mu.RUnlock()
+	if ok {
+		return n, nil
+	}
+	if closed {
+		return nil, ErrClosed
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return nil, ErrClosed
+	}
+	if n, ok := cl.nodes[addr]; ok {
+		return n, nil
+	}
+	cfg := cl.cfg.Config
+	cfg.Addr = addr
+	n = New(cfg)
+	cl.nodes[addr] = n
+	return n, nil
+}
+
+// loadSlots asks the seed nodes, then any others known, for the slot map,
+// and keeps the first one given.
+func (cl *cluster) loadSlots(ctx context.Context) error {
+	addrs := append([]string(nil), cl.cfg.Addrs...)
+	cl.mu.RLock()
+	for addr := range cl.nodes {
+		addrs = append(addrs, addr)
+	}
+	cl.mu.RUnlock()
+	if len(addrs) == 0 {
+		return errors.New("client: no cluster addresses")
+	}
+
+	var err error
+	for _, addr := range addrs {
+		var n *Client
+		if n, err = cl.node(addr); err != nil {
+			return err
+		}
+		var v protocol.Value
+		if v, err = n.Do(ctx, "CLUSTER", "SLOTS"); err != nil {
+			continue
+		}
+		var slots []string
+		if slots, err = parseClusterSlots(v); err != nil {
+			continue
+		}
+		cl.mu.Lock()
+		cl.slots = slots
+		cl.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("client: loading cluster slots: %w", err)
+}
+
+// parseClusterSlots reads a CLUSTER SLOTS reply, an array of
+// [start, end, [host, port, id]], into the address of each slot's node.
+func parseClusterSlots(v protocol.Value) ([]string, error) {
+	if v.Type != protocol.TypeArray {
+		return nil, unexpected(v, "array")
+	}
+	slots := make([]string, protocol.ClusterSlots)
+	for _, r := range v.Elems {
+		if len(r.Elems) < 3 || len(r.Elems[2].Elems) < 2 {
+			return nil, fmt.Errorf("%w: malformed CLUSTER SLOTS reply", protocol.ErrProtocol)
+		}
+		start, end := int(r.Elems[0].Int), int(r.Elems[1].Int)
+		node := r.Elems[2].Elems
+		addr := net.JoinHostPort(node[0].Str, strconv.FormatInt(node[1].Int, 10))
+		for slot := max(start, 0); slot <= end && slot < len(slots); slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+// addr returns the address of the node to send cmds to: the owner of the
+// slot of their first key, or the first seed if they have none.
+func (cl *cluster) addr(ctx context.Context, cmds [][]string) (string, error) {
+	cl.mu.RLock()
+	loaded := cl.slots != nil
+	cl.mu.RUnlock()
+	if !loaded {
+		if err := cl.loadSlots(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	for _, cmd := range cmds {
+		if keys := protocol.CommandKeys(cmd); len(keys) > 0 {
+			cl.mu.RLock()
+			addr := cl.slots[protocol.KeySlot(keys[0])]
+			cl.mu.RUnlock()
+			if addr != "" {
+				return addr, nil
+			}
+			break
+		}
+	}
+	return cl.cfg.Addrs[0], nil
+}
+
+// roundTrip sends cmds to the nodes that serve them and returns a reply to
+// each, in order. A transaction is sent to one node as a whole.
+func (cl *cluster) roundTrip(ctx context.Context, cmds [][]string, readTimeout time.Duration) ([]protocol.Value, error) {
+	if isTx(cmds) {
+		return cl.roundTripTx(ctx, cmds, readTimeout)
+	}
+
+	// Group the commands by node, keeping each node's in order
+	groups := make(map[string][]int)
+	var order []string
+	for i := range cmds {
+		addr, err := cl.addr(ctx, cmds[i:i+1])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := groups[addr]; !ok {
+			order = append(order, addr)
+		}
+		groups[addr] = append(groups[addr], i)
+	}
+
+	replies := make([]protocol.Value, len(cmds))
+	for _, addr := range order {
+		group := make([][]string, len(groups[addr]))
+		for j, i := range groups[addr] {
+			group[j] = cmds[i]
+		}
+		n, err := cl.node(addr)
+		if err != nil {
+			return nil, err
+		}
+		got, err := n.roundTripTimeout(ctx, group, readTimeout)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range groups[addr] {
+			replies[i] = got[j]
+		}
+	}
+
+	for i, v := range replies {
+		if _, _, ok := parseRedirect(v); !ok {
+			continue
+		}
+		got, err := cl.follow(ctx, [][]string{cmds[i]}, []protocol.Value{v}, readTimeout)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = got[0]
+	}
+	return replies, nil
+}
+
+// roundTripTx sends a MULTI ... EXEC batch to the node of its keys,
+// following a redirection of any of its commands with the whole batch.
+func (cl *cluster) roundTripTx(ctx context.Context, cmds [][]string, readTimeout time.Duration) ([]protocol.Value, error) {
+	addr, err := cl.addr(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+	n, err := cl.node(addr)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := n.roundTripTimeout(ctx, cmds, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return cl.follow(ctx, cmds, replies, readTimeout)
+}
+
+// follow resends cmds where a redirection in their replies points, until
+// none is redirected or MaxRedirects is reached.
+func (cl *cluster) follow(ctx context.Context, cmds [][]string, replies []protocol.Value, readTimeout time.Duration) ([]protocol.Value, error) {
+	for range cl.cfg.MaxRedirects {
+		var kind, addr string
+		for _, v := range replies {
+			var ok bool
+			if kind, addr, ok = parseRedirect(v); ok {
+				break
+			}
+		}
+		if addr == "" {
+			return replies, nil
+		}
+
+		n, err := cl.node(addr)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "MOVED" {
+			cl.moved(cmds, addr)
+			if replies, err = n.roundTripTimeout(ctx, cmds, readTimeout); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The slot is moving to addr, which only serves it to clients that
+		// ask first
+		asked := append([][]string{{"ASKING"}}, cmds...)
+		if replies, err = n.roundTripTimeout(ctx, asked, readTimeout); err != nil {
+			return nil, err
+		}
+		replies = replies[1:]
+	}
+	return replies, nil
+}
+
+// moved records that the slot of cmds' keys is now served by addr.
+func (cl *cluster) moved(cmds [][]string, addr string) {
+	for _, cmd := range cmds {
+		if keys := protocol.CommandKeys(cmd); len(keys) > 0 {
+			cl.mu.Lock()
+			if cl.slots != nil {
+				cl.slots[protocol.KeySlot(keys[0])] = addr
+			}
+			cl.mu.Unlock()
+			return
+		}
+	}
+}
+
+// parseRedirect reads a "MOVED slot addr" or "ASK slot addr" error reply.
+func parseRedirect(v protocol.Value) (kind, addr string, ok bool) {
+	if !v.IsError() {
+		return "", "", false
+	}
+	fields := strings.Fields(v.Str)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+func isTx(cmds [][]string) bool {
+	return len(cmds) >= 2 && strings.EqualFold(cmds[0][0], "MULTI") && strings.EqualFold(cmds[len(cmds)-1][0], "EXEC")
+}
+
+func (cl *cluster) close() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return nil
+	}
+	cl.closed = true
+	var err error
+	for _, n := range cl.nodes {
+		err = errors.Join(err, n.Close())
+	}
+	return err
+}
+
+// stats adds up the pools of every node.
+func (cl *cluster) stats() PoolStats {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	var total PoolStats
+	for _, n := range cl.nodes {
+		st := n.Stats()
+		total.TotalConns += st.TotalConns
+		total.IdleConns += st.IdleConns
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+		total.Timeouts += st.Timeouts
+		total.StaleConns += st.StaleConns
+	}
+	return total
+}
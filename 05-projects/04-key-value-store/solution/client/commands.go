@@ -0,0 +1,447 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// The typed methods below mirror the commands of protocol.Handler. Anything
+// else, such as REPLICAOF or RAFT, can be sent with Do.
+
+func stringReply(v protocol.Value, err error) (string, error) {
+	switch {
+	case err != nil:
+		return "", err
+	case v.Null:
+		return "", ErrNil
+	case v.Type != protocol.TypeBulkString && v.Type != protocol.TypeSimpleString:
+		return "", unexpected(v, "string")
+	}
+	return v.Str, nil
+}
+
+func intReply(v protocol.Value, err error) (int64, error) {
+	switch {
+	case err != nil:
+		return 0, err
+	case v.Null:
+		return 0, ErrNil
+	case v.Type != protocol.TypeInteger:
+		return 0, unexpected(v, "integer")
+	}
+	return v.Int, nil
+}
+
+func boolReply(v protocol.Value, err error) (bool, error) {
+	n, err := intReply(v, err)
+	return n == 1, err
+}
+
+// stringsReply accepts arrays and RESP3 sets and maps. A null array is
+// returned as nil.
+func stringsReply(v protocol.Value, err error) ([]string, error) {
+	switch {
+	case err != nil:
+		return nil, err
+	case v.Null:
+		return nil, nil
+	case v.Type != protocol.TypeArray && v.Type != protocol.TypeSet && v.Type != protocol.TypeMap:
+		return nil, unexpected(v, "array")
+	}
+	return v.Strings(), nil
+}
+
+func okReply(v protocol.Value, err error) error {
+	if err != nil {
+		return err
+	}
+	if v.Type != protocol.TypeSimpleString {
+		return unexpected(v, "status")
+	}
+	return nil
+}
+
+func formatInt(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func formatMillis(d time.Duration) string {
+	return formatInt(d.Milliseconds())
+}
+
+// Strings
+
+func (c *Client) Ping(ctx context.Context) error {
+	return okReply(c.Do(ctx, "PING"))
+}
+
+func (c *Client) Echo(ctx context.Context, message string) (string, error) {
+	return stringReply(c.Do(ctx, "ECHO", message))
+}
+
+// Get returns the string at key, or ErrNil if there is none.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return stringReply(c.Do(ctx, "GET", key))
+}
+
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	return okReply(c.Do(ctx, "SET", key, value))
+}
+
+// SetCondition makes SetArgs depend on whether the key exists.
+type SetCondition int
+
+const (
+	SetAlways    SetCondition = iota
+	SetIfAbsent               // NX
+	SetIfPresent              // XX
+)
+
+// SetOptions are the options of SET. TTL and ExpireAt are exclusive; if
+// neither is set, the key keeps whatever expiry it had.
+type SetOptions struct {
+	Condition SetCondition
+	TTL       time.Duration
+	ExpireAt  time.Time
+}
+
+// SetArgs is SET with options. It reports whether the value was set,
+// which is false when the condition didn't hold.
+func (c *Client) SetArgs(ctx context.Context, key, value string, opts SetOptions) (bool, error) {
+	args := []string{"SET", key, value}
+	switch opts.Condition {
+	case SetIfAbsent:
+		args = append(args, "NX")
+	case SetIfPresent:
+		args = append(args, "XX")
+	}
+	switch {
+	case opts.TTL > 0:
+		args = append(args, "PX", formatMillis(opts.TTL))
+	case !opts.ExpireAt.IsZero():
+		args = append(args, "PXAT", formatInt(opts.ExpireAt.UnixMilli()))
+	}
+
+	v, err := c.Do(ctx, args...)
+	if err == nil && v.Null {
+		return false, nil
+	}
+	if err := okReply(v, err); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetEX sets key to expire after ttl.
+func (c *Client) SetEX(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := c.SetArgs(ctx, key, value, SetOptions{TTL: ttl})
+	return err
+}
+
+func (c *Client) SetNX(ctx context.Context, key, value string) (bool, error) {
+	return boolReply(c.Do(ctx, "SETNX", key, value))
+}
+
+// GetSet sets key and returns its previous value, or ErrNil if there was
+// none.
+func (c *Client) GetSet(ctx context.Context, key, value string) (string, error) {
+	return stringReply(c.Do(ctx, "GETSET", key, value))
+}
+
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return intReply(c.Do(ctx, "INCR", key))
+}
+
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return intReply(c.Do(ctx, "DECR", key))
+}
+
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	return intReply(c.Do(ctx, "INCRBY", key, formatInt(delta)))
+}
+
+func (c *Client) DecrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	return intReply(c.Do(ctx, "DECRBY", key, formatInt(delta)))
+}
+
+// Keys
+
+// Del deletes keys and returns how many existed.
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"DEL"}, keys...)...))
+}
+
+// Exists returns how many of keys exist.
+func (c *Client) Exists(ctx context.Context, keys ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"EXISTS"}, keys...)...))
+}
+
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return stringsReply(c.Do(ctx, "KEYS", pattern))
+}
+
+// Scan returns a batch of keys matching pattern and the cursor to continue
+// from; iteration is complete when it is 0. An empty pattern matches every
+// key and a count of 0 leaves the batch size to the server.
+func (c *Client) Scan(ctx context.Context, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v.Type != protocol.TypeArray || len(v.Elems) != 2 {
+		return nil, 0, unexpected(v, "cursor and keys")
+	}
+	next, err := strconv.ParseUint(v.Elems[0].Str, 10, 64)
+	if err != nil {
+		return nil, 0, unexpected(v.Elems[0], "cursor")
+	}
+	keys, err := stringsReply(v.Elems[1], nil)
+	return keys, next, err
+}
+
+// Type returns "string", "list", "hash", "set", "zset" or "none".
+func (c *Client) Type(ctx context.Context, key string) (string, error) {
+	return stringReply(c.Do(ctx, "TYPE", key))
+}
+
+// Expire sets a key's TTL with millisecond precision. It reports false if
+// the key doesn't exist.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return boolReply(c.Do(ctx, "PEXPIRE", key, formatMillis(ttl)))
+}
+
+func (c *Client) ExpireAt(ctx context.Context, key string, at time.Time) (bool, error) {
+	return boolReply(c.Do(ctx, "PEXPIREAT", key, formatInt(at.UnixMilli())))
+}
+
+// Persist removes a key's TTL. It reports false if the key had none.
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	return boolReply(c.Do(ctx, "PERSIST", key))
+}
+
+// NoExpiry is the TTL of a key that exists but doesn't expire.
+const NoExpiry time.Duration = -1
+
+// TTL returns the time key has left to live, NoExpiry, or ErrNil if the
+// key doesn't exist.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := intReply(c.Do(ctx, "PTTL", key))
+	switch {
+	case err != nil:
+		return 0, err
+	case ms == -2:
+		return 0, ErrNil
+	case ms == -1:
+		return NoExpiry, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Lists
+
+// LPush prepends values to a list and returns its new length.
+func (c *Client) LPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"LPUSH", key}, values...)...))
+}
+
+// RPush appends values to a list and returns its new length.
+func (c *Client) RPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"RPUSH", key}, values...)...))
+}
+
+// LPop removes and returns the first element of a list, or ErrNil if the
+// list doesn't exist.
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return stringReply(c.Do(ctx, "LPOP", key))
+}
+
+// LPopCount removes and returns up to count elements from the head of a
+// list.
+func (c *Client) LPopCount(ctx context.Context, key string, count int) ([]string, error) {
+	return stringsReply(c.Do(ctx, "LPOP", key, strconv.Itoa(count)))
+}
+
+// RPop removes and returns the last element of a list, or ErrNil if the
+// list doesn't exist.
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return stringReply(c.Do(ctx, "RPOP", key))
+}
+
+// RPopCount removes and returns up to count elements from the tail of a
+// list, last one first.
+func (c *Client) RPopCount(ctx context.Context, key string, count int) ([]string, error) {
+	return stringsReply(c.Do(ctx, "RPOP", key, strconv.Itoa(count)))
+}
+
+// BLPop pops the first element of the first non-empty list among keys,
+// waiting up to timeout for one to be pushed if they are all empty, or
+// forever if timeout is 0. It returns the key and the element, or ErrNil
+// once the timeout passes. The connection is tied up while it waits.
+func (c *Client) BLPop(ctx context.Context, timeout time.Duration, keys ...string) (key, value string, err error) {
+	return c.blockingPop(ctx, "BLPOP", timeout, keys)
+}
+
+// BRPop is BLPop for the last element.
+func (c *Client) BRPop(ctx context.Context, timeout time.Duration, keys ...string) (key, value string, err error) {
+	return c.blockingPop(ctx, "BRPOP", timeout, keys)
+}
+
+func (c *Client) blockingPop(ctx context.Context, command string, timeout time.Duration, keys []string) (string, string, error) {
+	args := append(append([]string{command}, keys...), strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+
+	// The reply may take as long as the timeout on top of the usual
+	readTimeout := time.Duration(0)
+	if timeout > 0 {
+		readTimeout = c.cfg.ReadTimeout + timeout
+	}
+	replies, err := c.roundTripTimeout(ctx, [][]string{args}, readTimeout)
+	if err != nil {
+		return "", "", err
+	}
+	v := replies[0]
+	if err := replyError(v); err != nil {
+		return "", "", err
+	}
+	if v.Null {
+		return "", "", ErrNil
+	}
+	fields := v.Strings()
+	if len(fields) != 2 {
+		return "", "", unexpected(v, "key and element")
+	}
+	return fields[0], fields[1], nil
+}
+
+// LLen returns the length of a list, 0 if it doesn't exist.
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return intReply(c.Do(ctx, "LLEN", key))
+}
+
+func (c *Client) LRange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return stringsReply(c.Do(ctx, "LRANGE", key, strconv.Itoa(start), strconv.Itoa(stop)))
+}
+
+// Hashes
+
+// HSet sets fields of a hash, given as field, value pairs, and returns
+// how many were added.
+func (c *Client) HSet(ctx context.Context, key string, pairs ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"HSET", key}, pairs...)...))
+}
+
+// HGet returns a field of a hash, or ErrNil if it isn't set.
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	return stringReply(c.Do(ctx, "HGET", key, field))
+}
+
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	pairs, err := stringsReply(c.Do(ctx, "HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fields[pairs[i]] = pairs[i+1]
+	}
+	return fields, nil
+}
+
+// HDel removes fields from a hash and returns how many existed.
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"HDEL", key}, fields...)...))
+}
+
+// Sets
+
+// SAdd adds members to a set and returns how many were new.
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"SADD", key}, members...)...))
+}
+
+// SRem removes members from a set and returns how many were in it.
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"SREM", key}, members...)...))
+}
+
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return stringsReply(c.Do(ctx, "SMEMBERS", key))
+}
+
+func (c *Client) SInter(ctx context.Context, keys ...string) ([]string, error) {
+	return stringsReply(c.Do(ctx, append([]string{"SINTER"}, keys...)...))
+}
+
+// Sorted sets
+
+// Z is a sorted set member with its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// ZAdd adds members to a sorted set, or updates their scores, and returns
+// how many were new.
+func (c *Client) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := make([]string, 0, 2+2*len(members))
+	args = append(args, "ZADD", key)
+	for _, m := range members {
+		args = append(args, strconv.FormatFloat(m.Score, 'g', -1, 64), m.Member)
+	}
+	return intReply(c.Do(ctx, args...))
+}
+
+// ZRange returns the members ranked start to stop, lowest score first.
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return stringsReply(c.Do(ctx, "ZRANGE", key, strconv.Itoa(start), strconv.Itoa(stop)))
+}
+
+// ZRangeWithScores is ZRange with the members' scores.
+func (c *Client) ZRangeWithScores(ctx context.Context, key string, start, stop int) ([]Z, error) {
+	return zReply(c.Do(ctx, "ZRANGE", key, strconv.Itoa(start), strconv.Itoa(stop), "WITHSCORES"))
+}
+
+// ZRangeByScore returns the members with scores between min and max, which
+// take the server's syntax: a number, "(" before a number to exclude it,
+// "-inf" or "+inf".
+func (c *Client) ZRangeByScore(ctx context.Context, key, min, max string) ([]string, error) {
+	return stringsReply(c.Do(ctx, "ZRANGEBYSCORE", key, min, max))
+}
+
+// ZRank returns the rank of member, or ErrNil if it isn't in the set.
+func (c *Client) ZRank(ctx context.Context, key, member string) (int64, error) {
+	return intReply(c.Do(ctx, "ZRANK", key, member))
+}
+
+// zReply decodes a member, score list as sent by WITHSCORES in RESP2.
+func zReply(v protocol.Value, err error) ([]Z, error) {
+	flat, err := stringsReply(v, err)
+	if err != nil {
+		return nil, err
+	}
+	zs := make([]Z, 0, len(flat)/2)
+	for i := 0; i+1 < len(flat); i += 2 {
+		score, err := strconv.ParseFloat(flat[i+1], 64)
+		if err != nil {
+			return nil, unexpected(v.Elems[i+1], "score")
+		}
+		zs = append(zs, Z{Score: score, Member: flat[i]})
+	}
+	return zs, nil
+}
+
+// Publish sends a message to a channel and returns the number of clients
+// that received it.
+func (c *Client) Publish(ctx context.Context, channel, message string) (int64, error) {
+	return intReply(c.Do(ctx, "PUBLISH", channel, message))
+}
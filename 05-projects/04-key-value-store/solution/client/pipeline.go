@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// Pipeline queues commands and sends them together, saving a round trip per
+// command. It is not safe for concurrent use.
+type Pipeline struct {
+	c    *Client
+	cmds [][]string
+	tx   bool
+}
+
+// Pipeline returns an empty pipeline. The server runs its commands one
+// after another, but other clients' commands may run in between.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// TxPipeline returns a pipeline whose commands are wrapped in MULTI and
+// EXEC, so the server runs them as one transaction.
+func (c *Client) TxPipeline() *Pipeline {
+	return &Pipeline{c: c, tx: true}
+}
+
+// Do queues a command.
+func (p *Pipeline) Do(args ...string) {
+	p.cmds = append(p.cmds, args)
+}
+
+// Len returns the number of queued commands.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands on one connection and returns their
+// replies in order, emptying the pipeline. Error replies don't stop the
+// other commands; the first one is returned as an Error alongside all the
+// replies. If the connection fails, the commands may or may not have run.
+func (p *Pipeline) Exec(ctx context.Context) ([]protocol.Value, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	if p.tx {
+		cmds = append(append([][]string{{"MULTI"}}, cmds...), []string{"EXEC"})
+	}
+	replies, err := p.c.roundTrip(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tx {
+		// MULTI and the queued commands only answer +OK and +QUEUED, or an
+		// error that makes EXEC fail with EXECABORT
+		exec := replies[len(replies)-1]
+		if err := replyError(exec); err != nil {
+			return nil, err
+		}
+		if exec.Null {
+			return nil, ErrNil
+		}
+		replies = exec.Elems
+	}
+
+	for _, v := range replies {
+		if err := replyError(v); err != nil {
+			return replies, err
+		}
+	}
+	return replies, nil
+}
@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// PoolStats counts what the pool has done since the client was created.
+type PoolStats struct {
+	TotalConns int    // open connections, idle or in use
+	IdleConns  int    // connections waiting in the pool
+	Hits       uint64 // commands that got an idle connection
+	Misses     uint64 // commands that had to dial one
+	Timeouts   uint64 // commands that gave up waiting for a connection
+	StaleConns uint64 // connections closed as idle too long or failing a health check
+}
+
+// pool hands out connections, at most cfg.PoolSize at a time. A token in
+// slots is the right to use a connection; a connection is only dialed
+// when there is no idle one, so no more than PoolSize are ever open.
+type pool struct {
+	cfg   Config
+	slots chan struct{}
+	done  chan struct{}
+
+	mu     sync.Mutex
+	idle   []*conn // most recently used last
+	open   int
+	closed bool
+
+	hits, misses, timeouts, stale atomic.Uint64
+}
+
+func newPool(cfg Config) *pool {
+	return &pool{
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.PoolSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// get returns a healthy connection, waiting for a slot if every connection
+// is in use. The caller must give it back with put.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	timer := time.NewTimer(p.cfg.PoolTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		p.timeouts.Add(1)
+		return nil, ctx.Err()
+	case <-timer.C:
+		p.timeouts.Add(1)
+		return nil, ErrPoolTimeout
+	}
+
+	for {
+		cn, err := p.popIdle()
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		if cn == nil {
+			break
+		}
+		if p.healthy(ctx, cn) {
+			p.hits.Add(1)
+			return cn, nil
+		}
+		p.stale.Add(1)
+		p.discard(cn)
+	}
+
+	p.misses.Add(1)
+	cn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put returns a connection to the pool, or closes it if a failed command
+// left it in an unknown state.
+func (p *pool) put(cn *conn) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	if cn.broken || p.closed {
+		p.mu.Unlock()
+		p.discard(cn)
+		return
+	}
+	cn.usedAt = time.Now()
+	p.idle = append(p.idle, cn)
+	p.mu.Unlock()
+}
+
+// popIdle takes the most recently used idle connection, closing any that
+// have been idle longer than IdleTimeout on the way.
+func (p *pool) popIdle() (*conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+	for len(p.idle) > 0 {
+		cn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(cn.usedAt) <= p.cfg.IdleTimeout {
+			return cn, nil
+		}
+		p.stale.Add(1)
+		p.open--
+		cn.nc.Close()
+	}
+	return nil, nil
+}
+
+// healthy pings a connection that has been idle for a while. The server
+// may have closed it in the meantime, and a command sent on it would fail.
+func (p *pool) healthy(ctx context.Context, cn *conn) bool {
+	if time.Since(cn.usedAt) < p.cfg.HealthCheckInterval {
+		return true
+	}
+	replies, err := cn.roundTrip(ctx, [][]string{{"PING"}}, p.cfg.ReadTimeout, p.cfg.WriteTimeout)
+	return err == nil && replies[0].Str == "PONG"
+}
+
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: p.cfg.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", p.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := newConn(nc)
+	if err := authenticate(ctx, cn, p.cfg); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		nc.Close()
+		return nil, ErrClosed
+	}
+	p.open++
+	return cn, nil
+}
+
+func (p *pool) discard(cn *conn) {
+	p.mu.Lock()
+	p.open--
+	p.mu.Unlock()
+	cn.nc.Close()
+}
+
+func (p *pool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		TotalConns: p.open,
+		IdleConns:  len(p.idle),
+		Hits:       p.hits.Load(),
+		Misses:     p.misses.Load(),
+		Timeouts:   p.timeouts.Load(),
+		StaleConns: p.stale.Load(),
+	}
+}
+
+// close closes the idle connections and makes every later get fail.
+// Connections in use are closed when they are put back.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	close(p.done)
+
+	var err error
+	for _, cn := range p.idle {
+		if cerr := cn.nc.Close(); err == nil {
+			err = cerr
+		}
+		p.open--
+	}
+	p.idle = nil
+	return err
+}
+
+// conn is one connection to the server.
+type conn struct {
+	nc     net.Conn
+	r      *protocol.Reader
+	w      *protocol.Writer
+	usedAt time.Time
+	// broken is set when a round trip fails. A reply may then be half
+	// read, so the connection can't be reused.
+	broken bool
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{
+		nc:     nc,
+		r:      protocol.NewReader(nc),
+		w:      protocol.NewWriter(nc),
+		usedAt: time.Now(),
+	}
+}
+
+// roundTrip writes cmds in one go and reads a reply to each. It gives up
+// when ctx is done or a timeout passes, whichever comes first.
+func (cn *conn) roundTrip(ctx context.Context, cmds [][]string, readTimeout, writeTimeout time.Duration) ([]protocol.Value, error) {
+	// Cancelling ctx unblocks the reads and writes below by moving the
+	// deadline into the past
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(time.Unix(1, 0))
+	})
+	replies, err := cn.exchange(ctx, cmds, readTimeout, writeTimeout)
+	if !stop() {
+		cn.broken = true
+	}
+	if err != nil {
+		cn.broken = true
+		return nil, contextError(ctx, err)
+	}
+	return replies, nil
+}
+
+func (cn *conn) exchange(ctx context.Context, cmds [][]string, readTimeout, writeTimeout time.Duration) ([]protocol.Value, error) {
+	// Setting a deadline may undo the one set on cancellation, so ctx is
+	// checked after each
+	if err := cn.nc.SetWriteDeadline(deadline(ctx, writeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, args := range cmds {
+		if err := cn.w.WriteCommand(args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err := cn.nc.SetReadDeadline(deadline(ctx, readTimeout)); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	replies := make([]protocol.Value, len(cmds))
+	for i := range replies {
+		v, err := cn.r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = v
+	}
+	return replies, nil
+}
+
+// deadline is timeout from now, or the deadline of ctx if that is sooner.
+// A timeout of 0 leaves only the deadline of ctx, if any.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (d.IsZero() || ctxDeadline.Before(d)) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// contextError returns the error of ctx instead of err if ctx is done.
+// When the socket deadline is the context's, the read can time out just
+// before ctx notices.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Bounded(t *testing.T) {
+	c := startServer(t, Config{PoolSize: 2})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 20; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, err := c.Incr(ctx, "counter")
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, c.Stats().TotalConns, 2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := c.Get(ctx, "counter")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", val)
+
+	stats := c.Stats()
+	assert.LessOrEqual(t, stats.Misses, uint64(2))
+	assert.Equal(t, stats.TotalConns, stats.IdleConns)
+}
+
+func TestPool_WaitForConnection(t *testing.T) {
+	c := startServer(t, Config{PoolSize: 1, PoolTimeout: 30 * time.Millisecond})
+	ctx := context.Background()
+
+	cn, err := c.pool.get(ctx)
+	require.NoError(t, err)
+
+	// The only connection is taken
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Get(short, "key")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = c.Get(ctx, "key")
+	assert.ErrorIs(t, err, ErrPoolTimeout)
+	assert.Equal(t, uint64(2), c.Stats().Timeouts)
+
+	// A waiting command gets the connection once it is put back
+	time.AfterFunc(10*time.Millisecond, func() { c.pool.put(cn) })
+	require.NoError(t, c.Ping(ctx))
+	assert.Equal(t, uint64(1), c.Stats().Misses)
+}
+
+func TestPool_HealthCheckReplacesDroppedConnection(t *testing.T) {
+	c := startServer(t, Config{HealthCheckInterval: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	// QUIT makes the server close the connection, which goes back to the
+	// pool looking fine
+	_, err := c.Do(ctx, "QUIT")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, c.Set(ctx, "key", "value"))
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.StaleConns)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 1, stats.TotalConns)
+}
+
+func TestPool_IdleTimeout(t *testing.T) {
+	c := startServer(t, Config{IdleTimeout: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	require.NoError(t, c.Ping(ctx))
+	require.NoError(t, c.Ping(ctx))
+	assert.Equal(t, uint64(1), c.Stats().Hits)
+
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, c.Ping(ctx))
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.StaleConns)
+	assert.Equal(t, uint64(2), stats.Misses)
+}
+
+func TestClient_Close(t *testing.T) {
+	c := startServer(t, Config{})
+	ctx := context.Background()
+
+	require.NoError(t, c.Ping(ctx))
+	require.NoError(t, c.Close())
+	assert.Equal(t, 0, c.Stats().TotalConns)
+	assert.ErrorIs(t, c.Ping(ctx), ErrClosed)
+}
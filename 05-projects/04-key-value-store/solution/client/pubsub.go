@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// Message is a message published to a channel the PubSub is subscribed to.
+// Pattern is the pattern that matched, for PSUBSCRIBE.
+type Message struct {
+	Channel string
+	Pattern string
+	Payload string
+}
+
+// PubSub is a subscription on a connection of its own, outside the pool:
+// while subscribed, a RESP2 connection can't run other commands.
+type PubSub struct {
+	c  *Client
+	cn *conn
+
+	mu  sync.Mutex // guards err and serializes writes
+	err error
+}
+
+// Subscribe subscribes to channels and returns once the server has
+// confirmed it, so messages published afterwards are received.
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "SUBSCRIBE", channels)
+}
+
+// PSubscribe is Subscribe for glob patterns.
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (c *Client) subscribe(ctx context.Context, command string, names []string) (*PubSub, error) {
+	d := net.Dialer{Timeout: c.cfg.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// On a new connection nothing can arrive before the confirmations
+	ps := &PubSub{c: c, cn: newConn(nc)}
+	if err := authenticate(ctx, ps.cn, c.cfg); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	replies, err := ps.cn.roundTrip(ctx, [][]string{append([]string{command}, names...)}, c.cfg.ReadTimeout, c.cfg.WriteTimeout)
+	if err == nil && len(names) > 1 {
+		var more []protocol.Value
+		more, err = ps.readConfirmations(ctx, len(names)-1)
+		replies = append(replies, more...)
+	}
+	if err == nil {
+		err = replyError(replies[0])
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *PubSub) readConfirmations(ctx context.Context, n int) ([]protocol.Value, error) {
+	if err := ps.cn.nc.SetReadDeadline(deadline(ctx, ps.c.cfg.ReadTimeout)); err != nil {
+		return nil, err
+	}
+	out := make([]protocol.Value, n)
+	for i := range out {
+		v, err := ps.cn.r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// Subscribe adds channels. Their confirmations are skipped by Receive.
+func (ps *PubSub) Subscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "SUBSCRIBE", channels)
+}
+
+func (ps *PubSub) PSubscribe(ctx context.Context, patterns ...string) error {
+	return ps.send(ctx, "PSUBSCRIBE", patterns)
+}
+
+// Unsubscribe drops channels, or every channel if none are given.
+func (ps *PubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "UNSUBSCRIBE", channels)
+}
+
+func (ps *PubSub) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return ps.send(ctx, "PUNSUBSCRIBE", patterns)
+}
+
+func (ps *PubSub) send(ctx context.Context, command string, names []string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.err != nil {
+		return ps.err
+	}
+	if err := ps.cn.nc.SetWriteDeadline(deadline(ctx, ps.c.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	if err := ps.cn.w.WriteCommand(append([]string{command}, names...)...); err != nil {
+		return err
+	}
+	return ps.cn.w.Flush()
+}
+
+// Receive waits for the next message until ctx is done. It must not be
+// called concurrently. Once it fails, the connection may hold part of a
+// message, so the PubSub is unusable and should be closed.
+func (ps *PubSub) Receive(ctx context.Context) (Message, error) {
+	if err := ps.failed(); err != nil {
+		return Message{}, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		ps.cn.nc.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	// No timeout but that of ctx: messages may be a long time apart
+	var readDeadline time.Time
+	if d, ok := ctx.Deadline(); ok {
+		readDeadline = d
+	}
+	for {
+		if err := ps.cn.nc.SetReadDeadline(readDeadline); err != nil {
+			return Message{}, ps.fail(err)
+		}
+		if err := ctx.Err(); err != nil {
+			return Message{}, ps.fail(err)
+		}
+
+		v, err := ps.cn.r.ReadValue()
+		if err != nil {
+			return Message{}, ps.fail(contextError(ctx, err))
+		}
+
+		fields := v.Strings()
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "message":
+			if len(fields) == 3 {
+				return Message{Channel: fields[1], Payload: fields[2]}, nil
+			}
+		case "pmessage":
+			if len(fields) == 4 {
+				return Message{Pattern: fields[1], Channel: fields[2], Payload: fields[3]}, nil
+			}
+		}
+		// Subscription confirmations and pongs
+	}
+}
+
+func (ps *PubSub) failed() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.err
+}
+
+func (ps *PubSub) fail(err error) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.err == nil {
+		ps.err = err
+	}
+	return err
+}
+
+// Close closes the subscription's connection.
+func (ps *PubSub) Close() error {
+	ps.fail(ErrClosed)
+	return ps.cn.nc.Close()
+}
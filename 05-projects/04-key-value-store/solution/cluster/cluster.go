@@ -0,0 +1,174 @@
+// Package cluster sets up and rebalances a cluster of KV servers running
+// in cluster mode, the way redis-cli --cluster does for Redis. Nodes don't
+// gossip, so every change is made on each node in turn with CLUSTER
+// commands, as an admin user.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/alyxpink/go-training/kvstore/client"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// migrateBatch is how many keys MigrateSlot moves with each MIGRATE. The
+// source takes no writes to the shards of those keys while a batch is in
+// flight.
+const migrateBatch = 100
+
+// node is a connection to one node of the cluster.
+type node struct {
+	addr string
+	id   string
+	c    *client.Client
+}
+
+func dial(ctx context.Context, addr string, cfg client.Config) (*node, error) {
+	cfg.Addr = addr
+	c := client.New(cfg)
+	v, err := c.Do(ctx, "CLUSTER", "MYID")
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("cluster: %s: %w", addr, err)
+	}
+	return &node{addr: addr, id: v.Str, c: c}, nil
+}
+
+func (n *node) do(ctx context.Context, args ...string) error {
+	if _, err := n.c.Do(ctx, args...); err != nil {
+		return fmt.Errorf("cluster: %s: %v: %w", n.addr, args[:2], err)
+	}
+	return nil
+}
+
+func dialAll(ctx context.Context, addrs []string, cfg client.Config) ([]*node, error) {
+	nodes := make([]*node, 0, len(addrs))
+	for _, addr := range addrs {
+		n, err := dial(ctx, addr, cfg)
+		if err != nil {
+			closeAll(nodes)
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func closeAll(nodes []*node) {
+	for _, n := range nodes {
+		n.c.Close()
+	}
+}
+
+// Create makes a cluster of the nodes at addrs, which must be in cluster
+// mode and own no slots, and splits the slots evenly between them. The
+// addresses must be the ones each node announces to clients.
+func Create(ctx context.Context, addrs []string, cfg client.Config) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("cluster: no nodes")
+	}
+	nodes, err := dialAll(ctx, addrs, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeAll(nodes)
+
+	// Every node learns of the others first, so they can be given slots
+	for _, n := range nodes {
+		for _, other := range nodes {
+			if other != n {
+				if err := n.do(ctx, "CLUSTER", "ADDNODE", other.id, other.addr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	per := protocol.ClusterSlots / len(nodes)
+	for i, owner := range nodes {
+		start, end := i*per, (i+1)*per-1
+		if i == len(nodes)-1 {
+			end = protocol.ClusterSlots - 1
+		}
+		first, last := strconv.Itoa(start), strconv.Itoa(end)
+		if err := owner.do(ctx, "CLUSTER", "ADDSLOTSRANGE", first, last); err != nil {
+			return err
+		}
+		for _, n := range nodes {
+			if n != owner {
+				if err := n.do(ctx, "CLUSTER", "SETSLOTRANGE", first, last, "NODE", owner.id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateSlot moves slot, with its keys, from the node at from to the node
+// at to, while clients keep using it: the source serves the keys it still
+// has and redirects clients to the target for those it doesn't. The other
+// nodes at others are told of the new owner at the end.
+//
+// A migration that fails while moving keys can be resumed by calling
+// MigrateSlot again with the same arguments.
+func MigrateSlot(ctx context.Context, cfg client.Config, slot int, from, to string, others ...string) error {
+	nodes, err := dialAll(ctx, append([]string{from, to}, others...), cfg)
+	if err != nil {
+		return err
+	}
+	defer closeAll(nodes)
+	src, dst := nodes[0], nodes[1]
+	s := strconv.Itoa(slot)
+
+	if err := dst.do(ctx, "CLUSTER", "SETSLOT", s, "IMPORTING", src.id); err != nil {
+		return err
+	}
+	if err := src.do(ctx, "CLUSTER", "SETSLOT", s, "MIGRATING", dst.id); err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(dst.addr)
+	if err != nil {
+		return fmt.Errorf("cluster: %w", err)
+	}
+	readTimeout := cfg.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = client.DefaultReadTimeout
+	}
+	timeout := strconv.FormatInt(readTimeout.Milliseconds(), 10)
+	var auth []string
+	if cfg.Password != "" {
+		auth = []string{"AUTH2", cfg.Username, cfg.Password}
+		if cfg.Username == "" {
+			auth = []string{"AUTH", cfg.Password}
+		}
+	}
+	for {
+		v, err := src.c.Do(ctx, "CLUSTER", "GETKEYSINSLOT", s, strconv.Itoa(migrateBatch))
+		if err != nil {
+			return fmt.Errorf("cluster: %s: %w", src.addr, err)
+		}
+		keys := v.Strings()
+		if len(keys) == 0 {
+			break
+		}
+		args := append([]string{"MIGRATE", host, port, "", "0", timeout, "REPLACE"}, auth...)
+		args = append(append(args, "KEYS"), keys...)
+		if err := src.do(ctx, args...); err != nil {
+			return err
+		}
+	}
+
+	// The target first, so that once the source gives the slot away its
+	// redirections lead to a node that serves it
+	for _, n := range append([]*node{dst, src}, nodes[2:]...) {
+		if err := n.do(ctx, "CLUSTER", "SETSLOT", s, "NODE", dst.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
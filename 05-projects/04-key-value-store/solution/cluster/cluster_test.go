@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alyxpink/go-training/kvstore/client"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/server"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startNodes runs n servers in cluster mode and returns their addresses.
+func startNodes(t *testing.T, n int) []string {
+	t.Helper()
+	var addrs []string
+	for range n {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+
+		handler := protocol.NewHandler(store.NewKVStore(), nil)
+		require.NoError(t, handler.EnableCluster(filepath.Join(t.TempDir(), "nodes.conf"), addr))
+		srv := server.New(handler)
+		go srv.Serve(listener)
+		t.Cleanup(func() { srv.Close() })
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// owner returns the address of the node that owns slot, as node at addr
+// sees it.
+func owner(t *testing.T, addr string, slot int) string {
+	t.Helper()
+	c := client.New(client.Config{Addr: addr})
+	defer c.Close()
+	v, err := c.Do(context.Background(), "CLUSTER", "SLOTS")
+	require.NoError(t, err)
+	for _, r := range v.Elems {
+		if int(r.Elems[0].Int) <= slot && slot <= int(r.Elems[1].Int) {
+			node := r.Elems[2].Elems
+			return net.JoinHostPort(node[0].Str, strconv.FormatInt(node[1].Int, 10))
+		}
+	}
+	return ""
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	addrs := startNodes(t, 3)
+	require.NoError(t, Create(ctx, addrs, client.Config{}))
+
+	for _, addr := range addrs {
+		assert.Equal(t, addrs[0], owner(t, addr, 0))
+		assert.Equal(t, addrs[1], owner(t, addr, protocol.ClusterSlots/2))
+		assert.Equal(t, addrs[2], owner(t, addr, protocol.ClusterSlots-1))
+	}
+
+	// The client sends each command to the owner of its keys
+	c := client.NewCluster(client.ClusterConfig{Addrs: addrs[1:2]})
+	defer c.Close()
+	for i := range 100 {
+		require.NoError(t, c.Set(ctx, fmt.Sprintf("key:%d", i), strconv.Itoa(i)))
+	}
+	for i := range 100 {
+		v, err := c.Get(ctx, fmt.Sprintf("key:%d", i))
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), v)
+	}
+	counts := make([]int64, len(addrs))
+	for i, addr := range addrs {
+		node := client.New(client.Config{Addr: addr})
+		keys, err := node.Keys(ctx, "*")
+		node.Close()
+		require.NoError(t, err)
+		counts[i] = int64(len(keys))
+	}
+	assert.Equal(t, int64(100), counts[0]+counts[1]+counts[2])
+	for _, n := range counts {
+		assert.Positive(t, n, "keys are spread over the nodes")
+	}
+
+	// Pipelines are split by node; transactions stay on one
+	p := c.Pipeline()
+	p.Do("INCR", "a")
+	p.Do("INCR", "b")
+	p.Do("GET", "a")
+	replies, err := p.Exec(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "1", "1"}, []string{replies[0].Text(), replies[1].Text(), replies[2].Text()})
+
+	tx := c.TxPipeline()
+	tx.Do("INCR", "{user}a")
+	tx.Do("INCR", "{user}b")
+	_, err = tx.Exec(ctx)
+	require.NoError(t, err)
+	tx.Do("INCR", "a")
+	tx.Do("INCR", "b")
+	_, err = tx.Exec(ctx)
+	assert.ErrorContains(t, err, "EXECABORT")
+}
+
+func TestMigrateSlot(t *testing.T) {
+	ctx := context.Background()
+	addrs := startNodes(t, 3)
+	require.NoError(t, Create(ctx, addrs, client.Config{}))
+
+	// Counters in one slot, so that moving it moves all of them
+	const counters = 300
+	slot := protocol.KeySlot("{counter}")
+	from := owner(t, addrs[0], slot)
+	to := addrs[0]
+	if from == to {
+		to = addrs[1]
+	}
+	key := func(i int) string { return fmt.Sprintf("{counter}:%d", i) }
+
+	c := client.NewCluster(client.ClusterConfig{Addrs: addrs})
+	defer c.Close()
+	for i := range counters {
+		require.NoError(t, c.Set(ctx, key(i), "0"))
+	}
+
+	// Writers keep incrementing counters while the slot moves
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	incrs := make([]atomic.Int64, counters)
+	failed := make(chan error, 1)
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; !stop.Load(); i = (i + 7) % counters {
+				if _, err := c.Incr(ctx, key(i)); err != nil {
+					select {
+					case failed <- err:
+					default:
+					}
+					return
+				}
+				incrs[i].Add(1)
+			}
+		}()
+	}
+
+	var others []string
+	for _, addr := range addrs {
+		if addr != from && addr != to {
+			others = append(others, addr)
+		}
+	}
+	err := MigrateSlot(ctx, client.Config{}, slot, from, to, others...)
+	stop.Store(true)
+	wg.Wait()
+	require.NoError(t, err)
+	select {
+	case err := <-failed:
+		t.Fatal(err)
+	default:
+	}
+
+	for _, addr := range addrs {
+		assert.Equal(t, to, owner(t, addr, slot), addr)
+	}
+	src := client.New(client.Config{Addr: from})
+	defer src.Close()
+	v, err := src.Do(ctx, "CLUSTER", "COUNTKEYSINSLOT", strconv.Itoa(slot))
+	require.NoError(t, err)
+	assert.Zero(t, v.Int, "the source holds no keys of the slot")
+
+	// No increment was lost on the way
+	var total int64
+	for i := range counters {
+		n, err := c.Incr(ctx, key(i))
+		require.NoError(t, err)
+		assert.Equal(t, incrs[i].Load()+1, n, key(i))
+		total += incrs[i].Load()
+	}
+	assert.Positive(t, total)
+}
@@ -0,0 +1,142 @@
+// Package consensus runs the key-value store on Raft. Write commands are
+// encoded like WAL records and proposed to the Raft log; once committed,
+// every node runs them through protocol.Handler.Apply, so all stores apply
+// the same writes in the same order. No node expires keys by its own clock;
+// the leader deletes them through the log. The Raft log replaces the WAL, and
+// store snapshots in the regular snapshot format compact it.
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/raft"
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// StateMachine applies committed entries to a store. It implements
+// raft.StateMachine.
+type StateMachine struct {
+	handler   *protocol.Handler
+	store     *store.KVStore
+	snapshots *persistence.SnapshotManager
+}
+
+// NewStateMachine makes kvStore a follower (see store.KVStore.SetFollower):
+// its keys only go when the log deletes them, so every node holds the same.
+func NewStateMachine(handler *protocol.Handler, kvStore *store.KVStore, snapshots *persistence.SnapshotManager) *StateMachine {
+	kvStore.SetFollower(true)
+	return &StateMachine{handler: handler, store: kvStore, snapshots: snapshots}
+}
+
+// Apply runs the commands of an entry and returns their replies.
+func (sm *StateMachine) Apply(data []byte) any {
+	cmds, err := persistence.DecodeRecord(data)
+	if err != nil {
+		return err
+	}
+	return sm.handler.Apply(cmds)
+}
+
+func (sm *StateMachine) Snapshot() ([]byte, error) {
+	writes := sm.handler.WriteLock()
+	writes.Lock()
+	export := sm.store.Export()
+	writes.Unlock()
+	defer export.Close()
+
+	var buf bytes.Buffer
+	if err := sm.snapshots.StreamTo(&buf, export, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (sm *StateMachine) Restore(data []byte) error {
+	writes := sm.handler.WriteLock()
+	writes.Lock()
+	defer writes.Unlock()
+
+	sm.store.FlushAll()
+	_, err := sm.snapshots.LoadFrom(bytes.NewReader(data), sm.store)
+	return err
+}
+
+// Cluster gives the handler access to a Raft node. It implements
+// protocol.Consensus.
+type Cluster struct {
+	node *raft.Node
+}
+
+func NewCluster(node *raft.Node) *Cluster {
+	return &Cluster{node: node}
+}
+
+func (c *Cluster) Propose(cmds [][]string) ([]protocol.Value, error) {
+	result, err := c.node.Propose(persistence.EncodeRecord(cmds))
+	if err != nil {
+		return nil, c.clientError(err)
+	}
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
+	return result.([]protocol.Value), nil
+}
+
+func (c *Cluster) ReadBarrier() error {
+	return c.clientError(c.node.ReadIndex())
+}
+
+func (c *Cluster) IsLeader() bool {
+	return c.node.Status().State == raft.Leader
+}
+
+func (c *Cluster) AddServer(id, addr string) error {
+	return c.clientError(c.node.AddServer(raft.Server{ID: id, Addr: addr}))
+}
+
+func (c *Cluster) RemoveServer(id string) error {
+	return c.clientError(c.node.RemoveServer(id))
+}
+
+func (c *Cluster) Info() []string {
+	st := c.node.Status()
+	servers := make([]string, len(st.Servers))
+	for i, s := range st.Servers {
+		servers[i] = s.ID + "=" + s.Addr
+	}
+	return []string{
+		"id", st.ID,
+		"state", st.State.String(),
+		"term", strconv.FormatUint(st.Term, 10),
+		"leader", st.Leader,
+		"last_index", strconv.FormatUint(st.LastIndex, 10),
+		"commit_index", strconv.FormatUint(st.CommitIndex, 10),
+		"last_applied", strconv.FormatUint(st.LastApplied, 10),
+		"snapshot_index", strconv.FormatUint(st.SnapshotIndex, 10),
+		"servers", strings.Join(servers, ","),
+	}
+}
+
+// clientError turns Raft errors into replies a client can act on.
+func (c *Cluster) clientError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader):
+		if leader, ok := c.node.Leader(); ok {
+			return fmt.Errorf("NOTLEADER This node is not the Raft leader; the leader is %s", leader.ID)
+		}
+		return errors.New("CLUSTERDOWN No Raft leader is elected")
+	case errors.Is(err, raft.ErrLeadershipLost):
+		return errors.New("TRYAGAIN Leadership changed before the write completed; it may or may not have been applied")
+	case errors.Is(err, raft.ErrConfigChange):
+		return errors.New("TRYAGAIN A membership change is in progress")
+	}
+	return fmt.Errorf("ERR %v", err)
+}
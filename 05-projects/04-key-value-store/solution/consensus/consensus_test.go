@@ -0,0 +1,314 @@
+package consensus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/raft"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testServer struct {
+	store   *store.KVStore
+	handler *protocol.Handler
+	node    *raft.Node
+}
+
+func (s *testServer) do(args ...string) protocol.Value {
+	return s.handler.Exec(s.handler.NewSession(), args)
+}
+
+type testCluster struct {
+	t         *testing.T
+	net       *raft.MemNetwork
+	servers   []raft.Server
+	threshold uint64
+
+	mu       sync.Mutex
+	running  map[string]*testServer
+	storages map[string]*raft.MemoryStorage
+}
+
+func newTestCluster(t *testing.T, size int, threshold uint64) *testCluster {
+	c := &testCluster{
+		t:         t,
+		net:       raft.NewMemNetwork(),
+		threshold: threshold,
+		running:   make(map[string]*testServer),
+		storages:  make(map[string]*raft.MemoryStorage),
+	}
+	t.Cleanup(func() {
+		for id := range c.running {
+			c.stop(id)
+		}
+	})
+
+	for i := 1; i <= size; i++ {
+		c.servers = append(c.servers, raft.Server{ID: fmt.Sprintf("n%d", i)})
+	}
+	for _, s := range c.servers {
+		c.start(s.ID)
+	}
+	return c
+}
+
+// start starts id with an empty store on its Raft storage, which survives
+// restarts.
+func (c *testCluster) start(id string) *testServer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	storage, ok := c.storages[id]
+	if !ok {
+		storage = raft.NewMemoryStorage()
+		c.storages[id] = storage
+	}
+
+	kvStore := store.NewKVStore()
+	handler := protocol.NewHandler(kvStore, nil)
+	node, err := raft.NewNode(raft.Config{
+		ID:                id,
+		Servers:           c.servers,
+		Transport:         c.net.Transport(id),
+		Storage:           storage,
+		StateMachine:      NewStateMachine(handler, kvStore, persistence.NewSnapshotManager(c.t.TempDir(), 0, handler.WriteLock())),
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+	})
+	require.NoError(c.t, err)
+	c.net.Register(id, node)
+	handler.SetConsensus(NewCluster(node))
+
+	s := &testServer{store: kvStore, handler: handler, node: node}
+	c.running[id] = s
+	return s
+}
+
+func (c *testCluster) stop(id string) {
+	c.mu.Lock()
+	s := c.running[id]
+	delete(c.running, id)
+	c.mu.Unlock()
+
+	s.node.Stop()
+	s.store.Close()
+}
+
+func (c *testCluster) leader() (string, *testServer) {
+	var id string
+	require.Eventually(c.t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for sid, s := range c.running {
+			if s.node.Status().State == raft.Leader {
+				id = sid
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond, "no leader elected")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return id, c.running[id]
+}
+
+func (c *testCluster) follower(leader string) (string, *testServer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, s := range c.running {
+		if id != leader {
+			return id, s
+		}
+	}
+	c.t.Fatal("no follower running")
+	return "", nil
+}
+
+func (c *testCluster) waitForKey(key, value string) {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, s := range c.running {
+			if got, ok := s.store.Get(key); !ok || got != value {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "key %q never reached %q everywhere", key, value)
+}
+
+func TestCluster_WritesReachEveryNode(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	_, leader := c.leader()
+
+	assert.Equal(t, int64(2), leader.do("RPUSH", "list", "a", "b").Int)
+	assert.Equal(t, "a", leader.do("LPOP", "list").Str)
+	assert.Equal(t, "OK", leader.do("SET", "k", "v").Str)
+	assert.Equal(t, "v", leader.do("GET", "k").Str)
+
+	// Entries apply in order, so once k is everywhere the list is too
+	c.waitForKey("k", "v")
+	for _, s := range c.running {
+		s.store.View(func(tx *store.Tx) {
+			items, err := tx.LRange("list", 0, -1)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"b"}, items)
+		})
+	}
+}
+
+func TestCluster_FollowerRedirects(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	id, leader := c.leader()
+	_, follower := c.follower(id)
+	require.Equal(t, "OK", leader.do("SET", "k", "v").Str)
+
+	for _, args := range [][]string{{"SET", "k", "w"}, {"GET", "k"}} {
+		resp := follower.do(args...)
+		assert.Equal(t, protocol.TypeError, resp.Type)
+		assert.Equal(t, "NOTLEADER This node is not the Raft leader; the leader is "+id, resp.Str)
+	}
+}
+
+func TestCluster_Transaction(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	_, leader := c.leader()
+	sess := leader.handler.NewSession()
+
+	require.Equal(t, "OK", leader.handler.Exec(sess, []string{"MULTI"}).Str)
+	require.Equal(t, "QUEUED", leader.handler.Exec(sess, []string{"SET", "a", "1"}).Str)
+	require.Equal(t, "QUEUED", leader.handler.Exec(sess, []string{"SET", "b", "2"}).Str)
+	require.Equal(t, "QUEUED", leader.handler.Exec(sess, []string{"GET", "a"}).Str)
+	resp := leader.handler.Exec(sess, []string{"EXEC"})
+	require.Len(t, resp.Elems, 3)
+	assert.Equal(t, "1", resp.Elems[2].Str)
+	c.waitForKey("b", "2")
+
+	// WATCH relies on local versions, which followers don't share
+	require.Equal(t, "OK", leader.handler.Exec(sess, []string{"WATCH", "a"}).Str)
+	require.Equal(t, "OK", leader.handler.Exec(sess, []string{"MULTI"}).Str)
+	require.Equal(t, "QUEUED", leader.handler.Exec(sess, []string{"SET", "a", "3"}).Str)
+	resp = leader.handler.Exec(sess, []string{"EXEC"})
+	assert.True(t, strings.HasPrefix(resp.Str, "EXECABORT"), resp.Str)
+
+	// Blocking commands only run where they can't block
+	require.Equal(t, "OK", leader.handler.Exec(sess, []string{"MULTI"}).Str)
+	require.Equal(t, "QUEUED", leader.handler.Exec(sess, []string{"BLPOP", "queue", "0"}).Str)
+	resp = leader.handler.Exec(sess, []string{"EXEC"})
+	require.Len(t, resp.Elems, 1)
+	assert.True(t, resp.Elems[0].Null)
+	assert.Equal(t, "ERR 'blpop' is not supported in Raft mode", leader.do("BLPOP", "queue", "0").Str)
+}
+
+func TestCluster_LaggingNodeCatchesUpFromSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 16)
+	id, leader := c.leader()
+	lagging, _ := c.follower(id)
+	c.stop(lagging)
+
+	for i := 0; i < 100; i++ {
+		require.Equal(t, "OK", leader.do("SET", fmt.Sprintf("key%d", i), value(i)).Str)
+	}
+	require.Positive(t, leader.node.Status().SnapshotIndex)
+
+	c.start(lagging)
+	for i := 0; i < 100; i++ {
+		c.waitForKey(fmt.Sprintf("key%d", i), value(i))
+	}
+}
+
+func TestCluster_EvictionsReplicate(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	id, leader := c.leader()
+	_, follower := c.follower(id)
+	for _, s := range c.running {
+		s.store.SetMaxMemory(2000, store.AllKeysLRU)
+	}
+
+	for i := 0; i < 50; i++ {
+		require.Equal(t, "OK", leader.do("SET", fmt.Sprintf("key%d", i), value(i)).Str)
+	}
+	c.waitForKey("key49", value(49))
+	keys := follower.store.Stats().Keys
+	require.Less(t, keys, 50)
+
+	// A follower over the limit doesn't evict for a write it won't run
+	follower.store.SetMaxMemory(1000, store.AllKeysLRU)
+	assert.True(t, follower.do("SET", "other", "value").IsError())
+	assert.Equal(t, keys, follower.store.Stats().Keys)
+	follower.store.SetMaxMemory(2000, store.AllKeysLRU)
+
+	// Every node evicted the keys the leader chose
+	require.Equal(t, "OK", leader.do("SET", "done", "1").Str)
+	c.waitForKey("done", "1")
+	want := leader.store.Keys("*")
+	sort.Strings(want)
+	for _, s := range c.running {
+		got := s.store.Keys("*")
+		sort.Strings(got)
+		assert.Equal(t, want, got)
+	}
+}
+
+func TestCluster_ExpiryGoesThroughTheLog(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	_, leader := c.leader()
+
+	require.Equal(t, "OK", leader.do("SET", "key", "old", "PX", "300").Str)
+	require.Equal(t, "OK", leader.do("SET", "other", "v", "PX", "300").Str)
+	c.waitForKey("other", "v")
+	time.Sleep(350 * time.Millisecond)
+
+	// No node removes expired keys by its own clock
+	for _, s := range c.running {
+		assert.Equal(t, 0, s.store.ExpireCycle())
+		assert.Equal(t, 2, s.store.Stats().Keys)
+	}
+
+	// A write deletes the expired keys it uses first
+	require.Equal(t, "OK", leader.do("SET", "key", "new", "NX").Str)
+	c.waitForKey("key", "new")
+
+	n, err := leader.handler.ProposeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, s := range c.running {
+			if s.store.Stats().Keys != 1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "expired key never deleted everywhere")
+}
+
+func TestCluster_RaftInfo(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	id, leader := c.leader()
+
+	info := leader.do("RAFT", "INFO")
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(info.Elems); i += 2 {
+		fields[info.Elems[i].Str] = info.Elems[i+1].Str
+	}
+	assert.Equal(t, id, fields["id"])
+	assert.Equal(t, "leader", fields["state"])
+	assert.Equal(t, "n1=,n2=,n3=", fields["servers"])
+}
+
+func value(i int) string {
+	return fmt.Sprintf("v%d", i)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/consensus"
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/raft"
+	"github.com/alyxpink/go-training/kvstore/replication"
+	"github.com/alyxpink/go-training/kvstore/server"
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+var (
+	port        = flag.Int("port", 6380, "Server port")
+	dataDir     = flag.String("data-dir", "./data", "Data directory")
+	appendFsync = flag.String("appendfsync", "always", "When to fsync the WAL: always (writes share fsyncs), everysec or no")
+	snapshotInt = flag.Duration("snapshot-interval", 5*time.Minute, "Snapshot interval")
+	maxMemory   = flag.String("maxmemory", "0", "Memory limit, e.g. 512mb or 2gb (0 = unlimited)")
+	maxPolicy   = flag.String("maxmemory-policy", "noeviction", "Eviction policy: noeviction, allkeys-lru, allkeys-lfu, volatile-lru, volatile-ttl")
+	pubsubLimit = flag.Int("pubsub-limit", protocol.DefaultPubSubLimit, "Messages buffered per subscriber before it is disconnected")
+	metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9121 (empty = off)")
+	aclFile     = flag.String("aclfile", "", "File of ACL users, one \"user <name> <rules...>\" line each, as in Redis (empty = only ACL SETUSER defines users)")
+	notifyKeys  = flag.String("notify-keyspace-events", "", "Keyspace events to publish, as in Redis, e.g. KEA (empty = none)")
+	replicaOf   = flag.String("replicaof", "", "Leader to replicate from, as host:port")
+	leaderUser  = flag.String("masteruser", "", "User to authenticate as with the leader (empty = default user)")
+	leaderAuth  = flag.String("masterauth", "", "Password to authenticate with the leader")
+	backlogSize = flag.String("repl-backlog-size", "1mb", "WAL kept for replicas that reconnect, e.g. 1mb")
+	raftID      = flag.String("raft-id", "", "Run in Raft mode as this server ID")
+	raftAddr    = flag.String("raft-addr", "", "Address for Raft traffic, as host:port (default: this server's entry in -raft-peers)")
+	raftPeers   = flag.String("raft-peers", "", "Servers of a new Raft cluster, as id=host:port,... including this one")
+	clusterOn   = flag.Bool("cluster-enabled", false, "Run in cluster mode, serving the hash slots assigned to this node")
+	clusterConf = flag.String("cluster-config-file", "", "File this node keeps its view of the cluster in (default: data-dir/nodes.conf)")
+	clusterAddr = flag.String("cluster-announce-addr", "", "Address clients are redirected to for this node, as host:port (default: 127.0.0.1 and -port)")
+)
+
+func main() {
+	flag.Parse()
+
+	kvStore := store.NewKVStore()
+	defer kvStore.Close()
+
+	limit, err := parseSize(*maxMemory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := store.ParseEvictionPolicy(*maxPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kvStore.SetMaxMemory(limit, policy)
+
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	if *clusterOn && *raftID != "" {
+		log.Fatal("-cluster-enabled can't be combined with -raft-id")
+	}
+
+	var handler *protocol.Handler
+	var stop func()
+	if *raftID != "" {
+		handler, stop = startRaft(kvStore)
+	} else {
+		handler, stop = startStandalone(kvStore)
+	}
+	defer stop()
+
+	if err := handler.SetKeyspaceEvents(*notifyKeys); err != nil {
+		log.Fatal(err)
+	}
+	if *aclFile != "" {
+		if err := handler.LoadACLFile(*aclFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *clusterOn {
+		conf, announce := *clusterConf, *clusterAddr
+		if conf == "" {
+			conf = filepath.Join(*dataDir, "nodes.conf")
+		}
+		if announce == "" {
+			announce = fmt.Sprintf("127.0.0.1:%d", *port)
+		}
+		if err := handler.EnableCluster(conf, announce); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Reclaim expired keys in the background, ten passes per second. In
+	// Raft mode the leader does it through the log instead
+	if *raftID == "" {
+		kvStore.StartExpiry(100 * time.Millisecond)
+	}
+
+	srv := server.New(handler)
+
+	var metricsSrv *http.Server
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.MetricsHandler(handler))
+		metricsSrv = &http.Server{Addr: *metricsAddr, Handler: mux}
+		go func() {
+			log.Printf("Metrics on http://%s/metrics", *metricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		log.Println("Shutting down...")
+		if metricsSrv != nil {
+			metricsSrv.Close()
+		}
+		srv.Close()
+	}()
+
+	addr := fmt.Sprintf(":%d", *port)
+	log.Printf("Server listening on %s", addr)
+	if err := srv.ListenAndServe(addr); err != nil && err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// startStandalone recovers the store from its snapshot and WAL, and sets
+// up replication. stop takes a final snapshot and closes the WAL.
+func startStandalone(kvStore *store.KVStore) (handler *protocol.Handler, stop func()) {
+	wal, err := persistence.NewWAL(filepath.Join(*dataDir, "wal.log"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fsync, err := persistence.ParseFsyncPolicy(*appendFsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wal.SetFsyncPolicy(fsync)
+
+	// Recover from the latest snapshot, then replay the WAL on top of it.
+	// Nothing writes through the handler until it is served.
+	handler = protocol.NewHandler(kvStore, wal)
+	snapshot := persistence.NewSnapshotManager(*dataDir, *snapshotInt, handler.WriteLock())
+	snapshot.SetWAL(wal)
+	if err := snapshot.LoadLatest(kvStore); err != nil {
+		log.Printf("No snapshot found, starting fresh: %v", err)
+	}
+
+	if err := wal.Replay(kvStore); err != nil {
+		log.Fatal(err)
+	}
+	go snapshot.Run(kvStore)
+	handler.SetPubSubLimit(*pubsubLimit)
+	handler.SetSnapshotManager(snapshot)
+
+	// Writes are streamed to replicas from the WAL; with -replicaof this
+	// server is itself a read-only replica
+	backlog, err := parseSize(*backlogSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node := replication.NewNode(kvStore, wal, snapshot, handler.WriteLock())
+	node.SetBacklogSize(int(backlog))
+	node.SetLeaderAuth(*leaderUser, *leaderAuth)
+	handler.SetReplication(node)
+	if *replicaOf != "" {
+		if err := node.ReplicaOf(*replicaOf); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return handler, func() {
+		node.Close()
+		if err := snapshot.CreateSnapshot(kvStore); err != nil {
+			log.Printf("Final snapshot failed: %v", err)
+		}
+		wal.Close()
+	}
+}
+
+// startRaft joins the store to a Raft cluster. The Raft log and its
+// snapshots, kept under data-dir/raft, take the place of the WAL.
+func startRaft(kvStore *store.KVStore) (handler *protocol.Handler, stop func()) {
+	servers, err := parsePeers(*raftPeers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := *raftAddr
+	for _, s := range servers {
+		if s.ID == *raftID && addr == "" {
+			addr = s.Addr
+		}
+	}
+	if addr == "" {
+		log.Fatal("-raft-addr is required when this server is not in -raft-peers")
+	}
+
+	storage, err := raft.NewFileStorage(filepath.Join(*dataDir, "raft"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler = protocol.NewHandler(kvStore, nil)
+	handler.SetPubSubLimit(*pubsubLimit)
+	transport := raft.NewTCPTransport()
+	node, err := raft.NewNode(raft.Config{
+		ID:           *raftID,
+		Servers:      servers,
+		Transport:    transport,
+		Storage:      storage,
+		StateMachine: consensus.NewStateMachine(handler, kvStore, persistence.NewSnapshotManager(*dataDir, 0, handler.WriteLock())),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rpcServer := raft.ServeTCP(l, node)
+	handler.SetConsensus(consensus.NewCluster(node))
+	log.Printf("Raft server %s listening on %s", *raftID, addr)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if node.Status().State != raft.Leader {
+					continue
+				}
+				if _, err := handler.ProposeExpired(); err != nil {
+					log.Printf("Expiring keys failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	return handler, func() {
+		close(done)
+		rpcServer.Close()
+		node.Stop()
+		transport.Close()
+		storage.Close()
+	}
+}
+
+// parsePeers parses a list of id=host:port pairs. An empty list means the
+// server joins an existing cluster through RAFT ADDNODE.
+func parsePeers(s string) ([]raft.Server, error) {
+	var servers []raft.Server
+	for _, peer := range strings.Split(s, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(peer, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid Raft peer %q, want id=host:port", peer)
+		}
+		servers = append(servers, raft.Server{ID: id, Addr: addr})
+	}
+	return servers, nil
+}
+
+// parseSize parses a byte count with an optional kb/mb/gb suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
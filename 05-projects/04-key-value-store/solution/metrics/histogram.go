@@ -0,0 +1,80 @@
+// Package metrics has the histograms the server records latencies in, and
+// writes metrics in the Prometheus text exposition format. It keeps to what
+// the server needs instead of pulling in a client library.
+package metrics
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the default upper bounds of a latency histogram, in
+// seconds: from 10µs for an in-memory read to 10s for a slow fsync or a
+// blocked command.
+var LatencyBuckets = []float64{
+	.00001, .000025, .00005, .0001, .00025, .0005,
+	.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// Histogram counts durations in buckets. It is safe for concurrent use and
+// recording takes no lock.
+type Histogram struct {
+	bounds []float64       // upper bounds in seconds, ascending
+	counts []atomic.Uint64 // one per bound, then one for +Inf
+	sum    atomic.Int64    // nanoseconds
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds in
+// seconds, which must be ascending.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe records one duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Since records the time elapsed since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// HistogramSnapshot is the state of a Histogram at one point. Counts are
+// per bucket, not cumulative, and the last one is for durations above every
+// bound.
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Snapshot reads the histogram. Observations made meanwhile may be only
+// partly included.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+// Mean returns the average duration, or 0 if nothing was observed.
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
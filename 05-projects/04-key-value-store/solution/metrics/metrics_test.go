@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{.001, .01})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond) // bounds are inclusive
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	s := h.Snapshot()
+	assert.Equal(t, []uint64{2, 1, 1}, s.Counts)
+	assert.Equal(t, uint64(4), s.Count)
+	assert.Equal(t, 1006500*time.Microsecond, s.Sum)
+	assert.Equal(t, 251625*time.Microsecond, s.Mean())
+	assert.Zero(t, NewHistogram(LatencyBuckets).Snapshot().Mean())
+}
+
+func TestWriter(t *testing.T) {
+	h := NewHistogram([]float64{.001, .01})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	var b strings.Builder
+	w := NewWriter(&b)
+	w.Family("kv_keys", "gauge", "Keys in the store.\nIncluding expired ones.")
+	w.Value("kv_keys", 42)
+	w.Family("kv_commands_total", "counter", "Commands run.")
+	w.Value("kv_commands_total", 3, "cmd", `say "hi"\now`)
+	w.Family("kv_latency_seconds", "histogram", "Latency.")
+	w.Histogram("kv_latency_seconds", h.Snapshot(), "cmd", "get")
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, `# HELP kv_keys Keys in the store.\nIncluding expired ones.
+# TYPE kv_keys gauge
+kv_keys 42
+# HELP kv_commands_total Commands run.
+# TYPE kv_commands_total counter
+kv_commands_total{cmd="say \"hi\"\\now"} 3
+# HELP kv_latency_seconds Latency.
+# TYPE kv_latency_seconds histogram
+kv_latency_seconds_bucket{cmd="get",le="0.001"} 1
+kv_latency_seconds_bucket{cmd="get",le="0.01"} 2
+kv_latency_seconds_bucket{cmd="get",le="+Inf"} 3
+kv_latency_seconds_sum{cmd="get"} 1.0055
+kv_latency_seconds_count{cmd="get"} 3
+`, b.String())
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writer writes metric families in the Prometheus text format. Each family
+// starts with Family and is followed by its samples. Errors are sticky and
+// reported by Flush.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family starts a metric family. kind is counter, gauge or histogram.
+func (w *Writer) Family(name, kind, help string) {
+	w.write("# HELP ", name, " ", escapeHelp(help), "\n")
+	w.write("# TYPE ", name, " ", kind, "\n")
+}
+
+// Value writes a sample. labels are name, value pairs.
+func (w *Writer) Value(name string, value float64, labels ...string) {
+	w.write(name, formatLabels(labels, "", ""), " ", formatFloat(value), "\n")
+}
+
+// Histogram writes the _bucket, _sum and _count samples of a histogram,
+// with the sum in seconds.
+func (w *Writer) Histogram(name string, s HistogramSnapshot, labels ...string) {
+	var cumulative uint64
+	for i, n := range s.Counts {
+		cumulative += n
+		le := math.Inf(1)
+		if i < len(s.Bounds) {
+			le = s.Bounds[i]
+		}
+		w.write(name, "_bucket", formatLabels(labels, "le", formatFloat(le)), " ", strconv.FormatUint(cumulative, 10), "\n")
+	}
+	w.write(name, "_sum", formatLabels(labels, "", ""), " ", formatFloat(s.Sum.Seconds()), "\n")
+	w.write(name, "_count", formatLabels(labels, "", ""), " ", strconv.FormatUint(s.Count, 10), "\n")
+}
+
+// Flush writes out anything buffered and returns the first error met.
+func (w *Writer) Flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *Writer) write(parts ...string) {
+	for _, p := range parts {
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(p)
+	}
+}
+
+// formatLabels formats name, value pairs, plus extra if its name isn't
+// empty, as {name="value",...}.
+func formatLabels(labels []string, extraName, extraValue string) string {
+	if extraName != "" {
+		labels = append(labels[:len(labels):len(labels)], extraName, extraValue)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,222 @@
+package persistence
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	crashSeed = flag.Uint64("crash.seed", 0, "run TestCrashConsistency with only this seed")
+	crashRuns = flag.Int("crash.runs", 300, "number of seeds TestCrashConsistency tries")
+)
+
+const crashDir = "/data"
+
+// crashStep is one step of a crash test workload: the commands of one WAL
+// record, or a snapshot if cmds is nil.
+type crashStep struct {
+	cmds [][]string
+}
+
+func (s crashStep) String() string {
+	if s.cmds == nil {
+		return "SNAPSHOT"
+	}
+	parts := make([]string, len(s.cmds))
+	for i, args := range s.cmds {
+		parts[i] = strings.Join(args, " ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// crashWorkload makes a random sequence of writes, some of them batches,
+// with up to three snapshots among them. More than three would let snapshot
+// cleanup run, whose file operations depend on whether two snapshots were
+// taken in the same second and so would make runs irreproducible.
+func crashWorkload(rng *rand.Rand) []crashStep {
+	keys := []string{"a", "b", "c", "d"}
+	lists := []string{"l1", "l2"}
+	command := func(i int) []string {
+		switch rng.IntN(5) {
+		case 0, 1:
+			return []string{"SET", keys[rng.IntN(len(keys))], fmt.Sprintf("v%d", i)}
+		case 2:
+			return []string{"DEL", keys[rng.IntN(len(keys))]}
+		case 3:
+			return []string{"RPUSH", lists[rng.IntN(len(lists))], fmt.Sprintf("e%d", i)}
+		default:
+			return []string{"LPOP", lists[rng.IntN(len(lists))], "1"}
+		}
+	}
+
+	var steps []crashStep
+	snapshots := 0
+	for i := range 20 + rng.IntN(40) {
+		switch n := rng.IntN(10); {
+		case n == 0 && snapshots < 3:
+			snapshots++
+			steps = append(steps, crashStep{})
+		case n == 1:
+			steps = append(steps, crashStep{cmds: [][]string{command(i), command(i), command(i)}})
+		default:
+			steps = append(steps, crashStep{cmds: [][]string{command(i)}})
+		}
+	}
+	return steps
+}
+
+// dumpStore describes the contents of a store of strings and lists.
+func dumpStore(kvStore *store.KVStore) string {
+	keys := kvStore.Keys("*")
+	slices.Sort(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		if value, ok, err := kvStore.GetString(key); err == nil && ok {
+			fmt.Fprintf(&b, "%s=%q ", key, value)
+			continue
+		}
+		values, _ := kvStore.LRange(key, 0, -1)
+		fmt.Fprintf(&b, "%s=%q ", key, values)
+	}
+	return b.String()
+}
+
+// crashRun is what happened in a workload run until the crash.
+type crashRun struct {
+	states  []string // store contents after each logged step, from empty
+	durable int      // states[:durable+1] are known to be durable
+	ops     int      // file system operations done
+}
+
+// runCrashWorkload runs steps against a WAL and snapshot manager on fsys
+// until they are done or fsys crashes. Like the server, it applies each
+// write to the store before logging it.
+func runCrashWorkload(fsys *faultFS, policy FsyncPolicy, steps []crashStep) (run crashRun) {
+	kvStore := store.NewKVStore()
+	run.states = []string{dumpStore(kvStore)}
+	defer func() { run.ops = fsys.ops }()
+
+	wal, err := NewWALFS(fsys, filepath.Join(crashDir, "wal.log"))
+	if err != nil {
+		return run
+	}
+	wal.SetSegmentSize(256)
+	wal.SetFsyncPolicy(policy)
+	sm := NewSnapshotManagerFS(fsys, crashDir, 0, nil)
+	sm.SetWAL(wal)
+
+	for _, step := range steps {
+		if step.cmds == nil {
+			// Everything applied so far is in the snapshot
+			if sm.CreateSnapshot(kvStore) == nil {
+				run.durable = len(run.states) - 1
+			}
+		} else {
+			applyCommands(kvStore, step.cmds)
+			run.states = append(run.states, dumpStore(kvStore))
+			seq, err := wal.Log(step.cmds)
+			if err == nil {
+				err = wal.Commit(seq)
+			}
+			if err == nil && policy == FsyncAlways {
+				run.durable = len(run.states) - 1
+			}
+		}
+		if fsys.isCrashed() {
+			break
+		}
+	}
+	if !fsys.isCrashed() {
+		// Power is lost without a clean shutdown
+		fsys.crashed = true
+	}
+	return run
+}
+
+// recoverCrashed recovers a store from fsys the way the server starts up.
+func recoverCrashed(t *testing.T, fsys *faultFS) (*store.KVStore, *WAL) {
+	t.Helper()
+
+	kvStore := store.NewKVStore()
+	wal, err := NewWALFS(fsys, filepath.Join(crashDir, "wal.log"))
+	require.NoError(t, err)
+	sm := NewSnapshotManagerFS(fsys, crashDir, 0, nil)
+	sm.SetWAL(wal)
+
+	// Failing to load is only fine if there is no snapshot at all
+	if err := sm.LoadLatest(kvStore); err != nil {
+		names, _ := sm.snapshotNames()
+		require.Empty(t, names, "loading the latest snapshot: %v", err)
+	}
+	require.NoError(t, wal.Replay(kvStore))
+	return kvStore, wal
+}
+
+// TestCrashConsistency runs random workloads against the WAL and snapshots,
+// crashes them at a random file system operation, and checks that recovery
+// finds the store as it was after some prefix of the workload that includes
+// every write acknowledged as durable. It then checks that the recovered log
+// takes new writes. A failing seed can be rerun with -crash.seed.
+func TestCrashConsistency(t *testing.T) {
+	seeds := make([]uint64, 0, *crashRuns)
+	if *crashSeed != 0 {
+		seeds = append(seeds, *crashSeed)
+	} else {
+		for seed := uint64(1); seed <= uint64(*crashRuns); seed++ {
+			seeds = append(seeds, seed)
+		}
+	}
+	if testing.Short() && len(seeds) > 50 {
+		seeds = seeds[:50]
+	}
+
+	for _, seed := range seeds {
+		if !testCrashSeed(t, seed) {
+			t.Fatalf("seed %d failed; rerun with -run TestCrashConsistency -crash.seed=%d", seed, seed)
+		}
+	}
+}
+
+func testCrashSeed(t *testing.T, seed uint64) bool {
+	return t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		steps := crashWorkload(rng)
+		policy := FsyncAlways
+		if rng.IntN(4) == 0 {
+			policy = FsyncNo
+		}
+
+		// A dry run counts the operations, so the crash can hit any of them
+		// or, one past the end, none
+		total := runCrashWorkload(newFaultFS(rand.New(rand.NewPCG(seed, 1))), policy, steps).ops
+		fsys := newFaultFS(rng)
+		fsys.crashAt = 1 + rng.IntN(total+1)
+		run := runCrashWorkload(fsys, policy, steps)
+
+		after := fsys.reboot()
+		kvStore, wal := recoverCrashed(t, after)
+		got := dumpStore(kvStore)
+		if !slices.Contains(run.states[run.durable:], got) {
+			t.Fatalf("policy %s, crash at operation %d of %d\nrecovered: %s\nwant one of states %d..%d: %q\nsteps: %v\nfiles:\n%s",
+				policy, fsys.crashAt, total, got, run.durable, len(run.states)-1, run.states[run.durable:], steps, after)
+		}
+
+		// The recovered log takes new writes and recovers again cleanly
+		applyCommands(kvStore, [][]string{{"SET", "after", "crash"}})
+		want := dumpStore(kvStore)
+		require.NoError(t, wal.AppendCommand("SET", "after", "crash"))
+		require.NoError(t, wal.Close())
+		again, wal := recoverCrashed(t, after.reboot())
+		defer wal.Close()
+		require.Equal(t, want, dumpStore(again))
+	})
+}
@@ -0,0 +1,166 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// FsyncPolicy says when records appended to the WAL are forced to disk, like
+// Redis' appendfsync.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways makes each record durable before its append returns.
+	// Concurrent appends share fsyncs (group commit): an fsync covers every
+	// record written before it started, so appenders that arrive while one
+	// runs wait for it and then need at most one more between them.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec fsyncs once a second in the background. A crash loses
+	// up to the last second of writes.
+	FsyncEverySec
+	// FsyncNo leaves flushing to the operating system, apart from rotation
+	// and Close.
+	FsyncNo
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	case FsyncNo:
+		return "no"
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+}
+
+// ParseFsyncPolicy returns the policy with the given name: always, everysec
+// or no.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	for _, p := range []FsyncPolicy{FsyncAlways, FsyncEverySec, FsyncNo} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q", name)
+}
+
+// everySecInterval is how often FsyncEverySec syncs. Tests shorten it.
+var everySecInterval = time.Second
+
+// SetFsyncPolicy changes when appended records are forced to disk. The
+// default is FsyncAlways.
+func (w *WAL) SetFsyncPolicy(p FsyncPolicy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.policy = p
+	switch {
+	case p == FsyncEverySec && w.stopSync == nil && !w.closed:
+		w.stopSync = make(chan struct{})
+		go w.syncLoop(w.stopSync)
+	case p != FsyncEverySec && w.stopSync != nil:
+		close(w.stopSync)
+		w.stopSync = nil
+	}
+}
+
+// Commit returns once the record with sequence number seq, as returned by
+// Log, is as durable as the fsync policy asks: on disk with FsyncAlways,
+// and right away with the others.
+func (w *WAL) Commit(seq uint64) error {
+	w.mu.Lock()
+	policy := w.policy
+	w.mu.Unlock()
+
+	if policy != FsyncAlways {
+		return nil
+	}
+	return w.syncThrough(seq)
+}
+
+// syncThrough returns once the records up to seq are on disk. Only one
+// fsync runs at a time; whoever finds none running and its record not yet
+// covered starts the next one.
+func (w *WAL) syncThrough(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	for w.synced < seq {
+		if w.syncing {
+			w.syncDone.Wait()
+			continue
+		}
+
+		w.syncing = true
+		w.syncMu.Unlock()
+		err := w.syncActive()
+		w.syncMu.Lock()
+		w.syncing = false
+		w.syncDone.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncActive fsyncs the active segment without holding w.mu, so records
+// can be written meanwhile for the next fsync to pick up.
+func (w *WAL) syncActive() error {
+	w.mu.Lock()
+	file, last, closed := w.file, w.nextSeq-1, w.closed
+	w.mu.Unlock()
+	if closed {
+		return errors.New("WAL is closed")
+	}
+
+	start := time.Now()
+	err := file.Sync()
+	w.fsyncs.Since(start)
+	if errors.Is(err, os.ErrClosed) {
+		// Rotation or Close synced the file before closing it, unless that
+		// failed too
+		w.syncMu.Lock()
+		if w.synced >= last {
+			err = nil
+		}
+		w.syncMu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	w.markSynced(last)
+	return nil
+}
+
+// markSynced records that the records up to seq are on disk.
+func (w *WAL) markSynced(seq uint64) {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if seq > w.synced {
+		w.synced = seq
+	}
+}
+
+// syncLoop implements FsyncEverySec until stop is closed.
+func (w *WAL) syncLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(everySecInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := w.syncThrough(w.LastSeq()); err != nil {
+			log.Printf("WAL fsync failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// On-disk WAL layout:
+//
+//	header:  magic "KVWL" | version uint16 | reserved uint16 | firstSeq uint64
+//	record:  length uint32 | crc32c(payload) uint32 | payload
+//	payload: type byte | body
+//	body:    command, or for a batch: count uvarint | command*count
+//	command: argc uvarint | (len uvarint | bytes)*argc
+//
+// All integers are little-endian. A record is only valid if its full payload
+// is present and matches the checksum, so a write torn by a crash is detected
+// instead of being misparsed. firstSeq is the sequence number of the first
+// record in the segment; each following record is numbered one higher.
+//
+// A batch record holds the commands of a transaction. Sharing one checksum,
+// they are replayed together or not at all.
+const (
+	walMagic       = "KVWL"
+	walVersion     = 2
+	walHeaderSize  = 16
+	recordHeadSize = 8
+	// maxRecordSize is the most the length field of a record can hold.
+	maxRecordSize = math.MaxUint32
+	// readChunk is how much of a payload is read at a time, so that a
+	// damaged length can't make replay allocate more than the log holds.
+	readChunk = 64 * 1024
+)
+
+// MaxWriteSize is the most the commands of one write may come to, as
+// RecordSize counts them, for a handler to run them. What a handler logs
+// for a write is at most a few times its arguments, which keeps its record
+// within what the format can hold; a record that isn't is never written.
+const MaxWriteSize = 512 * 1024 * 1024
+
+const (
+	recordCommand byte = 1
+	recordBatch   byte = 2
+)
+
+var (
+	ErrBadHeader      = errors.New("wal: bad header")
+	ErrCorruptRecord  = errors.New("wal: corrupt record")
+	ErrRecordTooLarge = errors.New("wal: record too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeHeader(firstSeq uint64) []byte {
+	buf := make([]byte, walHeaderSize)
+	copy(buf, walMagic)
+	binary.LittleEndian.PutUint16(buf[4:], walVersion)
+	binary.LittleEndian.PutUint64(buf[8:], firstSeq)
+	return buf
+}
+
+// decodeHeader validates a segment header and returns its first sequence
+// number.
+func decodeHeader(buf []byte) (uint64, error) {
+	if len(buf) < walHeaderSize || string(buf[:4]) != walMagic {
+		return 0, ErrBadHeader
+	}
+	if v := binary.LittleEndian.Uint16(buf[4:]); v != walVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrBadHeader, v)
+	}
+	return binary.LittleEndian.Uint64(buf[8:]), nil
+}
+
+// appendRecord frames payload with its length and checksum.
+func appendRecord(buf, payload []byte) []byte {
+	var head [recordHeadSize]byte
+	binary.LittleEndian.PutUint32(head[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(head[4:], crc32.Checksum(payload, crcTable))
+	buf = append(buf, head[:]...)
+	return append(buf, payload...)
+}
+
+func encodeCommand(args []string) []byte {
+	buf := make([]byte, 0, 1+commandSize(args))
+	buf = append(buf, recordCommand)
+	return appendCommand(buf, args)
+}
+
+func encodeBatch(cmds [][]string) []byte {
+	buf := make([]byte, 0, RecordSize(cmds))
+	buf = append(buf, recordBatch)
+	buf = binary.AppendUvarint(buf, uint64(len(cmds)))
+	for _, args := range cmds {
+		buf = appendCommand(buf, args)
+	}
+	return buf
+}
+
+// RecordSize returns at least the size of the record payload holding cmds.
+func RecordSize(cmds [][]string) int {
+	size := 1 + binary.MaxVarintLen64
+	for _, args := range cmds {
+		size += commandSize(args)
+	}
+	return size
+}
+
+func commandSize(args []string) int {
+	size := binary.MaxVarintLen64
+	for _, a := range args {
+		size += binary.MaxVarintLen64 + len(a)
+	}
+	return size
+}
+
+func appendCommand(buf []byte, args []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(args)))
+	for _, a := range args {
+		buf = binary.AppendUvarint(buf, uint64(len(a)))
+		buf = append(buf, a...)
+	}
+	return buf
+}
+
+// EncodeRecord encodes commands as a record payload in the form the WAL
+// stores them: a command record for one, a batch for several. Other logs,
+// such as the Raft log, use it to carry writes.
+func EncodeRecord(cmds [][]string) []byte {
+	if len(cmds) == 1 {
+		return encodeCommand(cmds[0])
+	}
+	return encodeBatch(cmds)
+}
+
+// DecodeRecord returns the commands of a payload built by EncodeRecord.
+func DecodeRecord(payload []byte) ([][]string, error) {
+	return decodeRecord(payload)
+}
+
+// decodeRecord returns the commands held by a record payload: one for a
+// command record, any number for a batch.
+func decodeRecord(payload []byte) ([][]string, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("%w: empty record", ErrCorruptRecord)
+	}
+	buf := payload[1:]
+
+	count := uint64(1)
+	switch payload[0] {
+	case recordCommand:
+	case recordBatch:
+		var n int
+		count, n = binary.Uvarint(buf)
+		if n <= 0 || count > uint64(len(buf)) {
+			return nil, fmt.Errorf("%w: bad batch size", ErrCorruptRecord)
+		}
+		buf = buf[n:]
+	default:
+		return nil, fmt.Errorf("%w: unknown record type", ErrCorruptRecord)
+	}
+
+	cmds := make([][]string, count)
+	for i := range cmds {
+		var err error
+		if cmds[i], buf, err = decodeCommand(buf); err != nil {
+			return nil, err
+		}
+	}
+	if len(buf) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes", ErrCorruptRecord)
+	}
+	return cmds, nil
+}
+
+// decodeCommand decodes one command and returns the bytes after it.
+func decodeCommand(buf []byte) ([]string, []byte, error) {
+	argc, n := binary.Uvarint(buf)
+	if n <= 0 || argc > uint64(len(buf)) {
+		return nil, nil, fmt.Errorf("%w: bad argument count", ErrCorruptRecord)
+	}
+	buf = buf[n:]
+
+	args := make([]string, argc)
+	for i := range args {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || l > uint64(len(buf)-n) {
+			return nil, nil, fmt.Errorf("%w: bad argument length", ErrCorruptRecord)
+		}
+		args[i] = string(buf[n : n+int(l)])
+		buf = buf[n+int(l):]
+	}
+	return args, buf, nil
+}
+
+// recordReader iterates over the records of a WAL stream and tracks the
+// offset just past the last intact record.
+type recordReader struct {
+	r      io.Reader
+	offset int64
+	head   [recordHeadSize]byte
+}
+
+// next returns the next payload. It returns io.EOF at a clean end of log and
+// ErrCorruptRecord (wrapped) for a torn or damaged record; in both cases
+// offset is left at the end of the valid prefix.
+func (rr *recordReader) next() ([]byte, error) {
+	n, err := io.ReadFull(rr.r, rr.head[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: torn record header (%d bytes)", ErrCorruptRecord, n)
+	}
+
+	length := binary.LittleEndian.Uint32(rr.head[0:])
+	sum := binary.LittleEndian.Uint32(rr.head[4:])
+
+	// The length isn't checked yet, so the payload grows as it is read
+	// rather than being allocated up front
+	var buf bytes.Buffer
+	buf.Grow(int(min(length, readChunk)))
+	if _, err := io.CopyN(&buf, rr.r, int64(length)); err != nil {
+		return nil, fmt.Errorf("%w: torn record payload", ErrCorruptRecord)
+	}
+	payload := buf.Bytes()
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+
+	rr.offset += int64(recordHeadSize) + int64(length)
+	return payload, nil
+}
@@ -1,115 +1,243 @@
 package persistence
 
 import (
+	"bufio"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alyxpink/go-training/kvstore/store"
 )
 
+// snapshotVersion 3 added collection types to store.Entry. Version 2
+// snapshots only hold strings and decode unchanged.
+const snapshotVersion = 3
+
 type SnapshotManager struct {
+	fs       FS
 	dataDir  string
 	interval time.Duration
+	wal      *WAL
+	writes   sync.Locker
+
+	mu    sync.Mutex
+	stats SnapshotStats
+}
+
+// SnapshotStats describes the snapshots taken or loaded so far.
+type SnapshotStats struct {
+	Saves int64 // snapshots created
+	// LastSave is when the data of the newest snapshot created or loaded
+	// was current, zero if there is none.
+	LastSave     time.Time
+	LastDuration time.Duration // how long the last attempt to create one took
+	LastFailed   bool
+}
+
+// Snapshot files are a gob stream: one SnapshotHeader, then one
+// SnapshotRecord per key, then a SnapshotRecord with End set. Entries are
+// written as they are read from a store.Export, so creating a snapshot never
+// needs a second in-memory copy of the data.
+type SnapshotHeader struct {
+	Version int
+	// CreatedAt is the instant of the point-in-time view.
+	CreatedAt time.Time
+	// WALSeq is the sequence number of the last WAL record whose effect is
+	// included in the snapshot.
+	WALSeq uint64
 }
 
-type SnapshotData struct {
-	Data map[string]*store.Entry
+type SnapshotRecord struct {
+	Key   string
+	Entry store.Entry
+	// End marks the trailer; Count is the number of records before it.
+	End   bool
+	Count int
 }
 
-func NewSnapshotManager(dataDir string, interval time.Duration) *SnapshotManager {
+// NewSnapshotManager creates a manager for snapshots in dataDir, taken
+// every interval by Run. writes is the lock held while a write is applied
+// to the store and logged (see protocol.Handler.WriteLock): snapshots hold
+// it while they open their view, so that the view reflects exactly the WAL
+// records they say it covers. It may only be nil if nothing writes to the
+// store while a snapshot is taken.
+func NewSnapshotManager(dataDir string, interval time.Duration, writes sync.Locker) *SnapshotManager {
+	return NewSnapshotManagerFS(OSFS, dataDir, interval, writes)
+}
+
+// NewSnapshotManagerFS is NewSnapshotManager on the file system fsys.
+func NewSnapshotManagerFS(fsys FS, dataDir string, interval time.Duration, writes sync.Locker) *SnapshotManager {
 	return &SnapshotManager{
+		fs:       fsys,
 		dataDir:  dataDir,
 		interval: interval,
+		writes:   writes,
 	}
 }
 
+// SetWAL couples snapshots with the write-ahead log. Each snapshot then
+// rotates the WAL, records the last sequence number it covers and deletes
+// the segments it makes redundant, and LoadLatest tells the WAL which records
+// Replay can skip.
+func (sm *SnapshotManager) SetWAL(wal *WAL) {
+	sm.wal = wal
+}
+
 func (sm *SnapshotManager) Run(kvStore *store.KVStore) {
 	ticker := time.NewTicker(sm.interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		sm.CreateSnapshot(kvStore)
+		if err := sm.CreateSnapshot(kvStore); err != nil {
+			log.Printf("Snapshot failed: %v", err)
+		}
 	}
 }
 
+// Stats returns what the manager has done so far.
+func (sm *SnapshotManager) Stats() SnapshotStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.stats
+}
+
 func (sm *SnapshotManager) CreateSnapshot(kvStore *store.KVStore) error {
-	// Create snapshot filename with timestamp
-	timestamp := time.Now().Unix()
-	filename := fmt.Sprintf("snapshot-%d.db", timestamp)
-	tempPath := filepath.Join(sm.dataDir, filename+".tmp")
-	finalPath := filepath.Join(sm.dataDir, filename)
+	start := time.Now()
+	createdAt, err := sm.createSnapshot(kvStore)
 
-	// Create temporary file
-	file, err := os.Create(tempPath)
-	if err != nil {
-		return err
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.stats.LastDuration = time.Since(start)
+	sm.stats.LastFailed = err != nil
+	if err == nil {
+		sm.stats.Saves++
+		sm.stats.LastSave = createdAt
 	}
+	return err
+}
 
-	// Get all keys and their entries
-	keys := kvStore.Keys("*")
-	snapshotData := SnapshotData{
-		Data: make(map[string]*store.Entry),
+// createSnapshot writes a snapshot and returns the instant of its view.
+func (sm *SnapshotManager) createSnapshot(kvStore *store.KVStore) (time.Time, error) {
+	// Handlers apply and log writes under the write lock, so holding it the
+	// view reflects exactly the records up to seq: replaying those again
+	// would not be harmless, since pushes and pops aren't idempotent
+	if sm.writes != nil {
+		sm.writes.Lock()
+	}
+	var seq uint64
+	if sm.wal != nil {
+		seq = sm.wal.LastSeq()
 	}
+	export := kvStore.Export()
+	if sm.writes != nil {
+		sm.writes.Unlock()
+	}
+	defer export.Close()
 
-	// Copy data from store
-	for _, key := range keys {
-		if value, ok := kvStore.Get(key); ok {
-			// We need to reconstruct the entry
-			entry := &store.Entry{
-				Value:     value,
-				CreatedAt: time.Now(),
-				UpdatedAt: time.Now(),
-			}
+	// Seal the segment that holds seq, so that it can go once the snapshot
+	// is durable. Records after seq that it also holds keep it until the
+	// next snapshot.
+	if sm.wal != nil {
+		if _, err := sm.wal.Rotate(); err != nil {
+			return time.Time{}, err
+		}
+	}
 
-			// Check if key has TTL
-			ttl := kvStore.TTL(key)
-			if ttl > 0 {
-				expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
-				entry.ExpiresAt = &expiresAt
-			}
+	// Create snapshot filename with timestamp
+	filename := fmt.Sprintf("snapshot-%d.db", export.Time().Unix())
+	tempPath := filepath.Join(sm.dataDir, filename+".tmp")
+	finalPath := filepath.Join(sm.dataDir, filename)
 
-			snapshotData.Data[key] = entry
-		}
+	// Create temporary file
+	file, err := sm.fs.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return time.Time{}, err
 	}
 
-	// Encode to gob
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(snapshotData); err != nil {
+	if err := writeSnapshot(file, export, seq); err != nil {
 		file.Close()
-		os.Remove(tempPath)
-		return err
+		sm.fs.Remove(tempPath)
+		return time.Time{}, err
 	}
 
+	// The snapshot must be durable before the WAL it replaces is deleted
+	if err := file.Sync(); err != nil {
+		file.Close()
+		sm.fs.Remove(tempPath)
+		return time.Time{}, err
+	}
 	file.Close()
 
 	// Atomic rename
-	if err := os.Rename(tempPath, finalPath); err != nil {
-		return err
+	if err := sm.fs.Rename(tempPath, finalPath); err != nil {
+		return time.Time{}, err
+	}
+	if err := sm.fs.SyncDir(sm.dataDir); err != nil {
+		return time.Time{}, err
 	}
 
 	// Clean up old snapshots (keep only the latest 3)
 	sm.cleanupOldSnapshots()
 
-	return nil
+	if sm.wal != nil {
+		return export.Time(), sm.wal.RemoveSegmentsThrough(seq)
+	}
+	return export.Time(), nil
 }
 
-func (sm *SnapshotManager) LoadLatest(kvStore *store.KVStore) error {
-	// Find latest snapshot file
-	files, err := os.ReadDir(sm.dataDir)
-	if err != nil {
+// StreamTo streams a snapshot of export to w instead of a file, for example
+// to a replica. seq is the last WAL sequence number the export reflects.
+func (sm *SnapshotManager) StreamTo(w io.Writer, export *store.Export, seq uint64) error {
+	return writeSnapshot(w, export, seq)
+}
+
+// LoadFrom loads a snapshot written by StreamTo into kvStore. Unlike
+// LoadLatest it leaves the WAL alone.
+func (sm *SnapshotManager) LoadFrom(r io.Reader, kvStore *store.KVStore) (SnapshotHeader, error) {
+	return readSnapshot(r, func(key string, entry store.Entry) {
+		kvStore.Restore(key, entry)
+	})
+}
+
+func writeSnapshot(w io.Writer, export *store.Export, seq uint64) error {
+	buf := bufio.NewWriter(w)
+	encoder := gob.NewEncoder(buf)
+
+	header := SnapshotHeader{Version: snapshotVersion, CreatedAt: export.Time(), WALSeq: seq}
+	if err := encoder.Encode(header); err != nil {
 		return err
 	}
 
-	var snapshots []string
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), "snapshot-") && strings.HasSuffix(file.Name(), ".db") {
-			snapshots = append(snapshots, file.Name())
+	count := 0
+	for {
+		key, entry, ok := export.Next()
+		if !ok {
+			break
+		}
+		if err := encoder.Encode(SnapshotRecord{Key: key, Entry: entry}); err != nil {
+			return err
 		}
+		count++
+	}
+
+	if err := encoder.Encode(SnapshotRecord{End: true, Count: count}); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+func (sm *SnapshotManager) LoadLatest(kvStore *store.KVStore) error {
+	// Find latest snapshot file
+	snapshots, err := sm.snapshotNames()
+	if err != nil {
+		return err
 	}
 
 	if len(snapshots) == 0 {
@@ -122,46 +250,84 @@ func (sm *SnapshotManager) LoadLatest(kvStore *store.KVStore) error {
 
 	// Load snapshot
 	snapshotPath := filepath.Join(sm.dataDir, latestSnapshot)
-	file, err := os.Open(snapshotPath)
+	file, err := openRead(sm.fs, snapshotPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	var snapshotData SnapshotData
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(&snapshotData); err != nil {
-		return err
+	header, err := readSnapshot(file, func(key string, entry store.Entry) {
+		kvStore.Restore(key, entry)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", latestSnapshot, err)
 	}
 
-	// Load data into store
-	for key, entry := range snapshotData.Data {
-		kvStore.Set(key, entry.Value)
+	sm.mu.Lock()
+	sm.stats.LastSave = header.CreatedAt
+	sm.mu.Unlock()
 
-		// Restore expiration if it exists
-		if entry.ExpiresAt != nil {
-			ttl := time.Until(*entry.ExpiresAt).Seconds()
-			if ttl > 0 {
-				kvStore.Expire(key, int(ttl))
+	if sm.wal != nil {
+		return sm.wal.SkipThrough(header.WALSeq)
+	}
+	return nil
+}
+
+// readSnapshot decodes a snapshot stream, calling restore for each entry. It
+// fails if the stream ends before the trailer, so a truncated file is never
+// mistaken for a complete one.
+func readSnapshot(r io.Reader, restore func(key string, entry store.Entry)) (SnapshotHeader, error) {
+	decoder := gob.NewDecoder(bufio.NewReader(r))
+
+	var header SnapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return header, err
+	}
+	if header.Version != snapshotVersion && header.Version != 2 {
+		return header, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	count := 0
+	for {
+		var record SnapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return header, err
+		}
+		if record.End {
+			if record.Count != count {
+				return header, fmt.Errorf("snapshot has %d records, trailer says %d", count, record.Count)
 			}
+			return header, nil
 		}
+		restore(record.Key, record.Entry)
+		count++
 	}
-
-	return nil
 }
 
-func (sm *SnapshotManager) cleanupOldSnapshots() {
-	files, err := os.ReadDir(sm.dataDir)
+// snapshotNames lists the snapshot files in the data directory.
+func (sm *SnapshotManager) snapshotNames() ([]string, error) {
+	names, err := sm.fs.ReadDir(sm.dataDir)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	var snapshots []string
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), "snapshot-") && strings.HasSuffix(file.Name(), ".db") {
-			snapshots = append(snapshots, file.Name())
+	for _, name := range names {
+		if strings.HasPrefix(name, "snapshot-") && strings.HasSuffix(name, ".db") {
+			snapshots = append(snapshots, name)
 		}
 	}
+	return snapshots, nil
+}
+
+func (sm *SnapshotManager) cleanupOldSnapshots() {
+	snapshots, err := sm.snapshotNames()
+	if err != nil {
+		return
+	}
 
 	if len(snapshots) <= 3 {
 		return
@@ -170,6 +336,6 @@ func (sm *SnapshotManager) cleanupOldSnapshots() {
 	// Sort and remove old snapshots
 	sort.Strings(snapshots)
 	for i := 0; i < len(snapshots)-3; i++ {
-		os.Remove(filepath.Join(sm.dataDir, snapshots[i]))
+		sm.fs.Remove(filepath.Join(sm.dataDir, snapshots[i]))
 	}
 }
@@ -3,6 +3,7 @@ package persistence
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -13,7 +14,7 @@ import (
 
 func TestSnapshotManager_CreateSnapshot(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	kvStore := store.NewKVStore()
 	kvStore.Set("key1", "value1")
@@ -31,7 +32,7 @@ func TestSnapshotManager_CreateSnapshot(t *testing.T) {
 
 func TestSnapshotManager_LoadLatest(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create snapshot
 	kvStore1 := store.NewKVStore()
@@ -63,7 +64,7 @@ func TestSnapshotManager_LoadLatest(t *testing.T) {
 
 func TestSnapshotManager_LoadLatestNoSnapshot(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	kvStore := store.NewKVStore()
 	err := sm.LoadLatest(kvStore)
@@ -74,7 +75,7 @@ func TestSnapshotManager_LoadLatestNoSnapshot(t *testing.T) {
 
 func TestSnapshotManager_LoadLatestWithExpiration(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create snapshot with expiring key
 	kvStore1 := store.NewKVStore()
@@ -101,7 +102,7 @@ func TestSnapshotManager_LoadLatestWithExpiration(t *testing.T) {
 
 func TestSnapshotManager_MultipleSnapshots(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create first snapshot
 	kvStore1 := store.NewKVStore()
@@ -135,7 +136,7 @@ func TestSnapshotManager_MultipleSnapshots(t *testing.T) {
 
 func TestSnapshotManager_EmptyStore(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create snapshot of empty store
 	kvStore1 := store.NewKVStore()
@@ -154,7 +155,7 @@ func TestSnapshotManager_EmptyStore(t *testing.T) {
 
 func TestSnapshotManager_LargeDataset(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create store with many keys
 	kvStore1 := store.NewKVStore()
@@ -179,7 +180,7 @@ func TestSnapshotManager_LargeDataset(t *testing.T) {
 
 func TestSnapshotManager_SnapshotFilename(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	kvStore := store.NewKVStore()
 	kvStore.Set("key1", "value1")
@@ -200,7 +201,7 @@ func TestSnapshotManager_SnapshotFilename(t *testing.T) {
 
 func TestSnapshotManager_OverwriteSnapshot(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create first snapshot
 	kvStore1 := store.NewKVStore()
@@ -237,7 +238,7 @@ func TestSnapshotManager_CorruptedSnapshot(t *testing.T) {
 	err := os.WriteFile(corruptedPath, []byte("invalid data"), 0644)
 	require.NoError(t, err)
 
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 	kvStore := store.NewKVStore()
 
 	// Loading corrupted snapshot should error
@@ -247,7 +248,7 @@ func TestSnapshotManager_CorruptedSnapshot(t *testing.T) {
 
 func TestSnapshotManager_PreserveTimestamps(t *testing.T) {
 	tmpDir := t.TempDir()
-	sm := NewSnapshotManager(tmpDir, time.Minute)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
 
 	// Create snapshot with entries that have timestamps
 	kvStore1 := store.NewKVStore()
@@ -272,3 +273,219 @@ func TestSnapshotManager_PreserveTimestamps(t *testing.T) {
 	_, ok = kvStore2.Get("key2")
 	assert.True(t, ok)
 }
+
+func TestSnapshotManager_TruncatesCoveredSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "wal.log")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
+	sm.SetWAL(wal)
+
+	kvStore := store.NewKVStore()
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		kvStore.Set(key, "before")
+		require.NoError(t, wal.AppendCommand("SET", key, "before"))
+	}
+
+	require.NoError(t, sm.CreateSnapshot(kvStore))
+
+	segments, err := wal.sealedSegments()
+	require.NoError(t, err)
+	assert.Empty(t, segments, "segments covered by the snapshot should be deleted")
+
+	// Writes after the snapshot land in the new active segment
+	kvStore.Set("key0", "after")
+	require.NoError(t, wal.AppendCommand("SET", "key0", "after"))
+	wal.Close()
+
+	// Recover: snapshot first, then only the WAL tail
+	wal2, err := NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal2.Close()
+	sm2 := NewSnapshotManager(tmpDir, time.Minute, nil)
+	sm2.SetWAL(wal2)
+
+	recovered := store.NewKVStore()
+	require.NoError(t, sm2.LoadLatest(recovered))
+	result, err := wal2.Recover(recovered)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Records, "only the tail after the snapshot should be replayed")
+	assert.Equal(t, uint64(11), result.LastSeq)
+
+	val, ok := recovered.Get("key0")
+	require.True(t, ok)
+	assert.Equal(t, "after", val)
+	assert.Len(t, recovered.Keys("*"), 10)
+}
+
+func TestSnapshotManager_SkipsRecordsLeftBehindByCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "wal.log")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
+	sm.SetWAL(wal)
+
+	kvStore := store.NewKVStore()
+	kvStore.Set("key1", "value1")
+	require.NoError(t, wal.AppendCommand("SET", "key1", "value1"))
+	kvStore.Del("key1")
+	require.NoError(t, wal.AppendCommand("DEL", "key1"))
+
+	// Keep a copy of the segment the snapshot is about to delete
+	_, err = wal.Rotate()
+	require.NoError(t, err)
+	sealed := segmentPath(walPath, 1)
+	data, err := os.ReadFile(sealed)
+	require.NoError(t, err)
+
+	kvStore.Set("key1", "value2")
+	require.NoError(t, wal.AppendCommand("SET", "key1", "value2"))
+	require.NoError(t, sm.CreateSnapshot(kvStore))
+	wal.Close()
+
+	// Simulate a crash after the snapshot was written but before the
+	// covered segments were removed
+	require.NoError(t, os.WriteFile(sealed, data, 0644))
+
+	wal2, err := NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal2.Close()
+	sm2 := NewSnapshotManager(tmpDir, time.Minute, nil)
+	sm2.SetWAL(wal2)
+
+	recovered := store.NewKVStore()
+	require.NoError(t, sm2.LoadLatest(recovered))
+	result, err := wal2.Recover(recovered)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Skipped)
+	assert.Equal(t, 0, result.Records)
+
+	val, ok := recovered.Get("key1")
+	require.True(t, ok)
+	assert.Equal(t, "value2", val)
+}
+
+func TestSnapshotManager_PreservesExactEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
+
+	created := time.Now().Add(-time.Hour).Round(0)
+	updated := time.Now().Add(-time.Minute).Round(0)
+	expires := time.Now().Add(2500 * time.Millisecond).Round(0)
+
+	kvStore1 := store.NewKVStore()
+	kvStore1.Restore("key1", store.Entry{Value: "value1", CreatedAt: created, UpdatedAt: updated, ExpiresAt: &expires})
+
+	require.NoError(t, sm.CreateSnapshot(kvStore1))
+
+	kvStore2 := store.NewKVStore()
+	require.NoError(t, sm.LoadLatest(kvStore2))
+
+	export := kvStore2.Export()
+	defer export.Close()
+	key, entry, ok := export.Next()
+	require.True(t, ok)
+	assert.Equal(t, "key1", key)
+	assert.True(t, created.Equal(entry.CreatedAt))
+	assert.True(t, updated.Equal(entry.UpdatedAt))
+	require.NotNil(t, entry.ExpiresAt)
+	assert.True(t, expires.Equal(*entry.ExpiresAt), "expiry instant should survive with sub-second precision")
+}
+
+func TestSnapshotManager_TruncatedSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
+
+	kvStore := store.NewKVStore()
+	for i := 0; i < 100; i++ {
+		kvStore.Set("key"+strconv.Itoa(i), "value")
+	}
+	require.NoError(t, sm.CreateSnapshot(kvStore))
+
+	files, err := filepath.Glob(filepath.Join(tmpDir, "snapshot-*.db"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(files[0], data[:len(data)-10], 0644))
+
+	err = sm.LoadLatest(store.NewKVStore())
+	assert.Error(t, err, "a snapshot without its trailer must not load")
+}
+
+func TestSnapshotManager_CollectionTypes(t *testing.T) {
+	tmpDir := t.TempDir()
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
+
+	kvStore1 := store.NewKVStore()
+	kvStore1.RPush("list", "a", "b", "c")
+	kvStore1.HSet("hash", "f1", "v1", "f2", "v2")
+	kvStore1.SAdd("set", "x", "y")
+	kvStore1.ZAdd("zset", store.ScoredMember{Member: "m1", Score: 2}, store.ScoredMember{Member: "m2", Score: -1})
+	kvStore1.Expire("set", 100)
+
+	require.NoError(t, sm.CreateSnapshot(kvStore1))
+
+	kvStore2 := store.NewKVStore()
+	require.NoError(t, sm.LoadLatest(kvStore2))
+
+	list, err := kvStore2.LRange("list", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, list)
+
+	hash, err := kvStore2.HGetAll("hash")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, hash)
+
+	set, err := kvStore2.SMembers("set")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, set)
+	assert.Greater(t, kvStore2.TTL("set"), 0)
+
+	zset, err := kvStore2.ZRange("zset", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []store.ScoredMember{{Member: "m2", Score: -1}, {Member: "m1", Score: 2}}, zset)
+
+	// Memory accounting is rebuilt from the restored values
+	assert.Equal(t, kvStore1.Stats().UsedMemory, kvStore2.Stats().UsedMemory)
+}
+
+func TestSnapshotManager_Stats(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(tmpDir, 0755))
+	sm := NewSnapshotManager(tmpDir, time.Minute, nil)
+	assert.Zero(t, sm.Stats())
+
+	kvStore := store.NewKVStore()
+	kvStore.Set("key", "value")
+	before := time.Now()
+	require.NoError(t, sm.CreateSnapshot(kvStore))
+
+	st := sm.Stats()
+	assert.Equal(t, int64(1), st.Saves)
+	assert.False(t, st.LastFailed)
+	assert.WithinRange(t, st.LastSave, before, time.Now())
+
+	// A failure is recorded, and the last good snapshot is kept
+	saved := tmpDir + ".saved"
+	require.NoError(t, os.Rename(tmpDir, saved))
+	require.NoError(t, os.WriteFile(tmpDir, nil, 0644))
+	assert.Error(t, sm.CreateSnapshot(kvStore))
+	failed := sm.Stats()
+	assert.Equal(t, int64(1), failed.Saves)
+	assert.True(t, failed.LastFailed)
+	assert.Equal(t, st.LastSave, failed.LastSave)
+
+	// Loading picks up when the snapshot was taken
+	require.NoError(t, os.Remove(tmpDir))
+	require.NoError(t, os.Rename(saved, tmpDir))
+	loaded := NewSnapshotManager(tmpDir, time.Minute, nil)
+	require.NoError(t, loaded.LoadLatest(store.NewKVStore()))
+	assert.Equal(t, st.LastSave.Unix(), loaded.Stats().LastSave.Unix())
+}
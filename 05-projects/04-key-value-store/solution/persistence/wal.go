@@ -2,96 +2,685 @@ package persistence
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/alyxpink/go-training/kvstore/metrics"
 	"github.com/alyxpink/go-training/kvstore/store"
 )
 
+// DefaultSegmentSize is the size at which the active segment is sealed and a
+// new one started.
+const DefaultSegmentSize = 64 * 1024 * 1024
+
+// WAL is a segmented write-ahead log. New records go to the active segment at
+// the path given to NewWAL; sealed segments sit next to it, named after the
+// sequence number of their first record (wal.log.00000000000000000042).
+//
+// Every record gets a sequence number. A snapshot records the last sequence
+// number it covers, which lets the WAL delete sealed segments the snapshot
+// has made redundant and lets Replay skip records already in the snapshot.
 type WAL struct {
-	file   *os.File
-	mu     sync.Mutex
-	closed bool
+	fs          FS
+	path        string
+	file        File
+	mu          sync.Mutex
+	closed      bool
+	size        int64
+	firstSeq    uint64 // sequence number of the active segment's first record
+	nextSeq     uint64
+	segmentSize int64
+	skipThrough uint64 // records up to this sequence are already applied
+	feed        func(seq uint64, payload []byte)
+	fsyncs      *metrics.Histogram
+	policy      FsyncPolicy
+	stopSync    chan struct{} // closed to stop the FsyncEverySec loop
+
+	// Group commit state; see fsync.go. syncMu may be taken while holding
+	// mu, never the other way round.
+	syncMu   sync.Mutex
+	syncDone *sync.Cond // broadcast when an fsync finishes
+	syncing  bool
+	synced   uint64 // records up to this sequence are on disk
+}
+
+// WALStats describes the log for monitoring.
+type WALStats struct {
+	LastSeq     uint64
+	SegmentSize int64 // bytes in the active segment
+	Policy      FsyncPolicy
+	Fsyncs      metrics.HistogramSnapshot
 }
 
+// ReplayInfo describes how much of the log a replay was able to apply.
+type ReplayInfo struct {
+	Records  int    // records applied to the store
+	Skipped  int    // records skipped because a snapshot covers them
+	LastSeq  uint64 // sequence number of the last intact record
+	Segment  string // segment in which replay stopped
+	ValidEnd int64  // byte offset just past the last intact record in Segment
+	Torn     bool   // a torn or corrupt record was found at ValidEnd
+}
+
+// NewWAL opens or creates the log at path. If the active segment ends in a
+// record that was torn by a crash, the damaged tail is truncated so new
+// records are appended directly after the last intact one.
 func NewWAL(path string) (*WAL, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	return NewWALFS(OSFS, path)
+}
+
+// NewWALFS is NewWAL on the file system fsys.
+func NewWALFS(fsys FS, path string) (*WAL, error) {
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WAL{
-		file:   file,
-		closed: false,
-	}, nil
+	w := &WAL{fs: fsys, path: path, file: file, segmentSize: DefaultSegmentSize, fsyncs: metrics.NewHistogram(metrics.LatencyBuckets)}
+	w.syncDone = sync.NewCond(&w.syncMu)
+	if err := w.recoverTail(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.synced = w.nextSeq - 1
+
+	return w, nil
 }
 
+func (w *WAL) recoverTail() error {
+	firstSeq, info, err := scanSegment(w.fs, w.path, nil)
+	if err != nil {
+		return err
+	}
+
+	if info.ValidEnd == 0 {
+		// Empty file, or a header torn during creation or rotation. Continue
+		// numbering after the newest sealed segment.
+		if firstSeq, err = w.nextSeqAfterSealed(); err != nil {
+			return err
+		}
+		if err := w.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := w.file.WriteAt(encodeHeader(firstSeq), 0); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		// The file may be new; its directory entry must survive a crash
+		// too, or so would none of the records appended to it
+		if err := w.fs.SyncDir(filepath.Dir(w.path)); err != nil {
+			return err
+		}
+		info.ValidEnd = walHeaderSize
+	} else if info.Torn {
+		log.Printf("WAL %s: discarding torn tail after offset %d", w.path, info.ValidEnd)
+		if err := w.file.Truncate(info.ValidEnd); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	w.firstSeq = firstSeq
+	w.nextSeq = firstSeq + uint64(info.Records)
+	w.size = info.ValidEnd
+	_, err = w.file.Seek(w.size, io.SeekStart)
+	return err
+}
+
+func (w *WAL) nextSeqAfterSealed() (uint64, error) {
+	segments, err := w.sealedSegments()
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 1, nil
+	}
+
+	last := segments[len(segments)-1]
+	firstSeq, info, err := scanSegment(w.fs, last.path, nil)
+	if err != nil {
+		return 0, err
+	}
+	return firstSeq + uint64(info.Records), nil
+}
+
+// SetSegmentSize changes the size at which the active segment is rotated.
+func (w *WAL) SetSegmentSize(size int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.segmentSize = size
+}
+
+// LastSeq returns the sequence number of the most recently appended record,
+// or the one before the first record if nothing has been appended yet.
+func (w *WAL) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextSeq - 1
+}
+
+// Stats returns the log's position and how long its fsyncs took.
+func (w *WAL) Stats() WALStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WALStats{
+		LastSeq:     w.nextSeq - 1,
+		SegmentSize: w.size,
+		Policy:      w.policy,
+		Fsyncs:      w.fsyncs.Snapshot(),
+	}
+}
+
+// Append logs a command given as a single text line. The line is split on
+// whitespace; for SET every word after the key is treated as the value.
 func (w *WAL) Append(command string) error {
+	args := strings.Fields(command)
+	if len(args) > 3 && strings.EqualFold(args[0], "SET") {
+		args = []string{args[0], args[1], strings.Join(args[2:], " ")}
+	}
+	return w.AppendCommand(args...)
+}
+
+// AppendCommand logs a command as a list of arguments. Arguments may contain
+// any bytes, including spaces and newlines.
+func (w *WAL) AppendCommand(args ...string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	return w.commitRecord(appendRecord(nil, encodeCommand(args)))
+}
+
+// AppendPayload logs a record payload that was encoded elsewhere, such as
+// one received from a replication leader. It is rejected unless it decodes.
+func (w *WAL) AppendPayload(payload []byte) error {
+	if _, err := decodeRecord(payload); err != nil {
+		return err
+	}
+	return w.commitRecord(appendRecord(nil, payload))
+}
+
+// SetFeed registers fn to be called with the sequence number and payload of
+// every record appended from now on, in log order, as soon as it is written
+// and possibly before it is on disk. fn runs with the WAL locked and must not
+// call back into it; the payload must not be modified.
+func (w *WAL) SetFeed(fn func(seq uint64, payload []byte)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.feed = fn
+}
+
+// AppendBatch logs several commands as a single record, so replay applies
+// either all of them or, if the record was torn, none.
+func (w *WAL) AppendBatch(cmds [][]string) error {
+	seq, err := w.Log(cmds)
+	if err != nil {
+		return err
+	}
+	return w.Commit(seq)
+}
+
+// Log writes cmds as one record, a single command or a batch, and returns
+// its sequence number without waiting for it to be durable. A caller that
+// logs while holding a lock of its own can release it before calling Commit,
+// so that concurrent writers share an fsync.
+func (w *WAL) Log(cmds [][]string) (uint64, error) {
+	for _, args := range cmds {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("empty command")
+		}
+	}
+	switch len(cmds) {
+	case 0:
+		return 0, fmt.Errorf("empty command")
+	case 1:
+		return w.appendRecord(appendRecord(nil, encodeCommand(cmds[0])))
+	}
+	return w.appendRecord(appendRecord(nil, encodeBatch(cmds)))
+}
+
+// commitRecord appends record and waits for it as the fsync policy asks.
+func (w *WAL) commitRecord(record []byte) error {
+	seq, err := w.appendRecord(record)
+	if err != nil {
+		return err
+	}
+	return w.Commit(seq)
+}
+
+// appendRecord writes record to the active segment and returns its sequence
+// number. Whether it is on disk yet is up to Commit.
+func (w *WAL) appendRecord(record []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("WAL is closed")
+	}
+	// Replay would take a longer record for a torn one, and drop it with
+	// everything after it
+	if int64(len(record)-recordHeadSize) > maxRecordSize {
+		return 0, ErrRecordTooLarge
+	}
+
+	if w.size > walHeaderSize && w.size+int64(len(record)) > w.segmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := w.file.Write(record); err != nil {
+		// Drop whatever part of the record made it to the file so the next
+		// append does not land behind garbage.
+		w.file.Truncate(w.size)
+		w.file.Seek(w.size, io.SeekStart)
+		return 0, err
+	}
+	w.size += int64(len(record))
+	seq := w.nextSeq
+	w.nextSeq++
+
+	if w.feed != nil {
+		w.feed(seq, record[recordHeadSize:])
+	}
+	return seq, nil
+}
+
+// Rotate seals the active segment and starts a new one. It returns the
+// sequence number of the last record in the sealed part of the log. Rotating
+// an active segment that holds no records is a no-op.
+func (w *WAL) Rotate() (uint64, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.closed {
-		return fmt.Errorf("WAL is closed")
+		return 0, fmt.Errorf("WAL is closed")
+	}
+	if w.nextSeq > w.firstSeq {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
 	}
+	return w.nextSeq - 1, nil
+}
 
-	// Write command with newline
-	if _, err := w.file.WriteString(command + "\n"); err != nil {
+func (w *WAL) rotateLocked() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.markSynced(w.nextSeq - 1)
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := w.fs.Rename(w.path, segmentPath(w.path, w.firstSeq)); err != nil {
 		return err
 	}
 
-	// Sync to disk for durability
-	return w.file.Sync()
+	file, err := w.fs.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encodeHeader(w.nextSeq)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.fs.SyncDir(filepath.Dir(w.path)); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.firstSeq = w.nextSeq
+	w.size = walHeaderSize
+	return nil
 }
 
-func (w *WAL) Replay(kvStore *store.KVStore) error {
-	// Open the file for reading from the beginning
-	file, err := os.Open(w.file.Name())
+// RemoveSegmentsThrough deletes sealed segments whose records all have a
+// sequence number of at most seq. It is called once a durable snapshot
+// covers those records.
+func (w *WAL) RemoveSegmentsThrough(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments, err := w.sealedSegments()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
+	for i, seg := range segments {
+		// A segment ends right before the next one starts
+		end := w.firstSeq - 1
+		if i+1 < len(segments) {
+			end = segments[i+1].firstSeq - 1
+		}
+		if end > seq {
+			break
+		}
+		if err := w.fs.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return w.fs.SyncDir(filepath.Dir(w.path))
+}
+
+// SkipThrough tells Replay that records up to seq are already reflected in
+// the store, typically because they were loaded from a snapshot.
+func (w *WAL) SkipThrough(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.skipThrough = seq
+
+	// If the log is behind the snapshot (it was lost or deleted), restart
+	// numbering after it so new records are not mistaken for covered ones.
+	if w.nextSeq <= seq && w.nextSeq == w.firstSeq {
+		if _, err := w.file.WriteAt(encodeHeader(seq+1), 0); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.firstSeq = seq + 1
+		w.nextSeq = seq + 1
+		w.markSynced(seq)
+	}
+	return nil
+}
+
+// Replay applies every intact record to kvStore, stopping at the first torn
+// or corrupt record.
+func (w *WAL) Replay(kvStore *store.KVStore) error {
+	_, err := w.Recover(kvStore)
+	return err
+}
+
+// Recover is Replay that also reports where the valid log ends. Sealed
+// segments are replayed in order before the active one; records covered by
+// a snapshot (see SkipThrough) are skipped.
+func (w *WAL) Recover(kvStore *store.KVStore) (ReplayInfo, error) {
+	w.mu.Lock()
+	segments, err := w.sealedSegments()
+	skip := w.skipThrough
+	w.mu.Unlock()
+	if err != nil {
+		return ReplayInfo{}, err
+	}
+
+	paths := make([]string, 0, len(segments)+1)
+	for _, seg := range segments {
+		paths = append(paths, seg.path)
+	}
+	paths = append(paths, w.path)
+
+	var total ReplayInfo
+	var expected uint64
+	for _, path := range paths {
+		firstSeq, info, err := scanSegment(w.fs, path, func(seq uint64, cmds [][]string) {
+			if seq <= skip {
+				total.Skipped++
+				return
+			}
+			applyCommands(kvStore, cmds)
+			total.Records++
+		})
+		if err != nil {
+			return total, err
+		}
+		if info.ValidEnd == 0 {
+			// Active segment without a header yet
 			continue
 		}
+		// Gaps are fine as long as a snapshot covers the missing records
+		if expected != 0 && firstSeq != expected && firstSeq-1 > skip {
+			return total, fmt.Errorf("WAL %s: starts at sequence %d, expected %d (missing segment?)", path, firstSeq, expected)
+		}
+		expected = firstSeq + uint64(info.Records)
+
+		total.Segment = path
+		total.ValidEnd = info.ValidEnd
+		total.LastSeq = expected - 1
+		if info.Torn {
+			total.Torn = true
+			log.Printf("WAL %s: replay stopped at torn or corrupt record at offset %d", path, info.ValidEnd)
+			break
+		}
+	}
+
+	return total, nil
+}
+
+type segment struct {
+	path     string
+	firstSeq uint64
+}
 
-		// Parse and execute command
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
+func segmentPath(path string, firstSeq uint64) string {
+	return fmt.Sprintf("%s.%020d", path, firstSeq)
+}
+
+// sealedSegments lists sealed segments ordered by first sequence number.
+func (w *WAL) sealedSegments() ([]segment, error) {
+	dir, base := filepath.Split(w.path)
+	if dir == "" {
+		dir = "."
+	}
+	names, err := w.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, name := range names {
+		if !strings.HasPrefix(name, base+".") {
 			continue
 		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(name, base+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(dir, name), firstSeq: seq})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstSeq < segments[j].firstSeq
+	})
+	return segments, nil
+}
+
+// scanSegment reads the segment at path and calls apply with the sequence
+// number and commands of each record. A torn or corrupt record ends the scan
+// without an error; an unreadable header does not, unless the file is too
+// short to hold one.
+func scanSegment(fsys FS, path string, apply func(seq uint64, cmds [][]string)) (uint64, ReplayInfo, error) {
+	var info ReplayInfo
+
+	file, err := openRead(fsys, path)
+	if err != nil {
+		return 0, info, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		// A missing or partially written header means nothing was logged.
+		return 0, info, nil
+	}
+	firstSeq, err := decodeHeader(header)
+	if err != nil {
+		return 0, info, fmt.Errorf("%s: %w", path, err)
+	}
+
+	rr := &recordReader{r: reader, offset: walHeaderSize}
+	for {
+		payload, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrCorruptRecord) {
+			info.Torn = true
+			break
+		}
+		if err != nil {
+			info.ValidEnd = rr.offset
+			return firstSeq, info, err
+		}
+
+		cmds, err := decodeRecord(payload)
+		if err != nil {
+			// The checksum matched, so the record is from a writer we
+			// don't understand; treat it like corruption.
+			rr.offset -= int64(recordHeadSize + len(payload))
+			info.Torn = true
+			break
+		}
+		if apply != nil {
+			apply(firstSeq+uint64(info.Records), cmds)
+		}
+		info.Records++
+	}
+
+	info.ValidEnd = rr.offset
+	return firstSeq, info, nil
+}
+
+// ApplyRecord decodes a record payload, as passed to a feed, and applies its
+// commands to kvStore.
+func ApplyRecord(kvStore *store.KVStore, payload []byte) error {
+	cmds, err := decodeRecord(payload)
+	if err != nil {
+		return err
+	}
+	applyCommands(kvStore, cmds)
+	return nil
+}
+
+// applyCommands applies the commands of one record. A batch is applied
+// under one lock so readers never see part of a transaction. Keys don't
+// expire while it runs: the log has a DEL for every expiry its writes saw.
+func applyCommands(kvStore *store.KVStore, cmds [][]string) {
+	kvStore.Replay(func(tx *store.Tx) {
+		for _, args := range cmds {
+			applyCommand(tx, args)
+		}
+	})
+}
 
-		command := strings.ToUpper(parts[0])
-		args := parts[1:]
+func applyCommand(tx *store.Tx, args []string) {
+	if len(args) == 0 {
+		return
+	}
 
-		switch command {
-		case "SET":
-			if len(args) >= 2 {
-				// Join all parts after the key as the value
-				value := strings.Join(args[1:], " ")
-				kvStore.Set(args[0], value)
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch command {
+	case "SET":
+		switch {
+		case len(args) == 2:
+			tx.Set(args[0], args[1])
+		case len(args) == 4 && strings.EqualFold(args[2], "PXAT"):
+			ms, err := strconv.ParseInt(args[3], 10, 64)
+			if err == nil {
+				tx.SetWith(args[0], args[1], store.SetAlways, time.UnixMilli(ms))
+			}
+		case len(args) == 4 && strings.EqualFold(args[2], "PX"):
+			// Written by older versions, relative to when it is applied
+			ms, err := strconv.ParseInt(args[3], 10, 64)
+			if err == nil {
+				tx.SetWith(args[0], args[1], store.SetAlways, tx.Now().Add(time.Duration(ms)*time.Millisecond))
+			}
+		}
+	case "DEL":
+		for _, key := range args {
+			tx.Del(key)
+		}
+	case "PEXPIREAT":
+		if len(args) == 2 {
+			ms, err := strconv.ParseInt(args[1], 10, 64)
+			if err == nil {
+				tx.ExpireAt(args[0], time.UnixMilli(ms))
+			}
+		}
+	case "EXPIRE":
+		// Written by older versions, relative to when it is applied
+		if len(args) == 2 {
+			seconds, err := strconv.Atoi(args[1])
+			if err == nil {
+				tx.Expire(args[0], seconds)
+			}
+		}
+	case "PERSIST":
+		if len(args) == 1 {
+			tx.Persist(args[0])
+		}
+	case "LPUSH":
+		if len(args) >= 2 {
+			tx.LPush(args[0], args[1:]...)
+		}
+	case "RPUSH":
+		if len(args) >= 2 {
+			tx.RPush(args[0], args[1:]...)
+		}
+	case "LPOP":
+		if len(args) == 2 {
+			count, err := strconv.Atoi(args[1])
+			if err == nil {
+				tx.LPop(args[0], count)
 			}
-		case "DEL":
-			if len(args) >= 1 {
-				kvStore.Del(args[0])
+		}
+	case "RPOP":
+		if len(args) == 2 {
+			count, err := strconv.Atoi(args[1])
+			if err == nil {
+				tx.RPop(args[0], count)
 			}
-		case "EXPIRE":
-			if len(args) >= 2 {
-				seconds, err := strconv.Atoi(args[1])
-				if err == nil {
-					kvStore.Expire(args[0], seconds)
+		}
+	case "HSET":
+		if len(args) >= 3 && len(args)%2 == 1 {
+			tx.HSet(args[0], args[1:]...)
+		}
+	case "HDEL":
+		if len(args) >= 2 {
+			tx.HDel(args[0], args[1:]...)
+		}
+	case "SADD":
+		if len(args) >= 2 {
+			tx.SAdd(args[0], args[1:]...)
+		}
+	case "SREM":
+		if len(args) >= 2 {
+			tx.SRem(args[0], args[1:]...)
+		}
+	case "ZADD":
+		if len(args) >= 3 && len(args)%2 == 1 {
+			members := make([]store.ScoredMember, 0, len(args)/2)
+			for i := 1; i < len(args); i += 2 {
+				score, err := strconv.ParseFloat(args[i], 64)
+				if err != nil {
+					return
 				}
+				members = append(members, store.ScoredMember{Member: args[i+1], Score: score})
 			}
+			tx.ZAdd(args[0], members...)
 		}
 	}
-
-	return scanner.Err()
 }
 
 func (w *WAL) Close() error {
@@ -103,5 +692,17 @@ func (w *WAL) Close() error {
 	}
 
 	w.closed = true
-	return w.file.Close()
+	if w.stopSync != nil {
+		close(w.stopSync)
+		w.stopSync = nil
+	}
+	// Whatever the policy, records written so far reach the disk
+	err := w.file.Sync()
+	if err == nil {
+		w.markSynced(w.nextSeq - 1)
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
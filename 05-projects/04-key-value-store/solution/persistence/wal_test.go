@@ -1,9 +1,15 @@
 package persistence
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alyxpink/go-training/kvstore/store"
 	"github.com/stretchr/testify/assert"
@@ -260,3 +266,395 @@ func TestWAL_AppendPreservesOrder(t *testing.T) {
 	require.True(t, ok)
 	assert.Equal(t, "3", val)
 }
+
+func TestWAL_BinarySafeValues(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+
+	values := []string{"multi\nline\r\nvalue", "double  spaced", "", "nul\x00byte"}
+	for i, v := range values {
+		require.NoError(t, wal.AppendCommand("SET", "key"+strconv.Itoa(i), v))
+	}
+	wal.Close()
+
+	wal2, err := NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal2.Close()
+
+	kvStore := store.NewKVStore()
+	require.NoError(t, wal2.Replay(kvStore))
+
+	for i, v := range values {
+		val, ok := kvStore.Get("key" + strconv.Itoa(i))
+		require.True(t, ok)
+		assert.Equal(t, v, val)
+	}
+}
+
+func TestWAL_BatchIsAtomic(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	require.NoError(t, wal.AppendBatch([][]string{{"SET", "a", "1"}, {"RPUSH", "list", "x", "y"}}))
+	wal.Close()
+
+	kvStore := store.NewKVStore()
+	result, err := (&WAL{fs: OSFS, path: walPath}).Recover(kvStore)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Records)
+
+	val, ok := kvStore.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "1", val)
+	list, err := kvStore.LRange("list", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, list)
+
+	// A torn batch applies none of its commands
+	record := appendRecord(nil, encodeBatch([][]string{{"SET", "b", "2"}, {"SET", "c", "3"}}))
+	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)-1])
+	require.NoError(t, err)
+	f.Close()
+
+	kvStore = store.NewKVStore()
+	result, err = (&WAL{fs: OSFS, path: walPath}).Recover(kvStore)
+	require.NoError(t, err)
+	assert.True(t, result.Torn)
+	assert.False(t, kvStore.Exists("b"))
+	assert.False(t, kvStore.Exists("c"))
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	require.NoError(t, wal.AppendCommand("SET", "key1", "value1"))
+	require.NoError(t, wal.AppendCommand("SET", "key2", "value2"))
+	wal.Close()
+
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	validSize := info.Size()
+
+	// Simulate a crash halfway through writing a third record
+	record := appendRecord(nil, encodeCommand([]string{"SET", "key3", "value3"}))
+	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)-3])
+	require.NoError(t, err)
+	f.Close()
+
+	kvStore := store.NewKVStore()
+	result, err := (&WAL{fs: OSFS, path: walPath}).Recover(kvStore)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Records)
+	assert.Equal(t, validSize, result.ValidEnd)
+	assert.True(t, result.Torn)
+
+	_, ok := kvStore.Get("key3")
+	assert.False(t, ok)
+
+	// Reopening truncates the torn record so new appends are reachable
+	wal2, err := NewWAL(walPath)
+	require.NoError(t, err)
+	require.NoError(t, wal2.AppendCommand("SET", "key4", "value4"))
+	wal2.Close()
+
+	wal3, err := NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal3.Close()
+
+	kvStore = store.NewKVStore()
+	result, err = wal3.Recover(kvStore)
+	require.NoError(t, err)
+	assert.False(t, result.Torn)
+	assert.Equal(t, 3, result.Records)
+
+	val, ok := kvStore.Get("key4")
+	require.True(t, ok)
+	assert.Equal(t, "value4", val)
+}
+
+func TestWAL_CorruptRecordStopsReplay(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	require.NoError(t, wal.AppendCommand("SET", "key1", "value1"))
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	firstEnd := info.Size()
+	require.NoError(t, wal.AppendCommand("SET", "key2", "value2"))
+	require.NoError(t, wal.AppendCommand("SET", "key3", "value3"))
+	wal.Close()
+
+	// Flip a payload byte in the second record
+	data, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	data[firstEnd+recordHeadSize+2] ^= 0xff
+	require.NoError(t, os.WriteFile(walPath, data, 0644))
+
+	kvStore := store.NewKVStore()
+	result, err := (&WAL{fs: OSFS, path: walPath}).Recover(kvStore)
+	require.NoError(t, err)
+	assert.True(t, result.Torn)
+	assert.Equal(t, firstEnd, result.ValidEnd)
+
+	_, ok := kvStore.Get("key1")
+	assert.True(t, ok)
+	_, ok = kvStore.Get("key2")
+	assert.False(t, ok)
+	_, ok = kvStore.Get("key3")
+	assert.False(t, ok, "records after the corruption must not be applied")
+}
+
+// A damaged length can claim up to 4 GiB; replay reads only what is there.
+func TestWAL_HugeLengthIsTorn(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	require.NoError(t, wal.AppendCommand("SET", "key1", "value1"))
+	wal.Close()
+
+	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	require.NoError(t, err)
+	f.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	result, err := (&WAL{fs: OSFS, path: walPath}).Recover(store.NewKVStore())
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.True(t, result.Torn)
+	assert.Equal(t, 1, result.Records)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestRecordSize(t *testing.T) {
+	for _, cmds := range [][][]string{
+		{{"SET", "key", "value"}},
+		{{"SET", "a", "1"}, {"RPUSH", "list", strings.Repeat("x", 300), ""}},
+	} {
+		assert.GreaterOrEqual(t, RecordSize(cmds), len(EncodeRecord(cmds)))
+	}
+}
+
+func TestWAL_RejectsUnknownFormat(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	require.NoError(t, os.WriteFile(walPath, []byte("SET key1 value1\n"), 0644))
+
+	_, err := NewWAL(walPath)
+	assert.ErrorIs(t, err, ErrBadHeader)
+}
+
+func TestWAL_SegmentRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	wal.SetSegmentSize(256)
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, wal.AppendCommand("SET", "key"+strconv.Itoa(i), "value"))
+	}
+	assert.Equal(t, uint64(50), wal.LastSeq())
+	wal.Close()
+
+	segments, err := (&WAL{fs: OSFS, path: walPath}).sealedSegments()
+	require.NoError(t, err)
+	assert.Greater(t, len(segments), 1, "log should have rotated into several segments")
+
+	// Reopening continues the sequence and replays every segment in order
+	wal2, err := NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal2.Close()
+	assert.Equal(t, uint64(50), wal2.LastSeq())
+
+	kvStore := store.NewKVStore()
+	result, err := wal2.Recover(kvStore)
+	require.NoError(t, err)
+	assert.Equal(t, 50, result.Records)
+	assert.Equal(t, uint64(50), result.LastSeq)
+	assert.Len(t, kvStore.Keys("*"), 50)
+}
+
+func TestWAL_MissingSegmentIsAnError(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, wal.AppendCommand("SET", "key"+strconv.Itoa(i), "value"))
+		_, err := wal.Rotate()
+		require.NoError(t, err)
+	}
+	wal.Close()
+
+	require.NoError(t, os.Remove(segmentPath(walPath, 2)))
+
+	_, err = (&WAL{fs: OSFS, path: walPath}).Recover(store.NewKVStore())
+	assert.Error(t, err)
+}
+
+func TestWAL_Stats(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "test.wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+
+	require.NoError(t, wal.Append("SET key1 value1"))
+	require.NoError(t, wal.Append("SET key2 value2"))
+
+	st := wal.Stats()
+	assert.Equal(t, uint64(2), st.LastSeq)
+	assert.Positive(t, st.SegmentSize)
+	assert.Equal(t, uint64(2), st.Fsyncs.Count, "one fsync per append")
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, p := range []FsyncPolicy{FsyncAlways, FsyncEverySec, FsyncNo} {
+		parsed, err := ParseFsyncPolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+
+	_, err := ParseFsyncPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestWAL_GroupCommit(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "test.wal"))
+	require.NoError(t, err)
+	defer wal.Close()
+
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		seq, err := wal.Log([][]string{{"SET", "key" + strconv.Itoa(i), "value"}})
+		require.NoError(t, err)
+		seqs = append(seqs, seq)
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, seqs)
+	assert.Zero(t, wal.Stats().Fsyncs.Count, "Log doesn't sync")
+
+	// One fsync covers every record written before it
+	require.NoError(t, wal.Commit(seqs[1]))
+	require.NoError(t, wal.Commit(seqs[0]))
+	require.NoError(t, wal.Commit(seqs[2]))
+	assert.Equal(t, uint64(1), wal.Stats().Fsyncs.Count)
+}
+
+func TestWAL_ConcurrentGroupCommit(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	wal, err := NewWAL(walPath)
+	require.NoError(t, err)
+	wal.SetSegmentSize(4096)
+
+	const writers, appends = 16, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				assert.NoError(t, wal.AppendCommand("SET", fmt.Sprintf("key-%d-%d", w, i), "value"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every append waited for an fsync, but not necessarily its own
+	assert.LessOrEqual(t, wal.Stats().Fsyncs.Count, uint64(writers*appends))
+	require.NoError(t, wal.Close())
+
+	kvStore := store.NewKVStore()
+	newWAL, err := NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(kvStore))
+	assert.Len(t, kvStore.Keys("*"), writers*appends)
+}
+
+func TestWAL_FsyncPolicies(t *testing.T) {
+	defer func(d time.Duration) { everySecInterval = d }(everySecInterval)
+	everySecInterval = 10 * time.Millisecond
+
+	t.Run("everysec", func(t *testing.T) {
+		wal, err := NewWAL(filepath.Join(t.TempDir(), "test.wal"))
+		require.NoError(t, err)
+		defer wal.Close()
+		wal.SetFsyncPolicy(FsyncEverySec)
+
+		require.NoError(t, wal.Append("SET key value"))
+		assert.Eventually(t, func() bool { return wal.Stats().Fsyncs.Count == 1 }, time.Second, time.Millisecond)
+
+		// Nothing new, nothing to sync
+		time.Sleep(5 * everySecInterval)
+		assert.Equal(t, uint64(1), wal.Stats().Fsyncs.Count)
+	})
+
+	t.Run("no", func(t *testing.T) {
+		walPath := filepath.Join(t.TempDir(), "test.wal")
+		wal, err := NewWAL(walPath)
+		require.NoError(t, err)
+		wal.SetFsyncPolicy(FsyncNo)
+
+		require.NoError(t, wal.Append("SET key value"))
+		time.Sleep(5 * everySecInterval)
+		assert.Zero(t, wal.Stats().Fsyncs.Count)
+		assert.Equal(t, FsyncNo, wal.Stats().Policy)
+
+		// Close still flushes
+		require.NoError(t, wal.Close())
+		kvStore := store.NewKVStore()
+		newWAL, err := NewWAL(walPath)
+		require.NoError(t, err)
+		defer newWAL.Close()
+		require.NoError(t, newWAL.Replay(kvStore))
+		value, ok := kvStore.Get("key")
+		assert.True(t, ok)
+		assert.Equal(t, "value", value)
+	})
+}
+
+func BenchmarkWAL_Append(b *testing.B) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncEverySec, FsyncNo} {
+		b.Run(policy.String(), func(b *testing.B) {
+			wal, err := NewWAL(filepath.Join(b.TempDir(), "bench.wal"))
+			require.NoError(b, err)
+			defer wal.Close()
+			wal.SetFsyncPolicy(policy)
+
+			// Many writers at once, as with many clients: with FsyncAlways
+			// they share fsyncs
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := wal.AppendCommand("SET", "key", "value"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			if fsyncs := wal.Stats().Fsyncs.Count; fsyncs > 0 {
+				b.ReportMetric(float64(b.N)/float64(fsyncs), "appends/fsync")
+			}
+		})
+	}
+}
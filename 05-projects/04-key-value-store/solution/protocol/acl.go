@@ -0,0 +1,636 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// Access control, after Redis' ACLs. Each user has passwords, the
+// categories of commands it may run (read, write, admin) and glob patterns
+// for the keys it may touch. A connection that doesn't send AUTH runs as
+// the default user, as long as that user is enabled and needs no password
+// when the connection first uses it. The default user starts out that way
+// and allowed everything, so a server with no ACL configured is open as
+// before. Locking it down means giving the default user a password, or
+// turning it off.
+//
+// Commands outside the three categories, such as PING, HELLO or PUBLISH,
+// are open to every authenticated user. Commands that work on the whole
+// keyspace, such as KEYS and SCAN, need access to every key. So do
+// subscriptions to keyspace notifications, whose channels and messages name
+// keys of any pattern: SUBSCRIBE to a __keyspace@ or __keyevent@ channel,
+// and PSUBSCRIBE to a pattern that may match one. Commands queued by MULTI
+// are checked as they are queued.
+//
+// Users are defined in an ACL file of "user <name> <rules...>" lines, in
+// the format of Redis' aclfile, and changed at run time with ACL SETUSER
+// and ACL DELUSER. Changes apply to connections already authenticated as
+// the user; deleting the user logs them out.
+
+const defaultUser = "default"
+
+type aclCategory uint8
+
+const (
+	aclRead  aclCategory = 1 << iota // reads the store
+	aclWrite                         // modifies the store
+	aclAdmin                         // administers the server
+
+	aclAll = aclRead | aclWrite | aclAdmin
+)
+
+var aclCategoryNames = []struct {
+	name string
+	cat  aclCategory
+}{
+	{"read", aclRead},
+	{"write", aclWrite},
+	{"admin", aclAdmin},
+}
+
+// category returns the ACL category of the command, or 0 if it has none.
+func (cmd command) category() aclCategory {
+	switch {
+	case cmd.flags&cmdAdmin != 0:
+		return aclAdmin
+	case cmd.flags&cmdWrite != 0:
+		return aclWrite
+	case cmd.flags&cmdRead != 0:
+		return aclRead
+	}
+	return 0
+}
+
+// aclUser is a user's definition. Published users aren't modified: rules
+// are applied to a copy, which then replaces the user.
+type aclUser struct {
+	name       string
+	enabled    bool
+	nopass     bool     // any password is accepted
+	passwords  []string // hex SHA-256 hashes, in the order added
+	categories aclCategory
+	patterns   []string // key patterns, "*" for every key
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = slices.Clone(u.passwords)
+	c.patterns = slices.Clone(u.patterns)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply changes the user by one rule of ACL SETUSER.
+func (u *aclUser) apply(rule string) error {
+	if rule == "" {
+		return errors.New("syntax error")
+	}
+
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allkeys":
+		u.patterns = []string{"*"}
+	case lower == "resetkeys":
+		u.patterns = nil
+	case lower == "allcommands":
+		u.categories = aclAll
+	case lower == "nocommands":
+		u.categories = 0
+	case lower == "reset":
+		*u = aclUser{name: u.name}
+	case rule[0] == '>':
+		u.addPassword(hashPassword(rule[1:]))
+	case rule[0] == '#':
+		hash := strings.ToLower(rule[1:])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return errors.New("the password hash must be 64 hexadecimal characters")
+		}
+		u.addPassword(hash)
+	case rule[0] == '<':
+		return u.removePassword(hashPassword(rule[1:]))
+	case rule[0] == '!':
+		return u.removePassword(strings.ToLower(rule[1:]))
+	case rule[0] == '~':
+		if rule == "~*" {
+			u.patterns = []string{"*"}
+		} else if !slices.Contains(u.patterns, "*") && !slices.Contains(u.patterns, rule[1:]) {
+			u.patterns = append(u.patterns, rule[1:])
+		}
+	case strings.HasPrefix(lower, "+@"), strings.HasPrefix(lower, "-@"):
+		cat, ok := aclAll, lower[2:] == "all"
+		for _, c := range aclCategoryNames {
+			if c.name == lower[2:] {
+				cat, ok = c.cat, true
+			}
+		}
+		if !ok {
+			return errors.New("unknown command category")
+		}
+		if lower[0] == '+' {
+			u.categories |= cat
+		} else {
+			u.categories &^= cat
+		}
+	default:
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	if !slices.Contains(u.passwords, hash) {
+		u.passwords = append(u.passwords, hash)
+	}
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	i := slices.Index(u.passwords, hash)
+	if i < 0 {
+		return errors.New("no such password")
+	}
+	u.passwords = slices.Delete(u.passwords, i, i+1)
+	return nil
+}
+
+// checkPassword reports whether the user can authenticate with password.
+func (u *aclUser) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	ok := false
+	for _, p := range u.passwords {
+		// Every hash is compared, so the time taken doesn't tell which matched
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// canRun reports whether the user may run cmd at all.
+func (u *aclUser) canRun(cmd command) bool {
+	cat := cmd.category()
+	return cat == 0 || u.categories&cat != 0
+}
+
+// canAccess reports whether the user may touch the keys cmd would with args.
+func (u *aclUser) canAccess(cmd command, args []string) bool {
+	if slices.Contains(u.patterns, "*") {
+		return true
+	}
+	if cmd.keys.none() {
+		// Without keys of its own, a store command works on all of them
+		return cmd.flags&(cmdRead|cmdWrite) == 0
+	}
+	for _, key := range cmd.keys.keys(args) {
+		if !slices.ContainsFunc(u.patterns, func(pattern string) bool {
+			return store.MatchPattern(key, pattern)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// notificationPrefixes start the channels of keyspace notifications.
+var notificationPrefixes = []string{"__keyspace@", "__keyevent@"}
+
+// canSubscribe reports whether the user may subscribe to channels, or to
+// channel patterns if pattern is set. Only a user with access to every key
+// may hear keyspace notifications. A pattern is judged by its part before
+// the first special character, so one that could match their channels is
+// refused even if it never does.
+func (u *aclUser) canSubscribe(channels []string, pattern bool) bool {
+	if slices.Contains(u.patterns, "*") {
+		return true
+	}
+	for _, channel := range channels {
+		// A pattern that is all literal matches only itself
+		literal, open := channel, false
+		if i := strings.IndexAny(channel, `*?[\`); pattern && i >= 0 {
+			literal, open = channel[:i], true
+		}
+		for _, prefix := range notificationPrefixes {
+			if strings.HasPrefix(literal, prefix) || open && strings.HasPrefix(prefix, literal) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String describes the user as a line of an ACL file, as ACL LIST does.
+func (u *aclUser) String() string {
+	parts := []string{"user", u.name, "off"}
+	if u.enabled {
+		parts[2] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, hash := range u.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if slices.Contains(u.patterns, "*") {
+		parts = append(parts, "~*")
+	} else {
+		for _, pattern := range u.patterns {
+			parts = append(parts, "~"+pattern)
+		}
+	}
+	if u.categories == aclAll {
+		parts = append(parts, "+@all")
+	} else {
+		parts = append(parts, "-@all")
+		for _, c := range aclCategoryNames {
+			if u.categories&c.cat != 0 {
+				parts = append(parts, "+@"+c.name)
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// acl holds the users. It always has the default user.
+type acl struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+	file  string // where ACL LOAD and ACL SAVE read and write users
+}
+
+func newACL() *acl {
+	return &acl{users: defaultUsers()}
+}
+
+// defaultUsers returns the users of a server without ACLs: only the
+// default user, which may do anything without a password.
+func defaultUsers() map[string]*aclUser {
+	u := newACLUser(defaultUser)
+	u.enabled = true
+	u.nopass = true
+	u.categories = aclAll
+	u.patterns = []string{"*"}
+	return map[string]*aclUser{defaultUser: u}
+}
+
+// sessionUser returns the user the session runs as, or nil if it has to
+// authenticate first. A session that hasn't authenticated becomes the
+// default user if that user is enabled and needs no password, like a Redis
+// connection does when it connects, so giving the default user a password
+// later doesn't lock out the session that did it.
+func (a *acl) sessionUser(sess *Session) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if sess.user == "" {
+		u := a.users[defaultUser]
+		if !u.enabled || !u.nopass {
+			return nil
+		}
+		sess.user = defaultUser
+	}
+	return a.users[sess.user]
+}
+
+// authenticate reports whether name and password are the credentials of an
+// enabled user.
+func (a *acl) authenticate(name, password string) bool {
+	a.mu.RLock()
+	u := a.users[name]
+	a.mu.RUnlock()
+	return u != nil && u.checkPassword(password)
+}
+
+// setUser applies rules to the named user, creating it if it doesn't
+// exist. A new user starts disabled and allowed nothing. If a rule is
+// invalid, the user is left as it was.
+func (a *acl) setUser(name string, rules []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := newACLUser(name)
+	if old, ok := a.users[name]; ok {
+		u = old.clone()
+	}
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return fmt.Errorf("modifier '%s': %w", rule, err)
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// deleteUsers removes the named users and returns how many there were.
+func (a *acl) deleteUsers(names []string) (int, error) {
+	if slices.Contains(names, defaultUser) {
+		return 0, errors.New("the 'default' user cannot be removed")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// list returns the users, sorted by name.
+func (a *acl) list() []*aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	users := make([]*aclUser, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(x, y *aclUser) int { return strings.Compare(x.name, y.name) })
+	return users
+}
+
+// parseACLFile reads users in the format of Redis' aclfile: a "user <name>
+// <rules...>" line per user, with blank lines and lines starting with #
+// ignored. Each user starts from scratch, so the rules are the whole
+// definition. The default user keeps its open defaults unless the file
+// defines it.
+func parseACLFile(path string) (map[string]*aclUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := defaultUsers()
+	defined := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a \"user <name> <rules...>\" line", path, n)
+		}
+		name := fields[1]
+		if defined[name] {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", path, n, name)
+		}
+		defined[name] = true
+
+		u := newACLUser(name)
+		for _, rule := range fields[2:] {
+			if err := u.apply(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: rule %q: %w", path, n, rule, err)
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// load replaces the users with those of the ACL file. If the file can't be
+// read or has an error, the users are left as they were.
+func (a *acl) load() error {
+	a.mu.RLock()
+	path := a.file
+	a.mu.RUnlock()
+	if path == "" {
+		return errNoACLFile
+	}
+
+	users, err := parseACLFile(path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// save writes the users to the ACL file, replacing it atomically.
+// Passwords are written as their hashes.
+func (a *acl) save() error {
+	a.mu.RLock()
+	path := a.file
+	a.mu.RUnlock()
+	if path == "" {
+		return errNoACLFile
+	}
+
+	var b strings.Builder
+	for _, u := range a.list() {
+		b.WriteString(u.String())
+		b.WriteByte('\n')
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash
+// leaves either the old file or the new one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var errNoACLFile = errors.New("this instance is not configured to use an ACL file")
+
+// LoadACLFile loads users from an ACL file, which ACL LOAD and ACL SAVE
+// then read and write.
+func (h *Handler) LoadACLFile(path string) error {
+	users, err := parseACLFile(path)
+	if err != nil {
+		return err
+	}
+
+	h.acl.mu.Lock()
+	defer h.acl.mu.Unlock()
+	h.acl.users = users
+	h.acl.file = path
+	return nil
+}
+
+// authorize checks that the session may run the named command with args.
+// Before a session authenticates, only AUTH, HELLO and QUIT are allowed.
+func (h *Handler) authorize(sess *Session, name string, args []string) (Value, bool) {
+	u := h.acl.sessionUser(sess)
+	if u == nil {
+		switch name {
+		case "AUTH", "HELLO", "QUIT":
+			return Value{}, true
+		}
+		return Error("NOAUTH Authentication required."), false
+	}
+
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		// The transaction commands need no permission; unknown commands
+		// are rejected as such
+		return Value{}, true
+	}
+	if !u.canRun(cmd) {
+		return Errorf("NOPERM User %s has no permissions to run the '%s' command", u.name, strings.ToLower(name)), false
+	}
+	if !u.canAccess(cmd, args) {
+		return Error("NOPERM No permissions to access a key"), false
+	}
+	if (name == "SUBSCRIBE" || name == "PSUBSCRIBE") && !u.canSubscribe(args, name == "PSUBSCRIBE") {
+		return Error("NOPERM No permissions to access a channel"), false
+	}
+	return Value{}, true
+}
+
+// authorizeCategory checks that the session's user may run commands in
+// cat, for subcommands that need more than their command does. name is the
+// subcommand as NOPERM replies name it.
+func (h *Handler) authorizeCategory(sess *Session, cat aclCategory, name string) (Value, bool) {
+	u := h.acl.sessionUser(sess)
+	if u == nil {
+		return Error("NOAUTH Authentication required."), false
+	}
+	if u.categories&cat == 0 {
+		return Errorf("NOPERM User %s has no permissions to run the '%s' command", u.name, name), false
+	}
+	return Value{}, true
+}
+
+// handleAuth implements AUTH [username] password. Without a username it
+// authenticates as the default user.
+func (h *Handler) handleAuth(c *call, args []string) Value {
+	var name, password string
+	switch len(args) {
+	case 1:
+		name, password = defaultUser, args[0]
+	case 2:
+		name, password = args[0], args[1]
+	default:
+		return wrongArgs("auth")
+	}
+
+	if !h.acl.authenticate(name, password) {
+		return errWrongPass
+	}
+	c.sess.user = name
+	return OK()
+}
+
+var errWrongPass = Error("WRONGPASS invalid username-password pair or user is disabled.")
+
+// handleACL implements ACL SETUSER, DELUSER, LIST, USERS, WHOAMI, LOAD and
+// SAVE.
+func (h *Handler) handleACL(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("acl")
+	}
+
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "SETUSER":
+		if len(args) < 2 {
+			return wrongArgs("acl|setuser")
+		}
+		if err := h.acl.setUser(args[1], args[2:]); err != nil {
+			return Errorf("ERR Error in ACL SETUSER %v", err)
+		}
+		return OK()
+	case "DELUSER":
+		if len(args) < 2 {
+			return wrongArgs("acl|deluser")
+		}
+		n, err := h.acl.deleteUsers(args[1:])
+		if err != nil {
+			return Error("ERR " + err.Error())
+		}
+		return Integer(int64(n))
+	case "LIST", "USERS":
+		if len(args) != 1 {
+			return wrongArgs("acl|" + strings.ToLower(sub))
+		}
+		users := h.acl.list()
+		out := make([]Value, len(users))
+		for i, u := range users {
+			if sub == "LIST" {
+				out[i] = BulkString(u.String())
+			} else {
+				out[i] = BulkString(u.name)
+			}
+		}
+		return Array(out...)
+	case "WHOAMI":
+		if len(args) != 1 {
+			return wrongArgs("acl|whoami")
+		}
+		return BulkString(c.sess.user)
+	case "LOAD", "SAVE":
+		if len(args) != 1 {
+			return wrongArgs("acl|" + strings.ToLower(sub))
+		}
+		var err error
+		if sub == "LOAD" {
+			err = h.acl.load()
+		} else {
+			err = h.acl.save()
+		}
+		if err != nil {
+			return Error("ERR " + err.Error())
+		}
+		return OK()
+	default:
+		return Errorf("ERR unknown subcommand '%s'", args[0])
+	}
+}
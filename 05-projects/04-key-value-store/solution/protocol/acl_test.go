@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exec runs a command given as a line of words for sess and returns the
+// reply's text.
+func exec(h *Handler, sess *Session, line string) string {
+	return h.Exec(sess, strings.Fields(line)).Text()
+}
+
+func TestACL_Auth(t *testing.T) {
+	handler := NewHandler(store.NewKVStore(), nil)
+	admin := handler.NewSession()
+
+	// Everyone is the default user until it gets a password
+	assert.Equal(t, "OK", exec(handler, admin, "SET key value"))
+	assert.Equal(t, "default", exec(handler, admin, "ACL WHOAMI"))
+	assert.Equal(t, "OK", exec(handler, admin, "ACL SETUSER default >secret"))
+	assert.Equal(t, "value", exec(handler, admin, "GET key"), "sessions that never sent AUTH keep running as default")
+
+	sess := handler.NewSession()
+	assert.Equal(t, "NOAUTH Authentication required.", exec(handler, sess, "GET key"))
+	assert.Contains(t, exec(handler, sess, "HELLO 3"), "NOAUTH")
+	assert.Equal(t, errWrongPass.Str, exec(handler, sess, "AUTH wrong"))
+	assert.Equal(t, errWrongPass.Str, exec(handler, sess, "AUTH nobody secret"))
+	assert.Equal(t, "OK", exec(handler, sess, "AUTH secret"))
+	assert.Equal(t, "value", exec(handler, sess, "GET key"))
+
+	// HELLO can authenticate too, as a named user
+	assert.Equal(t, "OK", exec(handler, admin, "ACL SETUSER alice on >pw1 >pw2 +@read ~*"))
+	sess = handler.NewSession()
+	assert.Equal(t, errWrongPass.Str, exec(handler, sess, "HELLO 3 AUTH alice secret"))
+	assert.Equal(t, 2, sess.Protocol(), "a failed HELLO changes nothing")
+	reply := handler.Exec(sess, []string{"HELLO", "3", "AUTH", "alice", "pw2", "SETNAME", "app"})
+	require.False(t, reply.IsError(), reply.Text())
+	assert.Equal(t, 3, sess.Protocol())
+	assert.Contains(t, exec(handler, sess, "ACL WHOAMI"), "NOPERM", "ACL is admin only")
+
+	// Disabled users can't authenticate, and deleted ones are logged out
+	assert.Equal(t, "OK", exec(handler, admin, "ACL SETUSER alice off"))
+	assert.Equal(t, errWrongPass.Str, exec(handler, handler.NewSession(), "AUTH alice pw1"))
+	assert.Equal(t, "value", exec(handler, sess, "GET key"))
+	assert.Equal(t, "1", exec(handler, admin, "ACL DELUSER alice nobody"))
+	assert.Equal(t, "NOAUTH Authentication required.", exec(handler, sess, "GET key"))
+	assert.Contains(t, exec(handler, admin, "ACL DELUSER default"), "cannot be removed")
+
+	// Without a password for the default user nobody is let in as it
+	assert.Equal(t, "OK", exec(handler, admin, "ACL SETUSER default resetpass"))
+	assert.Equal(t, errWrongPass.Str, exec(handler, handler.NewSession(), "AUTH secret"))
+}
+
+func TestACL_Permissions(t *testing.T) {
+	handler := NewHandler(store.NewKVStore(), nil)
+	admin := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, admin, "ACL SETUSER reader on >pw +@read ~cache:* ~session:*"))
+	require.Equal(t, "OK", exec(handler, admin, "ACL SETUSER writer on >pw +@all -@admin ~cache:*"))
+	exec(handler, admin, "SET cache:a 1")
+	exec(handler, admin, "SET other 2")
+
+	reader := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, reader, "AUTH reader pw"))
+	assert.Equal(t, "1", exec(handler, reader, "GET cache:a"))
+	assert.Equal(t, "NOPERM User reader has no permissions to run the 'set' command", exec(handler, reader, "SET cache:a 3"))
+	assert.Equal(t, "NOPERM No permissions to access a key", exec(handler, reader, "GET other"))
+	assert.Equal(t, "NOPERM No permissions to access a key", exec(handler, reader, "EXISTS cache:a other"))
+	assert.Equal(t, "NOPERM No permissions to access a key", exec(handler, reader, "KEYS cache:*"), "KEYS sees the whole keyspace")
+	assert.Equal(t, "PONG", exec(handler, reader, "PING"), "uncategorized commands are open")
+	assert.Contains(t, exec(handler, reader, "ACL LIST"), "NOPERM")
+
+	writer := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, writer, "AUTH writer pw"))
+	assert.Equal(t, "OK", exec(handler, writer, "SET cache:b 2"))
+	assert.Equal(t, "NOPERM No permissions to access a key", exec(handler, writer, "DEL cache:b other"))
+	assert.Equal(t, "NOPERM User writer has no permissions to run the 'replicaof' command", exec(handler, writer, "REPLICAOF NO ONE"))
+	assert.Equal(t, "NOPERM No permissions to access a key", exec(handler, writer, "BLPOP cache:list other 0"))
+
+	// Keyspace notifications name every key, so they need access to all
+	for _, cmd := range []string{"SUBSCRIBE news __keyevent@0__:set", "PSUBSCRIBE __keyspace@0__:*", "PSUBSCRIBE *", "PSUBSCRIBE __key?pace@0__:cache:*"} {
+		assert.Equal(t, "NOPERM No permissions to access a channel", exec(handler, writer, cmd), cmd)
+	}
+	for _, cmd := range []string{"SUBSCRIBE news", "PSUBSCRIBE news.*", "PSUBSCRIBE __key"} {
+		sub := handler.NewSession()
+		require.Equal(t, "OK", exec(handler, sub, "AUTH writer pw"))
+		assert.NotContains(t, exec(handler, sub, cmd), "NOPERM", cmd)
+	}
+
+	// Changes apply to sessions already authenticated
+	require.Equal(t, "OK", exec(handler, admin, "ACL SETUSER reader -@read +@write allkeys"))
+	assert.Contains(t, exec(handler, reader, "GET cache:a"), "NOPERM")
+	assert.Equal(t, "OK", exec(handler, reader, "SET other 3"))
+}
+
+func TestACL_Multi(t *testing.T) {
+	handler := NewHandler(store.NewKVStore(), nil)
+	admin := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, admin, "ACL SETUSER app on >pw +@read +@write ~app:*"))
+
+	sess := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, sess, "AUTH app pw"))
+	assert.Equal(t, "NOPERM No permissions to access a key", exec(handler, sess, "WATCH app:a other"))
+
+	exec(handler, sess, "MULTI")
+	assert.Equal(t, "QUEUED", exec(handler, sess, "SET app:a 1"))
+	assert.Contains(t, exec(handler, sess, "SET other 1"), "NOPERM")
+	assert.Contains(t, exec(handler, sess, "EXEC"), "EXECABORT")
+	assert.Equal(t, "", exec(handler, admin, "GET app:a"))
+}
+
+func TestACL_SetUser(t *testing.T) {
+	handler := NewHandler(store.NewKVStore(), nil)
+	admin := handler.NewSession()
+	hash := hashPassword("pw")
+
+	for _, tt := range []struct {
+		rules string
+		want  string
+	}{
+		{"", "user u off -@all"},
+		{"on >pw ~a:* ~b:* +@read", "user u on #" + hash + " ~a:* ~b:* -@all +@read"},
+		{"~* +@write", "user u on #" + hash + " ~* -@all +@read +@write"},
+		{"<pw nopass allcommands", "user u on nopass ~* +@all"},
+		{"#" + strings.ToUpper(hash) + " -@admin resetkeys", "user u on #" + hash + " -@all +@read +@write"},
+		{"!" + hash + " off reset", "user u off -@all"},
+	} {
+		args := append([]string{"ACL", "SETUSER", "u"}, strings.Fields(tt.rules)...)
+		require.Equal(t, "OK", handler.Exec(admin, args).Text(), tt.rules)
+		assert.Equal(t, tt.want, handler.Exec(admin, []string{"ACL", "LIST"}).Strings()[1], tt.rules)
+	}
+
+	for _, rules := range []string{"bogus", "+@nothing", "<unset", "#abc"} {
+		reply := exec(handler, admin, "ACL SETUSER u on "+rules)
+		assert.Contains(t, reply, "ERR Error in ACL SETUSER modifier '"+rules+"'")
+	}
+	assert.Equal(t, "user u off -@all", handler.Exec(admin, []string{"ACL", "LIST"}).Strings()[1], "a failed SETUSER changes nothing")
+	assert.Equal(t, []string{"default", "u"}, handler.Exec(admin, []string{"ACL", "USERS"}).Strings())
+}
+
+func TestACL_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	require.NoError(t, os.WriteFile(path, []byte(`# Users of the test server
+user default off
+user admin on >secret +@all ~*
+
+user app on >pw +@read +@write ~app:*
+`), 0600))
+
+	handler := NewHandler(store.NewKVStore(), nil)
+	require.NoError(t, handler.LoadACLFile(path))
+	sess := handler.NewSession()
+	assert.Equal(t, "NOAUTH Authentication required.", exec(handler, sess, "PING"))
+	require.Equal(t, "OK", exec(handler, sess, "AUTH admin secret"))
+
+	// ACL SAVE writes the users back, with hashed passwords, and ACL LOAD
+	// reads them again
+	require.Equal(t, "OK", exec(handler, sess, "ACL SETUSER ops on >ops +@admin"))
+	require.Equal(t, "OK", exec(handler, sess, "ACL SAVE"))
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(saved), "secret")
+	require.Equal(t, "1", exec(handler, sess, "ACL DELUSER ops"))
+	require.Equal(t, "OK", exec(handler, sess, "ACL LOAD"))
+	assert.Equal(t, []string{"admin", "app", "default", "ops"}, handler.Exec(sess, []string{"ACL", "USERS"}).Strings())
+	assert.Equal(t, "OK", exec(handler, handler.NewSession(), "AUTH ops ops"))
+
+	// A bad file is rejected as a whole
+	require.NoError(t, os.WriteFile(path, []byte("user ops on >ops\nuser app on +@bogus\n"), 0600))
+	assert.Contains(t, exec(handler, sess, "ACL LOAD"), "users.acl:2")
+	assert.Len(t, handler.Exec(sess, []string{"ACL", "USERS"}).Strings(), 4)
+	require.NoError(t, os.WriteFile(path, []byte("user ops on\nuser ops off\n"), 0600))
+	assert.Contains(t, exec(handler, sess, "ACL LOAD"), "duplicate user")
+
+	// Files that leave out the default user keep it open
+	require.NoError(t, os.WriteFile(path, []byte("user ops on >ops +@admin\n"), 0600))
+	require.Equal(t, "OK", exec(handler, sess, "ACL LOAD"))
+	assert.Equal(t, "PONG", exec(handler, handler.NewSession(), "PING"))
+
+	other := NewHandler(nil, nil)
+	assert.Contains(t, exec(other, other.NewSession(), "ACL LOAD"), "not configured to use an ACL file")
+	assert.Error(t, other.LoadACLFile(filepath.Join(t.TempDir(), "missing")))
+}
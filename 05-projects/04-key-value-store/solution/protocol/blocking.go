@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// Blocking pops. BLPOP and BRPOP pop from the first of their lists that
+// isn't empty; when they all are, the client waits for another one to push.
+// Waiters queue up on each of their keys in the order they blocked. After
+// a write that pushed to a list, and before its Tx releases the list, the
+// handler pops an element for each waiter at the front of the list's queue
+// while there are any. So no other write comes between a push and the pops
+// it wakes, the first client to block is the first served, and an element
+// goes to exactly one waiter: one that gives up takes itself off the queues
+// under the same lock a pusher claims it with.
+
+// waiter is a client blocked on lists.
+type waiter struct {
+	keys    []string
+	head    bool // pops from the head, for BLPOP
+	timeout time.Duration
+
+	// reply receives [key, element] once the waiter has been claimed and
+	// served. It is buffered so that serving never waits on the client.
+	reply chan Value
+	// logged is the WAL sequence number of the pop, set before the reply
+	// is sent; the client commits it before replying.
+	logged uint64
+}
+
+type blocking struct {
+	mu      sync.Mutex
+	waiters map[string][]*waiter
+	blocked int // waiters queued, each once however many keys it has
+}
+
+func newBlocking() *blocking {
+	return &blocking{waiters: make(map[string][]*waiter)}
+}
+
+func (b *blocking) add(w *waiter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range w.keys {
+		b.waiters[key] = append(b.waiters[key], w)
+	}
+	b.blocked++
+}
+
+// remove takes w off the queues of all its keys and reports whether it was
+// still waiting, that is whether nobody has claimed it.
+func (b *blocking) remove(w *waiter) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.removeLocked(w)
+}
+
+func (b *blocking) removeLocked(w *waiter) bool {
+	found := false
+	for _, key := range w.keys {
+		queue := b.waiters[key]
+		i := slices.Index(queue, w)
+		if i < 0 {
+			continue
+		}
+		found = true
+		if len(queue) == 1 {
+			delete(b.waiters, key)
+		} else {
+			b.waiters[key] = slices.Delete(queue, i, i+1)
+		}
+	}
+	if found {
+		b.blocked--
+	}
+	return found
+}
+
+// claim removes the first waiter on key from all its queues and returns
+// it, or nil if nobody waits on key.
+func (b *blocking) claim(key string) *waiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queue := b.waiters[key]
+	if len(queue) == 0 {
+		return nil
+	}
+	w := queue[0]
+	b.removeLocked(w)
+	return w
+}
+
+// count returns how many clients are blocked.
+func (b *blocking) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.blocked
+}
+
+func (b *blocking) waiting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.waiters) > 0
+}
+
+// handleBlockingPop implements BLPOP and BRPOP key [key ...] timeout, with
+// the timeout in seconds and 0 to wait forever. If all the lists are empty
+// it registers the call's waiter, which Exec waits on once writeMu and the
+// Tx are released. A call that can't block replies with a null array instead.
+func (h *Handler) handleBlockingPop(c *call, args []string) Value {
+	if len(args) < 2 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return errorValue(err)
+	}
+	keys := args[:len(args)-1]
+	head := c.name == "BLPOP"
+
+	for _, key := range keys {
+		popped, err := c.pop(key, 1, head)
+		if err != nil {
+			return errorValue(err)
+		}
+		if len(popped) > 0 {
+			return BulkStrings([]string{key, popped[0]})
+		}
+	}
+
+	if c.nonBlocking {
+		return NullArray()
+	}
+	c.block = &waiter{keys: keys, head: head, timeout: timeout, reply: make(chan Value, 1)}
+	h.blocking.add(c.block)
+	return NullArray()
+}
+
+// parseTimeout parses the timeout of a blocking command, in seconds.
+func parseTimeout(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) || secs > math.MaxInt64/float64(time.Second) {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// wait blocks until w is served, its timeout passes or the session's block
+// hook cancels it, and returns the reply.
+func (h *Handler) wait(sess *Session, w *waiter) Value {
+	var expired <-chan time.Time
+	if w.timeout > 0 {
+		timer := time.NewTimer(w.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	cancelled := make(chan struct{})
+	if sess.blockHook != nil {
+		var once sync.Once
+		stop := sess.blockHook(func() { once.Do(func() { close(cancelled) }) })
+		defer stop()
+	}
+
+	select {
+	case v := <-w.reply:
+		h.commitSeq(w.logged)
+		return v
+	case <-expired:
+	case <-cancelled:
+	}
+	if h.blocking.remove(w) {
+		return NullArray()
+	}
+	// Claimed while giving up: the reply is on its way
+	v := <-w.reply
+	h.commitSeq(w.logged)
+	return v
+}
+
+// serveBlocked pops elements for the clients blocked on the lists in keys,
+// first come first served, and logs the pops. tx is the Tx of the write
+// that pushed to them, which still holds them. Callers hold writeMu.
+func (h *Handler) serveBlocked(tx *store.Tx, keys []string) {
+	if len(keys) == 0 || !h.blocking.waiting() {
+		return
+	}
+
+	type delivery struct {
+		w     *waiter
+		reply Value
+	}
+	var served []delivery
+	c := &call{sess: h.local, tx: tx}
+	for i, key := range keys {
+		if slices.Contains(keys[:i], key) {
+			continue
+		}
+		// Nothing else writes to the list while tx holds it, so a waiter
+		// that is claimed gets an element
+		for {
+			if n, err := tx.LLen(key); err != nil || n == 0 {
+				break
+			}
+			w := h.blocking.claim(key)
+			if w == nil {
+				break
+			}
+			popped, _ := c.pop(key, 1, w.head)
+			served = append(served, delivery{w, BulkStrings([]string{key, popped[0]})})
+		}
+	}
+
+	h.logWrites(c)
+	h.publishEvents(c.events)
+	for _, d := range served {
+		d.w.logged = c.logged
+		d.w.reply <- d.reply
+	}
+}
@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockedOn returns how many clients are blocked on key.
+func blockedOn(h *Handler, key string) int {
+	h.blocking.mu.Lock()
+	defer h.blocking.mu.Unlock()
+	return len(h.blocking.waiters[key])
+}
+
+// blockPop runs a blocking command in the background once the clients
+// already blocked on key are queued, and returns its reply channel.
+func blockPop(t *testing.T, h *Handler, key string, args ...string) <-chan Value {
+	t.Helper()
+
+	before := blockedOn(h, key)
+	sess := h.NewSession()
+	reply := make(chan Value, 1)
+	go func() { reply <- h.Exec(sess, args) }()
+	require.Eventually(t, func() bool { return blockedOn(h, key) == before+1 }, time.Second, time.Millisecond)
+	return reply
+}
+
+func receive(t *testing.T, reply <-chan Value) Value {
+	t.Helper()
+
+	select {
+	case v := <-reply:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("blocked command didn't return")
+		return Value{}
+	}
+}
+
+func TestHandler_BlockingPopWithoutWaiting(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"RPUSH list a b c", ":3"},
+		{"BLPOP empty list 0", "*2\r\n$4\r\nlist\r\n$1\r\na"},
+		{"BRPOP list 0", "*2\r\n$4\r\nlist\r\n$1\r\nc"},
+		{"RPOP list", "$1\r\nb"},
+		{"LLEN list", ":0"},
+		{"BLPOP list", "-ERR wrong number of arguments for 'blpop' command"},
+		{"BLPOP list soon", "-ERR timeout is not a float or out of range"},
+		{"BLPOP list -1", "-ERR timeout is negative"},
+		{"SET text hello", "+OK"},
+		{"BLPOP text 0", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"BLPOP empty 0.01", "*-1"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, handler.Handle(tt.command), tt.command)
+	}
+}
+
+func TestHandler_BlockingPopServesInOrder(t *testing.T) {
+	handler, _, wal, walPath := newStringsHandler(t)
+
+	first := blockPop(t, handler, "queue", "BLPOP", "queue", "0")
+	second := blockPop(t, handler, "queue", "BRPOP", "queue", "0")
+	third := blockPop(t, handler, "queue", "BLPOP", "other", "queue", "0")
+	fourth := blockPop(t, handler, "queue", "BLPOP", "queue", "0")
+
+	// The push replies with the length before the waiters pop
+	assert.Equal(t, ":3", handler.Handle("RPUSH queue a b c"))
+	assert.Equal(t, []string{"queue", "a"}, receive(t, first).Strings())
+	assert.Equal(t, []string{"queue", "c"}, receive(t, second).Strings())
+	assert.Equal(t, []string{"queue", "b"}, receive(t, third).Strings())
+	assert.Equal(t, ":0", handler.Handle("LLEN queue"))
+	assert.Equal(t, 1, blockedOn(handler, "queue"))
+	assert.Zero(t, blockedOn(handler, "other"))
+
+	handler.Handle("LPUSH queue d")
+	assert.Equal(t, []string{"queue", "d"}, receive(t, fourth).Strings())
+	handler.Handle("RPUSH queue e")
+	wal.Close()
+
+	// The pops are logged after the push that woke them
+	replayed := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(replayed))
+	values, err := replayed.LRange("queue", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"e"}, values)
+}
+
+func TestHandler_BlockingPopTimeout(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	start := time.Now()
+	assert.Equal(t, "*-1", handler.Handle("BLPOP queue 0.05"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Zero(t, blockedOn(handler, "queue"))
+
+	// Nobody is left to take the element
+	handler.Handle("RPUSH queue a")
+	assert.Equal(t, ":1", handler.Handle("LLEN queue"))
+}
+
+func TestHandler_BlockingPopCancelled(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	sess := handler.NewSession()
+	cancels := make(chan func(), 1)
+	stopped := make(chan struct{})
+	sess.SetBlockHook(func(cancel func()) func() {
+		cancels <- cancel
+		return func() { close(stopped) }
+	})
+
+	reply := make(chan Value, 1)
+	go func() { reply <- handler.Exec(sess, []string{"BLPOP", "queue", "0"}) }()
+	(<-cancels)()
+	assert.True(t, receive(t, reply).Null)
+	assert.Zero(t, blockedOn(handler, "queue"))
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("block hook not stopped")
+	}
+}
+
+func TestHandler_BlockingPopAfterExec(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	reply := blockPop(t, handler, "b", "BLPOP", "a", "b", "0")
+
+	// Waiters are served once the transaction is over, with what it left
+	sess := handler.NewSession()
+	handler.Exec(sess, []string{"MULTI"})
+	handler.Exec(sess, []string{"RPUSH", "a", "x"})
+	handler.Exec(sess, []string{"RPUSH", "b", "y", "z"})
+	handler.Exec(sess, []string{"LPOP", "b"})
+	handler.Exec(sess, []string{"BLPOP", "c", "0"})
+	v := handler.Exec(sess, []string{"EXEC"})
+	require.Len(t, v.Elems, 4)
+	assert.True(t, v.Elems[3].Null, "BLPOP doesn't block in a transaction")
+
+	assert.Equal(t, []string{"a", "x"}, receive(t, reply).Strings())
+	assert.Equal(t, "*1\r\n$1\r\nz", handler.Handle("LRANGE b 0 -1"))
+	assert.Zero(t, blockedOn(handler, "b"))
+}
+
+func TestHandler_BlockingPopDeliversOnce(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	// Waiters time out while elements are pushed: each element must end up
+	// with exactly one of them or stay in the list
+	const waiters, elements = 20, 200
+	var mu sync.Mutex
+	var got []string
+	var wg sync.WaitGroup
+	for w := 0; w < waiters; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess := handler.NewSession()
+			for i := 0; i < elements/waiters; i++ {
+				v := handler.Exec(sess, []string{"BLPOP", "queue", "0.001"})
+				if !v.Null {
+					mu.Lock()
+					got = append(got, v.Elems[1].Str)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	sess := handler.NewSession()
+	for i := 0; i < elements; i++ {
+		handler.Exec(sess, []string{"RPUSH", "queue", fmt.Sprint(i)})
+	}
+	wg.Wait()
+
+	left := handler.Exec(sess, []string{"LRANGE", "queue", "0", "-1"}).Strings()
+	all := append(got, left...)
+	assert.Len(t, all, elements)
+	slices.Sort(all)
+	assert.Len(t, slices.Compact(all), elements)
+}
@@ -0,0 +1,748 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// Cluster mode, after Redis Cluster. The keyspace is split into
+// ClusterSlots hash slots, each owned by one node, and a node only serves
+// keys in its own slots: for the others it replies "MOVED slot host:port"
+// and the client retries there. All keys of a command or transaction must
+// be in one slot. A hash tag, the part of a key between the first { and the
+// next }, is hashed instead of the whole key if it isn't empty, so related
+// keys can be kept together.
+//
+// Nodes don't gossip. Operators, or package cluster, tell each node about
+// the others with CLUSTER ADDNODE and about slot owners with CLUSTER
+// SETSLOT, and each node keeps its view in a config file that survives
+// restarts.
+//
+// Slots move between live nodes as in Redis. The target is told it is
+// IMPORTING the slot and the source that it is MIGRATING it; MIGRATE then
+// moves the slot's keys one batch at a time, and CLUSTER SETSLOT NODE gives
+// the slot to the target once the source holds none of them. Meanwhile the
+// source serves the keys it still has, and answers "ASK slot host:port" for
+// the others, which the target serves to clients that send ASKING first.
+// Writes never land on a node that has given the slot away: they are routed
+// with writeMu read-locked, which slot changes lock, and the check for
+// missing keys is made in the command's Tx, which MIGRATE holds the keys it
+// moves with.
+
+// ClusterSlots is the number of hash slots in cluster mode.
+const ClusterSlots = 16384
+
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 is CRC-16/XMODEM, which Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key.
+func KeySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % ClusterSlots
+}
+
+// CommandKeys returns the keys of a command given with its name first, as
+// the server finds them, so clients can tell which node to send it to.
+func CommandKeys(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, ok := lookupCommand(strings.ToUpper(args[0]))
+	if !ok {
+		return nil
+	}
+	return cmd.keys.keys(args[1:])
+}
+
+// redirect is a MOVED or ASK reply.
+type redirect struct {
+	kind string
+	slot int
+	addr string
+}
+
+func (r redirect) reply() Value {
+	return Errorf("%s %d %s", r.kind, r.slot, r.addr)
+}
+
+var errCrossSlot = Error("CROSSSLOT Keys in request don't hash to the same slot")
+
+// clusterState is a node's view of the cluster.
+type clusterState struct {
+	mu        sync.RWMutex
+	myID      string
+	nodes     map[string]string // node ID to the address clients reach it at
+	owners    [ClusterSlots]string
+	migrating map[int]string // our slots being moved, to node ID
+	importing map[int]string // slots being moved to us, from node ID
+	file      string
+}
+
+// EnableCluster turns on cluster mode. The node's view of the cluster is
+// kept in configFile; if there is none yet, the node starts out alone,
+// with a new ID and no slots. addr is the address clients are redirected
+// to for this node.
+func (h *Handler) EnableCluster(configFile, addr string) error {
+	cs := &clusterState{
+		nodes:     make(map[string]string),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+		file:      configFile,
+	}
+
+	err := cs.load()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		cs.myID = newNodeID()
+	case err != nil:
+		return err
+	}
+	cs.nodes[cs.myID] = addr
+	if err := cs.save(); err != nil {
+		return err
+	}
+
+	h.cluster = cs
+	return nil
+}
+
+func newNodeID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// route decides whether this node serves keys, which must all be in one
+// slot. If it doesn't, it returns the error to reply with. If the slot is
+// being migrated away, it returns the ASK redirection to reply with should
+// any of the keys be gone already, which only a Tx holding them can tell.
+func (cs *clusterState) route(keys []string, asking bool) (ask *redirect, reply Value, ok bool) {
+	if len(keys) == 0 {
+		return nil, Value{}, true
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return nil, errCrossSlot, false
+		}
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	owner := cs.owners[slot]
+	switch {
+	case owner == cs.myID:
+		if to, ok := cs.migrating[slot]; ok {
+			return &redirect{"ASK", slot, cs.nodes[to]}, Value{}, true
+		}
+		return nil, Value{}, true
+	case asking && cs.importing[slot] != "":
+		return nil, Value{}, true
+	case owner == "":
+		return nil, Errorf("CLUSTERDOWN Hash slot %d not served", slot), false
+	default:
+		return nil, redirect{"MOVED", slot, cs.nodes[owner]}.reply(), false
+	}
+}
+
+// routeTx is route for a call about to run in tx with keys locked. MIGRATE
+// moves whichever of its keys are left, so it isn't asked elsewhere.
+func (h *Handler) routeTx(c *call, tx *store.Tx, keys []string) (Value, bool) {
+	ask, reply, ok := h.cluster.route(keys, c.sess.asking)
+	if !ok || ask == nil || c.name == "MIGRATE" {
+		return reply, ok
+	}
+	for _, key := range keys {
+		if !tx.Exists(key) {
+			return ask.reply(), false
+		}
+	}
+	return Value{}, true
+}
+
+// save writes the node's view of the cluster, in the format of CLUSTER
+// NODES, to its config file. Callers hold mu.
+func (cs *clusterState) save() error {
+	return writeFileAtomic(cs.file, []byte(cs.nodesText()))
+}
+
+// load reads the node's view from its config file.
+func (cs *clusterState) load() error {
+	f, err := os.Open(cs.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := cs.loadNode(fields); err != nil {
+			return fmt.Errorf("%s:%d: %w", cs.file, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if cs.myID == "" {
+		return fmt.Errorf("%s: no node is marked myself", cs.file)
+	}
+	return nil
+}
+
+// loadNode reads one line of CLUSTER NODES: ID, address, flags, five
+// fields that don't apply here, and the node's slots.
+func (cs *clusterState) loadNode(fields []string) error {
+	if len(fields) < 8 {
+		return errors.New("expected a CLUSTER NODES line")
+	}
+	id := fields[0]
+	cs.nodes[id] = fields[1]
+	if slices.Contains(strings.Split(fields[2], ","), "myself") {
+		cs.myID = id
+	}
+
+	for _, field := range fields[8:] {
+		if strings.HasPrefix(field, "[") {
+			slot, dir, peer, ok := parseSlotTransfer(field)
+			if !ok {
+				return fmt.Errorf("invalid slot transfer %q", field)
+			}
+			if dir == "->-" {
+				cs.migrating[slot] = peer
+			} else {
+				cs.importing[slot] = peer
+			}
+			continue
+		}
+		start, end, err := parseSlotRange(field)
+		if err != nil {
+			return err
+		}
+		for slot := start; slot <= end; slot++ {
+			cs.owners[slot] = id
+		}
+	}
+	return nil
+}
+
+// parseSlotTransfer parses "[slot->-id]" (migrating) or "[slot-<-id]"
+// (importing).
+func parseSlotTransfer(field string) (slot int, dir, peer string, ok bool) {
+	inner, ok := strings.CutSuffix(strings.TrimPrefix(field, "["), "]")
+	if !ok {
+		return 0, "", "", false
+	}
+	for _, dir := range []string{"->-", "-<-"} {
+		if s, peer, found := strings.Cut(inner, dir); found {
+			slot, err := parseSlot(s)
+			return slot, dir, peer, err == nil && peer != ""
+		}
+	}
+	return 0, "", "", false
+}
+
+// parseSlotRange parses "start-end" or a single slot.
+func parseSlotRange(s string) (start, end int, err error) {
+	first, last, found := strings.Cut(s, "-")
+	if start, err = parseSlot(first); err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return start, start, nil
+	}
+	if end, err = parseSlot(last); err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid slot range %q", s)
+	}
+	return start, end, nil
+}
+
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= ClusterSlots {
+		return 0, fmt.Errorf("invalid slot %q", s)
+	}
+	return slot, nil
+}
+
+// slotRanges returns the ranges of slots each node owns, in slot order.
+func (cs *clusterState) slotRanges() map[string][][2]int {
+	ranges := make(map[string][][2]int)
+	for slot := 0; slot < ClusterSlots; {
+		owner := cs.owners[slot]
+		end := slot
+		for end+1 < ClusterSlots && cs.owners[end+1] == owner {
+			end++
+		}
+		if owner != "" {
+			ranges[owner] = append(ranges[owner], [2]int{slot, end})
+		}
+		slot = end + 1
+	}
+	return ranges
+}
+
+// nodesText describes the cluster as CLUSTER NODES does: per node its ID,
+// address, flags, master, ping and pong times, config epoch, link state and
+// slots. Only the ID, address, myself flag and slots mean anything here.
+func (cs *clusterState) nodesText() string {
+	ids := slices.Sorted(func(yield func(string) bool) {
+		for id := range cs.nodes {
+			if !yield(id) {
+				return
+			}
+		}
+	})
+	ranges := cs.slotRanges()
+
+	var b strings.Builder
+	for _, id := range ids {
+		flags := "master"
+		if id == cs.myID {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s %s - 0 0 0 connected", id, cs.nodes[id], flags)
+		for _, r := range ranges[id] {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+		if id == cs.myID {
+			for _, slot := range slices.Sorted(mapKeys(cs.migrating)) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, cs.migrating[slot])
+			}
+			for _, slot := range slices.Sorted(mapKeys(cs.importing)) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, cs.importing[slot])
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func mapKeys[K comparable, V any](m map[K]V) func(yield func(K) bool) {
+	return func(yield func(K) bool) {
+		for k := range m {
+			if !yield(k) {
+				return
+			}
+		}
+	}
+}
+
+// slotKeys returns up to limit keys in slot, or all of them if limit is
+// negative. Keys aren't indexed by slot, so this scans the keyspace.
+func (h *Handler) slotKeys(slot, limit int) []string {
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next := h.store.Scan(cursor, "*", 1000)
+		for _, key := range batch {
+			if KeySlot(key) == slot {
+				if len(keys) == limit {
+					return keys
+				}
+				keys = append(keys, key)
+			}
+		}
+		if next == 0 {
+			return keys
+		}
+		cursor = next
+	}
+}
+
+func (h *Handler) handleAsking(c *call, args []string) Value {
+	if len(args) != 0 {
+		return wrongArgs("asking")
+	}
+	if h.cluster == nil {
+		return errClusterDisabled
+	}
+	c.sess.asking = true
+	return OK()
+}
+
+var errClusterDisabled = Error("ERR This instance has cluster support disabled")
+
+// handleCluster implements the CLUSTER subcommands. Those that change the
+// cluster need the admin category; the others describe it to clients.
+func (h *Handler) handleCluster(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("cluster")
+	}
+	sub := strings.ToUpper(args[0])
+	if sub == "KEYSLOT" {
+		if len(args) != 2 {
+			return wrongArgs("cluster|keyslot")
+		}
+		return Integer(int64(KeySlot(args[1])))
+	}
+	if h.cluster == nil {
+		return errClusterDisabled
+	}
+
+	switch sub {
+	case "INFO", "MYID", "NODES", "SLOTS", "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		return h.clusterInfo(sub, args[1:])
+	case "ADDNODE", "FORGET", "ADDSLOTS", "ADDSLOTSRANGE", "DELSLOTS", "SETSLOT", "SETSLOTRANGE":
+		if reply, ok := h.authorizeCategory(c.sess, aclAdmin, "cluster|"+strings.ToLower(sub)); !ok {
+			return reply
+		}
+		// Slots change hands between writes, never during one
+		h.writeMu.Lock()
+		defer h.writeMu.Unlock()
+		return h.clusterChange(sub, args[1:])
+	default:
+		return Errorf("ERR unknown subcommand '%s'", args[0])
+	}
+}
+
+func (h *Handler) clusterInfo(sub string, args []string) Value {
+	cs := h.cluster
+	switch sub {
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		want := 2
+		if sub == "COUNTKEYSINSLOT" {
+			want = 1
+		}
+		if len(args) != want {
+			return wrongArgs("cluster|" + strings.ToLower(sub))
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return Error("ERR Invalid slot")
+		}
+		if sub == "COUNTKEYSINSLOT" {
+			return Integer(int64(len(h.slotKeys(slot, -1))))
+		}
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			return Error("ERR Invalid number of keys")
+		}
+		return BulkStrings(h.slotKeys(slot, limit))
+	}
+
+	if len(args) != 0 {
+		return wrongArgs("cluster|" + strings.ToLower(sub))
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	switch sub {
+	case "MYID":
+		return BulkString(cs.myID)
+	case "NODES":
+		return BulkString(cs.nodesText())
+	case "SLOTS":
+		// [start, end, [host, port, id]] per range, as in Redis
+		var out []Value
+		for id, ranges := range cs.slotRanges() {
+			host, port, _ := strings.Cut(cs.nodes[id], ":")
+			portNum, _ := strconv.Atoi(port)
+			node := Array(BulkString(host), Integer(int64(portNum)), BulkString(id))
+			for _, r := range ranges {
+				out = append(out, Array(Integer(int64(r[0])), Integer(int64(r[1])), node))
+			}
+		}
+		slices.SortFunc(out, func(a, b Value) int { return int(a.Elems[0].Int - b.Elems[0].Int) })
+		return Array(out...)
+	default: // INFO
+		assigned := 0
+		for _, owner := range cs.owners {
+			if owner != "" {
+				assigned++
+			}
+		}
+		state := "ok"
+		if assigned < ClusterSlots {
+			state = "fail"
+		}
+		var b strings.Builder
+		infoField(&b, "cluster_enabled", 1)
+		infoField(&b, "cluster_state", state)
+		infoField(&b, "cluster_slots_assigned", assigned)
+		infoField(&b, "cluster_known_nodes", len(cs.nodes))
+		infoField(&b, "cluster_size", len(cs.slotRanges()))
+		infoField(&b, "cluster_my_slots", len(cs.slotsOf(cs.myID)))
+		infoField(&b, "cluster_migrating_slots", len(cs.migrating))
+		infoField(&b, "cluster_importing_slots", len(cs.importing))
+		return BulkString(b.String())
+	}
+}
+
+func (cs *clusterState) slotsOf(id string) []int {
+	var slots []int
+	for slot, owner := range cs.owners {
+		if owner == id {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// clusterChange runs a subcommand that changes the cluster, and saves the
+// result. Callers hold writeMu.
+func (h *Handler) clusterChange(sub string, args []string) Value {
+	cs := h.cluster
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var reply Value
+	switch sub {
+	case "ADDNODE":
+		reply = cs.addNode(args)
+	case "FORGET":
+		reply = cs.forget(args)
+	case "ADDSLOTS", "ADDSLOTSRANGE", "DELSLOTS":
+		reply = cs.changeOwnSlots(sub, args)
+	case "SETSLOT":
+		reply = h.setSlot(args)
+	case "SETSLOTRANGE":
+		reply = h.setSlotRange(args)
+	}
+	if reply.IsError() {
+		return reply
+	}
+	if err := cs.save(); err != nil {
+		return Errorf("ERR saving the cluster config: %v", err)
+	}
+	return reply
+}
+
+// addNode implements CLUSTER ADDNODE id host:port, which tells this node
+// about another, or of a new address for it.
+func (cs *clusterState) addNode(args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("cluster|addnode")
+	}
+	if _, _, err := splitHostPort(args[1]); err != nil {
+		return Errorf("ERR Invalid node address '%s'", args[1])
+	}
+	if args[0] == cs.myID {
+		return Error("ERR I tried hard but I can't forget myself...")
+	}
+	cs.nodes[args[0]] = args[1]
+	return OK()
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	i := strings.LastIndexByte(addr, ':')
+	if i <= 0 {
+		return "", 0, errors.New("missing port")
+	}
+	port, err := strconv.Atoi(addr[i+1:])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errors.New("invalid port")
+	}
+	return addr[:i], port, nil
+}
+
+// forget implements CLUSTER FORGET id. A node that still owns slots can't
+// be forgotten.
+func (cs *clusterState) forget(args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("cluster|forget")
+	}
+	id := args[0]
+	switch {
+	case id == cs.myID:
+		return Error("ERR I tried hard but I can't forget myself...")
+	case cs.nodes[id] == "":
+		return Errorf("ERR Unknown node %s", id)
+	case len(cs.slotsOf(id)) > 0:
+		return Errorf("ERR Node %s still owns slots", id)
+	}
+	delete(cs.nodes, id)
+	return OK()
+}
+
+// changeOwnSlots implements ADDSLOTS slot..., ADDSLOTSRANGE start end...
+// and DELSLOTS slot..., which assign unassigned slots to this node or
+// unassign slots. Either applies to all the slots or none.
+func (cs *clusterState) changeOwnSlots(sub string, args []string) Value {
+	if len(args) == 0 || (sub == "ADDSLOTSRANGE" && len(args)%2 != 0) {
+		return wrongArgs("cluster|" + strings.ToLower(sub))
+	}
+
+	var slots []int
+	for i := 0; i < len(args); i++ {
+		start, err := parseSlot(args[i])
+		if err != nil {
+			return Error("ERR Invalid or out of range slot")
+		}
+		end := start
+		if sub == "ADDSLOTSRANGE" {
+			i++
+			if end, err = parseSlot(args[i]); err != nil || end < start {
+				return Error("ERR Invalid or out of range slot")
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			switch {
+			case sub == "DELSLOTS" && cs.owners[slot] == "":
+				return Errorf("ERR Slot %d is already unassigned", slot)
+			case sub != "DELSLOTS" && cs.owners[slot] != "":
+				return Errorf("ERR Slot %d is already busy", slot)
+			}
+			slots = append(slots, slot)
+		}
+	}
+
+	for _, slot := range slots {
+		if sub == "DELSLOTS" {
+			cs.owners[slot] = ""
+			delete(cs.migrating, slot)
+			delete(cs.importing, slot)
+		} else {
+			cs.owners[slot] = cs.myID
+		}
+	}
+	return OK()
+}
+
+// setSlot implements CLUSTER SETSLOT slot IMPORTING id | MIGRATING id |
+// NODE id | STABLE.
+func (h *Handler) setSlot(args []string) Value {
+	cs := h.cluster
+	if len(args) < 2 {
+		return wrongArgs("cluster|setslot")
+	}
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return Error("ERR Invalid or out of range slot")
+	}
+
+	action := strings.ToUpper(args[1])
+	if action == "STABLE" {
+		if len(args) != 2 {
+			return wrongArgs("cluster|setslot")
+		}
+		delete(cs.migrating, slot)
+		delete(cs.importing, slot)
+		return OK()
+	}
+	if len(args) != 3 {
+		return wrongArgs("cluster|setslot")
+	}
+	id := args[2]
+	if cs.nodes[id] == "" {
+		return Errorf("ERR Unknown node %s", id)
+	}
+
+	switch action {
+	case "MIGRATING":
+		switch {
+		case cs.owners[slot] != cs.myID:
+			return Errorf("ERR I'm not the owner of hash slot %d", slot)
+		case id == cs.myID:
+			return Error("ERR I can't migrate a slot to myself")
+		}
+		cs.migrating[slot] = id
+	case "IMPORTING":
+		switch {
+		case cs.owners[slot] == cs.myID:
+			return Errorf("ERR I'm already the owner of hash slot %d", slot)
+		case id == cs.myID:
+			return Error("ERR I can't import a slot from myself")
+		}
+		cs.importing[slot] = id
+	case "NODE":
+		return h.assignSlots(slot, slot, id)
+	default:
+		return Error("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	return OK()
+}
+
+// setSlotRange implements CLUSTER SETSLOTRANGE start end NODE id, which is
+// SETSLOT NODE for a range of slots. It stands in for gossip, telling a node
+// about slots assigned elsewhere in one command.
+func (h *Handler) setSlotRange(args []string) Value {
+	if len(args) != 4 || !strings.EqualFold(args[2], "NODE") {
+		return wrongArgs("cluster|setslotrange")
+	}
+	start, err := parseSlot(args[0])
+	if err != nil {
+		return Error("ERR Invalid or out of range slot")
+	}
+	end, err := parseSlot(args[1])
+	if err != nil || end < start {
+		return Error("ERR Invalid or out of range slot")
+	}
+	if h.cluster.nodes[args[3]] == "" {
+		return Errorf("ERR Unknown node %s", args[3])
+	}
+	return h.assignSlots(start, end, args[3])
+}
+
+// assignSlots gives slots start to end to node id. This node can only give
+// away slots it holds no keys in, and taking a slot ends its import.
+func (h *Handler) assignSlots(start, end int, id string) Value {
+	cs := h.cluster
+	for slot := start; slot <= end; slot++ {
+		if cs.owners[slot] == cs.myID && id != cs.myID && len(h.slotKeys(slot, 1)) > 0 {
+			return Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+	}
+	for slot := start; slot <= end; slot++ {
+		cs.owners[slot] = id
+		delete(cs.migrating, slot)
+		if id == cs.myID {
+			delete(cs.importing, slot)
+		}
+	}
+	return OK()
+}
+
+func (h *Handler) infoCluster(b *strings.Builder) {
+	enabled := 0
+	if h.cluster != nil {
+		enabled = 1
+	}
+	infoField(b, "cluster_enabled", enabled)
+}
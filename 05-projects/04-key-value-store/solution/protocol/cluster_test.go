@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, 12182, KeySlot("foo"))
+	assert.Equal(t, 5061, KeySlot("bar"))
+	assert.Equal(t, 0x31C3, int(crc16("123456789")), "the CRC-16/XMODEM check value")
+
+	// Only the first non-empty hash tag counts
+	assert.Equal(t, KeySlot("user1000"), KeySlot("{user1000}.following"))
+	assert.Equal(t, KeySlot("{user1000}.followers"), KeySlot("{user1000}.following"))
+	assert.Equal(t, KeySlot("bar"), KeySlot("foo{bar}{zap}"))
+	assert.Equal(t, KeySlot("{bar"), KeySlot("foo{{bar}}zap"))
+	assert.NotEqual(t, KeySlot("bar"), KeySlot("foo{}{bar}"))
+}
+
+// newClusterHandler returns a handler in cluster mode, with its config file.
+func newClusterHandler(t *testing.T, addr string) (*Handler, string) {
+	t.Helper()
+	conf := filepath.Join(t.TempDir(), "nodes.conf")
+	handler := NewHandler(store.NewKVStore(), nil)
+	require.NoError(t, handler.EnableCluster(conf, addr))
+	return handler, conf
+}
+
+const otherID = "0123456789abcdef0123456789abcdef01234567"
+
+func TestCluster_Redirects(t *testing.T) {
+	handler, _ := newClusterHandler(t, "127.0.0.1:7000")
+	sess := handler.NewSession()
+
+	assert.Equal(t, "CLUSTERDOWN Hash slot 5061 not served", exec(handler, sess, "SET bar 1"))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER ADDNODE "+otherID+" 127.0.0.1:7001"))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER ADDSLOTSRANGE 0 8191"))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER SETSLOTRANGE 8192 16383 NODE "+otherID))
+	assert.Contains(t, exec(handler, sess, "CLUSTER ADDSLOTS 100"), "already busy")
+
+	assert.Equal(t, "OK", exec(handler, sess, "SET bar 1"))
+	assert.Equal(t, "MOVED 12182 127.0.0.1:7001", exec(handler, sess, "SET foo 1"))
+	assert.Equal(t, "MOVED 12182 127.0.0.1:7001", exec(handler, sess, "GET foo"))
+	assert.Equal(t, errCrossSlot.Str, exec(handler, sess, "DEL bar foo"))
+	assert.Equal(t, "0", exec(handler, sess, "DEL {bar}a {bar}b"))
+	assert.Equal(t, "PONG", exec(handler, sess, "PING"))
+
+	// A transaction is redirected as a whole
+	exec(handler, sess, "MULTI")
+	assert.Equal(t, "QUEUED", exec(handler, sess, "INCR bar"))
+	assert.Contains(t, exec(handler, sess, "GET foo"), "MOVED")
+	assert.Contains(t, exec(handler, sess, "EXEC"), "EXECABORT")
+	assert.Equal(t, "1", exec(handler, sess, "GET bar"))
+
+	info := exec(handler, sess, "CLUSTER INFO")
+	assert.Contains(t, info, "cluster_state:ok")
+	assert.Contains(t, info, "cluster_known_nodes:2")
+	assert.Contains(t, info, "cluster_my_slots:8192")
+	slots := handler.Exec(sess, []string{"CLUSTER", "SLOTS"})
+	require.Len(t, slots.Elems, 2)
+	assert.Equal(t, []string{"127.0.0.1", "7001", otherID}, slots.Elems[1].Elems[2].Strings())
+	assert.Equal(t, "1", exec(handler, sess, "CLUSTER COUNTKEYSINSLOT 5061"))
+	assert.Equal(t, []string{"bar"}, handler.Exec(sess, []string{"CLUSTER", "GETKEYSINSLOT", "5061", "10"}).Strings())
+	assert.Contains(t, exec(handler, sess, "CLUSTER FORGET "+otherID), "still owns slots")
+
+	// Only admins change the cluster
+	require.Equal(t, "OK", exec(handler, sess, "ACL SETUSER app on nopass +@read +@write ~*"))
+	app := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, app, "AUTH app x"))
+	assert.Contains(t, exec(handler, app, "CLUSTER NODES"), "myself,master")
+	assert.Equal(t, "NOPERM User app has no permissions to run the 'cluster|delslots' command", exec(handler, app, "CLUSTER DELSLOTS 5061"))
+
+	assert.Equal(t, "OK", exec(handler, sess, "CLUSTER DELSLOTS 5061"))
+	assert.Equal(t, "CLUSTERDOWN Hash slot 5061 not served", exec(handler, sess, "GET bar"))
+	assert.Contains(t, exec(handler, sess, "CLUSTER INFO"), "cluster_state:fail")
+
+	other := NewHandler(store.NewKVStore(), nil)
+	assert.Equal(t, errClusterDisabled.Str, exec(other, other.NewSession(), "CLUSTER NODES"))
+	assert.Equal(t, "12182", exec(other, other.NewSession(), "CLUSTER KEYSLOT foo"))
+}
+
+func TestCluster_Migration(t *testing.T) {
+	source, _ := newClusterHandler(t, "127.0.0.1:7000")
+	target, _ := newClusterHandler(t, "127.0.0.1:7001")
+	src, dst := source.NewSession(), target.NewSession()
+	srcID, dstID := exec(source, src, "CLUSTER MYID"), exec(target, dst, "CLUSTER MYID")
+	require.Equal(t, "OK", exec(source, src, "CLUSTER ADDNODE "+dstID+" 127.0.0.1:7001"))
+	require.Equal(t, "OK", exec(target, dst, "CLUSTER ADDNODE "+srcID+" 127.0.0.1:7000"))
+	require.Equal(t, "OK", exec(source, src, "CLUSTER ADDSLOTSRANGE 0 16383"))
+	require.Equal(t, "OK", exec(target, dst, "CLUSTER SETSLOTRANGE 0 16383 NODE "+srcID))
+	exec(source, src, "SET {bar}a 1")
+	exec(source, src, "SET {bar}b 2")
+
+	require.Equal(t, "OK", exec(target, dst, "CLUSTER SETSLOT 5061 IMPORTING "+srcID))
+	require.Equal(t, "OK", exec(source, src, "CLUSTER SETSLOT 5061 MIGRATING "+dstID))
+
+	// The source serves the keys it has, and sends clients to the target
+	// for the others
+	assert.Equal(t, "1", exec(source, src, "GET {bar}a"))
+	assert.Equal(t, "ASK 5061 127.0.0.1:7001", exec(source, src, "GET {bar}new"))
+	assert.Equal(t, "ASK 5061 127.0.0.1:7001", exec(source, src, "EXISTS {bar}a {bar}new"))
+	assert.Equal(t, "MOVED 5061 127.0.0.1:7000", exec(target, dst, "SET {bar}new 3"), "the target only serves clients that ask")
+	require.Equal(t, "OK", exec(target, dst, "ASKING"))
+	assert.Equal(t, "OK", exec(target, dst, "SET {bar}new 3"))
+	assert.Equal(t, "MOVED 5061 127.0.0.1:7000", exec(target, dst, "GET {bar}new"), "ASKING lasts one command")
+
+	// Asked transactions run on the target
+	exec(target, dst, "ASKING")
+	exec(target, dst, "MULTI")
+	exec(target, dst, "INCR {bar}new")
+	assert.Equal(t, []string{"4"}, target.Exec(dst, []string{"EXEC"}).Strings())
+
+	// Keys are moved by hand here; MIGRATE needs a listening target
+	for _, key := range []string{"{bar}a", "{bar}b"} {
+		dump := source.Exec(src, []string{"DUMP", key}).Str
+		exec(target, dst, "ASKING")
+		require.Equal(t, "OK", target.Exec(dst, []string{"RESTORE", key, "0", dump}).Text())
+		assert.Contains(t, exec(source, src, "CLUSTER SETSLOT 5061 NODE "+dstID), "still hold keys")
+		exec(source, src, "DEL "+key)
+	}
+
+	require.Equal(t, "OK", exec(target, dst, "CLUSTER SETSLOT 5061 NODE "+dstID))
+	require.Equal(t, "OK", exec(source, src, "CLUSTER SETSLOT 5061 NODE "+dstID))
+	assert.Equal(t, "MOVED 5061 127.0.0.1:7001", exec(source, src, "GET {bar}a"))
+	assert.Equal(t, "1", exec(target, dst, "GET {bar}a"))
+	assert.NotContains(t, exec(source, src, "CLUSTER NODES"), "->-")
+	assert.NotContains(t, exec(target, dst, "CLUSTER NODES"), "-<-")
+}
+
+func TestCluster_Config(t *testing.T) {
+	handler, conf := newClusterHandler(t, "127.0.0.1:7000")
+	sess := handler.NewSession()
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER ADDNODE "+otherID+" 127.0.0.1:7001"))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER ADDSLOTS 0 1 2 5 9"))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER SETSLOTRANGE 10 20 NODE "+otherID))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER SETSLOT 5 MIGRATING "+otherID))
+	require.Equal(t, "OK", exec(handler, sess, "CLUSTER SETSLOT 30 IMPORTING "+otherID))
+	nodes := exec(handler, sess, "CLUSTER NODES")
+	assert.Contains(t, nodes, " 0-2 5 9 [5->-"+otherID+"] [30-<-"+otherID+"]\n")
+	assert.Contains(t, nodes, otherID+" 127.0.0.1:7001 master - 0 0 0 connected 10-20\n")
+
+	// A restarted node comes back with the same ID and view, at its new
+	// address
+	restarted := NewHandler(store.NewKVStore(), nil)
+	require.NoError(t, restarted.EnableCluster(conf, "127.0.0.1:7002"))
+	sess = restarted.NewSession()
+	assert.Equal(t, exec(handler, handler.NewSession(), "CLUSTER MYID"), exec(restarted, sess, "CLUSTER MYID"))
+	assert.Equal(t, strings.Replace(nodes, "127.0.0.1:7000", "127.0.0.1:7002", 1), exec(restarted, sess, "CLUSTER NODES"))
+
+	require.NoError(t, os.WriteFile(conf, []byte(otherID+" 127.0.0.1:7001 master - 0 0 0 connected 99999\n"), 0600))
+	assert.ErrorContains(t, NewHandler(nil, nil).EnableCluster(conf, "127.0.0.1:7000"), "nodes.conf:1")
+}
@@ -0,0 +1,422 @@
+package protocol
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// Commands for the list, hash, set and sorted set types. Like the string
+// commands they run against the call's Tx and log what they changed; the
+// command table takes care of locking and the memory limit.
+
+func errorValue(err error) Value {
+	return Error(err.Error())
+}
+
+func notInteger() Value {
+	return Error("ERR value is not an integer or out of range")
+}
+
+func (h *Handler) handleType(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("type")
+	}
+
+	kind, ok := c.tx.Type(args[0])
+	if !ok {
+		return SimpleString("none")
+	}
+	return SimpleString(kind.String())
+}
+
+func (h *Handler) handlePush(c *call, args []string) Value {
+	if len(args) < 2 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+
+	push := c.tx.RPush
+	if c.name == "LPUSH" {
+		push = c.tx.LPush
+	}
+	n, err := push(args[0], args[1:]...)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	c.log(append([]string{c.name}, args...)...)
+	c.notify(notifyList, strings.ToLower(c.name), args[0])
+	c.pushed = append(c.pushed, args[0])
+	return Integer(int64(n))
+}
+
+// handlePop implements LPOP and RPOP key [count]. Without a count it
+// replies with a single element, with one it replies with an array.
+func (h *Handler) handlePop(c *call, args []string) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return Error("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	popped, err := c.pop(args[0], count, c.name == "LPOP")
+	if err != nil {
+		return errorValue(err)
+	}
+	if popped == nil {
+		if len(args) == 2 {
+			return NullArray()
+		}
+		return NullBulk()
+	}
+
+	if len(args) == 2 {
+		return BulkStrings(popped)
+	}
+	return BulkString(popped[0])
+}
+
+// pop pops up to count elements from the head or the tail of the list at
+// key, and logs them.
+func (c *call) pop(key string, count int, head bool) ([]string, error) {
+	name, pop := "RPOP", c.tx.RPop
+	if head {
+		name, pop = "LPOP", c.tx.LPop
+	}
+	popped, err := pop(key, count)
+	if len(popped) > 0 {
+		c.log(name, key, strconv.Itoa(len(popped)))
+		c.notify(notifyList, strings.ToLower(name), key)
+		c.notifyIfGone(key)
+	}
+	return popped, err
+}
+
+func (h *Handler) handleLLen(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("llen")
+	}
+
+	n, err := c.tx.LLen(args[0])
+	if err != nil {
+		return errorValue(err)
+	}
+	return Integer(int64(n))
+}
+
+func (h *Handler) handleLRange(c *call, args []string) Value {
+	if len(args) != 3 {
+		return wrongArgs("lrange")
+	}
+
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return notInteger()
+	}
+
+	values, err := c.tx.LRange(args[0], start, stop)
+	if err != nil {
+		return errorValue(err)
+	}
+	return BulkStrings(values)
+}
+
+func (h *Handler) handleHSet(c *call, args []string) Value {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgs("hset")
+	}
+
+	added, err := c.tx.HSet(args[0], args[1:]...)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	c.log(append([]string{"HSET"}, args...)...)
+	c.notify(notifyHash, "hset", args[0])
+	return Integer(int64(added))
+}
+
+func (h *Handler) handleHGet(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("hget")
+	}
+
+	value, ok, err := c.tx.HGet(args[0], args[1])
+	if err != nil {
+		return errorValue(err)
+	}
+	if !ok {
+		return NullBulk()
+	}
+	return BulkString(value)
+}
+
+// handleHGetAll replies with a map in RESP3 and a flat field/value array in
+// RESP2, with fields in sorted order.
+func (h *Handler) handleHGetAll(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("hgetall")
+	}
+
+	hash, err := c.tx.HGetAll(args[0])
+	if err != nil {
+		return errorValue(err)
+	}
+
+	fields := make([]string, 0, len(hash))
+	for f := range hash {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	pairs := make([]Value, 0, 2*len(fields))
+	for _, f := range fields {
+		pairs = append(pairs, BulkString(f), BulkString(hash[f]))
+	}
+	return Map(pairs...)
+}
+
+func (h *Handler) handleHDel(c *call, args []string) Value {
+	if len(args) < 2 {
+		return wrongArgs("hdel")
+	}
+
+	removed, err := c.tx.HDel(args[0], args[1:]...)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	if removed > 0 {
+		c.log(append([]string{"HDEL"}, args...)...)
+		c.notify(notifyHash, "hdel", args[0])
+		c.notifyIfGone(args[0])
+	}
+	return Integer(int64(removed))
+}
+
+func (h *Handler) handleSAdd(c *call, args []string) Value {
+	if len(args) < 2 {
+		return wrongArgs("sadd")
+	}
+
+	added, err := c.tx.SAdd(args[0], args[1:]...)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	if added > 0 {
+		c.log(append([]string{"SADD"}, args...)...)
+		c.notify(notifySet, "sadd", args[0])
+	}
+	return Integer(int64(added))
+}
+
+func (h *Handler) handleSRem(c *call, args []string) Value {
+	if len(args) < 2 {
+		return wrongArgs("srem")
+	}
+
+	removed, err := c.tx.SRem(args[0], args[1:]...)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	if removed > 0 {
+		c.log(append([]string{"SREM"}, args...)...)
+		c.notify(notifySet, "srem", args[0])
+		c.notifyIfGone(args[0])
+	}
+	return Integer(int64(removed))
+}
+
+func (h *Handler) handleSMembers(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("smembers")
+	}
+
+	members, err := c.tx.SMembers(args[0])
+	if err != nil {
+		return errorValue(err)
+	}
+	return stringSet(members)
+}
+
+func (h *Handler) handleSInter(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("sinter")
+	}
+
+	members, err := c.tx.SInter(args...)
+	if err != nil {
+		return errorValue(err)
+	}
+	return stringSet(members)
+}
+
+func stringSet(members []string) Value {
+	elems := make([]Value, len(members))
+	for i, m := range members {
+		elems[i] = BulkString(m)
+	}
+	return Set(elems...)
+}
+
+// handleZAdd implements ZADD key score member [score member ...].
+func (h *Handler) handleZAdd(c *call, args []string) Value {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgs("zadd")
+	}
+
+	members := make([]store.ScoredMember, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, err := parseScore(args[i])
+		if err != nil {
+			return Error("ERR value is not a valid float")
+		}
+		members = append(members, store.ScoredMember{Member: args[i+1], Score: score})
+	}
+
+	added, err := c.tx.ZAdd(args[0], members...)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	c.log(append([]string{"ZADD"}, args...)...)
+	c.notify(notifyZSet, "zadd", args[0])
+	return Integer(int64(added))
+}
+
+// handleZRange implements ZRANGE key start stop [WITHSCORES].
+func (h *Handler) handleZRange(c *call, args []string) Value {
+	if len(args) != 3 && len(args) != 4 {
+		return wrongArgs("zrange")
+	}
+
+	withScores := false
+	if len(args) == 4 {
+		if !strings.EqualFold(args[3], "WITHSCORES") {
+			return Error("ERR syntax error")
+		}
+		withScores = true
+	}
+
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return notInteger()
+	}
+
+	members, err := c.tx.ZRange(args[0], start, stop)
+	if err != nil {
+		return errorValue(err)
+	}
+	return scoredMembers(c.sess, members, withScores)
+}
+
+// handleZRangeByScore implements
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count].
+func (h *Handler) handleZRangeByScore(c *call, args []string) Value {
+	if len(args) < 3 {
+		return wrongArgs("zrangebyscore")
+	}
+
+	minScore, err1 := parseScoreBound(args[1])
+	maxScore, err2 := parseScoreBound(args[2])
+	if err1 != nil || err2 != nil {
+		return Error("ERR min or max is not a float")
+	}
+
+	withScores := false
+	offset, count := 0, -1
+	for opts := args[3:]; len(opts) > 0; {
+		switch strings.ToUpper(opts[0]) {
+		case "WITHSCORES":
+			withScores = true
+			opts = opts[1:]
+		case "LIMIT":
+			if len(opts) < 3 {
+				return Error("ERR syntax error")
+			}
+			var err error
+			if offset, err = strconv.Atoi(opts[1]); err != nil {
+				return notInteger()
+			}
+			if count, err = strconv.Atoi(opts[2]); err != nil {
+				return notInteger()
+			}
+			opts = opts[3:]
+		default:
+			return Error("ERR syntax error")
+		}
+	}
+
+	members, err := c.tx.ZRangeByScore(args[0], minScore, maxScore, offset, count)
+	if err != nil {
+		return errorValue(err)
+	}
+	return scoredMembers(c.sess, members, withScores)
+}
+
+func (h *Handler) handleZRank(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("zrank")
+	}
+
+	rank, ok, err := c.tx.ZRank(args[0], args[1])
+	if err != nil {
+		return errorValue(err)
+	}
+	if !ok {
+		return NullBulk()
+	}
+	return Integer(int64(rank))
+}
+
+// scoredMembers formats a range reply. With scores, RESP2 gets a flat
+// member/score array and RESP3 an array of [member, score] pairs.
+func scoredMembers(sess *Session, members []store.ScoredMember, withScores bool) Value {
+	elems := make([]Value, 0, len(members))
+	for _, m := range members {
+		switch {
+		case !withScores:
+			elems = append(elems, BulkString(m.Member))
+		case sess.proto >= 3:
+			elems = append(elems, Array(BulkString(m.Member), Double(m.Score)))
+		default:
+			elems = append(elems, BulkString(m.Member), BulkString(formatDouble(m.Score)))
+		}
+	}
+	return Array(elems...)
+}
+
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, strconv.ErrSyntax
+	}
+	return f, nil
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE bound: a float, "-inf"/"+inf", or
+// either prefixed with "(" to make it exclusive.
+func parseScoreBound(s string) (store.ScoreBound, error) {
+	var b store.ScoreBound
+	if strings.HasPrefix(s, "(") {
+		b.Exclusive = true
+		s = s[1:]
+	}
+	f, err := parseScore(s)
+	b.Value = f
+	return b, err
+}
@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"strings"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// Consensus is a replicated log that writes go through instead of being
+// applied directly, as in Raft mode. The commands of a committed entry are
+// run on every node by Apply.
+type Consensus interface {
+	// Propose replicates cmds as one entry and returns their replies once
+	// it has been applied on this node.
+	Propose(cmds [][]string) ([]Value, error)
+	// ReadBarrier returns once the local store reflects every write that
+	// completed before the call, so a read served after it is
+	// linearizable.
+	ReadBarrier() error
+	// IsLeader reports whether this node is the leader, the only one that
+	// takes writes.
+	IsLeader() bool
+	AddServer(id, addr string) error
+	RemoveServer(id string) error
+	// Info describes the node as field/value pairs.
+	Info() []string
+}
+
+// SetConsensus routes reads and writes through c. The handler should have
+// no WAL then: the replicated log takes its place.
+func (h *Handler) SetConsensus(c Consensus) {
+	h.consensus = c
+}
+
+// Apply runs the commands of a committed log entry under one store lock and
+// returns their replies. The store must be a follower (see
+// store.KVStore.SetFollower), so that nothing in it expires by the clock of
+// the node: every node then gets the same result, whenever it applies the
+// entry. Keys are deleted by the DELs the leader proposes when they expire.
+func (h *Handler) Apply(cmds [][]string) []Value {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	var keys txKeys
+	for _, args := range cmds {
+		if cmd, ok := commands[strings.ToUpper(args[0])]; ok {
+			keys.add(cmd, args[1:])
+		}
+	}
+
+	c := &call{sess: h.local, nonBlocking: true}
+	replies := make([]Value, 0, len(cmds))
+	keys.update(h.store, func(tx *store.Tx) {
+		c.tx = tx
+		for _, args := range cmds {
+			name := strings.ToUpper(args[0])
+			cmd, ok := commands[name]
+			if !ok || cmd.flags&(cmdRead|cmdWrite) == 0 {
+				replies = append(replies, Error("ERR unknown command '"+name+"'"))
+				continue
+			}
+			c.name = name
+			replies = append(replies, cmd.run(h, c, args[1:]))
+		}
+		h.finish(c)
+	})
+	return replies
+}
+
+// execConsensus runs a command that touches the store in Raft mode. Writes
+// are proposed and run once committed; reads wait for a read barrier and
+// then run locally.
+func (h *Handler) execConsensus(c *call, cmd command, args []string) Value {
+	if cmd.flags&cmdWrite == 0 {
+		if err := h.consensus.ReadBarrier(); err != nil {
+			return errorValue(err)
+		}
+		var keys txKeys
+		keys.add(cmd, args)
+		var reply Value
+		keys.view(h.store, func(tx *store.Tx) {
+			c.tx = tx
+			reply = cmd.run(h, c, args)
+		})
+		return reply
+	}
+
+	if cmd.flags&cmdDenyOOM != 0 {
+		if err := h.freeMemory(); err != nil {
+			return errorValue(err)
+		}
+	}
+	var keys txKeys
+	keys.add(cmd, args)
+	cmds := h.expireFirst(keys)
+	cmds = append(cmds, absoluteExpiry(append([]string{c.name}, args...), time.Now()))
+	replies, err := h.consensus.Propose(cmds)
+	if err != nil {
+		return errorValue(err)
+	}
+	return replies[len(replies)-1]
+}
+
+// execConsensusMulti runs a transaction in Raft mode by proposing all its
+// commands as one entry.
+func (h *Handler) execConsensusMulti(sess *Session, m *multiState) Value {
+	if len(sess.watched) > 0 {
+		return Error("EXECABORT Transaction discarded because of: ERR WATCH is not supported in Raft mode")
+	}
+
+	now := time.Now()
+	var keys txKeys
+	cmds := make([][]string, 0, len(m.queued))
+	for _, q := range m.queued {
+		if q.cmd.flags&(cmdRead|cmdWrite) == 0 {
+			return Errorf("EXECABORT Transaction discarded because of: ERR '%s' can't be part of a transaction in Raft mode", strings.ToLower(q.name))
+		}
+		if q.cmd.flags&cmdDenyOOM != 0 {
+			if err := h.freeMemory(); err != nil {
+				return Error("EXECABORT Transaction discarded because of: " + err.Error())
+			}
+		}
+		keys.add(q.cmd, q.args)
+		cmds = append(cmds, absoluteExpiry(append([]string{q.name}, q.args...), now))
+	}
+	if len(cmds) == 0 {
+		return Array()
+	}
+
+	dels := h.expireFirst(keys)
+	replies, err := h.consensus.Propose(append(dels, cmds...))
+	if err != nil {
+		return errorValue(err)
+	}
+	return Array(replies[len(dels):]...)
+}
+
+// expireFirst returns DELs for the keys of a write that have expired, to
+// propose in the same entry ahead of it. Nodes don't expire keys on their
+// own in Raft mode, so the write would otherwise still find them.
+func (h *Handler) expireFirst(keys txKeys) [][]string {
+	var cmds [][]string
+	for _, key := range h.store.Expired(keys.keys) {
+		cmds = append(cmds, []string{"DEL", key})
+	}
+	return cmds
+}
+
+// expireBatch is the most expired keys ProposeExpired deletes per entry.
+const expireBatch = 20
+
+// ProposeExpired deletes expired keys through the log and returns how many
+// it deleted. In Raft mode the leader runs it in place of the store's
+// expiry cycle, which would remove keys on one node only. It goes on while
+// it finds a full batch.
+func (h *Handler) ProposeExpired() (int, error) {
+	total := 0
+	for {
+		keys := h.store.ExpiredKeys(expireBatch)
+		if len(keys) == 0 {
+			return total, nil
+		}
+		cmds := make([][]string, len(keys))
+		for i, key := range keys {
+			cmds[i] = []string{"DEL", key}
+		}
+		if _, err := h.consensus.Propose(cmds); err != nil {
+			return total, err
+		}
+		total += len(keys)
+		if len(keys) < expireBatch {
+			return total, nil
+		}
+	}
+}
+
+// handleRaft implements RAFT ADDNODE id addr, RAFT REMOVENODE id and
+// RAFT INFO.
+func (h *Handler) handleRaft(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("raft")
+	}
+	if h.consensus == nil {
+		return Error("ERR Raft mode is not enabled")
+	}
+
+	var err error
+	switch sub := strings.ToUpper(args[0]); {
+	case sub == "ADDNODE" && len(args) == 3:
+		err = h.consensus.AddServer(args[1], args[2])
+	case sub == "REMOVENODE" && len(args) == 2:
+		err = h.consensus.RemoveServer(args[1])
+	case sub == "INFO" && len(args) == 1:
+		info := h.consensus.Info()
+		pairs := make([]Value, len(info))
+		for i, s := range info {
+			pairs[i] = BulkString(s)
+		}
+		return Map(pairs...)
+	default:
+		return Errorf("ERR unknown subcommand or wrong number of arguments for '%s'", args[0])
+	}
+	if err != nil {
+		return errorValue(err)
+	}
+	return OK()
+}
@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expireOption describes the unit of an EX/PX/EXAT/PXAT option of SET, or
+// of the EXPIRE commands, and whether it counts from now.
+func expireOption(name string) (unit time.Duration, relative, ok bool) {
+	switch name {
+	case "EX", "EXPIRE":
+		return time.Second, true, true
+	case "PX", "PEXPIRE":
+		return time.Millisecond, true, true
+	case "EXAT", "EXPIREAT":
+		return time.Second, false, true
+	case "PXAT", "PEXPIREAT":
+		return time.Millisecond, false, true
+	}
+	return 0, false, false
+}
+
+// expiryAt turns n units, from now or from the Unix epoch, into an expiry
+// instant with the millisecond precision the WAL records. It reports false
+// if the instant doesn't fit in an int64 of milliseconds.
+func expiryAt(now time.Time, n int64, unit time.Duration, relative bool) (time.Time, bool) {
+	perUnit := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/perUnit || n < math.MinInt64/perUnit {
+		return time.Time{}, false
+	}
+	ms := n * perUnit
+	if relative {
+		base := now.UnixMilli()
+		if (ms > 0 && base > math.MaxInt64-ms) || (ms < 0 && base < math.MinInt64-ms) {
+			return time.Time{}, false
+		}
+		ms += base
+	}
+	return time.UnixMilli(ms), true
+}
+
+// handleExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. A time in
+// the past deletes the key. All of them are logged as PEXPIREAT, so replay
+// doesn't extend the TTL by however long the server was down.
+func (h *Handler) handleExpire(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+
+	key := args[0]
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return notInteger()
+	}
+	unit, relative, _ := expireOption(c.name)
+	at, ok := expiryAt(c.tx.Now(), n, unit, relative)
+	if !ok {
+		return Errorf("ERR invalid expire time in '%s' command", strings.ToLower(c.name))
+	}
+
+	if !c.tx.ExpireAt(key, at) {
+		return Integer(0)
+	}
+	logExpiry(c, key, at)
+	return Integer(1)
+}
+
+// logExpiry logs that key expires at at, which the command has just set.
+// An instant that has already passed deleted the key, and that is logged
+// as DEL: keys don't expire while the WAL is replayed.
+func logExpiry(c *call, key string, at time.Time) {
+	if !at.After(c.tx.Now()) {
+		c.log("DEL", key)
+		c.notify(notifyGeneric, "del", key)
+		return
+	}
+	c.log("PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10))
+	c.notify(notifyGeneric, "expire", key)
+}
+
+func (h *Handler) handlePersist(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("persist")
+	}
+
+	if !c.tx.Persist(args[0]) {
+		return Integer(0)
+	}
+	c.log("PERSIST", args[0])
+	c.notify(notifyGeneric, "persist", args[0])
+	return Integer(1)
+}
+
+// handleTTL implements TTL and PTTL.
+func (h *Handler) handleTTL(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+
+	if c.name == "PTTL" {
+		return Integer(c.tx.PTTL(args[0]))
+	}
+	return Integer(int64(c.tx.TTL(args[0])))
+}
+
+// absoluteExpiry rewrites a command that sets a relative TTL to the
+// equivalent absolute one, using the proposer's clock. In Raft mode every
+// node applies the command on its own, possibly much later when it
+// replays its log, and would otherwise start the TTL then. Commands that
+// don't parse are left for Apply to reject.
+func absoluteExpiry(cmd []string, now time.Time) []string {
+	name := strings.ToUpper(cmd[0])
+	switch {
+	case name == "EXPIRE" || name == "PEXPIRE" || name == "EXPIREAT":
+		if len(cmd) != 3 {
+			return cmd
+		}
+		unit, relative, _ := expireOption(name)
+		n, err := strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil {
+			return cmd
+		}
+		at, ok := expiryAt(now, n, unit, relative)
+		if !ok {
+			return cmd
+		}
+		return []string{"PEXPIREAT", cmd[1], strconv.FormatInt(at.UnixMilli(), 10)}
+
+	case name == "SET":
+		for i := 3; i+1 < len(cmd); i++ {
+			opt := strings.ToUpper(cmd[i])
+			if opt != "EX" && opt != "PX" {
+				continue
+			}
+			unit, _, _ := expireOption(opt)
+			n, err := strconv.ParseInt(cmd[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return cmd
+			}
+			at, ok := expiryAt(now, n, unit, true)
+			if !ok {
+				return cmd
+			}
+			out := append([]string(nil), cmd...)
+			out[i], out[i+1] = "PXAT", strconv.FormatInt(at.UnixMilli(), 10)
+			return out
+		}
+
+	case name == "RESTORE":
+		if len(cmd) < 4 {
+			return cmd
+		}
+		for _, opt := range cmd[4:] {
+			if strings.EqualFold(opt, "ABSTTL") {
+				return cmd
+			}
+		}
+		ttl, err := strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil || ttl <= 0 {
+			return cmd
+		}
+		at, ok := expiryAt(now, ttl, time.Millisecond, true)
+		if !ok {
+			return cmd
+		}
+		out := append([]string(nil), cmd...)
+		out[2] = strconv.FormatInt(at.UnixMilli(), 10)
+		return append(out, "ABSTTL")
+	}
+	return cmd
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_ExpireCommands(t *testing.T) {
+	handler, kvStore, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	inOneMinute := time.Now().Add(time.Minute)
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"SET key v", "+OK"},
+		{"PTTL key", ":-1"},
+		{"PTTL missing", ":-2"},
+		{"PEXPIRE key 100000", ":1"},
+		{"TTL key", ":99"},
+		{"PERSIST key", ":1"},
+		{"PERSIST key", ":0"},
+		{"TTL key", ":-1"},
+		{"EXPIREAT key " + strconv.FormatInt(inOneMinute.Unix(), 10), ":1"},
+		{"PEXPIREAT key " + strconv.FormatInt(inOneMinute.UnixMilli(), 10), ":1"},
+		{"PEXPIRE missing 100", ":0"},
+		{"EXPIRE key abc", "-ERR value is not an integer or out of range"},
+		{"PEXPIRE key 9223372036854775807", "-ERR invalid expire time in 'pexpire' command"},
+		{"EXPIREAT key 9223372036854775807", "-ERR invalid expire time in 'expireat' command"},
+		{"PTTL", "-ERR wrong number of arguments for 'pttl' command"},
+		{"EXPIRE key -1", ":1"},
+		{"EXISTS key", ":0"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, handler.Handle(tt.command), tt.command)
+	}
+	assert.Equal(t, 0, kvStore.Stats().Keys, "a TTL in the past deletes the key")
+}
+
+func TestHandler_SetAbsoluteExpiry(t *testing.T) {
+	handler, kvStore, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+	sess := handler.NewSession()
+
+	at := time.Now().Add(time.Minute)
+	reply := handler.Exec(sess, []string{"SET", "key", "v", "EXAT", strconv.FormatInt(at.Unix(), 10)})
+	assert.Equal(t, "OK", reply.Str)
+	assert.InDelta(t, 60, kvStore.TTL("key"), 1)
+
+	reply = handler.Exec(sess, []string{"SET", "key", "v", "PXAT", strconv.FormatInt(at.UnixMilli(), 10)})
+	assert.Equal(t, "OK", reply.Str)
+	assert.InDelta(t, time.Minute.Milliseconds(), kvStore.PTTL("key"), 50)
+
+	reply = handler.Exec(sess, []string{"SET", "key", "v", "PXAT", "0"})
+	assert.Equal(t, "ERR invalid expire time in 'set' command", reply.Str)
+	reply = handler.Exec(sess, []string{"SET", "key", "v", "EX", "10", "PXAT", "100"})
+	assert.Equal(t, "ERR syntax error", reply.Str)
+}
+
+// TTLs are logged as absolute instants, so a key whose TTL ran out while
+// the server was down is gone after replay instead of living on.
+func TestHandler_ExpiryDuringDowntime(t *testing.T) {
+	handler, _, wal, walPath := newStringsHandler(t)
+	sess := handler.NewSession()
+	for _, cmd := range [][]string{
+		{"SET", "short", "v", "PX", "50"},
+		{"SET", "expired", "v"},
+		{"PEXPIRE", "expired", "50"},
+		{"SET", "long", "v", "EX", "100"},
+		{"SET", "persisted", "v", "PX", "50"},
+		{"PERSIST", "persisted"},
+		{"SET", "past", "v", "PXAT", "1"},
+		{"SET", "reused", "v", "PX", "1"},
+	} {
+		require.NotEqual(t, TypeError, handler.Exec(sess, cmd).Type, "%v", cmd)
+	}
+
+	// The write finds the string expired and starts a new list
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, int64(1), handler.Exec(sess, []string{"RPUSH", "reused", "a"}).Int)
+	wal.Close()
+
+	// The server is down for longer than the short TTLs
+	time.Sleep(100 * time.Millisecond)
+
+	newStore := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(newStore))
+
+	assert.False(t, newStore.Exists("short"))
+	assert.False(t, newStore.Exists("expired"))
+	assert.True(t, newStore.Exists("persisted"))
+	assert.Equal(t, int64(-1), newStore.PTTL("persisted"))
+	assert.InDelta(t, 100*time.Second.Milliseconds()-100, newStore.PTTL("long"), 50)
+	assert.False(t, newStore.Exists("past"))
+	list, err := newStore.LRange("reused", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, list)
+}
+
+func TestAbsoluteExpiry(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		cmd  []string
+		want []string
+	}{
+		{[]string{"EXPIRE", "k", "10"}, []string{"PEXPIREAT", "k", "1700000010000"}},
+		{[]string{"pexpire", "k", "10"}, []string{"PEXPIREAT", "k", "1700000000010"}},
+		{[]string{"EXPIREAT", "k", "1800000000"}, []string{"PEXPIREAT", "k", "1800000000000"}},
+		{[]string{"PEXPIREAT", "k", "5"}, []string{"PEXPIREAT", "k", "5"}},
+		{[]string{"EXPIRE", "k", "soon"}, []string{"EXPIRE", "k", "soon"}},
+		{[]string{"SET", "k", "v", "NX", "ex", "2"}, []string{"SET", "k", "v", "NX", "PXAT", "1700000002000"}},
+		{[]string{"SET", "k", "v", "PX", "0"}, []string{"SET", "k", "v", "PX", "0"}},
+		{[]string{"SET", "k", "EX"}, []string{"SET", "k", "EX"}},
+		{[]string{"INCR", "k"}, []string{"INCR", "k"}},
+		{[]string{"RESTORE", "k", "500", "p", "REPLACE"}, []string{"RESTORE", "k", "1700000000500", "p", "REPLACE", "ABSTTL"}},
+		{[]string{"RESTORE", "k", "500", "p", "abstTL"}, []string{"RESTORE", "k", "500", "p", "abstTL"}},
+		{[]string{"RESTORE", "k", "0", "p"}, []string{"RESTORE", "k", "0", "p"}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, absoluteExpiry(tt.cmd, now), "%v", tt.cmd)
+	}
+}
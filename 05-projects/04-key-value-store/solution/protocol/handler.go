@@ -1,162 +1,885 @@
 package protocol
 
 import (
-	"fmt"
+	"log"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alyxpink/go-training/kvstore/persistence"
 	"github.com/alyxpink/go-training/kvstore/store"
 )
 
+const serverVersion = "7.0.0"
+
 type Handler struct {
-	store *store.KVStore
-	wal   *persistence.WAL
+	store  *store.KVStore
+	wal    *persistence.WAL
+	pubsub *pubsub
+	local  *Session
+	nextID atomic.Int64
+	stats  *stats
+
+	snapshots *persistence.SnapshotManager
+
+	blocking *blocking
+	acl      *acl
+	cluster  *clusterState // nil unless cluster mode is enabled
+	events   atomic.Uint32 // notifyFlags of the keyspace events to publish
+
+	replication Replication
+	consensus   Consensus
+
+	// writeMu is read-locked while a write is applied to the store and
+	// logged, and locked by whatever needs no write in flight: snapshots,
+	// replication, slot changes and Raft. Writes are ordered by their
+	// shard locks instead, under which they are logged, so the WAL records
+	// writes to a key in the order the store applied them. Pushes and pops
+	// don't commute, so replaying them out of order would be wrong.
+	writeMu sync.RWMutex
+}
+
+// Session holds the state of a single client connection.
+type Session struct {
+	id      int64
+	proto   int
+	name    string
+	user    string // set by AUTH; see acl.go
+	asking  bool   // set by ASKING for the next command; see cluster.go
+	closing bool
+	handoff func(conn net.Conn, r *Reader, w *Writer)
+
+	blockHook func(cancel func()) (stop func())
+
+	multi   *multiState       // non-nil between MULTI and EXEC
+	watched map[string]uint64 // WATCHed keys and their versions
+
+	channels map[string]struct{} // subscribed channels
+	patterns map[string]struct{} // subscribed patterns
+
+	// Messages waiting to be written to the client; see pubsub.go
+	pushMu     sync.Mutex
+	pushes     []Value
+	pushReady  chan struct{}
+	dropped    chan struct{}
+	overflowed bool
 }
 
 func NewHandler(store *store.KVStore, wal *persistence.WAL) *Handler {
-	return &Handler{store: store, wal: wal}
+	h := &Handler{store: store, wal: wal, pubsub: newPubSub(), blocking: newBlocking(), acl: newACL(), stats: newStats()}
+	h.local = h.newSession()
+
+	// Keys removed by active expiry or eviction are logged like any other
+	// delete, and have events of their own
+	if store != nil {
+		store.SetExpireHook(func(keys []string) {
+			h.logRemoved(keys)
+			h.notifyRemoved(notifyExpired, "expired", keys)
+		})
+		store.SetEvictHook(func(keys []string) {
+			h.logRemoved(keys)
+			h.notifyRemoved(notifyEvicted, "evicted", keys)
+		})
+	}
+	return h
+}
+
+func (h *Handler) logRemoved(keys []string) {
+	if h.wal == nil {
+		return
+	}
+	if err := h.wal.AppendCommand(append([]string{"DEL"}, keys...)...); err != nil {
+		log.Printf("WAL append for removed keys failed: %v", err)
+	}
+}
+
+// finish completes a write at the end of its Tx, before the Tx releases
+// its locks: it logs the call's writes, publishes its keyspace events and
+// then serves the clients blocked on lists it pushed to. Callers hold
+// writeMu, and call commit once they have released it.
+func (h *Handler) finish(c *call) {
+	h.logWrites(c)
+	h.publishEvents(c.events)
+	h.serveBlocked(c.tx, c.pushed)
+}
+
+// logWrites writes the writes of one command or transaction to the WAL as a
+// single record, without waiting for it to reach the disk. Callers hold
+// writeMu and the locks of the call's Tx.
+func (h *Handler) logWrites(c *call) {
+	if len(c.writes) == 0 || h.wal == nil {
+		return
+	}
+	seq, err := h.wal.Log(c.writes)
+	if err != nil {
+		log.Printf("WAL append for %s failed: %v", c.writes[0][0], err)
+		return
+	}
+	c.logged = seq
+}
+
+// commit waits until the WAL has made the call's writes as durable as its
+// fsync policy asks. It runs after writeMu and the Tx are released, so that
+// writers arriving meanwhile can log theirs and share the next fsync.
+func (h *Handler) commit(c *call) {
+	h.commitSeq(c.logged)
+}
+
+func (h *Handler) commitSeq(seq uint64) {
+	if seq == 0 || h.wal == nil {
+		return
+	}
+	if err := h.wal.Commit(seq); err != nil {
+		log.Printf("WAL fsync failed: %v", err)
+	}
+}
+
+// NewSession creates the state for a new client connection.
+func (h *Handler) NewSession() *Session {
+	h.stats.connections.Add(1)
+	h.stats.clients.Add(1)
+	return h.newSession()
+}
+
+func (h *Handler) newSession() *Session {
+	return &Session{
+		id:        h.nextID.Add(1),
+		proto:     2,
+		pushReady: make(chan struct{}, 1),
+		dropped:   make(chan struct{}),
+	}
 }
 
+// CloseSession releases the session's watches and subscriptions. It must
+// be called once the connection is gone.
+func (h *Handler) CloseSession(sess *Session) {
+	h.stats.clients.Add(-1)
+	sess.multi = nil
+	h.unwatchAll(sess)
+	h.unsubscribeAll(sess)
+}
+
+// Protocol returns the RESP version negotiated with HELLO.
+func (s *Session) Protocol() int { return s.proto }
+
+// Closing reports whether the client asked to close the connection.
+func (s *Session) Closing() bool { return s.closing }
+
+// SetBlockHook registers fn to be called when a command of the session
+// blocks, such as BLPOP. fn should call cancel if the client goes away
+// meanwhile, which ends the command as if it timed out. The function it
+// returns is called once the command is done, before Exec returns.
+func (s *Session) SetBlockHook(fn func(cancel func()) (stop func())) {
+	s.blockHook = fn
+}
+
+// Handle executes a single inline command and returns the RESP2 reply
+// without its trailing CRLF. Arguments are split on whitespace and, for
+// SET, the words after the key are joined into the value up to the first
+// that is an option of SET, so "SET k v EX 10" still sets a TTL.
 func (h *Handler) Handle(line string) string {
-	// Parse command
 	parts := strings.Fields(line)
 	if len(parts) == 0 {
 		return "-ERR empty command"
 	}
 
-	command := strings.ToUpper(parts[0])
-	args := parts[1:]
-
-	// Route to appropriate handler
-	switch command {
-	case "SET":
-		return h.handleSet(args)
-	case "GET":
-		return h.handleGet(args)
-	case "DEL":
-		return h.handleDel(args)
-	case "EXISTS":
-		return h.handleExists(args)
-	case "KEYS":
-		return h.handleKeys(args)
-	case "EXPIRE":
-		return h.handleExpire(args)
-	case "TTL":
-		return h.handleTTL(args)
+	if strings.EqualFold(parts[0], "SET") && len(parts) > 3 {
+		end := 3
+		for end < len(parts) && !isSetOption(parts[end]) {
+			end++
+		}
+		value := strings.Join(parts[2:end], " ")
+		parts = append([]string{parts[0], parts[1], value}, parts[end:]...)
+	}
+
+	reply := h.Exec(h.local, parts)
+	return strings.TrimSuffix(string(reply.AppendRESP(nil, h.local.proto)), "\r\n")
+}
+
+// isSetOption reports whether word is one of the options of SET.
+func isSetOption(word string) bool {
+	switch strings.ToUpper(word) {
+	case "NX", "XX", "EX", "PX", "EXAT", "PXAT":
+		return true
+	}
+	return false
+}
+
+type cmdFlags int
+
+const (
+	cmdRead     cmdFlags = 1 << iota // reads the store
+	cmdWrite                         // modifies the store
+	cmdDenyOOM                       // may grow the dataset, rejected over the memory limit
+	cmdPubSub                        // allowed while a RESP2 client is subscribed
+	cmdNoMulti                       // can't be queued by MULTI
+	cmdBlocking                      // may wait for another client's write
+	cmdAdmin                         // administers the server, for ACLs
+)
+
+type command struct {
+	run   func(h *Handler, c *call, args []string) Value
+	flags cmdFlags
+	keys  keySpec
+}
+
+// keySpec says which arguments of a command are keys, as in Redis: every
+// step-th argument from first to last, where a negative last counts from
+// the end, or those find returns for commands whose keys follow options.
+// Only the shards of those keys are locked while the command runs; a store
+// command without keys works on the whole keyspace.
+type keySpec struct {
+	first, last, step int
+	find              func(args []string) []string
+}
+
+var (
+	noKeys         = keySpec{}
+	firstKey       = keySpec{first: 0, last: 0, step: 1}
+	allKeys        = keySpec{first: 0, last: -1, step: 1}
+	keysBeforeLast = keySpec{first: 0, last: -2, step: 1} // the last argument is a timeout
+)
+
+// none reports whether the command takes no keys.
+func (k keySpec) none() bool {
+	return k.step == 0 && k.find == nil
+}
+
+func (k keySpec) keys(args []string) []string {
+	if k.find != nil {
+		return k.find(args)
+	}
+	if k.step == 0 || k.first >= len(args) {
+		return nil
+	}
+	last := k.last
+	if last < 0 {
+		last += len(args)
+	}
+	last = min(last, len(args)-1)
+
+	var keys []string
+	for i := k.first; i <= last; i += k.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// txKeys collects the keys a batch of commands uses, so that a Tx only locks
+// their shards. all is set once one of them works on the whole keyspace.
+type txKeys struct {
+	keys []string
+	all  bool
+}
+
+func (t *txKeys) add(cmd command, args []string) {
+	switch {
+	case cmd.flags&(cmdRead|cmdWrite) == 0:
+	case cmd.keys.none():
+		t.all = true
 	default:
-		return "-ERR unknown command '" + command + "'"
+		t.keys = append(t.keys, cmd.keys.keys(args)...)
 	}
 }
 
-func (h *Handler) handleSet(args []string) string {
-	if len(args) < 2 {
-		return "-ERR wrong number of arguments for 'set' command"
+func (t *txKeys) update(s *store.KVStore, fn func(tx *store.Tx)) {
+	if t.all {
+		s.Update(fn)
+	} else {
+		s.UpdateKeys(t.keys, fn)
 	}
+}
 
-	key := args[0]
-	value := strings.Join(args[1:], " ")
+func (t *txKeys) view(s *store.KVStore, fn func(tx *store.Tx)) {
+	if t.all {
+		s.View(fn)
+	} else {
+		s.ViewKeys(t.keys, fn)
+	}
+}
 
-	h.store.Set(key, value)
+// commands lists everything Exec can run outside of the transaction
+// commands, which manage the session rather than run in it.
+var commands = map[string]command{
+	"SET":           {(*Handler).handleSet, cmdWrite | cmdDenyOOM, firstKey},
+	"GET":           {(*Handler).handleGet, cmdRead, firstKey},
+	"SETNX":         {(*Handler).handleSetNX, cmdWrite | cmdDenyOOM, firstKey},
+	"GETSET":        {(*Handler).handleGetSet, cmdWrite | cmdDenyOOM, firstKey},
+	"INCR":          {(*Handler).handleIncr, cmdWrite | cmdDenyOOM, firstKey},
+	"DECR":          {(*Handler).handleIncr, cmdWrite | cmdDenyOOM, firstKey},
+	"INCRBY":        {(*Handler).handleIncr, cmdWrite | cmdDenyOOM, firstKey},
+	"DECRBY":        {(*Handler).handleIncr, cmdWrite | cmdDenyOOM, firstKey},
+	"DEL":           {(*Handler).handleDel, cmdWrite, allKeys},
+	"EXISTS":        {(*Handler).handleExists, cmdRead, allKeys},
+	"KEYS":          {(*Handler).handleKeys, cmdRead, noKeys},
+	"SCAN":          {(*Handler).handleScan, cmdRead, noKeys},
+	"EXPIRE":        {(*Handler).handleExpire, cmdWrite, firstKey},
+	"PEXPIRE":       {(*Handler).handleExpire, cmdWrite, firstKey},
+	"EXPIREAT":      {(*Handler).handleExpire, cmdWrite, firstKey},
+	"PEXPIREAT":     {(*Handler).handleExpire, cmdWrite, firstKey},
+	"PERSIST":       {(*Handler).handlePersist, cmdWrite, firstKey},
+	"TTL":           {(*Handler).handleTTL, cmdRead, firstKey},
+	"PTTL":          {(*Handler).handleTTL, cmdRead, firstKey},
+	"TYPE":          {(*Handler).handleType, cmdRead, firstKey},
+	"LPUSH":         {(*Handler).handlePush, cmdWrite | cmdDenyOOM, firstKey},
+	"RPUSH":         {(*Handler).handlePush, cmdWrite | cmdDenyOOM, firstKey},
+	"LPOP":          {(*Handler).handlePop, cmdWrite, firstKey},
+	"RPOP":          {(*Handler).handlePop, cmdWrite, firstKey},
+	"BLPOP":         {(*Handler).handleBlockingPop, cmdWrite | cmdBlocking, keysBeforeLast},
+	"BRPOP":         {(*Handler).handleBlockingPop, cmdWrite | cmdBlocking, keysBeforeLast},
+	"LLEN":          {(*Handler).handleLLen, cmdRead, firstKey},
+	"LRANGE":        {(*Handler).handleLRange, cmdRead, firstKey},
+	"HSET":          {(*Handler).handleHSet, cmdWrite | cmdDenyOOM, firstKey},
+	"HGET":          {(*Handler).handleHGet, cmdRead, firstKey},
+	"HGETALL":       {(*Handler).handleHGetAll, cmdRead, firstKey},
+	"HDEL":          {(*Handler).handleHDel, cmdWrite, firstKey},
+	"SADD":          {(*Handler).handleSAdd, cmdWrite | cmdDenyOOM, firstKey},
+	"SREM":          {(*Handler).handleSRem, cmdWrite, firstKey},
+	"SMEMBERS":      {(*Handler).handleSMembers, cmdRead, firstKey},
+	"SINTER":        {(*Handler).handleSInter, cmdRead, allKeys},
+	"ZADD":          {(*Handler).handleZAdd, cmdWrite | cmdDenyOOM, firstKey},
+	"ZRANGE":        {(*Handler).handleZRange, cmdRead, firstKey},
+	"ZRANGEBYSCORE": {(*Handler).handleZRangeByScore, cmdRead, firstKey},
+	"ZRANK":         {(*Handler).handleZRank, cmdRead, firstKey},
+	"SUBSCRIBE":     {(*Handler).handleSubscribe, cmdPubSub, noKeys},
+	"PSUBSCRIBE":    {(*Handler).handleSubscribe, cmdPubSub, noKeys},
+	"UNSUBSCRIBE":   {(*Handler).handleUnsubscribe, cmdPubSub, noKeys},
+	"PUNSUBSCRIBE":  {(*Handler).handleUnsubscribe, cmdPubSub, noKeys},
+	"PUBLISH":       {(*Handler).handlePublish, 0, noKeys},
+	"PING":          {(*Handler).handlePing, cmdPubSub, noKeys},
+	"ECHO":          {(*Handler).handleEcho, 0, noKeys},
+	"INFO":          {(*Handler).handleInfo, 0, noKeys},
+	"HELLO":         {(*Handler).handleHello, 0, noKeys},
+	"CLIENT":        {(*Handler).handleClient, 0, noKeys},
+	"SELECT":        {(*Handler).handleSelect, 0, noKeys},
+	"COMMAND":       {(*Handler).handleCommand, 0, noKeys},
+	"QUIT":          {(*Handler).handleQuit, cmdPubSub, noKeys},
+	"AUTH":          {(*Handler).handleAuth, 0, noKeys},
+	"ACL":           {(*Handler).handleACL, cmdAdmin, noKeys},
+	"REPLICAOF":     {(*Handler).handleReplicaOf, cmdNoMulti | cmdAdmin, noKeys},
+	"SLAVEOF":       {(*Handler).handleReplicaOf, cmdNoMulti | cmdAdmin, noKeys},
+	"PSYNC":         {(*Handler).handlePSync, cmdNoMulti | cmdAdmin, noKeys},
+	"RAFT":          {(*Handler).handleRaft, cmdNoMulti | cmdAdmin, noKeys},
+	"CLUSTER":       {(*Handler).handleCluster, cmdNoMulti, noKeys},
+	"ASKING":        {(*Handler).handleAsking, cmdNoMulti, noKeys},
+	"DUMP":          {(*Handler).handleDump, cmdRead, firstKey},
+	"RESTORE":       {(*Handler).handleRestore, cmdWrite | cmdDenyOOM, firstKey},
+	"MIGRATE":       {(*Handler).handleMigrate, cmdWrite | cmdNoMulti, keySpec{find: migrateKeys}},
+}
 
-	// Log to WAL
-	h.wal.Append(fmt.Sprintf("SET %s %s", key, value))
+// lookupCommand returns the command named name. WATCH, which Exec runs
+// itself, is described as a command with keys, for the checks made before
+// running it.
+func lookupCommand(name string) (command, bool) {
+	if name == "WATCH" {
+		return command{keys: allKeys}, true
+	}
+	cmd, ok := commands[name]
+	return cmd, ok
+}
 
-	return "+OK"
+// call is what a command runs with: the session that sent it and, if it
+// uses the store, a Tx. Writes and keyspace events are collected and
+// handled once the Tx ends.
+type call struct {
+	sess   *Session
+	name   string
+	tx     *store.Tx
+	writes [][]string
+	logged uint64 // WAL sequence number of the writes, to commit before replying
+	events []keyEvent
+	pushed []string // lists pushed to, whose blocked clients to serve
+
+	nonBlocking bool    // runs in a transaction, which can't wait
+	block       *waiter // set by a blocking command that has to wait
 }
 
-func (h *Handler) handleGet(args []string) string {
-	if len(args) < 1 {
-		return "-ERR wrong number of arguments for 'get' command"
+// log records a write to append to the WAL.
+func (c *call) log(args ...string) {
+	c.writes = append(c.writes, args)
+}
+
+// Exec runs one command for the given session and returns its reply. Inside
+// MULTI, commands are queued instead and run by EXEC.
+func (h *Handler) Exec(sess *Session, args []string) (reply Value) {
+	if len(args) == 0 {
+		return Error("ERR empty command")
 	}
 
-	key := args[0]
-	value, ok := h.store.Get(key)
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	// Queued commands are counted when EXEC runs them
+	start := time.Now()
+	queued := false
+	defer func() {
+		if !queued {
+			h.stats.record(name, reply, start)
+		}
+	}()
+
+	if reply, ok := h.authorize(sess, name, args); !ok {
+		if sess.multi != nil {
+			sess.multi.failed = true
+		}
+		return reply
+	}
+
+	if h.cluster != nil {
+		// ASKING only applies to the next command, or transaction
+		defer func() {
+			if name != "ASKING" && sess.multi == nil {
+				sess.asking = false
+			}
+		}()
+		if cmd, ok := lookupCommand(name); ok {
+			if _, reply, ok := h.cluster.route(cmd.keys.keys(args), sess.asking); !ok {
+				if sess.multi != nil {
+					sess.multi.failed = true
+				}
+				return reply
+			}
+		}
+	}
+
+	// A RESP2 connection can't tell replies from messages, so once
+	// subscribed it may only manage its subscriptions
+	if sess.subscriptions() > 0 && sess.proto < 3 && commands[name].flags&cmdPubSub == 0 {
+		return Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name))
+	}
+
+	switch name {
+	case "MULTI":
+		return h.handleMulti(sess, args)
+	case "EXEC":
+		return h.handleExec(sess, args)
+	case "DISCARD":
+		return h.handleDiscard(sess, args)
+	case "WATCH":
+		return h.handleWatch(sess, args)
+	case "UNWATCH":
+		return h.handleUnwatch(sess, args)
+	}
+
+	cmd, ok := commands[name]
 	if !ok {
-		return "$-1"
+		if sess.multi != nil {
+			sess.multi.failed = true
+		}
+		return Error("ERR unknown command '" + name + "'")
+	}
+	if sess.multi != nil {
+		if cmd.flags&cmdNoMulti != 0 {
+			sess.multi.failed = true
+			return Error("ERR Command not allowed inside a transaction")
+		}
+		sess.multi.queue(cmd, name, args)
+		queued = true
+		return SimpleString("QUEUED")
 	}
 
-	// Redis bulk string format: $<length>\r\n<data>
-	return fmt.Sprintf("$%d\r\n%s", len(value), value)
+	c := &call{sess: sess, name: name}
+	switch {
+	case cmd.flags&cmdWrite != 0 && h.readOnly():
+		return Error("READONLY You can't write against a read only replica.")
+	case cmd.flags&cmdWrite != 0 && writeTooLarge([][]string{args}):
+		return errWriteTooLarge
+	case cmd.flags&cmdBlocking != 0 && h.consensus != nil:
+		return Errorf("ERR '%s' is not supported in Raft mode", strings.ToLower(name))
+	case cmd.flags&(cmdRead|cmdWrite) != 0 && h.consensus != nil:
+		return h.execConsensus(c, cmd, args)
+	case cmd.flags&cmdWrite != 0:
+		reply := h.execWrite(c, cmd, args)
+		if c.block != nil {
+			return h.wait(sess, c.block)
+		}
+		return reply
+	case cmd.flags&cmdRead != 0:
+		var keys txKeys
+		keys.add(cmd, args)
+		var reply Value
+		keys.view(h.store, func(tx *store.Tx) {
+			if r, ok := h.route(c, tx, keys); !ok {
+				reply = r
+				return
+			}
+			c.tx = tx
+			reply = cmd.run(h, c, args)
+		})
+		return reply
+	default:
+		return cmd.run(h, c, args)
+	}
 }
 
-func (h *Handler) handleDel(args []string) string {
-	if len(args) < 1 {
-		return "-ERR wrong number of arguments for 'del' command"
+func (h *Handler) execWrite(c *call, cmd command, args []string) Value {
+	// Deferred first, so it runs once writeMu is released
+	defer h.commit(c)
+	h.writeMu.RLock()
+	defer h.writeMu.RUnlock()
+
+	if cmd.flags&cmdDenyOOM != 0 {
+		if err := h.freeMemory(); err != nil {
+			return errorValue(err)
+		}
+	}
+
+	var keys txKeys
+	keys.add(cmd, args)
+	var reply Value
+	keys.update(h.store, func(tx *store.Tx) {
+		if r, ok := h.route(c, tx, keys); !ok {
+			reply = r
+			return
+		}
+		c.tx = tx
+		reply = cmd.run(h, c, args)
+		h.finish(c)
+	})
+	return reply
+}
+
+// route checks, in cluster mode, that this node serves the keys a call is
+// about to use in tx, and if not returns the redirection to reply with.
+func (h *Handler) route(c *call, tx *store.Tx, keys txKeys) (Value, bool) {
+	if h.cluster == nil {
+		return Value{}, true
+	}
+	return h.routeTx(c, tx, keys.keys)
+}
+
+// freeMemory makes room for a write that may grow the dataset. A node
+// evicting on its own would drift from its copies, so in Raft mode the
+// keys to evict are deleted through the log, and on a replica not at all:
+// as in Redis, the leader's evictions reach it as deletes.
+func (h *Handler) freeMemory() error {
+	switch {
+	case h.readOnly():
+		return nil
+	case h.consensus == nil:
+		return h.store.FreeMemory()
+	}
+	for {
+		key, err := h.store.EvictionCandidate()
+		if err != nil || key == "" {
+			return err
+		}
+		if _, err := h.consensus.Propose([][]string{{"DEL", key}}); err != nil {
+			return err
+		}
+	}
+}
+
+var errWriteTooLarge = Error("ERR write is too large for the log")
+
+// writeTooLarge reports whether the commands of a write come to more than
+// the WAL takes for one. It is checked before they run: a write applied but
+// not logged would be acknowledged and then lost.
+func writeTooLarge(cmds [][]string) bool {
+	return persistence.RecordSize(cmds) > persistence.MaxWriteSize
+}
+
+// readOnly reports whether clients are kept from writing because the store
+// follows a replication leader.
+func (h *Handler) readOnly() bool {
+	return h.replication != nil && h.replication.IsReplica()
+}
+
+func wrongArgs(command string) Value {
+	return Errorf("ERR wrong number of arguments for '%s' command", command)
+}
+
+// handleSet implements
+// SET key value [NX | XX] [EX seconds | PX ms | EXAT unix-seconds | PXAT unix-ms].
+func (h *Handler) handleSet(c *call, args []string) Value {
+	if len(args) < 2 {
+		return wrongArgs("set")
 	}
 
 	key := args[0]
-	deleted := h.store.Del(key)
+	value := args[1]
+
+	cond := store.SetAlways
+	var expiresAt time.Time
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		unit, relative, isExpiry := expireOption(opt)
+		switch {
+		case opt == "NX" && cond == store.SetAlways:
+			cond = store.SetIfAbsent
+		case opt == "XX" && cond == store.SetAlways:
+			cond = store.SetIfPresent
+		case isExpiry && expiresAt.IsZero() && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return notInteger()
+			}
+			at, ok := expiryAt(c.tx.Now(), n, unit, relative)
+			if n <= 0 || !ok {
+				return Error("ERR invalid expire time in 'set' command")
+			}
+			expiresAt = at
+		default:
+			return Error("ERR syntax error")
+		}
+	}
 
-	// Log to WAL
-	if deleted {
-		h.wal.Append(fmt.Sprintf("DEL %s", key))
-		return ":1"
+	if !c.tx.SetWith(key, value, cond, expiresAt) {
+		return NullBulk()
 	}
 
-	return ":0"
+	// Log to WAL. The condition has been checked, so only the effect is
+	// logged, with the expiry alongside so the record applies atomically
+	c.notify(notifyString, "set", key)
+	switch {
+	case expiresAt.IsZero():
+		c.log("SET", key, value)
+		c.clearExpiry(key)
+	case !expiresAt.After(c.tx.Now()):
+		c.log("DEL", key)
+		c.notify(notifyGeneric, "del", key)
+	default:
+		c.log("SET", key, value, "PXAT", strconv.FormatInt(expiresAt.UnixMilli(), 10))
+		c.notify(notifyGeneric, "expire", key)
+	}
+	return OK()
 }
 
-func (h *Handler) handleExists(args []string) string {
-	if len(args) < 1 {
-		return "-ERR wrong number of arguments for 'exists' command"
+func (h *Handler) handleGet(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("get")
 	}
 
 	key := args[0]
-	exists := h.store.Exists(key)
+	value, ok, err := c.tx.GetString(key)
+	if err != nil {
+		return errorValue(err)
+	}
+	if !ok {
+		return NullBulk()
+	}
+
+	return BulkString(value)
+}
 
-	if exists {
-		return ":1"
+func (h *Handler) handleDel(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("del")
 	}
-	return ":0"
+
+	var deleted int64
+	for _, key := range args {
+		if c.tx.Del(key) {
+			// Log to WAL
+			c.log("DEL", key)
+			c.notify(notifyGeneric, "del", key)
+			deleted++
+		}
+	}
+
+	return Integer(deleted)
 }
 
-func (h *Handler) handleKeys(args []string) string {
+func (h *Handler) handleExists(c *call, args []string) Value {
 	if len(args) < 1 {
-		return "-ERR wrong number of arguments for 'keys' command"
+		return wrongArgs("exists")
+	}
+
+	var count int64
+	for _, key := range args {
+		if c.tx.Exists(key) {
+			count++
+		}
 	}
 
-	pattern := args[0]
-	keys := h.store.Keys(pattern)
+	return Integer(count)
+}
 
-	// Redis array format: *<count>\r\n$<len>\r\n<key>\r\n...
-	result := fmt.Sprintf("*%d", len(keys))
-	for _, key := range keys {
-		result += fmt.Sprintf("\r\n$%d\r\n%s", len(key), key)
+func (h *Handler) handleKeys(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("keys")
 	}
 
-	return result
+	return BulkStrings(c.tx.Keys(args[0]))
 }
 
-func (h *Handler) handleExpire(args []string) string {
-	if len(args) < 2 {
-		return "-ERR wrong number of arguments for 'expire' command"
+// handleScan implements SCAN cursor [MATCH pattern] [COUNT count]. The reply
+// is the next cursor and a batch of keys.
+func (h *Handler) handleScan(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("scan")
 	}
 
-	key := args[0]
-	seconds, err := strconv.Atoi(args[1])
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
 	if err != nil {
-		return "-ERR value is not an integer or out of range"
+		return Error("ERR invalid cursor")
 	}
 
-	success := h.store.Expire(key, seconds)
+	pattern, count := "", 0
+	for opts := args[1:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			return Error("ERR syntax error")
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "MATCH":
+			pattern = opts[1]
+		case "COUNT":
+			if count, err = strconv.Atoi(opts[1]); err != nil {
+				return notInteger()
+			}
+			if count < 1 {
+				return Error("ERR syntax error")
+			}
+		default:
+			return Error("ERR syntax error")
+		}
+	}
 
-	// Log to WAL
-	if success {
-		h.wal.Append(fmt.Sprintf("EXPIRE %s %d", key, seconds))
-		return ":1"
+	keys, next := c.tx.Scan(cursor, pattern, count)
+	return Array(BulkString(strconv.FormatUint(next, 10)), BulkStrings(keys))
+}
+
+func (h *Handler) handlePing(c *call, args []string) Value {
+	if c.sess.subscriptions() > 0 && c.sess.proto < 3 {
+		// Subscribed RESP2 clients expect every reply to be an array
+		switch len(args) {
+		case 0:
+			return Array(BulkString("pong"), BulkString(""))
+		case 1:
+			return Array(BulkString("pong"), BulkString(args[0]))
+		}
 	}
 
-	return ":0"
+	switch len(args) {
+	case 0:
+		return SimpleString("PONG")
+	case 1:
+		return BulkString(args[0])
+	default:
+		return wrongArgs("ping")
+	}
 }
 
-func (h *Handler) handleTTL(args []string) string {
+func (h *Handler) handleEcho(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("echo")
+	}
+	return BulkString(args[0])
+}
+
+// handleHello negotiates the protocol version: HELLO [protover [AUTH
+// username password] [SETNAME name]]. A session that hasn't authenticated
+// has to do so with the AUTH option.
+func (h *Handler) handleHello(c *call, args []string) Value {
+	proto := c.sess.proto
+	name := c.sess.name
+	var user, password string
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return Error("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return Error("NOPROTO unsupported protocol version")
+		}
+		proto = v
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if len(args) < 3 {
+				return Error("ERR syntax error")
+			}
+			user, password = args[1], args[2]
+			args = args[3:]
+		case "SETNAME":
+			if len(args) < 2 {
+				return Error("ERR syntax error")
+			}
+			name = args[1]
+			args = args[2:]
+		default:
+			return Errorf("ERR syntax error in HELLO option '%s'", args[0])
+		}
+	}
+
+	switch {
+	case user != "":
+		if !h.acl.authenticate(user, password) {
+			return errWrongPass
+		}
+		c.sess.user = user
+	case h.acl.sessionUser(c.sess) == nil:
+		return Error("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	// A replica, or a Raft node other than the leader, doesn't take writes
+	role := "master"
+	if h.readOnly() || h.consensus != nil && !h.consensus.IsLeader() {
+		role = "replica"
+	}
+
+	c.sess.proto = proto
+	c.sess.name = name
+	return Map(
+		BulkString("server"), BulkString("kvstore"),
+		BulkString("version"), BulkString(serverVersion),
+		BulkString("proto"), Integer(int64(proto)),
+		BulkString("id"), Integer(c.sess.id),
+		BulkString("mode"), BulkString(h.serverMode()),
+		BulkString("role"), BulkString(role),
+		BulkString("modules"), Array(),
+	)
+}
+
+func (h *Handler) handleClient(c *call, args []string) Value {
 	if len(args) < 1 {
-		return "-ERR wrong number of arguments for 'ttl' command"
+		return wrongArgs("client")
 	}
 
-	key := args[0]
-	ttl := h.store.TTL(key)
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		return Integer(c.sess.id)
+	case "SETNAME":
+		if len(args) != 2 {
+			return wrongArgs("client|setname")
+		}
+		c.sess.name = args[1]
+		return OK()
+	case "GETNAME":
+		if c.sess.name == "" {
+			return NullBulk()
+		}
+		return BulkString(c.sess.name)
+	case "SETINFO":
+		// Client libraries report their name and version; nothing to store.
+		return OK()
+	default:
+		return Errorf("ERR unknown subcommand '%s'", args[0])
+	}
+}
+
+func (h *Handler) handleSelect(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("select")
+	}
+	if args[0] != "0" {
+		return Error("ERR DB index is out of range")
+	}
+	return OK()
+}
+
+func (h *Handler) handleCommand(c *call, args []string) Value {
+	return Array()
+}
 
-	return fmt.Sprintf(":%d", ttl)
+func (h *Handler) handleQuit(c *call, args []string) Value {
+	c.sess.closing = true
+	return OK()
 }
@@ -1,9 +1,15 @@
 package protocol
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alyxpink/go-training/kvstore/persistence"
 	"github.com/alyxpink/go-training/kvstore/store"
@@ -213,6 +219,13 @@ func TestHandler_SETWithSpaces(t *testing.T) {
 	require.True(t, ok)
 	// Value should contain spaces
 	assert.Contains(t, val, " ")
+
+	// Options after the value are still options
+	assert.Equal(t, "+OK", handler.Handle("SET key2 hello world EX 10"))
+	val, ok = kvStore.Get("key2")
+	require.True(t, ok)
+	assert.Equal(t, "hello world", val)
+	assert.Greater(t, kvStore.TTL("key2"), 0)
 }
 
 func TestHandler_CaseInsensitiveCommands(t *testing.T) {
@@ -388,3 +401,485 @@ func TestHandler_KEYSPattern(t *testing.T) {
 		}
 	}
 }
+
+func TestHandler_ActiveExpiryLogsDeletes(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+
+	handler := NewHandler(kvStore, wal)
+	handler.Handle("SET key1 value1")
+	handler.Handle("SET key2 value2")
+	handler.Handle("PEXPIRE key1 1")
+
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 1, kvStore.ExpireCycle())
+	wal.Close()
+
+	// Replaying the log must not resurrect the expired key
+	newStore := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(newStore))
+
+	assert.Equal(t, 1, newStore.Stats().Keys)
+	_, ok := newStore.Get("key2")
+	assert.True(t, ok)
+}
+
+func TestHandler_OOM(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	handler := NewHandler(kvStore, wal)
+	kvStore.SetMaxMemory(300, store.NoEviction)
+
+	var resp string
+	for i := 0; i < 10 && !strings.HasPrefix(resp, "-"); i++ {
+		resp = handler.Handle("SET key" + strconv.Itoa(i) + " value")
+	}
+	assert.True(t, strings.HasPrefix(resp, "-OOM"), "got %q", resp)
+
+	// Reads and deletes still work
+	assert.Equal(t, "$5\r\nvalue", handler.Handle("GET key0"))
+	assert.Equal(t, ":1", handler.Handle("DEL key0"))
+}
+
+func TestHandler_CollectionCommands(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	handler := NewHandler(kvStore, wal)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"RPUSH list b c", ":2"},
+		{"LPUSH list a", ":3"},
+		{"LRANGE list 0 -1", "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc"},
+		{"LPOP list", "$1\r\na"},
+		{"LPOP list 5", "*2\r\n$1\r\nb\r\n$1\r\nc"},
+		{"LPOP list", "$-1"},
+		{"HSET hash f1 v1 f2 v2", ":2"},
+		{"HGET hash f1", "$2\r\nv1"},
+		{"HGETALL hash", "*4\r\n$2\r\nf1\r\n$2\r\nv1\r\n$2\r\nf2\r\n$2\r\nv2"},
+		{"HDEL hash f1 nope", ":1"},
+		{"SADD s1 a b c", ":3"},
+		{"SADD s2 b c d", ":3"},
+		{"SINTER s1 s2", "*2\r\n$1\r\nb\r\n$1\r\nc"},
+		{"SREM s1 a", ":1"},
+		{"SMEMBERS s1", "*2\r\n$1\r\nb\r\n$1\r\nc"},
+		{"ZADD z 1 one 2 two 3 three", ":3"},
+		{"ZRANGE z 0 1", "*2\r\n$3\r\none\r\n$3\r\ntwo"},
+		{"ZRANGE z -1 -1 WITHSCORES", "*2\r\n$5\r\nthree\r\n$1\r\n3"},
+		{"ZRANGEBYSCORE z (1 +inf", "*2\r\n$3\r\ntwo\r\n$5\r\nthree"},
+		{"ZRANGEBYSCORE z -inf +inf LIMIT 1 1", "*1\r\n$3\r\ntwo"},
+		{"ZRANK z three", ":2"},
+		{"ZRANK z nope", "$-1"},
+		{"ZADD z notafloat m", "-ERR value is not a valid float"},
+		{"TYPE z", "+zset"},
+		{"TYPE missing", "+none"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, handler.Handle(tt.command), tt.command)
+	}
+}
+
+func TestHandler_WrongType(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	handler := NewHandler(kvStore, wal)
+	handler.Handle("SET str value")
+	handler.Handle("RPUSH list a")
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value"
+	for _, cmd := range []string{"GET list", "LPUSH str a", "LRANGE str 0 -1", "HSET list f v", "SADD list m", "SINTER list", "ZADD str 1 m", "ZRANK list m"} {
+		assert.Equal(t, wrongType, handler.Handle(cmd), cmd)
+	}
+}
+
+func TestHandler_CollectionsSurviveReplay(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+
+	handler := NewHandler(kvStore, wal)
+	for _, cmd := range []string{
+		"RPUSH list a b c", "LPUSH list z", "LPOP list 2",
+		"HSET hash f1 v1 f2 v2", "HDEL hash f2",
+		"SADD set a b c", "SREM set b",
+		"ZADD zset 1.5 a 2 b", "ZADD zset 0.5 b",
+	} {
+		require.False(t, strings.HasPrefix(handler.Handle(cmd), "-"), cmd)
+	}
+	wal.Close()
+
+	newStore := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(newStore))
+
+	list, err := newStore.LRange("list", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, list)
+
+	hash, err := newStore.HGetAll("hash")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f1": "v1"}, hash)
+
+	set, err := newStore.SMembers("set")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, set)
+
+	zset, err := newStore.ZRange("zset", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []store.ScoredMember{{Member: "b", Score: 0.5}, {Member: "a", Score: 1.5}}, zset)
+}
+
+// Writes to different shards run at once, so the WAL must still order
+// the writes to each key as they were applied for replay to agree.
+func TestHandler_ConcurrentWritesReplay(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	handler := NewHandler(kvStore, wal)
+
+	const writers, ops, lists = 8, 500, 4
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess := handler.NewSession()
+			for i := range ops {
+				list := "list:" + strconv.Itoa(i%lists)
+				handler.Exec(sess, []string{"RPUSH", list, strconv.Itoa(w*ops + i)})
+				if i%3 == 0 {
+					handler.Exec(sess, []string{"LPOP", list})
+				}
+				handler.Exec(sess, []string{"INCR", "counter:" + strconv.Itoa(i%lists)})
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, wal.Close())
+
+	replayed := store.NewKVStore()
+	wal, err = persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+	require.NoError(t, wal.Replay(replayed))
+	for i := range lists {
+		list := "list:" + strconv.Itoa(i)
+		want, err := kvStore.LRange(list, 0, -1)
+		require.NoError(t, err)
+		got, err := replayed.LRange(list, 0, -1)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, list)
+
+		counter := "counter:" + strconv.Itoa(i)
+		want1, _ := kvStore.Get(counter)
+		got1, _ := replayed.Get(counter)
+		assert.Equal(t, want1, got1, counter)
+	}
+}
+
+func TestHandler_MultiExec(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+
+	handler := NewHandler(kvStore, wal)
+	assert.Equal(t, "+OK", handler.Handle("MULTI"))
+	assert.Equal(t, "-ERR MULTI calls can not be nested", handler.Handle("MULTI"))
+	assert.Equal(t, "+QUEUED", handler.Handle("SET key1 value1"))
+	assert.Equal(t, "+QUEUED", handler.Handle("RPUSH key1 a"))
+	assert.Equal(t, "+QUEUED", handler.Handle("RPUSH list a b"))
+	assert.Equal(t, "+QUEUED", handler.Handle("GET key1"))
+
+	// Nothing runs before EXEC
+	_, ok := kvStore.Get("key1")
+	assert.False(t, ok)
+
+	resp := handler.Handle("EXEC")
+	assert.Equal(t, "*4\r\n+OK\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n:2\r\n$6\r\nvalue1", resp)
+	assert.Equal(t, "-ERR EXEC without MULTI", handler.Handle("EXEC"))
+	wal.Close()
+
+	// The transaction is a single WAL record
+	newStore := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	info, err := newWAL.Recover(newStore)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Records)
+
+	val, ok := newStore.Get("key1")
+	require.True(t, ok)
+	assert.Equal(t, "value1", val)
+	list, err := newStore.LRange("list", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, list)
+}
+
+func TestHandler_MultiDiscard(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	handler := NewHandler(kvStore, wal)
+	assert.Equal(t, "-ERR DISCARD without MULTI", handler.Handle("DISCARD"))
+
+	handler.Handle("MULTI")
+	handler.Handle("SET key1 value1")
+	assert.Equal(t, "+OK", handler.Handle("DISCARD"))
+	assert.False(t, kvStore.Exists("key1"))
+
+	// An unknown command while queuing discards the whole transaction
+	handler.Handle("MULTI")
+	handler.Handle("SET key1 value1")
+	assert.Equal(t, "-ERR unknown command 'NOPE'", handler.Handle("NOPE"))
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.", handler.Handle("EXEC"))
+	assert.False(t, kvStore.Exists("key1"))
+}
+
+func TestHandler_Watch(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	handler := NewHandler(kvStore, wal)
+	other := handler.NewSession()
+	kvStore.Set("counter", "1")
+
+	// Unchanged watched key: EXEC runs
+	assert.Equal(t, "+OK", handler.Handle("WATCH counter"))
+	handler.Handle("MULTI")
+	assert.Equal(t, "-ERR WATCH inside MULTI is not allowed", handler.Handle("WATCH counter"))
+	handler.Handle("SET counter 2")
+	assert.Equal(t, "*1\r\n+OK", handler.Handle("EXEC"))
+
+	// Another client changes the key in between: EXEC aborts
+	handler.Handle("WATCH counter")
+	handler.Exec(other, []string{"SET", "counter", "10"})
+	handler.Handle("MULTI")
+	handler.Handle("SET counter 3")
+	assert.Equal(t, "*-1", handler.Handle("EXEC"))
+
+	val, _ := kvStore.Get("counter")
+	assert.Equal(t, "10", val)
+
+	// EXEC released the watch, and UNWATCH drops one before EXEC
+	handler.Handle("WATCH counter")
+	handler.Handle("UNWATCH")
+	handler.Exec(other, []string{"DEL", "counter"})
+	handler.Handle("MULTI")
+	handler.Handle("SET counter 4")
+	assert.Equal(t, "*1\r\n+OK", handler.Handle("EXEC"))
+}
+
+func TestHandler_Scan(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	handler := NewHandler(kvStore, wal)
+	sess := handler.NewSession()
+	for i := 0; i < 30; i++ {
+		kvStore.Set("user:"+strconv.Itoa(i)+":session", "v")
+		kvStore.Set("other"+strconv.Itoa(i), "v")
+	}
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply := handler.Exec(sess, []string{"SCAN", cursor, "MATCH", "user:*:session", "COUNT", "7"})
+		require.Equal(t, TypeArray, reply.Type)
+		require.Len(t, reply.Elems, 2)
+		cursor = reply.Elems[0].Str
+		keys = append(keys, reply.Elems[1].Strings()...)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Len(t, keys, 30)
+
+	assert.Equal(t, "-ERR invalid cursor", handler.Handle("SCAN abc"))
+	assert.Equal(t, "-ERR syntax error", handler.Handle("SCAN 0 COUNT 0"))
+	assert.Equal(t, "-ERR syntax error", handler.Handle("SCAN 0 MATCH"))
+}
+
+func TestHandler_WritesWaitForFsync(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	// Under FsyncAlways a write is on disk by the time it is acknowledged
+	assert.Equal(t, "+OK", handler.Handle("SET key value"))
+	assert.Equal(t, uint64(1), wal.Stats().Fsyncs.Count)
+	handler.Handle("GET key")
+	assert.Equal(t, uint64(1), wal.Stats().Fsyncs.Count, "reads don't sync")
+
+	// The push and the pop it wakes are logged before either commits, so
+	// whichever commits first syncs both
+	reply := blockPop(t, handler, "queue", "BLPOP", "queue", "0")
+	handler.Handle("RPUSH queue job")
+	receive(t, reply)
+	assert.Equal(t, uint64(3), wal.LastSeq())
+	assert.Equal(t, uint64(2), wal.Stats().Fsyncs.Count)
+
+	wal.SetFsyncPolicy(persistence.FsyncNo)
+	handler.Handle("SET key other")
+	assert.Equal(t, uint64(2), wal.Stats().Fsyncs.Count)
+}
+
+func TestHandler_SnapshotDuringWrites(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	handler := NewHandler(store.NewKVStore(), wal)
+	snapshots := persistence.NewSnapshotManager(dir, time.Hour, handler.WriteLock())
+	snapshots.SetWAL(wal)
+
+	// Pushes aren't idempotent, so a record both in a snapshot and in the
+	// WAL after it would show up as an extra element
+	const writers, pushes = 4, 500
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess := handler.NewSession()
+			for i := range pushes {
+				handler.Exec(sess, []string{"RPUSH", "list", strconv.Itoa(w*pushes + i)})
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for snapshotting := true; snapshotting; {
+		select {
+		case <-done:
+			snapshotting = false
+		default:
+		}
+		require.NoError(t, snapshots.CreateSnapshot(handler.store))
+	}
+	require.NoError(t, wal.Close())
+
+	recovered := store.NewKVStore()
+	wal, err = persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer wal.Close()
+	loader := persistence.NewSnapshotManager(dir, time.Hour, nil)
+	loader.SetWAL(wal)
+	require.NoError(t, loader.LoadLatest(recovered))
+	require.NoError(t, wal.Replay(recovered))
+	n, err := recovered.LLen("list")
+	require.NoError(t, err)
+	assert.Equal(t, writers*pushes, n)
+}
+
+func BenchmarkHandler_Set(b *testing.B) {
+	for _, policy := range []persistence.FsyncPolicy{persistence.FsyncAlways, persistence.FsyncEverySec, persistence.FsyncNo} {
+		b.Run(policy.String(), func(b *testing.B) {
+			wal, err := persistence.NewWAL(filepath.Join(b.TempDir(), "bench.wal"))
+			require.NoError(b, err)
+			defer wal.Close()
+			wal.SetFsyncPolicy(policy)
+			handler := NewHandler(store.NewKVStore(), wal)
+
+			// Clients write at once: with FsyncAlways they share fsyncs
+			// even though the handler applies writes one at a time
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				sess := handler.NewSession()
+				args := []string{"SET", "key", "value"}
+				for pb.Next() {
+					handler.Exec(sess, args)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkHandler_SetKeys writes to many keys through the handler, with
+// one shard, where every write waits for the one before, and with the
+// default sharding; without a WAL, and with one that doesn't fsync, whose
+// appends are the part that stays serial. Run it with -cpu 1,2,4,8.
+func BenchmarkHandler_SetKeys(b *testing.B) {
+	const keys = 1 << 16
+	for _, logged := range []bool{false, true} {
+		for _, shards := range []int{1, store.DefaultShards} {
+			b.Run(fmt.Sprintf("wal=%t/shards=%d", logged, shards), func(b *testing.B) {
+				var wal *persistence.WAL
+				if logged {
+					var err error
+					wal, err = persistence.NewWAL(filepath.Join(b.TempDir(), "bench.wal"))
+					require.NoError(b, err)
+					defer wal.Close()
+					wal.SetFsyncPolicy(persistence.FsyncNo)
+				}
+				handler := NewHandler(store.NewShardedKVStore(shards), wal)
+
+				var worker atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					sess := handler.NewSession()
+					i := int(worker.Add(1) * 7919)
+					for pb.Next() {
+						i += 4099
+						handler.Exec(sess, []string{"SET", "key:" + strconv.Itoa(i&(keys-1)), "value"})
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"io"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/metrics"
+)
+
+// WriteMetrics writes the server's metrics to w in the Prometheus text
+// format. They are the figures INFO reports, under kvstore_ names, with
+// latencies as histograms rather than averages.
+func (h *Handler) WriteMetrics(w io.Writer) error {
+	m := metrics.NewWriter(w)
+
+	m.Family("kvstore_uptime_seconds", "gauge", "Seconds since the server started.")
+	m.Value("kvstore_uptime_seconds", time.Since(h.stats.started).Seconds())
+	m.Family("kvstore_connected_clients", "gauge", "Client connections open.")
+	m.Value("kvstore_connected_clients", float64(h.stats.clients.Load()))
+	m.Family("kvstore_blocked_clients", "gauge", "Clients waiting in a blocking command.")
+	m.Value("kvstore_blocked_clients", float64(h.blocking.count()))
+	m.Family("kvstore_connections_received_total", "counter", "Client connections accepted.")
+	m.Value("kvstore_connections_received_total", float64(h.stats.connections.Load()))
+
+	called := h.stats.called()
+	m.Family("kvstore_commands_total", "counter", "Commands run, by command.")
+	for _, name := range called {
+		m.Value("kvstore_commands_total", float64(h.stats.commands[name].calls.Load()), "cmd", name)
+	}
+	m.Family("kvstore_command_errors_total", "counter", "Commands that replied with an error, by command.")
+	for _, name := range called {
+		m.Value("kvstore_command_errors_total", float64(h.stats.commands[name].failed.Load()), "cmd", name)
+	}
+	m.Family("kvstore_command_duration_seconds", "histogram", "Time taken to run commands, by command.")
+	for _, name := range called {
+		m.Histogram("kvstore_command_duration_seconds", h.stats.commands[name].latency.Snapshot(), "cmd", name)
+	}
+
+	if h.store != nil {
+		st := h.store.Stats()
+		m.Family("kvstore_keys", "gauge", "Keys in the keyspace, including expired ones not yet reclaimed.")
+		m.Value("kvstore_keys", float64(st.Keys))
+		m.Family("kvstore_expiring_keys", "gauge", "Keys with a TTL.")
+		m.Value("kvstore_expiring_keys", float64(st.Expires))
+		m.Family("kvstore_expired_keys_total", "counter", "Keys removed by expiry.")
+		m.Value("kvstore_expired_keys_total", float64(st.ExpiredKeys))
+		m.Family("kvstore_evicted_keys_total", "counter", "Keys evicted to stay within the memory limit.")
+		m.Value("kvstore_evicted_keys_total", float64(st.EvictedKeys))
+		m.Family("kvstore_memory_used_bytes", "gauge", "Estimated memory held by keys and values.")
+		m.Value("kvstore_memory_used_bytes", float64(st.UsedMemory))
+		m.Family("kvstore_memory_max_bytes", "gauge", "Memory limit, 0 if unlimited.")
+		m.Value("kvstore_memory_max_bytes", float64(st.MaxMemory))
+	}
+
+	channels, patterns := h.pubsub.counts()
+	m.Family("kvstore_pubsub_channels", "gauge", "Channels with subscribers.")
+	m.Value("kvstore_pubsub_channels", float64(channels))
+	m.Family("kvstore_pubsub_patterns", "gauge", "Patterns with subscribers.")
+	m.Value("kvstore_pubsub_patterns", float64(patterns))
+
+	if h.wal != nil {
+		st := h.wal.Stats()
+		m.Family("kvstore_wal_last_seq", "gauge", "Sequence number of the last WAL record.")
+		m.Value("kvstore_wal_last_seq", float64(st.LastSeq))
+		m.Family("kvstore_wal_segment_bytes", "gauge", "Size of the WAL file being appended to.")
+		m.Value("kvstore_wal_segment_bytes", float64(st.SegmentSize))
+		m.Family("kvstore_wal_fsync_duration_seconds", "histogram", "Time taken to fsync the WAL.")
+		m.Histogram("kvstore_wal_fsync_duration_seconds", st.Fsyncs)
+	}
+
+	if h.snapshots != nil {
+		st := h.snapshots.Stats()
+		failed := 0.0
+		if st.LastFailed {
+			failed = 1
+		}
+		m.Family("kvstore_snapshots_total", "counter", "Snapshots taken.")
+		m.Value("kvstore_snapshots_total", float64(st.Saves))
+		m.Family("kvstore_snapshot_last_failed", "gauge", "1 if the last snapshot failed.")
+		m.Value("kvstore_snapshot_last_failed", failed)
+		m.Family("kvstore_snapshot_last_duration_seconds", "gauge", "Time taken by the last attempt to take a snapshot.")
+		m.Value("kvstore_snapshot_last_duration_seconds", st.LastDuration.Seconds())
+		if !st.LastSave.IsZero() {
+			m.Family("kvstore_snapshot_last_success_timestamp_seconds", "gauge", "Unix time of the latest snapshot.")
+			m.Value("kvstore_snapshot_last_success_timestamp_seconds", float64(st.LastSave.UnixMilli())/1e3)
+			m.Family("kvstore_snapshot_age_seconds", "gauge", "Seconds since the latest snapshot.")
+			m.Value("kvstore_snapshot_age_seconds", time.Since(st.LastSave).Seconds())
+		}
+	}
+
+	return m.Flush()
+}
@@ -0,0 +1,335 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// DUMP, RESTORE and MIGRATE move keys between servers, as in Redis. The
+// payload DUMP returns is a gob encoded store.Entry followed by its CRC32C,
+// so it is only understood by this server, not by Redis. MIGRATE is what
+// moves a hash slot in cluster mode; see cluster.go.
+
+var dumpTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maxMigrateTimeout caps the timeout MIGRATE is given. Writes to the shards
+// of the keys it moves wait for it, and so does anything that needs every
+// shard, such as a snapshot, and every write behind that.
+const maxMigrateTimeout = 3 * time.Second
+
+var errBadPayload = Error("ERR DUMP payload version or checksum are wrong")
+
+// encodeDump serializes entry, without its expiry, for RESTORE.
+func encodeDump(entry store.Entry) (string, error) {
+	entry.ExpiresAt = nil
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return "", err
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(buf.Bytes(), dumpTable)))
+	return buf.String(), nil
+}
+
+func decodeDump(payload string) (store.Entry, error) {
+	var entry store.Entry
+	if len(payload) < 4 {
+		return entry, errors.New("payload too short")
+	}
+	data, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.Checksum([]byte(data), dumpTable) != binary.LittleEndian.Uint32([]byte(sum)) {
+		return entry, errors.New("checksum mismatch")
+	}
+	err := gob.NewDecoder(strings.NewReader(data)).Decode(&entry)
+	return entry, err
+}
+
+// entryCommands returns the commands that recreate entry at key when
+// replayed from the WAL: a DEL, the command that sets the value, and a
+// PEXPIREAT for the expiry.
+func entryCommands(key string, entry store.Entry) [][]string {
+	cmds := [][]string{{"DEL", key}}
+	switch entry.Kind {
+	case store.KindString:
+		cmds = append(cmds, []string{"SET", key, entry.Value})
+	case store.KindList:
+		cmds = append(cmds, append([]string{"RPUSH", key}, entry.List...))
+	case store.KindHash:
+		cmd := []string{"HSET", key}
+		for field, value := range entry.Hash {
+			cmd = append(cmd, field, value)
+		}
+		cmds = append(cmds, cmd)
+	case store.KindSet:
+		cmd := []string{"SADD", key}
+		for member := range entry.Set {
+			cmd = append(cmd, member)
+		}
+		cmds = append(cmds, cmd)
+	case store.KindZSet:
+		cmd := []string{"ZADD", key}
+		for _, m := range entry.ZSet.Members() {
+			cmd = append(cmd, formatDouble(m.Score), m.Member)
+		}
+		cmds = append(cmds, cmd)
+	}
+	if entry.ExpiresAt != nil {
+		cmds = append(cmds, []string{"PEXPIREAT", key, strconv.FormatInt(entry.ExpiresAt.UnixMilli(), 10)})
+	}
+	return cmds
+}
+
+// handleDump implements DUMP key.
+func (h *Handler) handleDump(c *call, args []string) Value {
+	if len(args) != 1 {
+		return wrongArgs("dump")
+	}
+	entry, ok := c.tx.Dump(args[0])
+	if !ok {
+		return NullBulk()
+	}
+	payload, err := encodeDump(entry)
+	if err != nil {
+		return errorValue(err)
+	}
+	return BulkString(payload)
+}
+
+// handleRestore implements RESTORE key ttl payload [REPLACE] [ABSTTL]. The
+// ttl is in milliseconds, or a Unix time in milliseconds with ABSTTL, and 0
+// for no expiry.
+func (h *Handler) handleRestore(c *call, args []string) Value {
+	if len(args) < 3 {
+		return wrongArgs("restore")
+	}
+	key := args[0]
+
+	var replace, absTTL bool
+	for _, opt := range args[3:] {
+		switch strings.ToUpper(opt) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			return Error("ERR syntax error")
+		}
+	}
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || ttl < 0 {
+		return Error("ERR Invalid TTL value, must be >= 0")
+	}
+	entry, err := decodeDump(args[2])
+	if err != nil {
+		return errBadPayload
+	}
+	if !replace && c.tx.Exists(key) {
+		return Error("BUSYKEY Target key name already exists.")
+	}
+
+	if ttl > 0 {
+		at := c.tx.Now().Add(time.Duration(ttl) * time.Millisecond)
+		if absTTL {
+			at = time.UnixMilli(ttl)
+		}
+		entry.ExpiresAt = &at
+	}
+
+	c.tx.Restore(key, entry)
+	if !c.tx.Exists(key) {
+		// Already expired, so only the key it replaced is gone
+		c.log("DEL", key)
+		return OK()
+	}
+	for _, cmd := range entryCommands(key, entry) {
+		c.log(cmd...)
+	}
+	c.notify(notifyGeneric, "restore", key)
+	return OK()
+}
+
+// migrateKeys finds the keys of MIGRATE host port key|"" db timeout [COPY]
+// [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...].
+func migrateKeys(args []string) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	if args[2] != "" {
+		return args[2:3]
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+// handleMigrate implements MIGRATE. It moves the keys to the server at host
+// and port with RESTORE, and deletes them here once restored, unless COPY
+// is given. Unlike Redis it dials the target every time.
+//
+// It runs in the Tx of its keys, so no other write to them happens on this
+// server until the target has replied or timeout has passed. That is what
+// keeps writes from being lost while a slot moves, and the reason for
+// migrating keys in small batches. The timeout is capped at
+// maxMigrateTimeout, since a snapshot waits for it and every write then
+// waits for the snapshot.
+func (h *Handler) handleMigrate(c *call, args []string) Value {
+	if len(args) < 5 {
+		return wrongArgs("migrate")
+	}
+	if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+		return Error("ERR Invalid port")
+	}
+	if args[3] != "0" {
+		return Error("ERR DB index is out of range")
+	}
+	timeout, err := migrateTimeout(args[4])
+	if err != nil {
+		return errorValue(err)
+	}
+
+	var copyKeys, replace bool
+	var auth []string
+	for i := 5; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COPY":
+			copyKeys = true
+		case opt == "REPLACE":
+			replace = true
+		case opt == "AUTH" && i+1 < len(args):
+			auth = []string{"AUTH", args[i+1]}
+			i++
+		case opt == "AUTH2" && i+2 < len(args):
+			auth = []string{"AUTH", args[i+1], args[i+2]}
+			i += 2
+		case opt == "KEYS" && args[2] == "":
+			i = len(args)
+		default:
+			return Error("ERR syntax error")
+		}
+	}
+
+	var keys, payloads, ttls []string
+	for _, key := range migrateKeys(args) {
+		entry, ok := c.tx.Dump(key)
+		if !ok || slices.Contains(keys, key) {
+			continue
+		}
+		payload, err := encodeDump(entry)
+		if err != nil {
+			return errorValue(err)
+		}
+		ttl := "0"
+		if entry.ExpiresAt != nil {
+			ttl = strconv.FormatInt(entry.ExpiresAt.UnixMilli(), 10)
+		}
+		keys, payloads, ttls = append(keys, key), append(payloads, payload), append(ttls, ttl)
+	}
+	if len(keys) == 0 {
+		return SimpleString("NOKEY")
+	}
+
+	// In cluster mode the target is importing the keys' slot, and only
+	// serves them when asked
+	var cmds [][]string
+	if auth != nil {
+		cmds = append(cmds, auth)
+	}
+	for i, key := range keys {
+		if h.cluster != nil {
+			cmds = append(cmds, []string{"ASKING"})
+		}
+		restore := []string{"RESTORE", key, ttls[i], payloads[i], "ABSTTL"}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		cmds = append(cmds, restore)
+	}
+	replies, err := exchange(net.JoinHostPort(args[0], args[1]), cmds, timeout)
+	if err != nil {
+		return Errorf("IOERR error or timeout talking to target instance: %v", err)
+	}
+
+	// Keys the target restored are gone from here, even if others failed
+	var failed Value
+	for i, reply := range replies {
+		switch {
+		case reply.IsError():
+			if !failed.IsError() {
+				failed = Errorf("ERR Target instance replied with error: %s", reply.Str)
+			}
+		case cmds[i][0] == "RESTORE" && !copyKeys:
+			key := cmds[i][1]
+			if c.tx.Del(key) {
+				c.log("DEL", key)
+				c.notify(notifyGeneric, "del", key)
+			}
+		}
+	}
+	if failed.IsError() {
+		return failed
+	}
+	return OK()
+}
+
+// migrateTimeout parses the timeout of MIGRATE, in milliseconds, where 0
+// means a second, and caps it at maxMigrateTimeout.
+func migrateTimeout(s string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, errors.New("ERR timeout is not an integer or out of range")
+	}
+	switch {
+	case ms == 0:
+		return time.Second, nil
+	case ms > maxMigrateTimeout.Milliseconds():
+		return maxMigrateTimeout, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// exchange sends cmds to the server at addr and reads a reply to each, all
+// within timeout.
+func exchange(addr string, cmds [][]string, timeout time.Duration) ([]Value, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := NewWriter(conn)
+	for _, cmd := range cmds {
+		if err := w.WriteCommand(cmd...); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	r := NewReader(conn)
+	replies := make([]Value, len(cmds))
+	for i := range cmds {
+		if replies[i], err = r.ReadValue(); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
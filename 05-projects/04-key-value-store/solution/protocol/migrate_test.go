@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_DumpRestore(t *testing.T) {
+	handler, _, wal, walPath := newStringsHandler(t)
+	sess := handler.NewSession()
+	for _, line := range []string{
+		"SET str hello",
+		"RPUSH list a b c",
+		"HSET hash f1 v1 f2 v2",
+		"SADD set x y",
+		"ZADD zset 1.5 one -inf low",
+		"SET volatile v EX 100",
+	} {
+		require.False(t, handler.Exec(sess, strings.Fields(line)).IsError(), line)
+	}
+
+	// Each key is dumped and restored under a new name
+	for _, key := range []string{"str", "list", "hash", "set", "zset", "volatile"} {
+		dump := handler.Exec(sess, []string{"DUMP", key})
+		require.False(t, dump.Null, key)
+		assert.Equal(t, "OK", handler.Exec(sess, []string{"RESTORE", key + ":copy", "0", dump.Str}).Text(), key)
+	}
+	dump := handler.Exec(sess, []string{"DUMP", "str"}).Str
+	assert.Equal(t, "BUSYKEY Target key name already exists.", handler.Exec(sess, []string{"RESTORE", "str:copy", "0", dump}).Text())
+	assert.Equal(t, "OK", handler.Exec(sess, []string{"RESTORE", "str:copy", "60000", dump, "REPLACE"}).Text())
+	assert.Equal(t, "OK", handler.Exec(sess, []string{"RESTORE", "gone", "1", dump, "ABSTTL"}).Text())
+	assert.Equal(t, "-1", exec(handler, sess, "TTL volatile:copy"), "DUMP leaves out the expiry")
+
+	assert.Equal(t, errBadPayload.Str, handler.Exec(sess, []string{"RESTORE", "bad", "0", dump[:len(dump)-1] + "x"}).Text())
+	assert.Equal(t, "ERR Invalid TTL value, must be >= 0", handler.Exec(sess, []string{"RESTORE", "bad", "-1", dump}).Text())
+	assert.True(t, handler.Exec(sess, []string{"DUMP", "missing"}).Null)
+
+	assert.Equal(t, "hello", exec(handler, sess, "GET str:copy"))
+	assert.Equal(t, []string{"a", "b", "c"}, handler.Exec(sess, strings.Fields("LRANGE list:copy 0 -1")).Strings())
+	assert.Equal(t, []string{"low", "-inf", "one", "1.5"}, handler.Exec(sess, strings.Fields("ZRANGE zset:copy 0 -1 WITHSCORES")).Strings())
+	assert.Equal(t, "0", exec(handler, sess, "EXISTS gone"))
+	wal.Close()
+
+	// The WAL recreates the restored keys as they were
+	replayed := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(replayed))
+
+	value, _ := replayed.Get("str:copy")
+	assert.Equal(t, "hello", value)
+	assert.Positive(t, replayed.TTL("str:copy"))
+	list, err := replayed.LRange("list:copy", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, list)
+	hash, err := replayed.HGetAll("hash:copy")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, hash)
+	set, err := replayed.SMembers("set:copy")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"x", "y"}, set)
+	assert.True(t, replayed.Exists("zset:copy"))
+	assert.False(t, replayed.Exists("gone"))
+}
+
+func TestMigrateKeys(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"host", "6380", "key", "0", "100"}, []string{"key"}},
+		{[]string{"host", "6380", "", "0", "100", "COPY", "AUTH", "KEYS", "KEYS", "a", "b"}, []string{"a", "b"}},
+		{[]string{"host", "6380", "", "0", "100", "AUTH2", "u", "KEYS", "KEYS", "a"}, []string{"a"}},
+		{[]string{"host", "6380", "", "0", "100"}, nil},
+		{[]string{"host", "6380"}, nil},
+	} {
+		assert.Equal(t, tt.want, migrateKeys(tt.args), tt.args)
+	}
+}
+
+func TestMigrateTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		arg  string
+		want time.Duration
+	}{
+		{"0", time.Second},
+		{"250", 250 * time.Millisecond},
+		{"3600000", maxMigrateTimeout},
+		{"9223372036854775807", maxMigrateTimeout},
+	} {
+		got, err := migrateTimeout(tt.arg)
+		require.NoError(t, err, tt.arg)
+		assert.Equal(t, tt.want, got, tt.arg)
+	}
+	for _, arg := range []string{"-1", "x"} {
+		_, err := migrateTimeout(arg)
+		assert.Error(t, err, arg)
+	}
+}
+
+// A MIGRATE waiting on its target only holds up writes to the shards of
+// the keys it moves.
+func TestHandler_MigrateOnlyHoldsItsKeys(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+	require.Equal(t, "OK", exec(handler, handler.NewSession(), "SET moving v"))
+
+	// The target reads the commands and doesn't reply until released
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	connected, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		close(connected)
+		<-release
+	}()
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+
+	migrated := make(chan Value)
+	go func() {
+		migrated <- handler.Exec(handler.NewSession(), []string{"MIGRATE", host, port, "moving", "0", "60000"})
+	}()
+	<-connected
+
+	// Some of these keys share a shard with the one moving and wait; the
+	// others go ahead
+	const keys = 16
+	var done atomic.Int32
+	for i := range keys {
+		go func() {
+			handler.Exec(handler.NewSession(), []string{"SET", "key" + strconv.Itoa(i), "v"})
+			done.Add(1)
+		}()
+	}
+	assert.Eventually(t, func() bool { return done.Load() > 0 }, time.Second, time.Millisecond)
+	select {
+	case v := <-migrated:
+		t.Fatalf("MIGRATE returned early: %v", v)
+	default:
+	}
+
+	close(release)
+	assert.True(t, (<-migrated).IsError())
+	assert.Eventually(t, func() bool { return done.Load() == keys }, time.Second, time.Millisecond)
+}
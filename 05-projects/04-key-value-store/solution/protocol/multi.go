@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// MULTI/EXEC transactions. Commands sent after MULTI are queued on the
+// session; EXEC runs them back to back in a single store Update, so no other
+// client sees the store in between, and logs their writes as one WAL batch.
+//
+// WATCH makes EXEC conditional: if any watched key changed since it was
+// watched, whether by another client, by this one, or through expiry or
+// eviction, EXEC runs nothing and replies with a null array.
+
+// multiState is the state of a session between MULTI and EXEC.
+type multiState struct {
+	queued []queuedCommand
+	failed bool // a command was rejected while queuing
+}
+
+type queuedCommand struct {
+	cmd  command
+	name string
+	args []string
+}
+
+func (m *multiState) queue(cmd command, name string, args []string) {
+	m.queued = append(m.queued, queuedCommand{cmd: cmd, name: name, args: args})
+}
+
+func (h *Handler) handleMulti(sess *Session, args []string) Value {
+	if len(args) != 0 {
+		return wrongArgs("multi")
+	}
+	if sess.multi != nil {
+		return Error("ERR MULTI calls can not be nested")
+	}
+
+	sess.multi = &multiState{}
+	return OK()
+}
+
+func (h *Handler) handleDiscard(sess *Session, args []string) Value {
+	if len(args) != 0 {
+		return wrongArgs("discard")
+	}
+	if sess.multi == nil {
+		return Error("ERR DISCARD without MULTI")
+	}
+
+	sess.multi = nil
+	h.unwatchAll(sess)
+	return OK()
+}
+
+// handleExec runs the queued commands and replies with an array of their
+// replies. As in Redis, a command that fails at run time doesn't stop the
+// others or undo what ran before it.
+func (h *Handler) handleExec(sess *Session, args []string) Value {
+	if len(args) != 0 {
+		return wrongArgs("exec")
+	}
+	if sess.multi == nil {
+		return Error("ERR EXEC without MULTI")
+	}
+
+	m := sess.multi
+	sess.multi = nil
+	defer h.unwatchAll(sess)
+
+	if m.failed {
+		return Error("EXECABORT Transaction discarded because of previous errors.")
+	}
+	var writes [][]string
+	for _, q := range m.queued {
+		if q.cmd.flags&cmdWrite != 0 && h.readOnly() {
+			return Error("EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.")
+		}
+		if q.cmd.flags&cmdWrite != 0 {
+			writes = append(writes, q.args)
+		}
+	}
+	if writeTooLarge(writes) {
+		return Error("EXECABORT Transaction discarded because of: " + errWriteTooLarge.Str)
+	}
+
+	if h.consensus != nil {
+		return h.execConsensusMulti(sess, m)
+	}
+
+	c := &call{sess: sess, nonBlocking: true}
+	defer h.commit(c)
+	h.writeMu.RLock()
+	defer h.writeMu.RUnlock()
+
+	for _, q := range m.queued {
+		if q.cmd.flags&cmdDenyOOM != 0 {
+			if err := h.freeMemory(); err != nil {
+				return Error("EXECABORT Transaction discarded because of: " + err.Error())
+			}
+			break
+		}
+	}
+
+	var keys txKeys
+	for key := range sess.watched {
+		keys.keys = append(keys.keys, key)
+	}
+	for _, q := range m.queued {
+		keys.add(q.cmd, q.args)
+	}
+
+	results := make([]Value, 0, len(m.queued))
+	aborted := false
+	var redirected *Value
+	keys.update(h.store, func(tx *store.Tx) {
+		if reply, ok := h.route(c, tx, keys); !ok {
+			redirected = &reply
+			return
+		}
+		for key, version := range sess.watched {
+			if tx.Version(key) != version {
+				aborted = true
+				return
+			}
+		}
+
+		c.tx = tx
+		for _, q := range m.queued {
+			c.name = q.name
+			start := time.Now()
+			reply := q.cmd.run(h, c, q.args)
+			h.stats.record(q.name, reply, start)
+			if reply.Type == typeReplies {
+				// Each confirmation of a SUBSCRIBE is an element, as in Redis
+				results = append(results, reply.Elems...)
+			} else {
+				results = append(results, reply)
+			}
+		}
+		h.finish(c)
+	})
+	if redirected != nil {
+		return *redirected
+	}
+	if aborted {
+		return NullArray()
+	}
+	return Array(results...)
+}
+
+func (h *Handler) handleWatch(sess *Session, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs("watch")
+	}
+	if sess.multi != nil {
+		return Error("ERR WATCH inside MULTI is not allowed")
+	}
+
+	if sess.watched == nil {
+		sess.watched = make(map[string]uint64)
+	}
+	for _, key := range args {
+		if _, ok := sess.watched[key]; !ok {
+			sess.watched[key] = h.store.Watch(key)
+		}
+	}
+	return OK()
+}
+
+func (h *Handler) handleUnwatch(sess *Session, args []string) Value {
+	if len(args) != 0 {
+		return wrongArgs("unwatch")
+	}
+	if sess.multi != nil {
+		// EXEC and DISCARD drop the watches anyway
+		return SimpleString("QUEUED")
+	}
+
+	h.unwatchAll(sess)
+	return OK()
+}
+
+func (h *Handler) unwatchAll(sess *Session) {
+	for key := range sess.watched {
+		h.store.Unwatch(key)
+	}
+	sess.watched = nil
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import "fmt"
+
+// Keyspace notifications. When enabled, each change to a key is published
+// as in Redis: on __keyspace@0__:<key> with the event as the message, and
+// on __keyevent@0__:<event> with the key as the message. They are off by
+// default and enabled per class of event, so subscribers only pay for what
+// they asked for. Like other messages they are fire-and-forget: a
+// subscriber that isn't connected when a key changes never hears of it.
+
+type notifyFlags uint32
+
+const (
+	notifyKeyspace notifyFlags = 1 << iota // K: __keyspace@0__ channels
+	notifyKeyevent                         // E: __keyevent@0__ channels
+	notifyGeneric                          // g: del, expire, persist
+	notifyString                           // $: set, incrby, decrby
+	notifyList                             // l: lpush, rpush, lpop, rpop
+	notifyHash                             // h: hset, hdel
+	notifySet                              // s: sadd, srem
+	notifyZSet                             // z: zadd
+	notifyExpired                          // x: expired
+	notifyEvicted                          // e: evicted
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifyHash |
+		notifySet | notifyZSet | notifyExpired | notifyEvicted // A
+)
+
+var notifyLetters = map[rune]notifyFlags{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': notifyGeneric,
+	'$': notifyString,
+	'l': notifyList,
+	'h': notifyHash,
+	's': notifySet,
+	'z': notifyZSet,
+	'x': notifyExpired,
+	'e': notifyEvicted,
+	'A': notifyAll,
+}
+
+// SetKeyspaceEvents selects the keyspace notifications to publish, with the
+// letters of Redis' notify-keyspace-events: K and E pick the channels, and
+// g, $, l, h, s, z, x, e or A (all of them) the events. Nothing is
+// published unless both a channel and an event are picked, so the empty
+// string turns notifications off.
+func (h *Handler) SetKeyspaceEvents(flags string) error {
+	var f notifyFlags
+	for _, r := range flags {
+		bit, ok := notifyLetters[r]
+		if !ok {
+			return fmt.Errorf("invalid keyspace event flag %q", r)
+		}
+		f |= bit
+	}
+	h.events.Store(uint32(f))
+	return nil
+}
+
+// keyEvent is a change to a key, published once the write is logged.
+type keyEvent struct {
+	class notifyFlags
+	event string
+	key   string
+}
+
+// notify records a keyspace event for the command's key.
+func (c *call) notify(class notifyFlags, event, key string) {
+	c.events = append(c.events, keyEvent{class, event, key})
+}
+
+// notifyIfGone records a del event if a command removed the last element
+// of key.
+func (c *call) notifyIfGone(key string) {
+	if !c.tx.Exists(key) {
+		c.notify(notifyGeneric, "del", key)
+	}
+}
+
+func (h *Handler) publishEvents(events []keyEvent) {
+	for _, e := range events {
+		h.publishEvent(e.class, e.event, e.key)
+	}
+}
+
+// notifyRemoved publishes an event for each key that expiry or eviction
+// removed from the store.
+func (h *Handler) notifyRemoved(class notifyFlags, event string, keys []string) {
+	for _, key := range keys {
+		h.publishEvent(class, event, key)
+	}
+}
+
+func (h *Handler) publishEvent(class notifyFlags, event, key string) {
+	flags := notifyFlags(h.events.Load())
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		h.pubsub.publish("__keyspace@0__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		h.pubsub.publish("__keyevent@0__:"+event, key)
+	}
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyspaceMessages returns the channel and payload of each message waiting
+// for sess.
+func keyspaceMessages(sess *Session) [][2]string {
+	var out [][2]string
+	for _, v := range sess.TakePushes() {
+		fields := v.Strings()
+		out = append(out, [2]string{fields[len(fields)-2], fields[len(fields)-1]})
+	}
+	return out
+}
+
+func TestHandler_KeyspaceNotifications(t *testing.T) {
+	kvStore := store.NewKVStore()
+	handler := NewHandler(kvStore, nil)
+	sub := handler.NewSession()
+	handler.Exec(sub, []string{"PSUBSCRIBE", "__key*__:*"})
+
+	// Off by default
+	handler.Handle("SET key value")
+	assert.Empty(t, sub.TakePushes())
+
+	require.NoError(t, handler.SetKeyspaceEvents("KEA"))
+	for _, command := range []string{
+		"SET key value",
+		"SETNX key other",
+		"INCR counter",
+		"DECRBY counter 2",
+		"PEXPIRE key 100000",
+		"PERSIST key",
+		"DEL key missing",
+		"RPUSH list a b",
+		"LPOP list",
+		"RPOP list",
+		"HSET hash f v",
+		"HDEL hash f",
+		"SADD set m",
+		"ZADD zset 1 m",
+	} {
+		handler.Handle(command)
+	}
+	handler.Exec(handler.NewSession(), []string{"SET", "temp", "value", "PX", "1"})
+	assert.Equal(t, [][2]string{
+		{"__keyspace@0__:key", "set"},
+		{"__keyevent@0__:set", "key"},
+		{"__keyspace@0__:counter", "incrby"},
+		{"__keyevent@0__:incrby", "counter"},
+		{"__keyspace@0__:counter", "decrby"},
+		{"__keyevent@0__:decrby", "counter"},
+		{"__keyspace@0__:key", "expire"},
+		{"__keyevent@0__:expire", "key"},
+		{"__keyspace@0__:key", "persist"},
+		{"__keyevent@0__:persist", "key"},
+		{"__keyspace@0__:key", "del"},
+		{"__keyevent@0__:del", "key"},
+		{"__keyspace@0__:list", "rpush"},
+		{"__keyevent@0__:rpush", "list"},
+		{"__keyspace@0__:list", "lpop"},
+		{"__keyevent@0__:lpop", "list"},
+		{"__keyspace@0__:list", "rpop"},
+		{"__keyevent@0__:rpop", "list"},
+		{"__keyspace@0__:list", "del"},
+		{"__keyevent@0__:del", "list"},
+		{"__keyspace@0__:hash", "hset"},
+		{"__keyevent@0__:hset", "hash"},
+		{"__keyspace@0__:hash", "hdel"},
+		{"__keyevent@0__:hdel", "hash"},
+		{"__keyspace@0__:hash", "del"},
+		{"__keyevent@0__:del", "hash"},
+		{"__keyspace@0__:set", "sadd"},
+		{"__keyevent@0__:sadd", "set"},
+		{"__keyspace@0__:zset", "zadd"},
+		{"__keyevent@0__:zadd", "zset"},
+		{"__keyspace@0__:temp", "set"},
+		{"__keyevent@0__:set", "temp"},
+		{"__keyspace@0__:temp", "expire"},
+		{"__keyevent@0__:expire", "temp"},
+	}, keyspaceMessages(sub))
+
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 1, kvStore.ExpireCycle())
+	assert.Equal(t, [][2]string{
+		{"__keyspace@0__:temp", "expired"},
+		{"__keyevent@0__:expired", "temp"},
+	}, keyspaceMessages(sub))
+}
+
+func TestHandler_KeyspaceNotificationClasses(t *testing.T) {
+	handler := NewHandler(store.NewKVStore(), nil)
+	sub := handler.NewSession()
+	handler.Exec(sub, []string{"PSUBSCRIBE", "__key*__:*"})
+
+	// Only list events, only on keyevent channels
+	require.NoError(t, handler.SetKeyspaceEvents("El"))
+	handler.Handle("SET key value")
+	handler.Handle("LPUSH list a")
+	handler.Handle("DEL list")
+	assert.Equal(t, [][2]string{{"__keyevent@0__:lpush", "list"}}, keyspaceMessages(sub))
+
+	// Events without a channel publish nothing
+	require.NoError(t, handler.SetKeyspaceEvents("A"))
+	handler.Handle("SET key value")
+	assert.Empty(t, sub.TakePushes())
+
+	assert.Error(t, handler.SetKeyspaceEvents("KEQ"))
+}
+
+func TestHandler_KeyspaceNotificationsForBlockedPops(t *testing.T) {
+	handler := NewHandler(store.NewKVStore(), nil)
+	require.NoError(t, handler.SetKeyspaceEvents("Kl"))
+
+	reply := blockPop(t, handler, "queue", "BLPOP", "queue", "0")
+	sub := handler.NewSession()
+	handler.Exec(sub, []string{"SUBSCRIBE", "__keyspace@0__:queue"})
+	sub.TakePushes()
+
+	// The push is published before the pop it wakes
+	handler.Handle("RPUSH queue job")
+	assert.Equal(t, []string{"queue", "job"}, receive(t, reply).Strings())
+	assert.Equal(t, [][2]string{
+		{"__keyspace@0__:queue", "rpush"},
+		{"__keyspace@0__:queue", "lpop"},
+	}, keyspaceMessages(sub))
+}
@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// DefaultPubSubLimit is how many messages may wait for a subscriber before
+// it is considered too slow and disconnected.
+const DefaultPubSubLimit = 1024
+
+// Publish/subscribe. Messages don't touch the store or the WAL: PUBLISH hands
+// them to every session subscribed to the channel, or to a pattern matching
+// it, and forgets them. Each session buffers its messages until the server
+// writes them out; a session whose buffer fills up is dropped rather than
+// letting it hold up publishers or grow without bound.
+
+type pubsub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Session]struct{}
+	patterns map[string]map[*Session]struct{}
+	limit    int
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*Session]struct{}),
+		patterns: make(map[string]map[*Session]struct{}),
+		limit:    DefaultPubSubLimit,
+	}
+}
+
+// SetPubSubLimit sets how many messages may wait for a subscriber before it
+// is disconnected.
+func (h *Handler) SetPubSubLimit(n int) {
+	h.pubsub.mu.Lock()
+	defer h.pubsub.mu.Unlock()
+
+	if n < 1 {
+		n = 1
+	}
+	h.pubsub.limit = n
+}
+
+// subscribe adds sess to subs[name] and reports whether it wasn't there yet.
+func (ps *pubsub) subscribe(subs map[string]map[*Session]struct{}, name string, sess *Session) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	set, ok := subs[name]
+	if !ok {
+		set = make(map[*Session]struct{})
+		subs[name] = set
+	}
+	if _, ok := set[sess]; ok {
+		return false
+	}
+	set[sess] = struct{}{}
+	return true
+}
+
+func (ps *pubsub) unsubscribe(subs map[string]map[*Session]struct{}, name string, sess *Session) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if set, ok := subs[name]; ok {
+		delete(set, sess)
+		if len(set) == 0 {
+			delete(subs, name)
+		}
+	}
+}
+
+// counts returns how many channels and patterns have subscribers.
+func (ps *pubsub) counts() (channels, patterns int) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.channels), len(ps.patterns)
+}
+
+// publish delivers message to the subscribers of channel and of patterns
+// matching it, and returns how many deliveries it made.
+func (ps *pubsub) publish(channel, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	receivers := 0
+	for sess := range ps.channels[channel] {
+		sess.deliver(Push(BulkString("message"), BulkString(channel), BulkString(message)), ps.limit)
+		receivers++
+	}
+	for pattern, set := range ps.patterns {
+		if !store.MatchPattern(channel, pattern) {
+			continue
+		}
+		for sess := range set {
+			sess.deliver(Push(BulkString("pmessage"), BulkString(pattern), BulkString(channel), BulkString(message)), ps.limit)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// deliver queues a message for the session, or drops the session if too
+// many are already waiting.
+func (s *Session) deliver(v Value, limit int) {
+	s.pushMu.Lock()
+	defer s.pushMu.Unlock()
+
+	if s.overflowed {
+		return
+	}
+	if len(s.pushes) >= limit {
+		s.overflowed = true
+		s.pushes = nil
+		close(s.dropped)
+		return
+	}
+
+	s.pushes = append(s.pushes, v)
+	select {
+	case s.pushReady <- struct{}{}:
+	default:
+	}
+}
+
+// PushReady is signalled when messages are waiting in TakePushes.
+func (s *Session) PushReady() <-chan struct{} { return s.pushReady }
+
+// TakePushes returns the messages waiting for the session and clears them.
+func (s *Session) TakePushes() []Value {
+	s.pushMu.Lock()
+	defer s.pushMu.Unlock()
+
+	pushes := s.pushes
+	s.pushes = nil
+	return pushes
+}
+
+// Dropped is closed when the session fell too far behind on its messages.
+// The connection should then be closed.
+func (s *Session) Dropped() <-chan struct{} { return s.dropped }
+
+// subscriptions is the number of channels and patterns the session is
+// subscribed to.
+func (s *Session) subscriptions() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+func (h *Handler) handleSubscribe(c *call, args []string) Value {
+	if len(args) < 1 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+
+	sess := c.sess
+	subs, kind := h.pubsub.channels, "subscribe"
+	if c.name == "PSUBSCRIBE" {
+		subs, kind = h.pubsub.patterns, "psubscribe"
+	}
+
+	out := make([]Value, 0, len(args))
+	for _, name := range args {
+		if h.pubsub.subscribe(subs, name, sess) {
+			if kind == "subscribe" {
+				sess.channels = addName(sess.channels, name)
+			} else {
+				sess.patterns = addName(sess.patterns, name)
+			}
+		}
+		out = append(out, Push(BulkString(kind), BulkString(name), Integer(int64(sess.subscriptions()))))
+	}
+	return replies(out...)
+}
+
+// handleUnsubscribe implements UNSUBSCRIBE and PUNSUBSCRIBE. Without
+// arguments, every channel or pattern is dropped.
+func (h *Handler) handleUnsubscribe(c *call, args []string) Value {
+	sess := c.sess
+	subs, names, kind := h.pubsub.channels, sess.channels, "unsubscribe"
+	if c.name == "PUNSUBSCRIBE" {
+		subs, names, kind = h.pubsub.patterns, sess.patterns, "punsubscribe"
+	}
+
+	if len(args) == 0 {
+		if len(names) == 0 {
+			return Push(BulkString(kind), NullBulk(), Integer(int64(sess.subscriptions())))
+		}
+		for name := range names {
+			args = append(args, name)
+		}
+		sort.Strings(args)
+	}
+
+	out := make([]Value, 0, len(args))
+	for _, name := range args {
+		if _, ok := names[name]; ok {
+			h.pubsub.unsubscribe(subs, name, sess)
+			delete(names, name)
+		}
+		out = append(out, Push(BulkString(kind), BulkString(name), Integer(int64(sess.subscriptions()))))
+	}
+	return replies(out...)
+}
+
+func (h *Handler) handlePublish(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("publish")
+	}
+	return Integer(int64(h.pubsub.publish(args[0], args[1])))
+}
+
+// unsubscribeAll drops every subscription of a session that is going away.
+func (h *Handler) unsubscribeAll(sess *Session) {
+	for name := range sess.channels {
+		h.pubsub.unsubscribe(h.pubsub.channels, name, sess)
+	}
+	for name := range sess.patterns {
+		h.pubsub.unsubscribe(h.pubsub.patterns, name, sess)
+	}
+	sess.channels = nil
+	sess.patterns = nil
+}
+
+func addName(names map[string]struct{}, name string) map[string]struct{} {
+	if names == nil {
+		names = make(map[string]struct{})
+	}
+	names[name] = struct{}{}
+	return names
+}
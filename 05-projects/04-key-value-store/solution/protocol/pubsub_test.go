@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_PublishSubscribe(t *testing.T) {
+	handler := NewHandler(nil, nil)
+	sub := handler.NewSession()
+	psub := handler.NewSession()
+	pub := handler.NewSession()
+
+	reply := handler.Exec(sub, []string{"SUBSCRIBE", "news", "sport"})
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n", string(reply.AppendRESP(nil, 2)))
+
+	reply = handler.Exec(psub, []string{"PSUBSCRIBE", "n?ws*"})
+	assert.Equal(t, []string{"psubscribe", "n?ws*", "1"}, reply.Elems[0].Strings())
+
+	assert.Equal(t, Integer(2), handler.Exec(pub, []string{"PUBLISH", "news", "hello"}))
+	assert.Equal(t, Integer(1), handler.Exec(pub, []string{"PUBLISH", "newsroom", "hi"}))
+	assert.Equal(t, Integer(0), handler.Exec(pub, []string{"PUBLISH", "weather", "rain"}))
+
+	pushes := sub.TakePushes()
+	require.Len(t, pushes, 1)
+	assert.Equal(t, TypePush, pushes[0].Type)
+	assert.Equal(t, []string{"message", "news", "hello"}, pushes[0].Strings())
+
+	pushes = psub.TakePushes()
+	require.Len(t, pushes, 2)
+	assert.Equal(t, []string{"pmessage", "n?ws*", "news", "hello"}, pushes[0].Strings())
+	assert.Equal(t, []string{"pmessage", "n?ws*", "newsroom", "hi"}, pushes[1].Strings())
+
+	// Unsubscribing from everything, in name order
+	reply = handler.Exec(sub, []string{"UNSUBSCRIBE"})
+	require.Len(t, reply.Elems, 2)
+	assert.Equal(t, []string{"unsubscribe", "news", "1"}, reply.Elems[0].Strings())
+	assert.Equal(t, []string{"unsubscribe", "sport", "0"}, reply.Elems[1].Strings())
+	assert.Equal(t, Integer(1), handler.Exec(pub, []string{"PUBLISH", "news", "again"}))
+
+	handler.CloseSession(psub)
+	assert.Equal(t, Integer(0), handler.Exec(pub, []string{"PUBLISH", "news", "again"}))
+}
+
+func TestHandler_SubscribedMode(t *testing.T) {
+	handler := NewHandler(nil, nil)
+	sess := handler.NewSession()
+
+	handler.Exec(sess, []string{"SUBSCRIBE", "ch"})
+	reply := handler.Exec(sess, []string{"GET", "key"})
+	assert.True(t, reply.IsError())
+	assert.Contains(t, reply.Str, "only (P)SUBSCRIBE")
+	assert.Equal(t, []string{"pong", ""}, handler.Exec(sess, []string{"PING"}).Strings())
+
+	handler.Exec(sess, []string{"UNSUBSCRIBE", "ch"})
+	assert.Equal(t, SimpleString("PONG"), handler.Exec(sess, []string{"PING"}))
+
+	// RESP3 tells pushes apart from replies, so anything goes
+	resp3 := handler.NewSession()
+	handler.Exec(resp3, []string{"HELLO", "3"})
+	handler.Exec(resp3, []string{"SUBSCRIBE", "ch"})
+	assert.Equal(t, SimpleString("PONG"), handler.Exec(resp3, []string{"PING"}))
+	assert.Equal(t, BulkString("x"), handler.Exec(resp3, []string{"ECHO", "x"}))
+}
+
+func TestHandler_SlowSubscriberDropped(t *testing.T) {
+	handler := NewHandler(nil, nil)
+	handler.SetPubSubLimit(3)
+	sub := handler.NewSession()
+	pub := handler.NewSession()
+	handler.Exec(sub, []string{"SUBSCRIBE", "ch"})
+
+	for i := 0; i < 3; i++ {
+		handler.Exec(pub, []string{"PUBLISH", "ch", "msg"})
+	}
+	select {
+	case <-sub.PushReady():
+	default:
+		t.Fatal("expected pending messages")
+	}
+	select {
+	case <-sub.Dropped():
+		t.Fatal("dropped before the buffer was full")
+	default:
+	}
+
+	handler.Exec(pub, []string{"PUBLISH", "ch", "msg"})
+	select {
+	case <-sub.Dropped():
+	default:
+		t.Fatal("expected the subscriber to be dropped")
+	}
+	assert.Empty(t, sub.TakePushes())
+}
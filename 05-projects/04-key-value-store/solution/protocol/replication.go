@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Replication is the replication layer as the handler sees it. It lives in
+// its own package, which builds on this one for the wire format.
+type Replication interface {
+	// ReplicaOf starts following the leader at addr, or stops following
+	// if addr is empty.
+	ReplicaOf(addr string) error
+	// IsReplica reports whether the node follows a leader, in which case
+	// clients may not write to it.
+	IsReplica() bool
+	// ServeReplica takes over a connection that sent PSYNC and streams the
+	// dataset and then every write to it. replid and offset are what the
+	// replica last saw, or "?" and -1.
+	ServeReplica(conn net.Conn, r *Reader, w *Writer, replid string, offset int64)
+}
+
+// SetReplication enables REPLICAOF and PSYNC.
+func (h *Handler) SetReplication(r Replication) {
+	h.replication = r
+}
+
+// WriteLock returns the lock that keeps writes out: holding it, none is
+// between being applied to the store and being logged, so the store
+// reflects exactly the records in the WAL.
+func (h *Handler) WriteLock() sync.Locker {
+	return &h.writeMu
+}
+
+// Handoff returns the function the server must hand the connection to after
+// writing the reply, or nil. The session is done once it is set.
+func (s *Session) Handoff() func(conn net.Conn, r *Reader, w *Writer) {
+	return s.handoff
+}
+
+// handleReplicaOf implements REPLICAOF host port and REPLICAOF NO ONE.
+func (h *Handler) handleReplicaOf(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs(strings.ToLower(c.name))
+	}
+	if h.replication == nil {
+		return Error("ERR replication is not enabled")
+	}
+
+	addr := ""
+	if !strings.EqualFold(args[0], "NO") || !strings.EqualFold(args[1], "ONE") {
+		if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+			return Error("ERR Invalid master port")
+		}
+		addr = net.JoinHostPort(args[0], args[1])
+	}
+
+	if err := h.replication.ReplicaOf(addr); err != nil {
+		return errorValue(err)
+	}
+	return OK()
+}
+
+// handlePSync implements PSYNC replid offset, sent by a replica to start
+// or resume replication. The reply and everything after it is written by
+// the replication layer.
+func (h *Handler) handlePSync(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("psync")
+	}
+	if h.replication == nil {
+		return Error("ERR replication is not enabled")
+	}
+
+	replid := args[0]
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return notInteger()
+	}
+
+	c.sess.handoff = func(conn net.Conn, r *Reader, w *Writer) {
+		h.replication.ServeReplica(conn, r, w, replid, offset)
+	}
+	return replies()
+}
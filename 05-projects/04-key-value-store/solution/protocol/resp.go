@@ -0,0 +1,631 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Type identifies a RESP value by its leading byte on the wire.
+type Type byte
+
+const (
+	TypeSimpleString Type = '+'
+	TypeError        Type = '-'
+	TypeInteger      Type = ':'
+	TypeBulkString   Type = '$'
+	TypeArray        Type = '*'
+
+	// RESP3 additions
+	TypeNull      Type = '_'
+	TypeBoolean   Type = '#'
+	TypeDouble    Type = ','
+	TypeBigNumber Type = '('
+	TypeBulkError Type = '!'
+	TypeVerbatim  Type = '='
+	TypeMap       Type = '%'
+	TypeSet       Type = '~'
+	TypePush      Type = '>'
+	TypeAttribute Type = '|'
+
+	// typeReplies is not on the wire: it holds several replies sent for one
+	// command, such as SUBSCRIBE with more than one channel.
+	typeReplies Type = 0
+)
+
+const (
+	maxBulkLen  = 512 * 1024 * 1024
+	maxArrayLen = 1024 * 1024
+	maxInline   = 64 * 1024
+	maxDepth    = 128
+
+	// Slices and buffers sized from a length on the wire start no bigger
+	// than this and grow as the data arrives, so that a header alone
+	// can't make the reader allocate much.
+	maxPrealloc     = 64
+	maxBulkPrealloc = 64 * 1024
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// Value is a single RESP2/RESP3 value. Aggregate types keep their children in
+// Elems; maps and attributes store them as alternating key, value pairs.
+type Value struct {
+	Type  Type
+	Str   string
+	Int   int64
+	Float float64
+	Bool  bool
+	Elems []Value
+	Null  bool
+}
+
+func SimpleString(s string) Value { return Value{Type: TypeSimpleString, Str: s} }
+func Error(msg string) Value      { return Value{Type: TypeError, Str: msg} }
+func Integer(n int64) Value       { return Value{Type: TypeInteger, Int: n} }
+func BulkString(s string) Value   { return Value{Type: TypeBulkString, Str: s} }
+func Double(f float64) Value      { return Value{Type: TypeDouble, Float: f} }
+func Boolean(b bool) Value        { return Value{Type: TypeBoolean, Bool: b} }
+func Array(elems ...Value) Value  { return Value{Type: TypeArray, Elems: elems} }
+func Set(elems ...Value) Value    { return Value{Type: TypeSet, Elems: elems} }
+func Push(elems ...Value) Value   { return Value{Type: TypePush, Elems: elems} }
+
+// replies sends each of vals as a reply of its own.
+func replies(vals ...Value) Value { return Value{Type: typeReplies, Elems: vals} }
+
+// Map builds a map reply from alternating key, value pairs.
+func Map(pairs ...Value) Value { return Value{Type: TypeMap, Elems: pairs} }
+
+// NullBulk is the "key not found" reply: $-1 in RESP2 and _ in RESP3.
+func NullBulk() Value { return Value{Type: TypeBulkString, Null: true} }
+
+// NullArray is encoded as *-1 in RESP2 and _ in RESP3.
+func NullArray() Value { return Value{Type: TypeArray, Null: true} }
+
+// OK is the canonical +OK reply.
+func OK() Value { return SimpleString("OK") }
+
+// Errorf builds an error reply from a format string.
+func Errorf(format string, args ...interface{}) Value {
+	return Error(fmt.Sprintf(format, args...))
+}
+
+// BulkStrings builds an array of bulk strings.
+func BulkStrings(items []string) Value {
+	elems := make([]Value, len(items))
+	for i, s := range items {
+		elems[i] = BulkString(s)
+	}
+	return Array(elems...)
+}
+
+// IsError reports whether v is a simple or bulk error.
+func (v Value) IsError() bool {
+	return v.Type == TypeError || v.Type == TypeBulkError
+}
+
+// Text returns the value as a string for scalar types.
+func (v Value) Text() string {
+	switch v.Type {
+	case TypeInteger:
+		return strconv.FormatInt(v.Int, 10)
+	case TypeDouble:
+		return formatDouble(v.Float)
+	case TypeBoolean:
+		if v.Bool {
+			return "1"
+		}
+		return "0"
+	default:
+		return v.Str
+	}
+}
+
+// Strings flattens an aggregate of scalars into a string slice.
+func (v Value) Strings() []string {
+	out := make([]string, len(v.Elems))
+	for i, e := range v.Elems {
+		out[i] = e.Text()
+	}
+	return out
+}
+
+// AppendRESP appends the wire encoding of v to buf. proto selects RESP2 or
+// RESP3; RESP3-only types are downgraded to their RESP2 equivalents when
+// proto is 2.
+func (v Value) AppendRESP(buf []byte, proto int) []byte {
+	if v.Null {
+		if proto >= 3 {
+			return append(buf, "_\r\n"...)
+		}
+		if v.Type == TypeArray || v.Type == TypeMap || v.Type == TypeSet || v.Type == TypePush {
+			return append(buf, "*-1\r\n"...)
+		}
+		return append(buf, "$-1\r\n"...)
+	}
+
+	switch v.Type {
+	case TypeSimpleString, TypeError:
+		buf = append(buf, byte(v.Type))
+		buf = append(buf, sanitizeLine(v.Str)...)
+		return append(buf, "\r\n"...)
+	case TypeInteger:
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, v.Int, 10)
+		return append(buf, "\r\n"...)
+	case TypeBulkString:
+		return appendBulk(buf, '$', v.Str)
+	case TypeNull:
+		if proto >= 3 {
+			return append(buf, "_\r\n"...)
+		}
+		return append(buf, "$-1\r\n"...)
+	case TypeBoolean:
+		if proto >= 3 {
+			if v.Bool {
+				return append(buf, "#t\r\n"...)
+			}
+			return append(buf, "#f\r\n"...)
+		}
+		if v.Bool {
+			return append(buf, ":1\r\n"...)
+		}
+		return append(buf, ":0\r\n"...)
+	case TypeDouble:
+		if proto >= 3 {
+			buf = append(buf, ',')
+			buf = append(buf, formatDouble(v.Float)...)
+			return append(buf, "\r\n"...)
+		}
+		return appendBulk(buf, '$', formatDouble(v.Float))
+	case TypeBigNumber:
+		if proto >= 3 {
+			buf = append(buf, '(')
+			buf = append(buf, v.Str...)
+			return append(buf, "\r\n"...)
+		}
+		return appendBulk(buf, '$', v.Str)
+	case TypeBulkError:
+		if proto >= 3 {
+			return appendBulk(buf, '!', v.Str)
+		}
+		buf = append(buf, '-')
+		buf = append(buf, sanitizeLine(v.Str)...)
+		return append(buf, "\r\n"...)
+	case TypeVerbatim:
+		if proto >= 3 {
+			return appendBulk(buf, '=', v.Str)
+		}
+		text := v.Str
+		if len(text) >= 4 && text[3] == ':' {
+			text = text[4:]
+		}
+		return appendBulk(buf, '$', text)
+	case TypeArray, TypeSet, TypePush:
+		prefix := byte(v.Type)
+		if proto < 3 {
+			prefix = '*'
+		}
+		buf = appendHeader(buf, prefix, len(v.Elems))
+		for _, e := range v.Elems {
+			buf = e.AppendRESP(buf, proto)
+		}
+		return buf
+	case TypeMap, TypeAttribute:
+		if proto >= 3 {
+			buf = appendHeader(buf, byte(v.Type), len(v.Elems)/2)
+		} else {
+			buf = appendHeader(buf, '*', len(v.Elems))
+		}
+		for _, e := range v.Elems {
+			buf = e.AppendRESP(buf, proto)
+		}
+		return buf
+	case typeReplies:
+		for _, e := range v.Elems {
+			buf = e.AppendRESP(buf, proto)
+		}
+		return buf
+	default:
+		buf = append(buf, "-ERR unsupported reply type\r\n"...)
+		return buf
+	}
+}
+
+func appendHeader(buf []byte, prefix byte, n int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, "\r\n"...)
+}
+
+func appendBulk(buf []byte, prefix byte, s string) []byte {
+	buf = appendHeader(buf, prefix, len(s))
+	buf = append(buf, s...)
+	return append(buf, "\r\n"...)
+}
+
+// sanitizeLine keeps simple strings and errors on one line.
+func sanitizeLine(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Reader decodes RESP values from a stream. It accepts both multibulk
+// commands and the inline format used by telnet and redis-cli.
+type Reader struct {
+	rd *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Reader{rd: br}
+	}
+	return &Reader{rd: bufio.NewReaderSize(r, 16*1024)}
+}
+
+// Buffered returns the number of bytes that can be read without blocking.
+// The server uses it to batch replies for pipelined commands.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// Peek waits until there is input to read, without consuming any. The
+// server uses it to notice a client hanging up while its command blocks.
+func (r *Reader) Peek() error {
+	_, err := r.rd.Peek(1)
+	return err
+}
+
+// ReadCommand reads the next client command as a list of arguments. An empty
+// inline line yields an empty, non-nil slice.
+func (r *Reader) ReadCommand() ([]string, error) {
+	b, err := r.rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] != '*' {
+		line, err := r.readLine(maxInline)
+		if err != nil {
+			return nil, err
+		}
+		return SplitArgs(line)
+	}
+
+	// Commands are a flat array of bulk strings, as in Redis; nothing
+	// else is accepted, so no command can nest
+	line, err := r.readLine(maxInline)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseLength(line[1:], maxArrayLen)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, min(max(n, 0), maxPrealloc))
+	for range n {
+		line, err := r.readLine(maxInline)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || Type(line[0]) != TypeBulkString {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", ErrProtocol, sanitizeLine(line[:min(len(line), 1)]))
+		}
+		size, err := parseLength(line[1:], maxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("%w: expected bulk string in command", ErrProtocol)
+		}
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// ReadValue reads the next RESP value, including RESP3 types. Aggregates
+// may nest up to 128 levels deep.
+func (r *Reader) ReadValue() (Value, error) {
+	return r.readValue(0)
+}
+
+func (r *Reader) readValue(depth int) (Value, error) {
+	line, err := r.readLine(maxInline)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+
+	t, body := Type(line[0]), line[1:]
+	switch t {
+	case TypeSimpleString, TypeError, TypeBigNumber:
+		return Value{Type: t, Str: body}, nil
+	case TypeInteger:
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("%w: invalid integer %q", ErrProtocol, body)
+		}
+		return Integer(n), nil
+	case TypeNull:
+		return Value{Type: TypeNull, Null: true}, nil
+	case TypeBoolean:
+		switch body {
+		case "t":
+			return Boolean(true), nil
+		case "f":
+			return Boolean(false), nil
+		}
+		return Value{}, fmt.Errorf("%w: invalid boolean %q", ErrProtocol, body)
+	case TypeDouble:
+		f, err := parseDouble(body)
+		if err != nil {
+			return Value{}, fmt.Errorf("%w: invalid double %q", ErrProtocol, body)
+		}
+		return Double(f), nil
+	case TypeBulkString, TypeBulkError, TypeVerbatim:
+		n, err := parseLength(body, maxBulkLen)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			return Value{Type: t, Null: true}, nil
+		}
+		str, err := r.readBulk(n)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Type: t, Str: str}, nil
+	case TypeArray, TypeSet, TypePush, TypeMap, TypeAttribute:
+		n, err := parseLength(body, maxArrayLen)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			return Value{Type: t, Null: true}, nil
+		}
+		if depth >= maxDepth {
+			return Value{}, fmt.Errorf("%w: aggregates nested too deeply", ErrProtocol)
+		}
+		if t == TypeMap || t == TypeAttribute {
+			n *= 2
+		}
+		elems := make([]Value, 0, min(n, maxPrealloc))
+		for range n {
+			e, err := r.readValue(depth + 1)
+			if err != nil {
+				return Value{}, err
+			}
+			elems = append(elems, e)
+		}
+		if t == TypeAttribute {
+			// Attributes are out-of-band metadata for the value that follows.
+			return r.readValue(depth)
+		}
+		return Value{Type: t, Elems: elems}, nil
+	default:
+		return Value{}, fmt.Errorf("%w: unknown type byte %q", ErrProtocol, line[0])
+	}
+}
+
+// readBulk reads the n bytes of a bulk string and the CRLF after them. Large
+// strings are read into a buffer that grows as they arrive.
+func (r *Reader) readBulk(n int) (string, error) {
+	var data []byte
+	if n <= maxBulkPrealloc {
+		data = make([]byte, n+2)
+		if _, err := io.ReadFull(r.rd, data); err != nil {
+			return "", err
+		}
+	} else {
+		var buf bytes.Buffer
+		buf.Grow(maxBulkPrealloc)
+		if _, err := io.CopyN(&buf, r.rd, int64(n)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		data = buf.Bytes()
+	}
+	if data[n] != '\r' || data[n+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return string(data[:n]), nil
+}
+
+func (r *Reader) readLine(limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.rd.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	return string(line), nil
+}
+
+func parseLength(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, s)
+	}
+	if n > limit {
+		return 0, fmt.Errorf("%w: length %d exceeds limit", ErrProtocol, n)
+	}
+	return n, nil
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Writer encodes replies onto a buffered stream.
+type Writer struct {
+	wr    *bufio.Writer
+	buf   []byte
+	proto int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriterSize(w, 16*1024), proto: 2}
+}
+
+// SetProtocol switches between RESP2 (2) and RESP3 (3) encoding.
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+func (w *Writer) WriteValue(v Value) error {
+	w.buf = v.AppendRESP(w.buf[:0], w.proto)
+	_, err := w.wr.Write(w.buf)
+	return err
+}
+
+// WriteCommand encodes args as a multibulk command, as clients send them.
+func (w *Writer) WriteCommand(args ...string) error {
+	w.buf = appendHeader(w.buf[:0], '*', len(args))
+	for _, a := range args {
+		w.buf = appendBulk(w.buf, '$', a)
+	}
+	_, err := w.wr.Write(w.buf)
+	return err
+}
+
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+// SplitArgs splits an inline command line into arguments. Double-quoted
+// arguments support the usual backslash escapes (\n, \r, \t, \", \\, \xHH);
+// single-quoted arguments only support \'.
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var cur strings.Builder
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			if i >= len(line) {
+				if inDouble || inSingle {
+					return nil, fmt.Errorf("%w: unbalanced quotes in request", ErrProtocol)
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					cur.WriteByte(byte(n))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						cur.WriteByte('\n')
+					case 'r':
+						cur.WriteByte('\r')
+					case 't':
+						cur.WriteByte('\t')
+					case 'b':
+						cur.WriteByte('\b')
+					case 'a':
+						cur.WriteByte('\a')
+					default:
+						cur.WriteByte(line[i])
+					}
+				} else if c == '"' {
+					// Closing quote must be followed by a space or nothing.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("%w: unbalanced quotes in request", ErrProtocol)
+					}
+					done = true
+				} else {
+					cur.WriteByte(c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					cur.WriteByte('\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("%w: unbalanced quotes in request", ErrProtocol)
+					}
+					done = true
+				} else {
+					cur.WriteByte(c)
+				}
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					cur.WriteByte(c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, cur.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_ReadCommandMultibulk(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$12\r\nhello\r\nworld\r\n"
+	r := NewReader(strings.NewReader(input))
+
+	args, err := r.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SET", "key", "hello\r\nworld"}, args)
+}
+
+func TestReader_ReadCommandBinarySafe(t *testing.T) {
+	value := "a\x00b\xffc  d"
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteCommand("SET", "bin", value))
+	require.NoError(t, w.Flush())
+
+	args, err := NewReader(&buf).ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SET", "bin", value}, args)
+}
+
+func TestReader_ReadCommandInline(t *testing.T) {
+	r := NewReader(strings.NewReader("SET key \"hello world\\n\" 'it\\'s'\r\nPING\r\n"))
+
+	args, err := r.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SET", "key", "hello world\n", "it's"}, args)
+
+	args, err = r.ReadCommand()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PING"}, args)
+}
+
+func TestReader_Pipelined(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, w.WriteCommand("PING"))
+	}
+	require.NoError(t, w.Flush())
+
+	r := NewReader(&buf)
+	for i := 0; i < 3; i++ {
+		args, err := r.ReadCommand()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"PING"}, args)
+	}
+}
+
+func TestReader_ProtocolErrors(t *testing.T) {
+	tests := []string{
+		"*1\r\n:5\r\n",
+		"*1\r\n$3\r\nabcd\r\n",
+		"*1\r\n*1\r\n$1\r\na\r\n",
+		"*1\r\n$-1\r\n",
+		"*2\r\n$1\r\na\r\n\r\n",
+		"*x\r\n",
+		"SET \"unterminated\r\n",
+	}
+
+	for _, input := range tests {
+		_, err := NewReader(strings.NewReader(input)).ReadCommand()
+		assert.ErrorIs(t, err, ErrProtocol, "input %q", input)
+	}
+}
+
+func TestReader_Limits(t *testing.T) {
+	// Aggregates nest only so deep
+	nested := func(depth int) string { return strings.Repeat("*1\r\n", depth) + ":1\r\n" }
+	_, err := NewReader(strings.NewReader(nested(maxDepth))).ReadValue()
+	assert.NoError(t, err)
+	_, err = NewReader(strings.NewReader(nested(maxDepth + 1))).ReadValue()
+	assert.ErrorIs(t, err, ErrProtocol)
+	_, err = NewReader(strings.NewReader(nested(1 << 20))).ReadValue()
+	assert.ErrorIs(t, err, ErrProtocol)
+
+	// Lengths in headers with no data behind them allocate next to nothing
+	for _, input := range []string{
+		"*1048576\r\n",
+		"*1\r\n$536870912\r\nabc",
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := NewReader(strings.NewReader(input)).ReadCommand()
+		runtime.ReadMemStats(&after)
+		assert.Error(t, err, "input %q", input)
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20), "input %q", input)
+
+		runtime.ReadMemStats(&before)
+		_, err = NewReader(strings.NewReader(input)).ReadValue()
+		runtime.ReadMemStats(&after)
+		assert.Error(t, err, "input %q", input)
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20), "input %q", input)
+	}
+}
+
+func TestReader_ReadValueRESP3(t *testing.T) {
+	input := "%2\r\n+a\r\n#t\r\n+b\r\n,1.5\r\n" +
+		"~2\r\n:1\r\n:2\r\n" +
+		"_\r\n" +
+		"|1\r\n+ttl\r\n:3\r\n$2\r\nhi\r\n" +
+		"=8\r\ntxt:text\r\n"
+	r := NewReader(strings.NewReader(input))
+
+	v, err := r.ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, TypeMap, v.Type)
+	require.Len(t, v.Elems, 4)
+	assert.True(t, v.Elems[1].Bool)
+	assert.Equal(t, 1.5, v.Elems[3].Float)
+
+	v, err = r.ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, TypeSet, v.Type)
+	assert.Equal(t, []string{"1", "2"}, v.Strings())
+
+	v, err = r.ReadValue()
+	require.NoError(t, err)
+	assert.True(t, v.Null)
+
+	// Attributes are skipped in favour of the value they annotate
+	v, err = r.ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", v.Str)
+
+	v, err = r.ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, TypeVerbatim, v.Type)
+	assert.Equal(t, "txt:text", v.Str)
+}
+
+func TestValue_AppendRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		value Value
+		resp2 string
+		resp3 string
+	}{
+		{"simple", OK(), "+OK\r\n", "+OK\r\n"},
+		{"error", Error("ERR bad"), "-ERR bad\r\n", "-ERR bad\r\n"},
+		{"integer", Integer(-3), ":-3\r\n", ":-3\r\n"},
+		{"bulk", BulkString("a\r\nb"), "$4\r\na\r\nb\r\n", "$4\r\na\r\nb\r\n"},
+		{"null bulk", NullBulk(), "$-1\r\n", "_\r\n"},
+		{"null array", NullArray(), "*-1\r\n", "_\r\n"},
+		{"boolean", Boolean(true), ":1\r\n", "#t\r\n"},
+		{"double", Double(2.5), "$3\r\n2.5\r\n", ",2.5\r\n"},
+		{"array", BulkStrings([]string{"a", "b"}), "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{"map", Map(BulkString("k"), Integer(1)), "*2\r\n$1\r\nk\r\n:1\r\n", "%1\r\n$1\r\nk\r\n:1\r\n"},
+		{"set", Set(Integer(1)), "*1\r\n:1\r\n", "~1\r\n:1\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.resp2, string(tt.value.AppendRESP(nil, 2)))
+			assert.Equal(t, tt.resp3, string(tt.value.AppendRESP(nil, 3)))
+		})
+	}
+}
+
+func TestValue_RoundTrip(t *testing.T) {
+	original := Array(BulkString("x"), Integer(7), Array(SimpleString("nested")), NullBulk())
+
+	v, err := NewReader(bytes.NewReader(original.AppendRESP(nil, 2))).ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, original, v)
+}
+
+func TestHandler_Hello(t *testing.T) {
+	handler := NewHandler(nil, nil)
+	sess := handler.NewSession()
+
+	reply := handler.Exec(sess, []string{"HELLO", "3"})
+	require.Equal(t, TypeMap, reply.Type)
+	assert.Equal(t, 3, sess.Protocol())
+	fields := map[string]string{}
+	for i := 0; i+1 < len(reply.Elems); i += 2 {
+		fields[reply.Elems[i].Str] = reply.Elems[i+1].Str
+	}
+	assert.Equal(t, "standalone", fields["mode"])
+	assert.Equal(t, "master", fields["role"])
+
+	reply = handler.Exec(sess, []string{"HELLO", "4"})
+	assert.True(t, reply.IsError())
+	assert.Equal(t, 3, sess.Protocol())
+}
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/metrics"
+	"github.com/alyxpink/go-training/kvstore/persistence"
+)
+
+// Statistics for INFO and the metrics endpoint. Each command is counted and
+// timed in an entry made for it up front, so recording takes no lock. Names
+// that aren't commands aren't recorded, which keeps the number of series
+// bounded whatever clients send.
+
+type commandStats struct {
+	calls   atomic.Uint64
+	failed  atomic.Uint64 // calls that replied with an error
+	latency *metrics.Histogram
+}
+
+type stats struct {
+	started     time.Time
+	commands    map[string]*commandStats // not modified after newStats
+	connections atomic.Uint64            // sessions created
+	clients     atomic.Int64             // sessions not closed yet
+}
+
+func newStats() *stats {
+	s := &stats{started: time.Now(), commands: make(map[string]*commandStats)}
+	names := []string{"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH"}
+	for name := range commands {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		s.commands[name] = &commandStats{latency: metrics.NewHistogram(metrics.LatencyBuckets)}
+	}
+	return s
+}
+
+// record counts a call of the command name that started at start. The time
+// a blocking command spends waiting counts too.
+func (s *stats) record(name string, reply Value, start time.Time) {
+	cs, ok := s.commands[name]
+	if !ok {
+		return
+	}
+	cs.latency.Since(start)
+	cs.calls.Add(1)
+	if reply.IsError() {
+		cs.failed.Add(1)
+	}
+}
+
+// called returns the names of the commands that have run, in order.
+func (s *stats) called() []string {
+	var names []string
+	for name, cs := range s.commands {
+		if cs.calls.Load() > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SetSnapshotManager adds the snapshots sm takes to INFO and the metrics.
+func (h *Handler) SetSnapshotManager(sm *persistence.SnapshotManager) {
+	h.snapshots = sm
+}
+
+// infoSections are the sections of INFO in the order they are written.
+// Those that aren't default are only written on request.
+var infoSections = []struct {
+	name    string
+	dflt    bool
+	write   func(h *Handler, b *strings.Builder)
+	present func(h *Handler) bool
+}{
+	{"server", true, (*Handler).infoServer, nil},
+	{"clients", true, (*Handler).infoClients, nil},
+	{"memory", true, (*Handler).infoMemory, (*Handler).hasStore},
+	{"persistence", true, (*Handler).infoPersistence, nil},
+	{"stats", true, (*Handler).infoStats, nil},
+	{"replication", true, (*Handler).infoReplication, nil},
+	{"raft", true, (*Handler).infoRaft, func(h *Handler) bool { return h.consensus != nil }},
+	{"cluster", true, (*Handler).infoCluster, nil},
+	{"keyspace", true, (*Handler).infoKeyspace, (*Handler).hasStore},
+	{"commandstats", false, (*Handler).infoCommandStats, nil},
+}
+
+// handleInfo implements INFO [section ...]. Without a section, or with
+// "default", it returns the default sections; "all" and "everything" return
+// every one.
+func (h *Handler) handleInfo(c *call, args []string) Value {
+	want := func(name string, dflt bool) bool {
+		if len(args) == 0 {
+			return dflt
+		}
+		for _, arg := range args {
+			switch arg = strings.ToLower(arg); {
+			case arg == name, arg == "all", arg == "everything", arg == "default" && dflt:
+				return true
+			}
+		}
+		return false
+	}
+
+	var b strings.Builder
+	for _, s := range infoSections {
+		if !want(s.name, s.dflt) || (s.present != nil && !s.present(h)) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(s.name[:1]), s.name[1:])
+		s.write(h, &b)
+	}
+	return BulkString(b.String())
+}
+
+func (h *Handler) hasStore() bool { return h.store != nil }
+
+func infoField(b *strings.Builder, name string, value any) {
+	fmt.Fprintf(b, "%s:%v\r\n", name, value)
+}
+
+// serverMode returns how the server runs: standalone, raft or cluster.
+func (h *Handler) serverMode() string {
+	switch {
+	case h.consensus != nil:
+		return "raft"
+	case h.cluster != nil:
+		return "cluster"
+	}
+	return "standalone"
+}
+
+func (h *Handler) infoServer(b *strings.Builder) {
+	uptime := time.Since(h.stats.started)
+	infoField(b, "redis_version", serverVersion)
+	infoField(b, "server_mode", h.serverMode())
+	infoField(b, "process_id", os.Getpid())
+	infoField(b, "uptime_in_seconds", int64(uptime.Seconds()))
+	infoField(b, "uptime_in_days", int64(uptime.Hours()/24))
+}
+
+func (h *Handler) infoClients(b *strings.Builder) {
+	infoField(b, "connected_clients", h.stats.clients.Load())
+	infoField(b, "blocked_clients", h.blocking.count())
+}
+
+func (h *Handler) infoMemory(b *strings.Builder) {
+	st := h.store.Stats()
+	infoField(b, "used_memory", st.UsedMemory)
+	infoField(b, "maxmemory", st.MaxMemory)
+	infoField(b, "maxmemory_policy", st.Policy)
+}
+
+func (h *Handler) infoPersistence(b *strings.Builder) {
+	if h.wal == nil {
+		infoField(b, "wal_enabled", 0)
+	} else {
+		st := h.wal.Stats()
+		infoField(b, "wal_enabled", 1)
+		infoField(b, "wal_fsync_policy", st.Policy)
+		infoField(b, "wal_last_seq", st.LastSeq)
+		infoField(b, "wal_segment_bytes", st.SegmentSize)
+		infoField(b, "wal_fsyncs", st.Fsyncs.Count)
+		infoField(b, "wal_fsync_avg_usec", st.Fsyncs.Mean().Microseconds())
+	}
+
+	if h.snapshots == nil {
+		return
+	}
+	st := h.snapshots.Stats()
+	lastSave := int64(-1)
+	if !st.LastSave.IsZero() {
+		lastSave = st.LastSave.Unix()
+	}
+	status := "ok"
+	if st.LastFailed {
+		status = "err"
+	}
+	infoField(b, "rdb_saves", st.Saves)
+	infoField(b, "rdb_last_save_time", lastSave)
+	infoField(b, "rdb_last_bgsave_status", status)
+	infoField(b, "rdb_last_bgsave_time_sec", int64(st.LastDuration.Seconds()))
+}
+
+func (h *Handler) infoStats(b *strings.Builder) {
+	var processed, failed uint64
+	for _, cs := range h.stats.commands {
+		processed += cs.calls.Load()
+		failed += cs.failed.Load()
+	}
+	channels, patterns := h.pubsub.counts()
+
+	infoField(b, "total_connections_received", h.stats.connections.Load())
+	infoField(b, "total_commands_processed", processed)
+	infoField(b, "total_error_replies", failed)
+	if h.store != nil {
+		st := h.store.Stats()
+		infoField(b, "expired_keys", st.ExpiredKeys)
+		infoField(b, "evicted_keys", st.EvictedKeys)
+	}
+	infoField(b, "pubsub_channels", channels)
+	infoField(b, "pubsub_patterns", patterns)
+}
+
+func (h *Handler) infoReplication(b *strings.Builder) {
+	role := "master"
+	if h.readOnly() {
+		role = "slave"
+	}
+	infoField(b, "role", role)
+}
+
+func (h *Handler) infoRaft(b *strings.Builder) {
+	fields := h.consensus.Info()
+	for i := 0; i+1 < len(fields); i += 2 {
+		infoField(b, fields[i], fields[i+1])
+	}
+}
+
+func (h *Handler) infoKeyspace(b *strings.Builder) {
+	if st := h.store.Stats(); st.Keys > 0 {
+		fmt.Fprintf(b, "db0:keys=%d,expires=%d\r\n", st.Keys, st.Expires)
+	}
+}
+
+func (h *Handler) infoCommandStats(b *strings.Builder) {
+	for _, name := range h.stats.called() {
+		cs := h.stats.commands[name]
+		latency := cs.latency.Snapshot()
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,failed_calls=%d\r\n",
+			strings.ToLower(name), latency.Count, latency.Sum.Microseconds(),
+			float64(latency.Mean().Nanoseconds())/1e3, cs.failed.Load())
+	}
+}
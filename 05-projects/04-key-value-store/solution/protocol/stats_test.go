@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// infoFields parses an INFO reply into its section headers and fields.
+func infoFields(t *testing.T, v Value) (sections []string, fields map[string]string) {
+	t.Helper()
+
+	require.Equal(t, TypeBulkString, v.Type, v.Str)
+	fields = make(map[string]string)
+	for _, line := range strings.Split(v.Str, "\r\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# "):
+			sections = append(sections, strings.TrimPrefix(line, "# "))
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			require.True(t, ok, line)
+			fields[name] = value
+		}
+	}
+	return sections, fields
+}
+
+func TestHandler_Info(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+	sm := persistence.NewSnapshotManager(t.TempDir(), time.Minute, nil)
+	handler.SetSnapshotManager(sm)
+
+	sess := handler.NewSession()
+	handler.Exec(sess, []string{"SET", "a", "1"})
+	handler.Exec(sess, []string{"SET", "b", "two", "EX", "100"})
+	handler.Exec(sess, []string{"INCR", "b"})
+	handler.Exec(sess, []string{"NOSUCHCOMMAND"})
+	handler.Exec(handler.NewSession(), []string{"SUBSCRIBE", "news"})
+
+	sections, fields := infoFields(t, handler.Exec(sess, []string{"INFO"}))
+	assert.Equal(t, []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Replication", "Cluster", "Keyspace"}, sections)
+	assert.Equal(t, "standalone", fields["server_mode"])
+	assert.Equal(t, "0", fields["cluster_enabled"])
+	assert.Equal(t, "2", fields["connected_clients"])
+	assert.Equal(t, "1", fields["wal_enabled"])
+	assert.Equal(t, "always", fields["wal_fsync_policy"])
+	assert.Equal(t, "2", fields["wal_last_seq"], "only successful writes are logged")
+	assert.Equal(t, "0", fields["rdb_saves"])
+	assert.Equal(t, "-1", fields["rdb_last_save_time"])
+	assert.Equal(t, "4", fields["total_commands_processed"], "unknown commands aren't counted")
+	assert.Equal(t, "1", fields["total_error_replies"])
+	assert.Equal(t, "1", fields["pubsub_channels"])
+	assert.Equal(t, "master", fields["role"])
+	assert.Equal(t, "keys=2,expires=1", fields["db0"])
+	assert.NotContains(t, fields, "cmdstat_set")
+
+	require.NoError(t, sm.CreateSnapshot(store.NewKVStore()))
+	sections, fields = infoFields(t, handler.Exec(sess, []string{"INFO", "persistence", "COMMANDSTATS"}))
+	assert.Equal(t, []string{"Persistence", "Commandstats"}, sections)
+	assert.Equal(t, "1", fields["rdb_saves"])
+	assert.Equal(t, "ok", fields["rdb_last_bgsave_status"])
+	assert.Regexp(t, `^calls=2,usec=\d+,usec_per_call=[\d.]+,failed_calls=0$`, fields["cmdstat_set"])
+	assert.Regexp(t, `^calls=1,.*,failed_calls=1$`, fields["cmdstat_incr"])
+	assert.Regexp(t, `^calls=1,`, fields["cmdstat_info"])
+	assert.NotContains(t, fields, "cmdstat_get")
+
+	sections, _ = infoFields(t, handler.Exec(sess, []string{"INFO", "all"}))
+	assert.Contains(t, sections, "Commandstats")
+	sections, _ = infoFields(t, handler.Exec(sess, []string{"INFO", "default"}))
+	assert.NotContains(t, sections, "Commandstats")
+
+	handler.CloseSession(sess)
+	_, fields = infoFields(t, handler.Exec(handler.NewSession(), []string{"INFO", "clients", "stats"}))
+	assert.Equal(t, "2", fields["connected_clients"])
+	assert.Equal(t, "3", fields["total_connections_received"])
+}
+
+func TestHandler_InfoCountsTransactions(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	sess := handler.NewSession()
+	handler.Exec(sess, []string{"MULTI"})
+	handler.Exec(sess, []string{"SET", "a", "1"})
+	handler.Exec(sess, []string{"GET", "a"})
+	handler.Exec(sess, []string{"EXEC"})
+
+	// Queued commands are counted when they run, not when they are queued
+	_, fields := infoFields(t, handler.Exec(sess, []string{"INFO", "commandstats"}))
+	for _, name := range []string{"multi", "set", "get", "exec"} {
+		assert.Regexp(t, `^calls=1,`, fields["cmdstat_"+name], name)
+	}
+}
+
+func TestHandler_WriteMetrics(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	handler.Handle("SET key value")
+	handler.Handle("INCR key")
+	handler.Handle("GET key")
+
+	var buf bytes.Buffer
+	require.NoError(t, handler.WriteMetrics(&buf))
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE kvstore_commands_total counter\n",
+		`kvstore_commands_total{cmd="SET"} 1` + "\n",
+		`kvstore_command_errors_total{cmd="INCR"} 1` + "\n",
+		`kvstore_command_duration_seconds_bucket{cmd="GET",le="+Inf"} 1` + "\n",
+		`kvstore_command_duration_seconds_count{cmd="GET"} 1` + "\n",
+		"kvstore_keys 1\n",
+		"kvstore_wal_last_seq 1\n",
+		"kvstore_wal_fsync_duration_seconds_count 1\n",
+	} {
+		assert.Contains(t, out, want)
+	}
+	assert.NotContains(t, out, `cmd="DEL"`, "commands never run aren't listed")
+	assert.NotContains(t, out, "kvstore_snapshots_total", "no snapshot manager")
+}
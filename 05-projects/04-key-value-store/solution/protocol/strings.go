@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+func (h *Handler) handleSetNX(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("setnx")
+	}
+
+	key, value := args[0], args[1]
+	if !c.tx.SetNX(key, value) {
+		return Integer(0)
+	}
+	c.log("SET", key, value)
+	c.notify(notifyString, "set", key)
+	return Integer(1)
+}
+
+func (h *Handler) handleGetSet(c *call, args []string) Value {
+	if len(args) != 2 {
+		return wrongArgs("getset")
+	}
+
+	key, value := args[0], args[1]
+	old, ok, err := c.tx.GetSet(key, value)
+	if err != nil {
+		return errorValue(err)
+	}
+	c.log("SET", key, value)
+	c.clearExpiry(key)
+	c.notify(notifyString, "set", key)
+
+	if !ok {
+		return NullBulk()
+	}
+	return BulkString(old)
+}
+
+// clearExpiry removes the expiry of a key whose value was just replaced, as
+// SET and GETSET do in Redis, and logs that after the SET. The store's Set
+// keeps the expiry, which INCR relies on, and so does replaying a SET.
+func (c *call) clearExpiry(key string) {
+	if c.tx.Persist(key) {
+		c.log("PERSIST", key)
+	}
+}
+
+// handleIncr implements INCR, DECR, INCRBY and DECRBY. The new value is
+// logged as a SET, so replay doesn't depend on the value it started from.
+func (h *Handler) handleIncr(c *call, args []string) Value {
+	var delta int64
+	switch c.name {
+	case "INCR", "DECR":
+		if len(args) != 1 {
+			return wrongArgs(strings.ToLower(c.name))
+		}
+		delta = 1
+	default:
+		if len(args) != 2 {
+			return wrongArgs(strings.ToLower(c.name))
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return notInteger()
+		}
+		delta = n
+	}
+	if c.name == "DECR" || c.name == "DECRBY" {
+		if delta == -delta && delta != 0 {
+			// -MinInt64 doesn't fit
+			return Error("ERR decrement would overflow")
+		}
+		delta = -delta
+	}
+
+	key := args[0]
+	n, err := c.tx.IncrBy(key, delta)
+	if err != nil {
+		return errorValue(err)
+	}
+	c.log("SET", key, strconv.FormatInt(n, 10))
+	if strings.HasPrefix(c.name, "INCR") {
+		c.notify(notifyString, "incrby", key)
+	} else {
+		c.notify(notifyString, "decrby", key)
+	}
+	return Integer(n)
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStringsHandler(t *testing.T) (*Handler, *store.KVStore, *persistence.WAL, string) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	return NewHandler(kvStore, wal), kvStore, wal, walPath
+}
+
+func TestHandler_Counters(t *testing.T) {
+	handler, _, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"INCR counter", ":1"},
+		{"INCRBY counter 10", ":11"},
+		{"DECR counter", ":10"},
+		{"DECRBY counter 15", ":-5"},
+		{"GET counter", "$2\r\n-5"},
+		{"INCRBY counter notanumber", "-ERR value is not an integer or out of range"},
+		{"SET text hello", "+OK"},
+		{"INCR text", "-ERR value is not an integer or out of range"},
+		{"SET big 9223372036854775807", "+OK"},
+		{"INCR big", "-ERR increment or decrement would overflow"},
+		{"DECRBY counter -9223372036854775808", "-ERR decrement would overflow"},
+		{"RPUSH list a", ":1"},
+		{"INCR list", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"INCR", "-ERR wrong number of arguments for 'incr' command"},
+		{"SETNX fresh v1", ":1"},
+		{"SETNX fresh v2", ":0"},
+		{"GET fresh", "$2\r\nv1"},
+		{"GETSET fresh v3", "$2\r\nv1"},
+		{"GETSET missing v", "$-1"},
+		{"GET fresh", "$2\r\nv3"},
+		{"GETSET list v", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, handler.Handle(tt.command), tt.command)
+	}
+}
+
+func TestHandler_SetOptions(t *testing.T) {
+	handler, kvStore, wal, _ := newStringsHandler(t)
+	defer wal.Close()
+	sess := handler.NewSession()
+	set := func(args ...string) Value {
+		return handler.Exec(sess, append([]string{"SET"}, args...))
+	}
+
+	assert.True(t, set("key", "v1", "XX").Null, "XX on a missing key")
+	assert.Equal(t, "OK", set("key", "v1", "NX").Str)
+	assert.True(t, set("key", "v2", "NX").Null, "NX on an existing key")
+	assert.Equal(t, "OK", set("key", "v2", "xx", "ex", "100").Str)
+	assert.InDelta(t, 100, kvStore.TTL("key"), 1)
+
+	assert.Equal(t, "OK", set("short", "v", "PX", "50").Str)
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, kvStore.Exists("short"))
+
+	for _, args := range [][]string{
+		{"key", "v", "NX", "XX"},
+		{"key", "v", "EX", "10", "PX", "100"},
+		{"key", "v", "EX"},
+		{"key", "v", "KEEP"},
+	} {
+		assert.Equal(t, "ERR syntax error", set(args...).Str, "%v", args)
+	}
+	assert.Equal(t, "ERR invalid expire time in 'set' command", set("key", "v", "EX", "0").Str)
+	assert.Equal(t, "ERR invalid expire time in 'set' command", set("key", "v", "PX", "-5").Str)
+	assert.Equal(t, "ERR value is not an integer or out of range", set("key", "v", "EX", "ten").Str)
+}
+
+// SET and GETSET replace a value along with its expiry, as in Redis, while
+// INCR keeps it.
+func TestHandler_SetClearsExpiry(t *testing.T) {
+	handler, kvStore, wal, walPath := newStringsHandler(t)
+	sess := handler.NewSession()
+	for _, key := range []string{"set", "getset", "incr"} {
+		require.Equal(t, "OK", exec(handler, sess, "SET "+key+" 1 EX 100"))
+	}
+	assert.Equal(t, "OK", exec(handler, sess, "SET set 2"))
+	assert.Equal(t, "1", exec(handler, sess, "GETSET getset 2"))
+	assert.Equal(t, "2", exec(handler, sess, "INCR incr"))
+	assert.Equal(t, -1, kvStore.TTL("set"))
+	assert.Equal(t, -1, kvStore.TTL("getset"))
+	assert.InDelta(t, 100, kvStore.TTL("incr"), 1)
+	wal.Close()
+
+	newStore := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(newStore))
+	assert.Equal(t, -1, newStore.TTL("set"))
+	assert.Equal(t, -1, newStore.TTL("getset"))
+	assert.InDelta(t, 100, newStore.TTL("incr"), 1)
+}
+
+func TestHandler_StringCommandsSurviveReplay(t *testing.T) {
+	handler, _, wal, walPath := newStringsHandler(t)
+	sess := handler.NewSession()
+	for _, cmd := range [][]string{
+		{"INCRBY", "counter", "41"},
+		{"INCR", "counter"},
+		{"SETNX", "once", "first"},
+		{"SETNX", "once", "second"},
+		{"GETSET", "swap", "new"},
+		{"SET", "ttl", "v", "EX", "100"},
+		{"SET", "nx", "v", "NX"},
+		{"SET", "nx", "ignored", "NX"},
+	} {
+		require.NotEqual(t, TypeError, handler.Exec(sess, cmd).Type, "%v", cmd)
+	}
+	wal.Close()
+
+	newStore := store.NewKVStore()
+	newWAL, err := persistence.NewWAL(walPath)
+	require.NoError(t, err)
+	defer newWAL.Close()
+	require.NoError(t, newWAL.Replay(newStore))
+
+	for key, want := range map[string]string{"counter": "42", "once": "first", "swap": "new", "ttl": "v", "nx": "v"} {
+		got, ok := newStore.Get(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, want, got, key)
+	}
+	assert.Greater(t, newStore.TTL("ttl"), 90)
+	assert.Equal(t, -1, newStore.TTL("counter"))
+}
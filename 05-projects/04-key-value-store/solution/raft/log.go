@@ -0,0 +1,90 @@
+package raft
+
+// EntryType says what a log entry holds.
+type EntryType uint8
+
+const (
+	EntryCommand EntryType = iota + 1 // data for the state machine
+	EntryConfig                       // the new set of servers
+	EntryNoop                         // appended by a new leader to commit its term
+)
+
+// Entry is one record of the replicated log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// raftLog holds the entries that follow the latest snapshot. Indexes are
+// contiguous: entries[i] has index snapIndex+1+i.
+type raftLog struct {
+	snapIndex uint64
+	snapTerm  uint64
+	entries   []Entry
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index. ok is false if the entry
+// is past the end of the log or compacted away, except for the last one
+// the snapshot covers, whose term is kept.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	switch {
+	case index == l.snapIndex:
+		return l.snapTerm, true
+	case index < l.snapIndex || index > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// slice returns up to max entries starting at lo, which must not be
+// compacted.
+func (l *raftLog) slice(lo uint64, max int) []Entry {
+	if lo > l.lastIndex() {
+		return nil
+	}
+	entries := l.entries[lo-l.snapIndex-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// truncate drops the entries at index and after.
+func (l *raftLog) truncate(index uint64) {
+	if index <= l.lastIndex() {
+		l.entries = l.entries[:index-l.snapIndex-1]
+	}
+}
+
+func (l *raftLog) append(entries ...Entry) {
+	l.entries = append(l.entries, entries...)
+}
+
+// compact drops the entries up to index, which a snapshot now covers. If
+// the log doesn't hold index with the given term, everything is dropped.
+func (l *raftLog) compact(index, term uint64) {
+	if t, ok := l.term(index); ok && t == term && index <= l.lastIndex() {
+		l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	} else {
+		l.entries = nil
+	}
+	l.snapIndex = index
+	l.snapTerm = term
+}
@@ -0,0 +1,1058 @@
+// Package raft implements the Raft consensus algorithm: leader election, log
+// replication, log compaction with snapshots, single-server membership
+// changes and linearizable reads through ReadIndex.
+//
+// A Node replicates opaque commands. Once an entry is committed, every node
+// hands it to its StateMachine in log order. Nodes talk through a
+// Transport; MemNetwork connects nodes in one process and can simulate
+// partitions, TCPTransport connects real servers.
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultElectionTimeout   = 500 * time.Millisecond
+	DefaultHeartbeatInterval = 50 * time.Millisecond
+	DefaultSnapshotThreshold = 8192
+	DefaultMaxAppendEntries  = 256
+)
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrLeadershipLost = errors.New("raft: leadership lost before the entry was applied")
+	ErrStopped        = errors.New("raft: node stopped")
+	ErrConfigChange   = errors.New("raft: a configuration change is in progress")
+)
+
+// StateMachine is what the log is replicated for. Apply and Snapshot are
+// only ever called from one goroutine, so Snapshot sees exactly the entries
+// applied before it.
+type StateMachine interface {
+	// Apply applies a committed command. Its result is returned by Propose
+	// on the node that proposed it.
+	Apply(data []byte) any
+	// Snapshot returns the state so far, from which Restore can rebuild it.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot.
+	Restore(data []byte) error
+}
+
+type Config struct {
+	ID string
+	// Servers is the initial cluster. It is only used to bootstrap a node
+	// whose storage is empty; every server of a new cluster must be given
+	// the same list. A node joining an existing cluster gets none and waits
+	// to be added with AddServer.
+	Servers      []Server
+	Transport    Transport
+	Storage      Storage
+	StateMachine StateMachine
+
+	// ElectionTimeout is the least time a follower waits for a leader
+	// before calling an election; the actual wait is randomized up to
+	// twice that.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many applied entries the log may hold
+	// before it is compacted into a snapshot.
+	SnapshotThreshold uint64
+	MaxAppendEntries  int
+}
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Status is a point-in-time view of a node.
+type Status struct {
+	ID            string
+	State         State
+	Term          uint64
+	Leader        string
+	LastIndex     uint64
+	CommitIndex   uint64
+	LastApplied   uint64
+	SnapshotIndex uint64
+	Servers       []Server
+}
+
+type Node struct {
+	id                string
+	transport         Transport
+	storage           Storage
+	fsm               StateMachine
+	electionTimeout   time.Duration
+	heartbeat         time.Duration
+	snapshotThreshold uint64
+	maxAppend         int
+
+	mu sync.Mutex
+	// cond is broadcast whenever the commit index, the applied index, the
+	// state or a follower's acknowledgements change
+	cond *sync.Cond
+
+	state       State
+	term        uint64
+	vote        string
+	leader      string
+	log         raftLog
+	servers     []Server // the latest configuration in the log
+	configIndex uint64   // where servers comes from, 0 for a snapshot
+	commitIndex uint64
+	lastApplied uint64
+	snapshot    *Snapshot // latest snapshot, sent to lagging followers
+	restore     *Snapshot // received snapshot the apply loop has yet to restore
+
+	electionDeadline time.Time
+	lastContact      time.Time // when a leader was last heard from
+
+	// Leader state
+	peers   map[string]*peer
+	pending map[uint64]*proposal
+
+	stopped bool
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// peer is the leader's view of a follower.
+type peer struct {
+	server      Server
+	next        uint64 // next entry to send
+	match       uint64 // last entry known to be replicated
+	lastContact time.Time
+	acked       time.Time // send time of the latest request answered in our term
+	trigger     chan struct{}
+	stop        chan struct{}
+}
+
+type proposal struct {
+	term uint64
+	done chan result
+}
+
+type result struct {
+	value any
+	err   error
+}
+
+// NewNode restores a node from its storage and starts it. The caller must
+// make the node reachable through its transport, e.g. with
+// MemNetwork.Register or ServeTCP.
+func NewNode(cfg Config) (*Node, error) {
+	n := &Node{
+		id:                cfg.ID,
+		transport:         cfg.Transport,
+		storage:           cfg.Storage,
+		fsm:               cfg.StateMachine,
+		electionTimeout:   cfg.ElectionTimeout,
+		heartbeat:         cfg.HeartbeatInterval,
+		snapshotThreshold: cfg.SnapshotThreshold,
+		maxAppend:         cfg.MaxAppendEntries,
+		pending:           make(map[uint64]*proposal),
+		stopCh:            make(chan struct{}),
+	}
+	n.cond = sync.NewCond(&n.mu)
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = DefaultElectionTimeout
+	}
+	if n.heartbeat <= 0 {
+		n.heartbeat = DefaultHeartbeatInterval
+	}
+	if n.snapshotThreshold == 0 {
+		n.snapshotThreshold = DefaultSnapshotThreshold
+	}
+	if n.maxAppend <= 0 {
+		n.maxAppend = DefaultMaxAppendEntries
+	}
+
+	st, snap, entries, err := n.storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n.term, n.vote = st.Term, st.Vote
+	if snap != nil {
+		if err := n.fsm.Restore(snap.Data); err != nil {
+			return nil, err
+		}
+		n.snapshot = snap
+		n.log.snapIndex, n.log.snapTerm = snap.Index, snap.Term
+		n.commitIndex, n.lastApplied = snap.Index, snap.Index
+	}
+	if len(entries) > 0 && entries[0].Index != n.log.snapIndex+1 {
+		return nil, fmt.Errorf("raft: log starts at %d after snapshot %d", entries[0].Index, n.log.snapIndex)
+	}
+	n.log.append(entries...)
+
+	if n.term == 0 && n.log.lastIndex() == 0 && len(cfg.Servers) > 0 {
+		// Every bootstrapped server writes the same first entry, so their
+		// logs agree from the start
+		first := Entry{Index: 1, Term: 1, Type: EntryConfig, Data: encodeServers(cfg.Servers)}
+		if err := n.storage.Append([]Entry{first}); err != nil {
+			return nil, err
+		}
+		n.log.append(first)
+		n.term = 1
+		if err := n.storage.SetState(HardState{Term: n.term}); err != nil {
+			return nil, err
+		}
+	}
+	n.updateConfig()
+	n.resetElectionTimer()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Stop halts the node. Pending proposals fail with ErrStopped.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stopCh)
+	n.stopPeers()
+	n.failPending(ErrStopped)
+	n.cond.Broadcast()
+	n.mu.Unlock()
+
+	n.wg.Wait()
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		LastIndex:     n.log.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.log.snapIndex,
+		Servers:       append([]Server(nil), n.servers...),
+	}
+}
+
+// Leader returns the server this node believes is the leader. ok is false
+// if it doesn't know of one.
+func (n *Node) Leader() (Server, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, s := range n.servers {
+		if s.ID == n.leader {
+			return s, true
+		}
+	}
+	return Server{}, false
+}
+
+// Propose replicates data and returns the state machine's result once it is
+// applied. Only the leader accepts proposals. ErrLeadershipLost means the
+// entry may or may not end up applied.
+func (n *Node) Propose(data []byte) (any, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	p := n.propose(EntryCommand, data)
+	n.mu.Unlock()
+
+	r := <-p.done
+	return r.value, r.err
+}
+
+func (n *Node) propose(typ EntryType, data []byte) *proposal {
+	index := n.appendLocal(typ, data)
+	p := &proposal{term: n.term, done: make(chan result, 1)}
+	n.pending[index] = p
+	return p
+}
+
+// ReadIndex returns once the state machine reflects every entry committed
+// before the call, after checking with a majority that this node is still
+// the leader. A read served after it is linearizable.
+func (n *Node) ReadIndex() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	term := n.term
+	stillLeader := func() bool { return n.state == Leader && n.term == term && !n.stopped }
+	if !stillLeader() {
+		return ErrNotLeader
+	}
+
+	// Until an entry of its own term commits, a new leader doesn't know
+	// how far the commit index really is
+	ok := n.waitFor(n.electionTimeout, func() bool {
+		t, _ := n.log.term(n.commitIndex)
+		return !stillLeader() || t == term
+	})
+	if !ok || !stillLeader() {
+		return ErrNotLeader
+	}
+	readIndex := n.commitIndex
+
+	start := time.Now()
+	for _, p := range n.peers {
+		p.kick()
+	}
+	ok = n.waitFor(n.electionTimeout, func() bool {
+		return !stillLeader() || n.ackedSince(start)
+	})
+	if !ok || !stillLeader() {
+		return ErrNotLeader
+	}
+
+	for n.lastApplied < readIndex && !n.stopped {
+		n.cond.Wait()
+	}
+	if n.stopped {
+		return ErrStopped
+	}
+	return nil
+}
+
+// ackedSince reports whether a majority answered requests sent after t.
+func (n *Node) ackedSince(t time.Time) bool {
+	count := 0
+	for _, s := range n.servers {
+		if s.ID == n.id {
+			count++
+		} else if p, ok := n.peers[s.ID]; ok && !p.acked.Before(t) {
+			count++
+		}
+	}
+	return count >= quorum(n.servers)
+}
+
+// waitFor waits until done returns true or timeout passes, and returns the
+// last result of done. n.mu must be held.
+func (n *Node) waitFor(timeout time.Duration, done func() bool) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		n.mu.Lock()
+		expired = true
+		n.cond.Broadcast()
+		n.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for !done() && !expired && !n.stopped {
+		n.cond.Wait()
+	}
+	return done()
+}
+
+// AddServer adds a server to the cluster. It returns once the change is
+// committed. Only one change can be in progress at a time.
+func (n *Node) AddServer(s Server) error {
+	return n.changeConfig(func(servers []Server) ([]Server, error) {
+		for _, existing := range servers {
+			if existing.ID == s.ID {
+				return nil, fmt.Errorf("raft: server %s is already a member", s.ID)
+			}
+		}
+		return append(servers, s), nil
+	})
+}
+
+// RemoveServer removes a server from the cluster. A leader that removes
+// itself steps down once the change is committed.
+func (n *Node) RemoveServer(id string) error {
+	return n.changeConfig(func(servers []Server) ([]Server, error) {
+		for i, s := range servers {
+			if s.ID == id {
+				return append(servers[:i:i], servers[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("raft: server %s is not a member", id)
+	})
+}
+
+func (n *Node) changeConfig(change func([]Server) ([]Server, error)) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	// One change at a time, and not before the leader has committed an
+	// entry of its term: an older uncommitted change might still win
+	if t, _ := n.log.term(n.commitIndex); n.configIndex > n.commitIndex || t != n.term {
+		n.mu.Unlock()
+		return ErrConfigChange
+	}
+
+	servers, err := change(append([]Server(nil), n.servers...))
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	p := n.propose(EntryConfig, encodeServers(servers))
+	n.mu.Unlock()
+
+	r := <-p.done
+	return r.err
+}
+
+// run drives elections and, on the leader, checks that a majority is still
+// reachable.
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.electionTimeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		now := time.Now()
+		switch n.state {
+		case Leader:
+			// A leader cut off from the majority steps down instead of
+			// accepting writes it can't commit
+			count := 0
+			for _, s := range n.servers {
+				if s.ID == n.id {
+					count++
+				} else if p, ok := n.peers[s.ID]; ok && now.Sub(p.lastContact) < n.electionTimeout {
+					count++
+				}
+			}
+			if count < quorum(n.servers) {
+				n.becomeFollower(n.term)
+			}
+		default:
+			if now.After(n.electionDeadline) && n.isMember(n.id) {
+				n.startElection()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) resetElectionTimer() {
+	wait := n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = time.Now().Add(wait)
+}
+
+func (n *Node) startElection() {
+	n.term++
+	n.vote = n.id
+	n.state = Candidate
+	n.leader = ""
+	n.persistState()
+	n.resetElectionTimer()
+
+	term := n.term
+	req := &VoteRequest{Term: term, Candidate: n.id, LastIndex: n.log.lastIndex(), LastTerm: n.log.lastTerm()}
+	votes := 1
+	if votes >= quorum(n.servers) {
+		n.becomeLeader()
+		return
+	}
+
+	for _, s := range n.servers {
+		if s.ID == n.id {
+			continue
+		}
+		go func(s Server) {
+			resp, err := n.transport.RequestVote(s, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.state != Candidate || n.term != term || !resp.Granted || !n.isMember(s.ID) {
+				return
+			}
+			votes++
+			if votes >= quorum(n.servers) {
+				n.becomeLeader()
+			}
+		}(s)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.id
+	n.peers = make(map[string]*peer)
+	n.syncPeers()
+	n.appendLocal(EntryNoop, nil)
+	n.cond.Broadcast()
+}
+
+// becomeFollower moves to term, if it is newer, and follows.
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.leader = ""
+		n.persistState()
+	}
+	if n.state == Leader {
+		n.leader = ""
+		n.stopPeers()
+		n.failPending(ErrLeadershipLost)
+	}
+	n.state = Follower
+	n.resetElectionTimer()
+	n.cond.Broadcast()
+}
+
+func (n *Node) failPending(err error) {
+	for index, p := range n.pending {
+		p.done <- result{err: err}
+		delete(n.pending, index)
+	}
+}
+
+func (n *Node) persistState() {
+	if err := n.storage.SetState(HardState{Term: n.term, Vote: n.vote}); err != nil {
+		// Carrying on could mean voting twice in a term
+		panic(fmt.Sprintf("raft: saving state: %v", err))
+	}
+}
+
+// appendLocal appends an entry of the current term to the leader's log.
+func (n *Node) appendLocal(typ EntryType, data []byte) uint64 {
+	e := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.storage.Append([]Entry{e}); err != nil {
+		panic(fmt.Sprintf("raft: appending to log: %v", err))
+	}
+	n.log.append(e)
+	if typ == EntryConfig {
+		n.updateConfig()
+	}
+
+	n.advanceCommit()
+	for _, p := range n.peers {
+		p.kick()
+	}
+	return e.Index
+}
+
+// updateConfig takes the servers from the latest configuration entry in the
+// log. A configuration is used as soon as it is in the log, committed or not.
+func (n *Node) updateConfig() {
+	n.servers, n.configIndex = nil, 0
+	if n.snapshot != nil {
+		n.servers = n.snapshot.Servers
+	}
+	for i := len(n.log.entries) - 1; i >= 0; i-- {
+		if e := n.log.entries[i]; e.Type == EntryConfig {
+			n.servers, n.configIndex = decodeServers(e.Data), e.Index
+			break
+		}
+	}
+	if n.state == Leader {
+		n.syncPeers()
+	}
+}
+
+// configAt returns the servers configured as of index.
+func (n *Node) configAt(index uint64) []Server {
+	for i := int(index - n.log.snapIndex - 1); i >= 0; i-- {
+		if e := n.log.entries[i]; e.Type == EntryConfig {
+			return decodeServers(e.Data)
+		}
+	}
+	if n.snapshot != nil {
+		return n.snapshot.Servers
+	}
+	return nil
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, s := range n.servers {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func quorum(servers []Server) int {
+	return len(servers)/2 + 1
+}
+
+// advanceCommit commits the latest entry of the current term that a
+// majority has. Entries of earlier terms are committed along with it.
+func (n *Node) advanceCommit() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if t, _ := n.log.term(index); t != n.term {
+			return
+		}
+
+		count := 0
+		for _, s := range n.servers {
+			if s.ID == n.id {
+				count++
+			} else if p, ok := n.peers[s.ID]; ok && p.match >= index {
+				count++
+			}
+		}
+		if count >= quorum(n.servers) {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// applyLoop hands committed entries to the state machine in order, and
+// compacts the log once enough of them are applied.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		for !n.stopped && n.restore == nil && n.lastApplied >= n.commitIndex {
+			n.cond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+
+		if snap := n.restore; snap != nil {
+			n.restore = nil
+			if snap.Index <= n.lastApplied {
+				continue
+			}
+			n.mu.Unlock()
+			err := n.fsm.Restore(snap.Data)
+			n.mu.Lock()
+			if err != nil {
+				panic(fmt.Sprintf("raft: restoring snapshot: %v", err))
+			}
+			n.lastApplied = snap.Index
+			n.cond.Broadcast()
+			continue
+		}
+
+		lo := n.lastApplied + 1
+		entries := n.log.slice(lo, int(n.commitIndex-lo+1))
+		n.mu.Unlock()
+		results := make([]any, len(entries))
+		for i, e := range entries {
+			if e.Type == EntryCommand {
+				results[i] = n.fsm.Apply(e.Data)
+			}
+		}
+		n.mu.Lock()
+
+		for i, e := range entries {
+			n.lastApplied = e.Index
+			if p, ok := n.pending[e.Index]; ok {
+				delete(n.pending, e.Index)
+				if p.term == e.Term {
+					p.done <- result{value: results[i]}
+				} else {
+					p.done <- result{err: ErrLeadershipLost}
+				}
+			}
+		}
+		n.cond.Broadcast()
+
+		if n.state == Leader && !n.isMember(n.id) && n.configIndex <= n.lastApplied {
+			n.becomeFollower(n.term)
+		}
+		n.maybeSnapshot()
+	}
+}
+
+// maybeSnapshot compacts the log into a snapshot of the state machine once
+// it holds enough applied entries. It runs on the apply goroutine, so the
+// state machine is at lastApplied.
+func (n *Node) maybeSnapshot() {
+	if n.lastApplied <= n.log.snapIndex || n.lastApplied-n.log.snapIndex < n.snapshotThreshold {
+		return
+	}
+
+	index := n.lastApplied
+	term, _ := n.log.term(index)
+	servers := n.configAt(index)
+	n.mu.Unlock()
+	data, err := n.fsm.Snapshot()
+	n.mu.Lock()
+	if err != nil || index <= n.log.snapIndex {
+		return
+	}
+
+	snap := &Snapshot{Index: index, Term: term, Servers: servers, Data: data}
+	n.log.compact(index, term)
+	if err := n.storage.SaveSnapshot(snap, n.log.entries); err != nil {
+		panic(fmt.Sprintf("raft: saving snapshot: %v", err))
+	}
+	n.snapshot = snap
+}
+
+// syncPeers starts replicating to new servers and stops for removed ones.
+func (n *Node) syncPeers() {
+	wanted := make(map[string]bool)
+	for _, s := range n.servers {
+		if s.ID == n.id {
+			continue
+		}
+		wanted[s.ID] = true
+		if _, ok := n.peers[s.ID]; ok {
+			continue
+		}
+		p := &peer{
+			server:      s,
+			next:        n.log.lastIndex() + 1,
+			lastContact: time.Now(),
+			trigger:     make(chan struct{}, 1),
+			stop:        make(chan struct{}),
+		}
+		n.peers[s.ID] = p
+		n.wg.Add(1)
+		go n.replicate(p, n.term)
+	}
+	for id, p := range n.peers {
+		if !wanted[id] {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+}
+
+func (n *Node) stopPeers() {
+	for id, p := range n.peers {
+		close(p.stop)
+		delete(n.peers, id)
+	}
+}
+
+// kick makes the replicator send now rather than at the next heartbeat.
+func (p *peer) kick() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// replicate sends entries, or heartbeats when there are none, to one
+// follower for as long as this node leads in term.
+func (n *Node) replicate(p *peer, term uint64) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		n.sendAppend(p, term)
+
+		select {
+		case <-p.stop:
+			return
+		case <-n.stopCh:
+			return
+		case <-p.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) sendAppend(p *peer, term uint64) {
+	n.mu.Lock()
+	if n.state != Leader || n.term != term {
+		n.mu.Unlock()
+		return
+	}
+	if p.next <= n.log.snapIndex {
+		n.sendSnapshot(p, term)
+		return
+	}
+
+	prevIndex := p.next - 1
+	prevTerm, _ := n.log.term(prevIndex)
+	req := &AppendRequest{
+		Term:      term,
+		Leader:    n.id,
+		PrevIndex: prevIndex,
+		PrevTerm:  prevTerm,
+		Entries:   n.log.slice(p.next, n.maxAppend),
+		Commit:    n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	sent := time.Now()
+	resp, err := n.transport.AppendEntries(p.server, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return
+	}
+	if n.state != Leader || n.term != term {
+		return
+	}
+	n.acknowledge(p, sent)
+
+	if resp.Success {
+		match := prevIndex + uint64(len(req.Entries))
+		if match > p.match {
+			p.match = match
+		}
+		if p.match+1 > p.next {
+			p.next = p.match + 1
+		}
+		n.advanceCommit()
+		if p.next <= n.log.lastIndex() {
+			p.kick()
+		}
+		return
+	}
+
+	// Back off, skipping what the follower says it doesn't have
+	next := p.next - 1
+	if resp.LastIndex+1 < next {
+		next = resp.LastIndex + 1
+	}
+	p.next = max(next, 1)
+	p.kick()
+}
+
+func (n *Node) sendSnapshot(p *peer, term uint64) {
+	req := &SnapshotRequest{Term: term, Leader: n.id, Snapshot: n.snapshot}
+	n.mu.Unlock()
+
+	sent := time.Now()
+	resp, err := n.transport.InstallSnapshot(p.server, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return
+	}
+	if n.state != Leader || n.term != term {
+		return
+	}
+	n.acknowledge(p, sent)
+	if req.Snapshot.Index > p.match {
+		p.match = req.Snapshot.Index
+	}
+	p.next = p.match + 1
+	n.advanceCommit()
+	p.kick()
+}
+
+// acknowledge records that p answered a request of the current term.
+func (n *Node) acknowledge(p *peer, sent time.Time) {
+	p.lastContact = time.Now()
+	if sent.After(p.acked) {
+		p.acked = sent
+	}
+	n.cond.Broadcast()
+}
+
+func (n *Node) HandleRequestVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &VoteResponse{Term: n.term}
+	if n.stopped {
+		return resp
+	}
+
+	// While a leader is known to be alive, ignore candidates: they are
+	// partitioned or removed servers that would only disrupt it
+	if n.state == Leader || (n.leader != "" && time.Since(n.lastContact) < n.electionTimeout) {
+		return resp
+	}
+
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	resp.Term = n.term
+	if req.Term < n.term {
+		return resp
+	}
+
+	upToDate := req.LastTerm > n.log.lastTerm() ||
+		(req.LastTerm == n.log.lastTerm() && req.LastIndex >= n.log.lastIndex())
+	if (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		n.vote = req.Candidate
+		n.persistState()
+		n.resetElectionTimer()
+		resp.Granted = true
+	}
+	return resp
+}
+
+func (n *Node) HandleAppendEntries(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &AppendResponse{Term: n.term}
+	if n.stopped || req.Term < n.term {
+		return resp
+	}
+	if req.Term > n.term || n.state != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.Leader
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+	resp.Term = n.term
+
+	// Entries up to the snapshot are committed, so they match
+	prevIndex, prevTerm, entries := req.PrevIndex, req.PrevTerm, req.Entries
+	if prevIndex < n.log.snapIndex {
+		skip := min(n.log.snapIndex-prevIndex, uint64(len(entries)))
+		entries = entries[skip:]
+		prevIndex, prevTerm = n.log.snapIndex, n.log.snapTerm
+	}
+
+	t, ok := n.log.term(prevIndex)
+	if !ok {
+		resp.LastIndex = n.log.lastIndex()
+		return resp
+	}
+	if t != prevTerm {
+		// Let the leader skip the whole conflicting term in one go
+		first := prevIndex
+		for first > n.log.snapIndex+1 {
+			if pt, _ := n.log.term(first - 1); pt != t {
+				break
+			}
+			first--
+		}
+		resp.LastIndex = first - 1
+		return resp
+	}
+
+	for i, e := range entries {
+		if t, ok := n.log.term(e.Index); ok && t == e.Term {
+			continue
+		}
+		if e.Index <= n.commitIndex {
+			panic(fmt.Sprintf("raft: leader %s would overwrite committed entry %d", req.Leader, e.Index))
+		}
+		if err := n.storage.Append(entries[i:]); err != nil {
+			panic(fmt.Sprintf("raft: appending to log: %v", err))
+		}
+		n.log.truncate(e.Index)
+		n.log.append(entries[i:]...)
+		n.updateConfig()
+		break
+	}
+
+	if lastNew := prevIndex + uint64(len(entries)); req.Commit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = min(req.Commit, lastNew)
+		n.cond.Broadcast()
+	}
+	resp.Success = true
+	resp.LastIndex = n.log.lastIndex()
+	return resp
+}
+
+func (n *Node) HandleInstallSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &SnapshotResponse{Term: n.term}
+	if n.stopped || req.Term < n.term {
+		return resp
+	}
+	if req.Term > n.term || n.state != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.Leader
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+	resp.Term = n.term
+
+	snap := req.Snapshot
+	if snap.Index <= n.commitIndex {
+		// Everything it holds is already committed here
+		return resp
+	}
+
+	n.log.compact(snap.Index, snap.Term)
+	if err := n.storage.SaveSnapshot(snap, n.log.entries); err != nil {
+		panic(fmt.Sprintf("raft: saving snapshot: %v", err))
+	}
+	n.snapshot = snap
+	n.restore = snap
+	n.commitIndex = snap.Index
+	n.updateConfig()
+	n.cond.Broadcast()
+	return resp
+}
+
+func encodeServers(servers []Server) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(servers); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeServers(data []byte) []Server {
+	var servers []Server
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&servers); err != nil {
+		panic(fmt.Sprintf("raft: bad configuration entry: %v", err))
+	}
+	return servers
+}
@@ -0,0 +1,527 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const waitTime = 5 * time.Second
+
+// testFSM is a map set by "key=value" commands.
+type testFSM struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newTestFSM() *testFSM {
+	return &testFSM{data: make(map[string]string)}
+}
+
+func (f *testFSM) Apply(data []byte) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, value, _ := strings.Cut(string(data), "=")
+	f.data[key] = value
+	return len(f.data)
+}
+
+func (f *testFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(f.data)
+	return buf.Bytes(), err
+}
+
+func (f *testFSM) Restore(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = make(map[string]string)
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(&f.data)
+}
+
+func (f *testFSM) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.data[key]
+	return v, ok
+}
+
+func (f *testFSM) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.data)
+}
+
+type testCluster struct {
+	t         *testing.T
+	net       *MemNetwork
+	threshold uint64
+
+	mu       sync.Mutex
+	nodes    map[string]*Node
+	fsms     map[string]*testFSM
+	storages map[string]*MemoryStorage
+}
+
+func newTestCluster(t *testing.T, size int, threshold uint64) (*testCluster, []Server) {
+	c := &testCluster{
+		t:         t,
+		net:       NewMemNetwork(),
+		threshold: threshold,
+		nodes:     make(map[string]*Node),
+		fsms:      make(map[string]*testFSM),
+		storages:  make(map[string]*MemoryStorage),
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+
+	var servers []Server
+	for i := 1; i <= size; i++ {
+		servers = append(servers, Server{ID: fmt.Sprintf("n%d", i)})
+	}
+	for _, s := range servers {
+		c.start(s.ID, servers)
+	}
+	return c, servers
+}
+
+// start starts the node id on its storage, which survives restarts.
+func (c *testCluster) start(id string, servers []Server) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	storage, ok := c.storages[id]
+	if !ok {
+		storage = NewMemoryStorage()
+		c.storages[id] = storage
+	}
+	fsm := newTestFSM()
+	n, err := NewNode(Config{
+		ID:                id,
+		Servers:           servers,
+		Transport:         c.net.Transport(id),
+		Storage:           storage,
+		StateMachine:      fsm,
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+	})
+	require.NoError(c.t, err)
+	c.net.Register(id, n)
+	c.nodes[id] = n
+	c.fsms[id] = fsm
+	return n
+}
+
+func (c *testCluster) stop(id string) {
+	c.mu.Lock()
+	n := c.nodes[id]
+	delete(c.nodes, id)
+	c.mu.Unlock()
+	n.Stop()
+}
+
+func (c *testCluster) node(id string) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[id]
+}
+
+func (c *testCluster) fsm(id string) *testFSM {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fsms[id]
+}
+
+// waitLeader waits until one of ids leads with the others following it,
+// and returns its ID.
+func (c *testCluster) waitLeader(ids ...string) string {
+	c.t.Helper()
+
+	var leader string
+	require.Eventually(c.t, func() bool {
+		leader = ""
+		var term uint64
+		for _, id := range ids {
+			st := c.node(id).Status()
+			if st.State == Leader {
+				if leader != "" {
+					return false
+				}
+				leader, term = id, st.Term
+			}
+		}
+		if leader == "" {
+			return false
+		}
+		for _, id := range ids {
+			st := c.node(id).Status()
+			if st.Term != term || st.Leader != leader {
+				return false
+			}
+		}
+		return true
+	}, waitTime, 10*time.Millisecond, "no stable leader among %v", ids)
+	return leader
+}
+
+// propose sets key on the cluster through whichever of ids leads.
+func (c *testCluster) propose(key, value string, ids ...string) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(waitTime)
+	for time.Now().Before(deadline) {
+		for _, id := range ids {
+			_, err := c.node(id).Propose([]byte(key + "=" + value))
+			if err == nil {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatalf("could not propose %s=%s", key, value)
+}
+
+func (c *testCluster) waitValue(key, value string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		assert.Eventually(c.t, func() bool {
+			got, ok := c.fsm(id).get(key)
+			return ok && got == value
+		}, waitTime, 10*time.Millisecond, "%s never applied %s=%s", id, key, value)
+	}
+}
+
+func ids(servers []Server) []string {
+	var out []string
+	for _, s := range servers {
+		out = append(out, s.ID)
+	}
+	return out
+}
+
+func without(all []string, drop ...string) []string {
+	var out []string
+	for _, id := range all {
+		keep := true
+		for _, d := range drop {
+			keep = keep && id != d
+		}
+		if keep {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func TestRaft_ElectsOneLeader(t *testing.T) {
+	c, servers := newTestCluster(t, 3, 0)
+	leader := c.waitLeader(ids(servers)...)
+
+	for _, id := range ids(servers) {
+		if id != leader {
+			assert.Equal(t, Follower, c.node(id).Status().State)
+		}
+	}
+	_, err := c.node(without(ids(servers), leader)[0]).Propose([]byte("a=1"))
+	assert.ErrorIs(t, err, ErrNotLeader)
+}
+
+func TestRaft_ReplicatesToAll(t *testing.T) {
+	c, servers := newTestCluster(t, 5, 0)
+	all := ids(servers)
+	leader := c.waitLeader(all...)
+
+	for i := 0; i < 20; i++ {
+		result, err := c.node(leader).Propose([]byte(fmt.Sprintf("k%d=v%d", i, i)))
+		require.NoError(t, err)
+		assert.Equal(t, i+1, result, "Propose returns what Apply returned")
+	}
+	c.waitValue("k19", "v19", all...)
+	for _, id := range all {
+		assert.Equal(t, 20, c.fsm(id).len())
+	}
+}
+
+func TestRaft_LeaderFailover(t *testing.T) {
+	c, servers := newTestCluster(t, 3, 0)
+	all := ids(servers)
+	old := c.waitLeader(all...)
+	c.propose("a", "1", old)
+
+	c.net.Disconnect(old)
+	rest := without(all, old)
+	leader := c.waitLeader(rest...)
+	c.propose("b", "2", leader)
+	c.waitValue("b", "2", rest...)
+
+	// The old leader rejoins as a follower and catches up
+	c.net.Reconnect(old)
+	c.waitValue("b", "2", old)
+	assert.Eventually(t, func() bool {
+		return c.node(old).Status().State == Follower
+	}, waitTime, 10*time.Millisecond)
+}
+
+func TestRaft_PartitionedLeaderCannotCommit(t *testing.T) {
+	c, servers := newTestCluster(t, 5, 0)
+	all := ids(servers)
+	old := c.waitLeader(all...)
+	c.propose("a", "1", old)
+	c.waitValue("a", "1", all...)
+
+	minority := []string{old, without(all, old)[0]}
+	majority := without(all, minority...)
+	c.net.Partition(minority, majority)
+
+	// The old leader can't reach a majority: the write is never applied
+	// and the leader steps down
+	_, err := c.node(old).Propose([]byte("lost=1"))
+	assert.ErrorIs(t, err, ErrLeadershipLost)
+
+	leader := c.waitLeader(majority...)
+	c.propose("b", "2", leader)
+	c.waitValue("b", "2", majority...)
+
+	c.net.Heal()
+	c.waitValue("b", "2", all...)
+	c.propose("c", "3", all...)
+	c.waitValue("c", "3", all...)
+	for _, id := range all {
+		_, ok := c.fsm(id).get("lost")
+		assert.False(t, ok, "%s applied an uncommitted entry", id)
+	}
+}
+
+func TestRaft_SnapshotInstalledOnLaggingFollower(t *testing.T) {
+	c, servers := newTestCluster(t, 3, 5)
+	all := ids(servers)
+	leader := c.waitLeader(all...)
+	lagging := without(all, leader)[0]
+
+	c.net.Disconnect(lagging)
+	for i := 0; i < 30; i++ {
+		c.propose(fmt.Sprintf("k%d", i), "v", leader)
+	}
+	assert.Eventually(t, func() bool {
+		return c.node(leader).Status().SnapshotIndex > 20
+	}, waitTime, 10*time.Millisecond, "leader never compacted its log")
+
+	c.net.Reconnect(lagging)
+	c.waitValue("k29", "v", lagging)
+	st := c.node(lagging).Status()
+	assert.Positive(t, st.SnapshotIndex, "follower caught up without a snapshot")
+	assert.Equal(t, 30, c.fsm(lagging).len())
+}
+
+func TestRaft_Membership(t *testing.T) {
+	c, servers := newTestCluster(t, 3, 0)
+	all := ids(servers)
+	leader := c.waitLeader(all...)
+	c.propose("a", "1", leader)
+
+	// New servers start empty and join through the leader
+	for _, id := range []string{"n4", "n5"} {
+		c.start(id, nil)
+		require.NoError(t, c.node(leader).AddServer(Server{ID: id}))
+		all = append(all, id)
+	}
+	c.waitValue("a", "1", "n4", "n5")
+	c.propose("b", "2", leader)
+	c.waitValue("b", "2", all...)
+	assert.Len(t, c.node("n5").Status().Servers, 5)
+
+	// A leader that removes itself steps down and the rest elect another
+	require.NoError(t, c.node(leader).RemoveServer(leader))
+	rest := without(all, leader)
+	next := c.waitLeader(rest...)
+	assert.NotEqual(t, leader, next)
+	assert.Len(t, c.node(next).Status().Servers, 4)
+	c.propose("c", "3", next)
+	c.waitValue("c", "3", rest...)
+
+	err := c.node(next).AddServer(Server{ID: "n4"})
+	assert.Error(t, err, "adding a member twice")
+}
+
+func TestRaft_ReadIndex(t *testing.T) {
+	c, servers := newTestCluster(t, 3, 0)
+	all := ids(servers)
+	leader := c.waitLeader(all...)
+
+	c.propose("a", "1", leader)
+	require.NoError(t, c.node(leader).ReadIndex())
+	v, _ := c.fsm(leader).get("a")
+	assert.Equal(t, "1", v)
+
+	follower := without(all, leader)[0]
+	assert.ErrorIs(t, c.node(follower).ReadIndex(), ErrNotLeader)
+
+	// A leader cut off from the others must not serve reads, even before
+	// it notices it has been replaced
+	c.net.Disconnect(leader)
+	assert.ErrorIs(t, c.node(leader).ReadIndex(), ErrNotLeader)
+
+	next := c.waitLeader(without(all, leader)...)
+	c.propose("a", "2", next)
+	require.NoError(t, c.node(next).ReadIndex())
+	v, _ = c.fsm(next).get("a")
+	assert.Equal(t, "2", v)
+}
+
+func TestRaft_RestartKeepsLog(t *testing.T) {
+	c, servers := newTestCluster(t, 3, 4)
+	all := ids(servers)
+	leader := c.waitLeader(all...)
+	for i := 0; i < 10; i++ {
+		c.propose(fmt.Sprintf("k%d", i), "v", leader)
+	}
+	c.waitValue("k9", "v", all...)
+
+	for _, id := range all {
+		c.stop(id)
+	}
+	for _, id := range all {
+		c.start(id, servers)
+	}
+	leader = c.waitLeader(all...)
+	c.propose("after", "restart", leader)
+	c.waitValue("after", "restart", all...)
+	for _, id := range all {
+		assert.Equal(t, 11, c.fsm(id).len())
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetState(HardState{Term: 3, Vote: "n2"}))
+	require.NoError(t, s.Append([]Entry{
+		{Index: 1, Term: 1, Type: EntryNoop},
+		{Index: 2, Term: 1, Type: EntryCommand, Data: []byte("a")},
+		{Index: 3, Term: 1, Type: EntryCommand, Data: []byte("b")},
+	}))
+	// A new leader's entries replace a conflicting suffix
+	require.NoError(t, s.Append([]Entry{{Index: 3, Term: 2, Type: EntryCommand, Data: []byte("c")}}))
+	require.NoError(t, s.Close())
+
+	s, err = NewFileStorage(dir)
+	require.NoError(t, err)
+	st, snap, entries, err := s.Load()
+	require.NoError(t, err)
+	assert.Equal(t, HardState{Term: 3, Vote: "n2"}, st)
+	assert.Nil(t, snap)
+	require.Len(t, entries, 3)
+	assert.Equal(t, []byte("c"), entries[2].Data)
+
+	// Compaction keeps what follows the snapshot
+	require.NoError(t, s.SaveSnapshot(&Snapshot{Index: 2, Term: 1, Data: []byte("state")}, entries[2:]))
+	require.NoError(t, s.Append([]Entry{{Index: 4, Term: 2, Type: EntryCommand, Data: []byte("d")}}))
+	require.NoError(t, s.Close())
+
+	// A torn record at the end is dropped
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{40, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	f.Close()
+
+	s, err = NewFileStorage(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	_, snap, entries, err = s.Load()
+	require.NoError(t, err)
+	require.NotNil(t, snap)
+	assert.Equal(t, uint64(2), snap.Index)
+	assert.Equal(t, []byte("state"), snap.Data)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(3), entries[0].Index)
+	assert.Equal(t, uint64(4), entries[1].Index)
+
+	require.NoError(t, s.Append([]Entry{{Index: 5, Term: 2, Type: EntryNoop}}))
+	_, _, entries, err = s.Load()
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestRaft_TCPTransport(t *testing.T) {
+	var servers []Server
+	var listeners []net.Listener
+	for i := 1; i <= 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+		servers = append(servers, Server{ID: fmt.Sprintf("n%d", i), Addr: l.Addr().String()})
+	}
+
+	nodes := make(map[string]*Node)
+	fsms := make(map[string]*testFSM)
+	for i, s := range servers {
+		storage, err := NewFileStorage(t.TempDir())
+		require.NoError(t, err)
+		transport := NewTCPTransport()
+		fsm := newTestFSM()
+		n, err := NewNode(Config{
+			ID:                s.ID,
+			Servers:           servers,
+			Transport:         transport,
+			Storage:           storage,
+			StateMachine:      fsm,
+			ElectionTimeout:   200 * time.Millisecond,
+			HeartbeatInterval: 40 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		srv := ServeTCP(listeners[i], n)
+		t.Cleanup(func() {
+			srv.Close()
+			n.Stop()
+			transport.Close()
+			storage.Close()
+		})
+		nodes[s.ID] = n
+		fsms[s.ID] = fsm
+	}
+
+	var leader *Node
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.Status().State == Leader {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, waitTime, 10*time.Millisecond)
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if _, err = leader.Propose([]byte("key=value")); !errors.Is(err, ErrLeadershipLost) {
+			break
+		}
+	}
+	require.NoError(t, err)
+	for id, fsm := range fsms {
+		assert.Eventually(t, func() bool {
+			v, ok := fsm.get("key")
+			return ok && v == "value"
+		}, waitTime, 10*time.Millisecond, "%s never applied the entry", id)
+	}
+}
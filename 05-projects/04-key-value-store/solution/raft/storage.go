@@ -0,0 +1,354 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HardState is the part of a node's state that must survive a restart for
+// it to keep its promises: the latest term it has seen and whom it voted
+// for in that term.
+type HardState struct {
+	Term uint64
+	Vote string
+}
+
+// Snapshot is the state machine's state after applying every entry up to
+// Index, plus the servers configured at that point.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Servers []Server
+	Data    []byte
+}
+
+// Storage keeps a node's hard state, log and latest snapshot. Every method
+// must be durable when it returns.
+type Storage interface {
+	// Load returns what was saved, or zero values if nothing was.
+	Load() (HardState, *Snapshot, []Entry, error)
+	SetState(st HardState) error
+	// Append saves entries, first dropping saved entries at or after the
+	// index of the first one.
+	Append(entries []Entry) error
+	// SaveSnapshot saves snap and replaces the saved log with keep, the
+	// entries that follow it.
+	SaveSnapshot(snap *Snapshot, keep []Entry) error
+}
+
+// MemoryStorage keeps everything in memory, for tests.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	state   HardState
+	snap    *Snapshot
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.snap, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStorage) SetState(st HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = st
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = appendEntries(s.entries, entries)
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(snap *Snapshot, keep []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snap = snap
+	s.entries = append([]Entry(nil), keep...)
+	return nil
+}
+
+// appendEntries appends entries to log, replacing what it holds from the
+// first new index on.
+func appendEntries(log, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return log
+	}
+	first := entries[0].Index
+	for len(log) > 0 && log[len(log)-1].Index >= first {
+		log = log[:len(log)-1]
+	}
+	return append(log, entries...)
+}
+
+// File layout of FileStorage, in its directory:
+//
+//	state     gob HardState, replaced atomically
+//	snapshot  gob Snapshot, replaced atomically
+//	log       records: length uint32 | crc32c(payload) uint32 | payload
+//	payload:  index uint64 | term uint64 | type byte | data
+//
+// The log is append-only. An entry whose index is not one past the entry
+// before it replaces that entry and everything after it, which is how a
+// follower's conflicting suffix is dropped. A record torn by a crash ends
+// the log; it was never acknowledged.
+const (
+	stateFile    = "state"
+	snapshotFile = "snapshot"
+	logFile      = "log"
+
+	logRecordHead = 8
+	maxLogRecord  = 512 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptLog = errors.New("raft: corrupt log record")
+
+// FileStorage keeps a node's state in files in a directory.
+type FileStorage struct {
+	dir string
+
+	mu   sync.Mutex
+	log  *os.File
+	size int64
+}
+
+// NewFileStorage opens the storage in dir, creating it if needed.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir, log: file}, nil
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// Load reads everything back. It also positions the log for appending
+// after its last intact record.
+func (s *FileStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var st HardState
+	if err := readGob(filepath.Join(s.dir, stateFile), &st); err != nil && !os.IsNotExist(err) {
+		return HardState{}, nil, nil, err
+	}
+	var snap *Snapshot
+	var saved Snapshot
+	switch err := readGob(filepath.Join(s.dir, snapshotFile), &saved); {
+	case err == nil:
+		snap = &saved
+	case !os.IsNotExist(err):
+		return HardState{}, nil, nil, err
+	}
+
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return HardState{}, nil, nil, err
+	}
+	var entries []Entry
+	r := bufio.NewReader(s.log)
+	var offset int64
+	for {
+		e, n, err := readLogRecord(r)
+		if err == io.EOF || errors.Is(err, errCorruptLog) {
+			break
+		}
+		if err != nil {
+			return HardState{}, nil, nil, err
+		}
+		entries = appendEntries(entries, []Entry{e})
+		offset += n
+	}
+
+	// Drop a torn tail so new records follow the last intact one
+	if err := s.log.Truncate(offset); err != nil {
+		return HardState{}, nil, nil, err
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return HardState{}, nil, nil, err
+	}
+	s.size = offset
+
+	// Entries the snapshot covers may remain if a crash came between
+	// saving it and rewriting the log
+	if snap != nil {
+		for len(entries) > 0 && entries[0].Index <= snap.Index {
+			entries = entries[1:]
+		}
+	}
+	return st, snap, entries, nil
+}
+
+func (s *FileStorage) SetState(st HardState) error {
+	return writeGob(s.dir, stateFile, st)
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, e := range entries {
+		buf = appendLogRecord(buf, e)
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		s.log.Truncate(s.size)
+		s.log.Seek(s.size, io.SeekStart)
+		return err
+	}
+	s.size += int64(len(buf))
+	return s.log.Sync()
+}
+
+// SaveSnapshot writes the snapshot, then rewrites the log with only the
+// entries after it.
+func (s *FileStorage) SaveSnapshot(snap *Snapshot, keep []Entry) error {
+	if err := writeGob(s.dir, snapshotFile, snap); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, e := range keep {
+		buf = appendLogRecord(buf, e)
+	}
+	path := filepath.Join(s.dir, logFile)
+	if err := writeFile(path, buf); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+	s.log.Close()
+	s.log = file
+	s.size = int64(len(buf))
+	return nil
+}
+
+func appendLogRecord(buf []byte, e Entry) []byte {
+	payload := make([]byte, 17, 17+len(e.Data))
+	binary.LittleEndian.PutUint64(payload[0:], e.Index)
+	binary.LittleEndian.PutUint64(payload[8:], e.Term)
+	payload[16] = byte(e.Type)
+	payload = append(payload, e.Data...)
+
+	var head [logRecordHead]byte
+	binary.LittleEndian.PutUint32(head[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(head[4:], crc32.Checksum(payload, crcTable))
+	buf = append(buf, head[:]...)
+	return append(buf, payload...)
+}
+
+// readLogRecord returns the next entry and the number of bytes it took.
+func readLogRecord(r io.Reader) (Entry, int64, error) {
+	var head [logRecordHead]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Entry{}, 0, errCorruptLog
+		}
+		return Entry{}, 0, err
+	}
+	size := binary.LittleEndian.Uint32(head[0:])
+	if size < 17 || size > maxLogRecord {
+		return Entry{}, 0, errCorruptLog
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Entry{}, 0, errCorruptLog
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(head[4:]) {
+		return Entry{}, 0, errCorruptLog
+	}
+
+	e := Entry{
+		Index: binary.LittleEndian.Uint64(payload[0:]),
+		Term:  binary.LittleEndian.Uint64(payload[8:]),
+		Type:  EntryType(payload[16]),
+		Data:  payload[17:],
+	}
+	return e, int64(logRecordHead) + int64(size), nil
+}
+
+func readGob(path string, v any) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(v); err != nil {
+		return fmt.Errorf("raft: reading %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+func writeGob(dir, name string, v any) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, name), buf.Bytes())
+}
+
+// writeFile replaces path with data atomically.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
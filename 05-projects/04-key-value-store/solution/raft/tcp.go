@@ -0,0 +1,193 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// DefaultRPCTimeout bounds every RPC sent over TCP, including the dial.
+const DefaultRPCTimeout = time.Second
+
+// TCPTransport sends RPCs over TCP with net/rpc, keeping one connection per
+// server.
+type TCPTransport struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{timeout: DefaultRPCTimeout, clients: make(map[string]*rpc.Client)}
+}
+
+// Close drops the connections to other servers.
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for addr, c := range t.clients {
+		c.Close()
+		delete(t.clients, addr)
+	}
+	return nil
+}
+
+func (t *TCPTransport) RequestVote(to Server, req *VoteRequest) (*VoteResponse, error) {
+	var resp VoteResponse
+	return &resp, t.call(to, "Raft.RequestVote", req, &resp)
+}
+
+func (t *TCPTransport) AppendEntries(to Server, req *AppendRequest) (*AppendResponse, error) {
+	var resp AppendResponse
+	return &resp, t.call(to, "Raft.AppendEntries", req, &resp)
+}
+
+func (t *TCPTransport) InstallSnapshot(to Server, req *SnapshotRequest) (*SnapshotResponse, error) {
+	var resp SnapshotResponse
+	return &resp, t.call(to, "Raft.InstallSnapshot", req, &resp)
+}
+
+func (t *TCPTransport) call(to Server, method string, req, resp any) error {
+	c, err := t.client(to.Addr)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	call := c.Go(method, req, resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = fmt.Errorf("raft: %s to %s timed out", method, to.ID)
+	}
+	if err != nil {
+		// Start over with a new connection next time
+		t.drop(to.Addr, c)
+	}
+	return err
+}
+
+func (t *TCPTransport) client(addr string) (*rpc.Client, error) {
+	t.mu.Lock()
+	c, ok := t.clients[addr]
+	t.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c = rpc.NewClient(conn)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if existing, ok := t.clients[addr]; ok {
+		c.Close()
+		return existing, nil
+	}
+	t.clients[addr] = c
+	return c, nil
+}
+
+func (t *TCPTransport) drop(addr string, c *rpc.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients[addr] == c {
+		delete(t.clients, addr)
+	}
+	c.Close()
+}
+
+// TCPServer receives RPCs sent by TCPTransport.
+type TCPServer struct {
+	listener net.Listener
+	rpc      *rpc.Server
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ServeTCP accepts connections on l and passes their RPCs to h until the
+// returned server is closed.
+func ServeTCP(l net.Listener, h RPCHandler) *TCPServer {
+	s := &TCPServer{listener: l, rpc: rpc.NewServer(), conns: make(map[net.Conn]struct{})}
+	s.rpc.RegisterName("Raft", &rpcService{h})
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *TCPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.rpc.ServeConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and closes open ones.
+func (s *TCPServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// rpcService adapts an RPCHandler to the method set net/rpc expects.
+type rpcService struct {
+	h RPCHandler
+}
+
+func (s *rpcService) RequestVote(req *VoteRequest, resp *VoteResponse) error {
+	*resp = *s.h.HandleRequestVote(req)
+	return nil
+}
+
+func (s *rpcService) AppendEntries(req *AppendRequest, resp *AppendResponse) error {
+	*resp = *s.h.HandleAppendEntries(req)
+	return nil
+}
+
+func (s *rpcService) InstallSnapshot(req *SnapshotRequest, resp *SnapshotResponse) error {
+	*resp = *s.h.HandleInstallSnapshot(req)
+	return nil
+}
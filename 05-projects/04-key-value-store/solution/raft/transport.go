@@ -0,0 +1,196 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+)
+
+// Server is a member of the cluster. Addr is only meaningful to the
+// transport.
+type Server struct {
+	ID   string
+	Addr string
+}
+
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+}
+
+type AppendResponse struct {
+	Term    uint64
+	Success bool
+	// LastIndex is the follower's last log index, so that after a mismatch
+	// the leader can skip straight past entries the follower doesn't have.
+	LastIndex uint64
+}
+
+type SnapshotRequest struct {
+	Term     uint64
+	Leader   string
+	Snapshot *Snapshot
+}
+
+type SnapshotResponse struct {
+	Term uint64
+}
+
+// Transport sends RPCs to other servers. A call that fails returns an
+// error; the node retries on its own schedule.
+type Transport interface {
+	RequestVote(to Server, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(to Server, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(to Server, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// RPCHandler answers RPCs. *Node implements it; transports deliver the
+// requests they receive to it.
+type RPCHandler interface {
+	HandleRequestVote(req *VoteRequest) *VoteResponse
+	HandleAppendEntries(req *AppendRequest) *AppendResponse
+	HandleInstallSnapshot(req *SnapshotRequest) *SnapshotResponse
+}
+
+// ErrUnreachable is returned by MemNetwork when the destination is down or
+// cut off from the sender.
+var ErrUnreachable = errors.New("raft: server unreachable")
+
+// MemNetwork connects nodes in the same process. Links can be cut to
+// simulate crashes and partitions.
+type MemNetwork struct {
+	mu       sync.RWMutex
+	handlers map[string]RPCHandler
+	down     map[string]bool
+	cut      map[[2]string]bool
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		handlers: make(map[string]RPCHandler),
+		down:     make(map[string]bool),
+		cut:      make(map[[2]string]bool),
+	}
+}
+
+// Register makes h reachable as id.
+func (m *MemNetwork) Register(id string, h RPCHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = h
+}
+
+// Transport returns the transport the server id sends with.
+func (m *MemNetwork) Transport(id string) Transport {
+	return &memTransport{net: m, from: id}
+}
+
+// Disconnect cuts id off from every other server.
+func (m *MemNetwork) Disconnect(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down[id] = true
+}
+
+// Reconnect undoes Disconnect.
+func (m *MemNetwork) Reconnect(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.down, id)
+}
+
+// Partition splits the servers into groups that can only reach servers in
+// the same group. Servers not listed keep all their links.
+func (m *MemNetwork) Partition(groups ...[]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, a := range groups {
+		for j, b := range groups {
+			if i == j {
+				continue
+			}
+			for _, x := range a {
+				for _, y := range b {
+					m.cut[[2]string{x, y}] = true
+				}
+			}
+		}
+	}
+}
+
+// Heal removes every partition.
+func (m *MemNetwork) Heal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cut = make(map[[2]string]bool)
+}
+
+func (m *MemNetwork) route(from, to string) (RPCHandler, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h, ok := m.handlers[to]
+	if !ok || m.down[from] || m.down[to] || m.cut[[2]string{from, to}] {
+		return nil, ErrUnreachable
+	}
+	return h, nil
+}
+
+type memTransport struct {
+	net  *MemNetwork
+	from string
+}
+
+func (t *memTransport) RequestVote(to Server, req *VoteRequest) (*VoteResponse, error) {
+	h, err := t.net.route(t.from, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	resp := h.HandleRequestVote(req)
+	// The link may have been cut while the request was in flight
+	if _, err := t.net.route(to.ID, t.from); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *memTransport) AppendEntries(to Server, req *AppendRequest) (*AppendResponse, error) {
+	h, err := t.net.route(t.from, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	req.Entries = append([]Entry(nil), req.Entries...)
+	resp := h.HandleAppendEntries(req)
+	if _, err := t.net.route(to.ID, t.from); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *memTransport) InstallSnapshot(to Server, req *SnapshotRequest) (*SnapshotResponse, error) {
+	h, err := t.net.route(t.from, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	resp := h.HandleInstallSnapshot(req)
+	if _, err := t.net.route(to.ID, t.from); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
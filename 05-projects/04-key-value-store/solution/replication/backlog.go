@@ -0,0 +1,56 @@
+package replication
+
+// DefaultBacklogSize is how many bytes of recent records a node keeps for
+// replicas that reconnect after a short break.
+const DefaultBacklogSize = 1 << 20
+
+type record struct {
+	seq     uint64
+	payload []byte
+}
+
+// backlog holds the most recent WAL records, oldest first, with contiguous
+// sequence numbers. A replica that reconnects can continue from it as long
+// as the records it missed are still there.
+type backlog struct {
+	records []record
+	size    int
+	limit   int
+}
+
+// reset forgets every record, for when the dataset is replaced.
+func (b *backlog) reset() {
+	b.records = nil
+	b.size = 0
+}
+
+func (b *backlog) append(seq uint64, payload []byte) {
+	b.records = append(b.records, record{seq: seq, payload: payload})
+	b.size += len(payload)
+
+	// Keep the newest record even if it alone is over the limit
+	for b.size > b.limit && len(b.records) > 1 {
+		b.size -= len(b.records[0].payload)
+		b.records[0] = record{}
+		b.records = b.records[1:]
+	}
+}
+
+// since returns the records after seq. ok is false if some of them have
+// already been dropped. With no records at all there is nothing to miss:
+// callers only ask for positions taken after the last reset.
+func (b *backlog) since(seq uint64) ([]record, bool) {
+	if len(b.records) == 0 {
+		return nil, true
+	}
+
+	first := b.records[0].seq
+	last := b.records[len(b.records)-1].seq
+	switch {
+	case seq >= last:
+		return nil, seq == last
+	case seq+1 < first:
+		return nil, false
+	}
+	return b.records[seq+1-first:], true
+}
@@ -0,0 +1,288 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// linkTimeout is how long a follower waits for its leader before giving up
+// on the connection. The leader pings every HeartbeatInterval, so silence
+// this long means the link is gone.
+const linkTimeout = 5 * HeartbeatInterval
+
+const (
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+var errClosed = errors.New("follower closed")
+
+// follower keeps the node in sync with a leader, reconnecting after the
+// link breaks.
+type follower struct {
+	node *Node
+	addr string
+
+	mu           sync.Mutex
+	conn         net.Conn
+	connected    bool
+	replid       string // "?" until the first full resync
+	offset       int64  // last leader sequence number applied
+	fullSyncs    int
+	partialSyncs int
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newFollower(n *Node, addr string) *follower {
+	return &follower{
+		node:    n,
+		addr:    addr,
+		replid:  "?",
+		offset:  -1,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (f *follower) run() {
+	defer close(f.stopped)
+
+	delay := minRetryDelay
+	for {
+		synced, err := f.sync()
+		if err == errClosed {
+			return
+		}
+		log.Printf("Replication from %s: %v", f.addr, err)
+
+		if synced {
+			delay = minRetryDelay
+		}
+		select {
+		case <-f.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// close stops the follower and waits for it to let go of the store.
+func (f *follower) close() {
+	f.mu.Lock()
+	close(f.done)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+
+	<-f.stopped
+}
+
+// dropLink closes the connection to the leader without stopping the
+// follower, which reconnects and resyncs.
+func (f *follower) dropLink() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *follower) status(st *Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	st.Role = "follower"
+	st.Leader = f.addr
+	st.Connected = f.connected
+	st.Offset = f.offset
+	st.FullSyncs = f.fullSyncs
+	st.PartialSyncs = f.partialSyncs
+}
+
+// sync connects to the leader and applies what it sends until the link
+// fails. synced reports whether the leader accepted the PSYNC.
+func (f *follower) sync() (synced bool, err error) {
+	conn, err := net.DialTimeout("tcp", f.addr, linkTimeout)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		conn.Close()
+		return false, errClosed
+	default:
+	}
+	f.conn = conn
+	replid, offset := f.replid, f.offset
+	f.mu.Unlock()
+
+	f.node.mu.Lock()
+	user, password := f.node.leaderUser, f.node.leaderPassword
+	f.node.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.conn = nil
+		f.connected = false
+		f.mu.Unlock()
+		conn.Close()
+
+		select {
+		case <-f.done:
+			err = errClosed
+		default:
+		}
+	}()
+
+	r := protocol.NewReader(conn)
+	w := protocol.NewWriter(conn)
+	conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	if password != "" {
+		auth := []string{"AUTH", password}
+		if user != "" {
+			auth = []string{"AUTH", user, password}
+		}
+		if err := w.WriteCommand(auth...); err != nil {
+			return false, err
+		}
+	}
+	if err := w.WriteCommand("PSYNC", replid, strconv.FormatInt(offset, 10)); err != nil {
+		return false, err
+	}
+	if err := w.Flush(); err != nil {
+		return false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(linkTimeout))
+	if password != "" {
+		v, err := r.ReadValue()
+		if err != nil {
+			return false, err
+		}
+		if v.IsError() {
+			return false, fmt.Errorf("leader refused AUTH: %s", v.Str)
+		}
+	}
+	v, err := r.ReadValue()
+	if err != nil {
+		return false, err
+	}
+	if v.Type != protocol.TypeSimpleString {
+		return false, fmt.Errorf("unexpected PSYNC reply %q", v.Text())
+	}
+
+	fields := strings.Fields(v.Str)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		seq, err := strconv.ParseUint(fields[2], 10, 63)
+		if err != nil {
+			return false, fmt.Errorf("invalid FULLRESYNC offset %q", fields[2])
+		}
+		if err := f.fullResync(&chunkReader{r: r, conn: conn, timeout: linkTimeout}, fields[1], int64(seq)); err != nil {
+			return false, err
+		}
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		f.mu.Lock()
+		f.replid = fields[1]
+		f.partialSyncs++
+		f.mu.Unlock()
+	default:
+		return false, fmt.Errorf("unexpected PSYNC reply %q", v.Str)
+	}
+
+	f.mu.Lock()
+	f.connected = true
+	f.mu.Unlock()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(linkTimeout))
+		v, err := r.ReadValue()
+		if err != nil {
+			return true, err
+		}
+		if v.Type == protocol.TypeSimpleString && v.Str == "PING" {
+			continue
+		}
+		if v.Type != protocol.TypeArray || len(v.Elems) != 2 ||
+			v.Elems[0].Type != protocol.TypeInteger || v.Elems[1].Type != protocol.TypeBulkString {
+			return true, fmt.Errorf("%w: unexpected replication frame", protocol.ErrProtocol)
+		}
+		if err := f.apply(v.Elems[0].Int, []byte(v.Elems[1].Str)); err != nil {
+			return true, err
+		}
+	}
+}
+
+// fullResync replaces the dataset with the leader's snapshot and persists
+// it, so a restart doesn't replay the old WAL over it.
+func (f *follower) fullResync(r io.Reader, replid string, seq int64) error {
+	n := f.node
+	n.writes.Lock()
+	n.store.FlushAll()
+	if _, err := n.snapshots.LoadFrom(r, n.store); err != nil {
+		n.writes.Unlock()
+		return err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		n.writes.Unlock()
+		return err
+	}
+	n.resetDataset()
+
+	f.mu.Lock()
+	f.replid = replid
+	f.offset = seq
+	f.fullSyncs++
+	f.mu.Unlock()
+	n.writes.Unlock()
+
+	// The snapshot takes the write lock itself
+	if err := n.snapshots.CreateSnapshot(n.store); err != nil {
+		log.Printf("Snapshot after full resync failed: %v", err)
+	}
+	return nil
+}
+
+// apply applies and logs one record from the leader. Records must arrive
+// in order; anything else means the stream is broken.
+func (f *follower) apply(seq int64, payload []byte) error {
+	f.mu.Lock()
+	offset := f.offset
+	f.mu.Unlock()
+	if seq != offset+1 {
+		return fmt.Errorf("got record %d after %d", seq, offset)
+	}
+
+	n := f.node
+	n.writes.Lock()
+	defer n.writes.Unlock()
+
+	if err := persistence.ApplyRecord(n.store, payload); err != nil {
+		return err
+	}
+	if err := n.wal.AppendPayload(payload); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.offset = seq
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,384 @@
+// Package replication keeps standby copies of a store up to date.
+//
+// Every node streams its WAL to the replicas that connect to it. A replica
+// sends PSYNC with the replication ID and offset it last saw. If the leader
+// still has the records after that offset in its backlog, it replies
+// +CONTINUE and streams them; otherwise it replies +FULLRESYNC with a new
+// position, sends a snapshot and streams from there. The offset is the WAL
+// sequence number of the last record applied.
+//
+// On the wire, the snapshot is a series of bulk strings ended by an empty
+// one. Each record follows as an array of its sequence number and encoded
+// payload, the same bytes the WAL holds, so a transaction reaches the
+// replica as one unit. PING is sent while there is nothing to stream.
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/store"
+)
+
+// HeartbeatInterval is how often a leader pings a replica that has nothing
+// to receive. A replica that hears nothing for several intervals reconnects.
+const HeartbeatInterval = time.Second
+
+// Node is the replication state of one server. It is a leader for any
+// replica that connects, and after ReplicaOf also follows a leader itself.
+type Node struct {
+	store     *store.KVStore
+	wal       *persistence.WAL
+	snapshots *persistence.SnapshotManager
+	writes    sync.Locker
+
+	mu       sync.Mutex
+	replid   string
+	backlog  backlog
+	notify   chan struct{} // closed and replaced when a record arrives
+	replicas int
+	follower *follower
+	closed   bool
+
+	// Credentials to AUTH with when following a leader that requires them
+	leaderUser     string
+	leaderPassword string
+}
+
+// Status describes a node's replication state.
+type Status struct {
+	Role         string // "leader" or "follower"
+	ReplID       string // ID of the dataset this node streams to replicas
+	Replicas     int    // replicas currently streaming from this node
+	Leader       string // address followed, if any
+	Connected    bool   // whether the link to the leader is up
+	Offset       int64  // last leader sequence number applied, or -1
+	FullSyncs    int
+	PartialSyncs int
+}
+
+// NewNode feeds the WAL to connecting replicas. writes must be held by
+// whoever applies and logs writes (see protocol.Handler.WriteLock), so a
+// full resync can take the store and WAL position at the same point.
+func NewNode(kvStore *store.KVStore, wal *persistence.WAL, snapshots *persistence.SnapshotManager, writes sync.Locker) *Node {
+	n := &Node{
+		store:     kvStore,
+		wal:       wal,
+		snapshots: snapshots,
+		writes:    writes,
+		replid:    newReplID(),
+		backlog:   backlog{limit: DefaultBacklogSize},
+		notify:    make(chan struct{}),
+	}
+	wal.SetFeed(n.feed)
+	return n
+}
+
+// SetBacklogSize changes how many bytes of records are kept for partial
+// resyncs.
+func (n *Node) SetBacklogSize(size int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.backlog.limit = size
+}
+
+// SetLeaderAuth sets the credentials sent with AUTH when connecting to a
+// leader, like Redis' masteruser and masterauth. With an empty user the
+// password is the default user's.
+func (n *Node) SetLeaderAuth(user, password string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.leaderUser = user
+	n.leaderPassword = password
+}
+
+func newReplID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// feed receives every record the WAL appends.
+func (n *Node) feed(seq uint64, payload []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.backlog.append(seq, payload)
+	close(n.notify)
+	n.notify = make(chan struct{})
+}
+
+// resetDataset is called when the dataset was replaced by a full resync
+// from our own leader. Our replicas' positions mean nothing anymore, so
+// they get a new replication ID and have to resync too.
+func (n *Node) resetDataset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.replid = newReplID()
+	n.backlog.reset()
+	close(n.notify)
+	n.notify = make(chan struct{})
+}
+
+// Close stops following and disconnects replicas.
+func (n *Node) Close() {
+	n.wal.SetFeed(nil)
+
+	n.mu.Lock()
+	f := n.follower
+	n.follower = nil
+	n.closed = true
+	close(n.notify)
+	n.notify = make(chan struct{})
+	n.mu.Unlock()
+
+	if f != nil {
+		f.close()
+	}
+}
+
+// ReplicaOf starts following the leader at addr, dropping any previous
+// leader. An empty addr stops following and makes the node writable again,
+// keeping its data; keys that expired meanwhile are then removed as usual.
+func (n *Node) ReplicaOf(addr string) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return fmt.Errorf("replication is closed")
+	}
+	old := n.follower
+	n.follower = nil
+	n.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	// A replica leaves expiry to its leader, whose DELs it applies like any
+	// other write
+	n.store.SetFollower(addr != "")
+	if addr == "" {
+		return nil
+	}
+
+	f := newFollower(n, addr)
+	n.mu.Lock()
+	n.follower = f
+	n.mu.Unlock()
+	go f.run()
+	return nil
+}
+
+// IsReplica reports whether the node follows a leader.
+func (n *Node) IsReplica() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.follower != nil
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	st := Status{Role: "leader", ReplID: n.replid, Replicas: n.replicas, Offset: -1}
+	f := n.follower
+	n.mu.Unlock()
+
+	if f != nil {
+		f.status(&st)
+	}
+	return st
+}
+
+// ServeReplica streams to a replica until the connection fails or the node
+// is closed.
+func (n *Node) ServeReplica(conn net.Conn, r *protocol.Reader, w *protocol.Writer, replid string, offset int64) {
+	n.mu.Lock()
+	n.replicas++
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.replicas--
+		n.mu.Unlock()
+	}()
+
+	rw := replicaWriter{conn: conn, w: w}
+	epoch, pos, err := n.startStream(rw, replid, offset)
+	if err != nil {
+		log.Printf("Replica %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Replicas don't send anything once streaming, so a read only returns
+	// when the connection is gone
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, err := r.ReadValue(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := n.stream(rw, epoch, pos, gone); err != nil {
+		log.Printf("Replica %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// startStream answers PSYNC, sending a snapshot if the replica can't
+// continue from the backlog. It returns the replication ID the stream
+// belongs to and the sequence number to stream after.
+func (n *Node) startStream(w replicaWriter, replid string, offset int64) (string, uint64, error) {
+	n.mu.Lock()
+	epoch := n.replid
+	partial := false
+	if replid == epoch && offset >= 0 {
+		_, partial = n.backlog.since(uint64(offset))
+	}
+	n.mu.Unlock()
+
+	if partial {
+		if err := w.WriteValue(protocol.SimpleString("CONTINUE " + epoch)); err != nil {
+			return "", 0, err
+		}
+		return epoch, uint64(offset), w.Flush()
+	}
+
+	// Handlers apply and log writes under the write lock, so holding it the
+	// view matches the WAL exactly
+	n.writes.Lock()
+	seq := n.wal.LastSeq()
+	export := n.store.Export()
+	n.mu.Lock()
+	epoch = n.replid
+	n.mu.Unlock()
+	n.writes.Unlock()
+	defer export.Close()
+
+	if err := w.WriteValue(protocol.SimpleString("FULLRESYNC " + epoch + " " + strconv.FormatUint(seq, 10))); err != nil {
+		return "", 0, err
+	}
+	if err := n.snapshots.StreamTo(chunkWriter{w}, export, seq); err != nil {
+		return "", 0, err
+	}
+	if err := w.WriteValue(protocol.BulkString("")); err != nil {
+		return "", 0, err
+	}
+	return epoch, seq, w.Flush()
+}
+
+func (n *Node) stream(w replicaWriter, epoch string, pos uint64, gone <-chan struct{}) error {
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		n.mu.Lock()
+		if n.closed || n.replid != epoch {
+			n.mu.Unlock()
+			return nil
+		}
+		records, ok := n.backlog.since(pos)
+		notify := n.notify
+		n.mu.Unlock()
+
+		if !ok {
+			return fmt.Errorf("replica fell behind the backlog at %d", pos)
+		}
+		for _, rec := range records {
+			v := protocol.Array(protocol.Integer(int64(rec.seq)), protocol.BulkString(string(rec.payload)))
+			if err := w.WriteValue(v); err != nil {
+				return err
+			}
+			pos = rec.seq
+		}
+		if len(records) > 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-gone:
+			return nil
+		case <-heartbeat.C:
+			if err := w.WriteValue(protocol.SimpleString("PING")); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replicaWriter writes to a replica, giving up on one that stops reading.
+type replicaWriter struct {
+	conn net.Conn
+	w    *protocol.Writer
+}
+
+func (rw replicaWriter) WriteValue(v protocol.Value) error {
+	rw.conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	return rw.w.WriteValue(v)
+}
+
+func (rw replicaWriter) Flush() error {
+	rw.conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	return rw.w.Flush()
+}
+
+// chunkWriter sends everything written to it as bulk strings.
+type chunkWriter struct {
+	w replicaWriter
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := c.w.WriteValue(protocol.BulkString(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads back what a chunkWriter sent, up to the empty bulk
+// string that ends it.
+type chunkReader struct {
+	r       *protocol.Reader
+	conn    net.Conn
+	timeout time.Duration
+	buf     string
+	done    bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		v, err := c.r.ReadValue()
+		if err != nil {
+			return 0, err
+		}
+		if v.Type != protocol.TypeBulkString || v.Null {
+			return 0, fmt.Errorf("%w: expected snapshot chunk", protocol.ErrProtocol)
+		}
+		c.buf = v.Str
+		c.done = v.Str == ""
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,263 @@
+package replication
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/server"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNode struct {
+	addr  string
+	store *store.KVStore
+	node  *Node
+}
+
+func startNode(t *testing.T) *testNode {
+	t.Helper()
+
+	dir := t.TempDir()
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(dir + "/wal.log")
+	require.NoError(t, err)
+	handler := protocol.NewHandler(kvStore, wal)
+	snapshots := persistence.NewSnapshotManager(dir, time.Hour, handler.WriteLock())
+	snapshots.SetWAL(wal)
+	node := NewNode(kvStore, wal, snapshots, handler.WriteLock())
+	handler.SetReplication(node)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := server.New(handler)
+	go srv.Serve(listener)
+
+	t.Cleanup(func() {
+		srv.Close()
+		node.Close()
+		wal.Close()
+	})
+	return &testNode{addr: listener.Addr().String(), store: kvStore, node: node}
+}
+
+// testConn is a client connection, for commands that must share one such
+// as a transaction.
+type testConn struct {
+	r *protocol.Reader
+	w *protocol.Writer
+}
+
+func (n *testNode) dial(t *testing.T) *testConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", n.addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{r: protocol.NewReader(conn), w: protocol.NewWriter(conn)}
+}
+
+func (c *testConn) do(t *testing.T, args ...string) protocol.Value {
+	t.Helper()
+
+	require.NoError(t, c.w.WriteCommand(args...))
+	require.NoError(t, c.w.Flush())
+	v, err := c.r.ReadValue()
+	require.NoError(t, err)
+	return v
+}
+
+// do runs a command on a connection of its own.
+func (n *testNode) do(t *testing.T, args ...string) protocol.Value {
+	t.Helper()
+	return n.dial(t).do(t, args...)
+}
+
+func (n *testNode) replicaOf(t *testing.T, leader *testNode) {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(leader.addr)
+	require.NoError(t, err)
+	require.Equal(t, "OK", n.do(t, "REPLICAOF", host, port).Str)
+}
+
+func waitForKey(t *testing.T, n *testNode, key, value string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		got, ok := n.store.Get(key)
+		return ok && got == value
+	}, 5*time.Second, 10*time.Millisecond, "key %q never reached %q", key, value)
+}
+
+func TestReplication_FullSyncThenStream(t *testing.T) {
+	leader := startNode(t)
+	replica := startNode(t)
+
+	leader.do(t, "SET", "before", "1")
+	leader.do(t, "RPUSH", "list", "a", "b")
+	replica.do(t, "SET", "stale", "x")
+
+	replica.replicaOf(t, leader)
+	waitForKey(t, replica, "before", "1")
+	assert.False(t, replica.store.Exists("stale"), "full resync keeps old data")
+
+	conn := leader.dial(t)
+	require.Equal(t, "OK", conn.do(t, "MULTI").Str)
+	require.Equal(t, "QUEUED", conn.do(t, "SET", "after", "2").Str)
+	require.Equal(t, "QUEUED", conn.do(t, "DEL", "before").Str)
+	require.Equal(t, protocol.Array(protocol.OK(), protocol.Integer(1)), conn.do(t, "EXEC"))
+	waitForKey(t, replica, "after", "2")
+	assert.Eventually(t, func() bool { return !replica.store.Exists("before") },
+		5*time.Second, 10*time.Millisecond, "DEL never replicated")
+	assert.Equal(t, protocol.BulkStrings([]string{"a", "b"}), replica.do(t, "LRANGE", "list", "0", "-1"))
+
+	st := replica.node.Status()
+	assert.Equal(t, "follower", st.Role)
+	assert.True(t, st.Connected)
+	assert.Equal(t, 1, st.FullSyncs)
+}
+
+func TestReplication_ReplicaIsReadOnly(t *testing.T) {
+	leader := startNode(t)
+	replica := startNode(t)
+	replica.replicaOf(t, leader)
+
+	v := replica.do(t, "SET", "key", "value")
+	assert.True(t, v.IsError())
+	assert.Contains(t, v.Str, "READONLY")
+
+	// Promoting keeps the data and allows writes again
+	leader.do(t, "SET", "kept", "yes")
+	waitForKey(t, replica, "kept", "yes")
+	assert.Equal(t, "OK", replica.do(t, "REPLICAOF", "NO", "ONE").Str)
+	assert.Equal(t, "OK", replica.do(t, "SET", "key", "value").Str)
+	assert.Equal(t, "yes", replica.do(t, "GET", "kept").Str)
+	assert.Equal(t, "leader", replica.node.Status().Role)
+}
+
+func TestReplication_ReplicaFollowsEvictions(t *testing.T) {
+	leader := startNode(t)
+	replica := startNode(t)
+	replica.replicaOf(t, leader)
+
+	// The replica's lower limit doesn't make it evict keys of its own
+	leader.store.SetMaxMemory(2000, store.AllKeysLRU)
+	replica.store.SetMaxMemory(1000, store.AllKeysLRU)
+	for i := 0; i < 50; i++ {
+		require.Equal(t, "OK", leader.do(t, "SET", fmt.Sprintf("key%d", i), "value").Str)
+	}
+	waitForKey(t, replica, "key49", "value")
+
+	want := leader.store.Keys("*")
+	require.Less(t, len(want), 50)
+	sort.Strings(want)
+	got := replica.store.Keys("*")
+	sort.Strings(got)
+	assert.Equal(t, want, got)
+}
+
+func TestReplication_ReplicaFollowsExpiry(t *testing.T) {
+	leader := startNode(t)
+	replica := startNode(t)
+	replica.replicaOf(t, leader)
+
+	require.Equal(t, "OK", leader.do(t, "SET", "key", "value", "PX", "20").Str)
+	waitForKey(t, replica, "key", "value")
+	time.Sleep(30 * time.Millisecond)
+
+	// Expired keys are hidden, but only the leader's DEL removes them
+	assert.Equal(t, protocol.NullBulk(), replica.do(t, "GET", "key"))
+	assert.Equal(t, 0, replica.store.ExpireCycle())
+	assert.Equal(t, 1, replica.store.Stats().Keys)
+
+	require.Equal(t, 1, leader.store.ExpireCycle())
+	assert.Eventually(t, func() bool { return replica.store.Stats().Keys == 0 },
+		5*time.Second, 10*time.Millisecond, "DEL never replicated")
+}
+
+func TestReplication_AuthenticatesWithLeader(t *testing.T) {
+	leader := startNode(t)
+	replica := startNode(t)
+
+	leader.do(t, "SET", "key", "value")
+	require.Equal(t, "OK", leader.do(t, "ACL", "SETUSER", "replicator", "on", ">secret", "+@admin").Str)
+	require.Equal(t, "OK", leader.do(t, "ACL", "SETUSER", "default", ">other").Str)
+
+	replica.node.SetLeaderAuth("replicator", "secret")
+	replica.replicaOf(t, leader)
+	waitForKey(t, replica, "key", "value")
+}
+
+func TestReplication_PartialResyncAfterDisconnect(t *testing.T) {
+	leader := startNode(t)
+	replica := startNode(t)
+	replica.replicaOf(t, leader)
+
+	leader.do(t, "SET", "a", "1")
+	waitForKey(t, replica, "a", "1")
+
+	replica.node.mu.Lock()
+	f := replica.node.follower
+	replica.node.mu.Unlock()
+	f.dropLink()
+
+	for i := 0; i < 10; i++ {
+		leader.do(t, "SET", fmt.Sprintf("k%d", i), "v")
+	}
+	waitForKey(t, replica, "k9", "v")
+
+	st := replica.node.Status()
+	assert.Equal(t, 1, st.FullSyncs)
+	assert.Equal(t, 1, st.PartialSyncs)
+	assert.ElementsMatch(t, leader.store.Keys("*"), replica.store.Keys("*"))
+}
+
+func TestReplication_FullResyncWhenBacklogIsGone(t *testing.T) {
+	leader := startNode(t)
+	leader.node.SetBacklogSize(1)
+	replica := startNode(t)
+	replica.replicaOf(t, leader)
+
+	leader.do(t, "SET", "a", "1")
+	waitForKey(t, replica, "a", "1")
+
+	replica.node.mu.Lock()
+	f := replica.node.follower
+	replica.node.mu.Unlock()
+	f.dropLink()
+
+	leader.do(t, "SET", "b", "2")
+	leader.do(t, "SET", "c", "3")
+	waitForKey(t, replica, "c", "3")
+	assert.Equal(t, "2", replica.do(t, "GET", "b").Str)
+	assert.Equal(t, 2, replica.node.Status().FullSyncs)
+}
+
+func TestBacklog_Since(t *testing.T) {
+	b := backlog{limit: 10}
+	recs, ok := b.since(0)
+	assert.True(t, ok)
+	assert.Empty(t, recs)
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		b.append(seq, []byte("abc"))
+	}
+	// Only the last three fit
+	_, ok = b.since(1)
+	assert.False(t, ok)
+	recs, ok = b.since(2)
+	require.True(t, ok)
+	assert.Len(t, recs, 3)
+	assert.Equal(t, uint64(3), recs[0].seq)
+	recs, ok = b.since(5)
+	assert.True(t, ok)
+	assert.Empty(t, recs)
+	_, ok = b.since(6)
+	assert.False(t, ok)
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/alyxpink/go-training/kvstore/metrics"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+// MetricsHandler serves the handler's metrics in the Prometheus text format,
+// for mounting at /metrics.
+func MetricsHandler(h *protocol.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Buffer the page so a failure can still be reported with a status
+		var buf bytes.Buffer
+		if err := h.WriteMetrics(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", metrics.ContentType)
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/protocol"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// Server accepts TCP connections and serves RESP commands through a
+// protocol.Handler. Each connection runs in its own goroutine; pipelined
+// commands are executed in order and their replies flushed together.
+type Server struct {
+	handler *protocol.Handler
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	quit     chan struct{} // closed by Close
+	wg       sync.WaitGroup
+}
+
+func New(handler *protocol.Handler) *Server {
+	return &Server{
+		handler: handler,
+		conns:   make(map[net.Conn]struct{}),
+		quit:    make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on addr and serves until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until Close is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Addr returns the listener address, or nil before Serve is called.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections, closes open ones and waits for their
+// goroutines to exit.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.quit)
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
+	sess := s.handler.NewSession()
+	defer s.handler.CloseSession(sess)
+
+	// writeMu is held from running a command until its reply is written, so
+	// a message published to a channel the command just subscribed to can't
+	// overtake the confirmation.
+	var writeMu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	go s.writePushes(conn, writer, &writeMu, sess, done)
+
+	sess.SetBlockHook(func(cancel func()) func() {
+		return s.watchConn(conn, reader, cancel)
+	})
+
+	for {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, protocol.ErrProtocol) {
+				writeMu.Lock()
+				writer.WriteValue(protocol.Error("ERR " + err.Error()))
+				writer.Flush()
+				writeMu.Unlock()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Connection %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		writeMu.Lock()
+		reply := s.handler.Exec(sess, args)
+		writer.SetProtocol(sess.Protocol())
+		err = writer.WriteValue(reply)
+
+		// Only flush once the pipeline is drained so a batch of commands
+		// gets its replies in as few writes as possible.
+		if err == nil && (reader.Buffered() == 0 || sess.Closing()) {
+			err = writer.Flush()
+		}
+		writeMu.Unlock()
+
+		if err != nil || sess.Closing() {
+			return
+		}
+		if handoff := sess.Handoff(); handoff != nil {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+			handoff(conn, reader, writer)
+			return
+		}
+	}
+}
+
+// watchConn calls cancel if the client hangs up or the server closes while
+// a command blocks. Nothing reads from the connection meanwhile, so it waits
+// on the reader; the function it returns stops it before reading resumes.
+func (s *Server) watchConn(conn net.Conn, reader *protocol.Reader, cancel func()) (stop func()) {
+	stopped := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		if err := reader.Peek(); err != nil {
+			cancel()
+			return
+		}
+		// The client pipelined more commands, which run once this one is
+		// done
+		select {
+		case <-s.quit:
+			cancel()
+		case <-stopped:
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-finished
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// writePushes writes pub/sub messages for sess as they arrive, until done is
+// closed. A subscriber that falls too far behind is disconnected.
+func (s *Server) writePushes(conn net.Conn, writer *protocol.Writer, writeMu *sync.Mutex, sess *protocol.Session, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-sess.Dropped():
+			log.Printf("Connection %s: closing slow subscriber", conn.RemoteAddr())
+			conn.Close()
+			return
+		case <-sess.PushReady():
+		}
+
+		writeMu.Lock()
+		var err error
+		for _, v := range sess.TakePushes() {
+			if err = writer.WriteValue(v); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		writeMu.Unlock()
+
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
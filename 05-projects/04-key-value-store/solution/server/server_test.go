@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alyxpink/go-training/kvstore/metrics"
+	"github.com/alyxpink/go-training/kvstore/persistence"
+	"github.com/alyxpink/go-training/kvstore/protocol"
+	"github.com/alyxpink/go-training/kvstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (string, *store.KVStore) {
+	t.Helper()
+
+	kvStore := store.NewKVStore()
+	wal, err := persistence.NewWAL(filepath.Join(t.TempDir(), "test.wal"))
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := New(protocol.NewHandler(kvStore, wal))
+	go srv.Serve(listener)
+
+	t.Cleanup(func() {
+		srv.Close()
+		wal.Close()
+	})
+	return listener.Addr().String(), kvStore
+}
+
+type testConn struct {
+	conn net.Conn
+	r    *protocol.Reader
+	w    *protocol.Writer
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &testConn{conn: conn, r: protocol.NewReader(conn), w: protocol.NewWriter(conn)}
+}
+
+func (c *testConn) do(t *testing.T, args ...string) protocol.Value {
+	t.Helper()
+
+	require.NoError(t, c.w.WriteCommand(args...))
+	require.NoError(t, c.w.Flush())
+	v, err := c.r.ReadValue()
+	require.NoError(t, err)
+	return v
+}
+
+func TestServer_SetGetBinaryValue(t *testing.T) {
+	addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	value := "line one\r\nline  two\x00"
+	assert.Equal(t, "OK", c.do(t, "SET", "key", value).Str)
+	assert.Equal(t, value, c.do(t, "GET", "key").Str)
+	assert.True(t, c.do(t, "GET", "missing").Null)
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, c.w.WriteCommand("SET", fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+	}
+	require.NoError(t, c.w.WriteCommand("KEYS", "*"))
+	require.NoError(t, c.w.Flush())
+
+	for i := 0; i < n; i++ {
+		v, err := c.r.ReadValue()
+		require.NoError(t, err)
+		assert.Equal(t, "OK", v.Str)
+	}
+
+	v, err := c.r.ReadValue()
+	require.NoError(t, err)
+	assert.Len(t, v.Elems, n)
+}
+
+func TestServer_InlineCommands(t *testing.T) {
+	addr, _ := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "SET greeting \"hello world\"\r\nGET greeting\r\n")
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", line)
+
+	v, err := protocol.NewReader(reader).ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", v.Str)
+}
+
+func TestServer_ConcurrentClients(t *testing.T) {
+	addr, kvStore := startServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		c := dial(t, addr)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("client%d:%d", id, j)
+				c.w.WriteCommand("SET", key, "v")
+				c.w.Flush()
+				v, err := c.r.ReadValue()
+				assert.NoError(t, err)
+				assert.Equal(t, "OK", v.Str)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, kvStore.Keys("*"), 20*50)
+}
+
+func TestServer_RESP3(t *testing.T) {
+	addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	hello := c.do(t, "HELLO", "3")
+	assert.Equal(t, protocol.TypeMap, hello.Type)
+
+	v := c.do(t, "GET", "missing")
+	assert.Equal(t, protocol.TypeNull, v.Type)
+}
+
+func TestServer_ProtocolErrorClosesConnection(t *testing.T) {
+	addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	fmt.Fprint(c.conn, "*1\r\n$abc\r\n")
+	v, err := c.r.ReadValue()
+	require.NoError(t, err)
+	assert.True(t, v.IsError())
+
+	_, err = c.r.ReadValue()
+	assert.Error(t, err)
+}
+
+func TestServer_Quit(t *testing.T) {
+	addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, "OK", c.do(t, "QUIT").Str)
+	_, err := c.r.ReadValue()
+	assert.Error(t, err)
+}
+
+func TestServer_PublishSubscribe(t *testing.T) {
+	addr, _ := startServer(t)
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	v := sub.do(t, "SUBSCRIBE", "news")
+	assert.Equal(t, []string{"subscribe", "news", "1"}, v.Strings())
+
+	assert.Equal(t, int64(1), pub.do(t, "PUBLISH", "news", "hello").Int)
+
+	v, err := sub.r.ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"message", "news", "hello"}, v.Strings())
+
+	// Replies and messages share the connection in order
+	assert.Equal(t, []string{"pong", ""}, sub.do(t, "PING").Strings())
+	v = sub.do(t, "UNSUBSCRIBE")
+	assert.Equal(t, []string{"unsubscribe", "news", "0"}, v.Strings())
+	assert.Equal(t, int64(0), pub.do(t, "PUBLISH", "news", "hello").Int)
+}
+
+func TestServer_BlockingPop(t *testing.T) {
+	addr, kvStore := startServer(t)
+	consumer := dial(t, addr)
+	producer := dial(t, addr)
+
+	require.NoError(t, consumer.w.WriteCommand("BLPOP", "queue", "0"))
+	require.NoError(t, consumer.w.Flush())
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, int64(1), producer.do(t, "RPUSH", "queue", "job").Int)
+	v, err := consumer.r.ReadValue()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"queue", "job"}, v.Strings())
+
+	// A client that hangs up stops waiting, so it takes nothing
+	require.NoError(t, consumer.w.WriteCommand("BLPOP", "queue", "0"))
+	require.NoError(t, consumer.w.Flush())
+	time.Sleep(10 * time.Millisecond)
+	consumer.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	producer.do(t, "RPUSH", "queue", "job")
+	n, err := kvStore.LLen("queue")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestServer_CloseInterruptsBlockingPop(t *testing.T) {
+	kvStore := store.NewKVStore()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := New(protocol.NewHandler(kvStore, nil))
+	go srv.Serve(listener)
+
+	c := dial(t, listener.Addr().String())
+	// The command after BLPOP is already waiting to be read
+	require.NoError(t, c.w.WriteCommand("BLPOP", "queue", "0"))
+	require.NoError(t, c.w.WriteCommand("PING"))
+	require.NoError(t, c.w.Flush())
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waits for the blocked client")
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	handler := protocol.NewHandler(store.NewKVStore(), nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := New(handler)
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	c := dial(t, listener.Addr().String())
+	c.do(t, "SET", "key", "value")
+
+	web := httptest.NewServer(MetricsHandler(handler))
+	defer web.Close()
+	resp, err := http.Get(web.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, metrics.ContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "kvstore_connected_clients 1\n")
+	assert.Contains(t, string(body), `kvstore_commands_total{cmd="SET"} 1`+"\n")
+	assert.Contains(t, string(body), "kvstore_keys 1\n")
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+const (
+	defaultEvictSamples = 5
+
+	// entryOverhead approximates the per-key cost beyond the key and value
+	// bytes: map slot, item struct, timestamps and string headers.
+	entryOverhead = 96
+)
+
+func entrySize(key string, e *Entry) int64 {
+	return int64(len(key)) + e.valueSize() + entryOverhead
+}
+
+// Candidate describes a sampled key to an eviction policy.
+type Candidate struct {
+	Key       string
+	Entry     *Entry // read-only
+	Idle      time.Duration
+	Frequency uint8 // decayed logarithmic access counter, 0-255
+}
+
+// EvictionPolicy chooses which keys to evict once the memory limit is hit.
+// Like Redis, eviction is approximate: a few keys are sampled and the one
+// with the highest score is evicted.
+type EvictionPolicy interface {
+	// Name is the maxmemory-policy name, such as "allkeys-lru".
+	Name() string
+	// Volatile reports whether only keys with a TTL may be evicted.
+	Volatile() bool
+	// Score rates a candidate; higher scores are evicted first.
+	Score(c Candidate, now time.Time) int64
+}
+
+var (
+	NoEviction  EvictionPolicy = noEviction{}
+	AllKeysLRU  EvictionPolicy = lruPolicy{}
+	VolatileLRU EvictionPolicy = lruPolicy{volatile: true}
+	AllKeysLFU  EvictionPolicy = lfuPolicy{}
+	VolatileTTL EvictionPolicy = ttlPolicy{}
+)
+
+// ParseEvictionPolicy returns the built-in policy with the given name.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for _, p := range []EvictionPolicy{NoEviction, AllKeysLRU, VolatileLRU, AllKeysLFU, VolatileTTL} {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+type noEviction struct{}
+
+func (noEviction) Name() string                     { return "noeviction" }
+func (noEviction) Volatile() bool                   { return false }
+func (noEviction) Score(Candidate, time.Time) int64 { return 0 }
+
+type lruPolicy struct{ volatile bool }
+
+func (p lruPolicy) Name() string {
+	if p.volatile {
+		return "volatile-lru"
+	}
+	return "allkeys-lru"
+}
+
+func (p lruPolicy) Volatile() bool { return p.volatile }
+
+func (lruPolicy) Score(c Candidate, _ time.Time) int64 {
+	return int64(c.Idle)
+}
+
+type lfuPolicy struct{}
+
+func (lfuPolicy) Name() string   { return "allkeys-lfu" }
+func (lfuPolicy) Volatile() bool { return false }
+
+func (lfuPolicy) Score(c Candidate, _ time.Time) int64 {
+	// Least frequently used first; break ties by idle time
+	idle := int64(c.Idle / time.Millisecond)
+	if idle > 1<<32-1 {
+		idle = 1<<32 - 1
+	}
+	return int64(255-c.Frequency)<<32 | idle
+}
+
+type ttlPolicy struct{}
+
+func (ttlPolicy) Name() string   { return "volatile-ttl" }
+func (ttlPolicy) Volatile() bool { return true }
+
+func (ttlPolicy) Score(c Candidate, _ time.Time) int64 {
+	// Soonest expiry first
+	return -c.Entry.ExpiresAt.UnixNano()
+}
+
+// SetMaxMemory sets the memory limit in bytes (0 disables it) and the policy
+// used to get back under it.
+func (s *KVStore) SetMaxMemory(limit int64, policy EvictionPolicy) {
+	if policy == nil {
+		policy = NoEviction
+	}
+	s.configure(func(cfg *settings) {
+		cfg.maxMemory = limit
+		cfg.policy = policy
+	})
+}
+
+// SetEvictionSamples sets how many keys are sampled per eviction. More
+// samples approximate the policy better at the cost of CPU.
+func (s *KVStore) SetEvictionSamples(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.configure(func(cfg *settings) { cfg.evictSamples = n })
+}
+
+// SetEvictHook registers fn to be called with keys evicted by FreeMemory.
+// Like the expire hook, it runs under the write lock of the keys' shard.
+func (s *KVStore) SetEvictHook(fn func(keys []string)) {
+	s.configure(func(cfg *settings) { cfg.onEvict = fn })
+}
+
+// FreeMemory evicts keys until memory use is within the limit. It returns
+// ErrOOM if the policy can't free enough, in which case the caller should
+// reject commands that would grow the dataset. As in Redis, it is called
+// before a write rather than sized to it, so a single write may overshoot.
+func (s *KVStore) FreeMemory() error {
+	cfg := s.settings.Load()
+	if cfg.maxMemory <= 0 || s.used.Load() <= cfg.maxMemory {
+		return nil
+	}
+	if cfg.policy == NoEviction {
+		return ErrOOM
+	}
+
+	now := time.Now()
+	for s.used.Load() > cfg.maxMemory {
+		sh, key, ok := s.evictionCandidate(cfg, now)
+		if !ok {
+			return ErrOOM
+		}
+		s.evict(sh, key, cfg)
+	}
+	return nil
+}
+
+// EvictionCandidate returns the key FreeMemory would evict next, or "" if
+// memory use is within the limit, without evicting it. It is for stores
+// kept in step through a replicated log, where one copy can't evict on its
+// own: the caller deletes the key through the log, so every copy evicts the
+// same keys, and calls again until it gets "". It returns ErrOOM as
+// FreeMemory does.
+func (s *KVStore) EvictionCandidate() (string, error) {
+	cfg := s.settings.Load()
+	if cfg.maxMemory <= 0 || s.used.Load() <= cfg.maxMemory {
+		return "", nil
+	}
+	if cfg.policy == NoEviction {
+		return "", ErrOOM
+	}
+	_, key, ok := s.evictionCandidate(cfg, time.Now())
+	if !ok {
+		return "", ErrOOM
+	}
+	return key, nil
+}
+
+// evict removes key unless another writer got to it first.
+func (s *KVStore) evict(sh *shard, key string, cfg *settings) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, ok := sh.data[key]; !ok {
+		return
+	}
+	sh.beforeChange(key)
+	sh.remove(key)
+	s.evictedKeys.Add(1)
+	if cfg.onEvict != nil {
+		cfg.onEvict([]string{key})
+	}
+}
+
+// evictionCandidate samples keys across shards, starting at a different
+// shard each time and holding one shard's read lock at a time, and returns
+// the one with the highest score.
+func (s *KVStore) evictionCandidate(cfg *settings, now time.Time) (*shard, string, bool) {
+	var best string
+	var bestShard *shard
+	var bestScore int64
+	sampled := 0
+
+	consider := func(sh *shard, key string, it *item) {
+		c := Candidate{
+			Key:       key,
+			Entry:     &it.Entry,
+			Idle:      now.Sub(time.Unix(0, it.lastAccess.Load())),
+			Frequency: lfuCounter(it.lfu.Load(), now),
+		}
+		score := cfg.policy.Score(c, now)
+		if bestShard == nil || score > bestScore {
+			best, bestShard, bestScore = key, sh, score
+		}
+		sampled++
+	}
+
+	start := s.nextEvict.Add(1)
+	for i := uint64(0); i < uint64(len(s.shards)) && sampled < cfg.evictSamples; i++ {
+		sh := s.shards[(start+i)&s.mask]
+		sh.mu.RLock()
+		// Map iteration starts at a random position, which gives us the
+		// sample
+		if cfg.policy.Volatile() {
+			for key := range sh.volatile {
+				if sampled == cfg.evictSamples {
+					break
+				}
+				if it, ok := sh.data[key]; ok {
+					consider(sh, key, it)
+				}
+			}
+		} else {
+			for key, it := range sh.data {
+				if sampled == cfg.evictSamples {
+					break
+				}
+				consider(sh, key, it)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return bestShard, best, bestShard != nil
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_MemoryAccounting(t *testing.T) {
+	s := NewKVStore()
+
+	s.Set("key", "12345")
+	assert.Equal(t, int64(3+5+entryOverhead), s.Stats().UsedMemory)
+
+	s.Set("key", "1234567890")
+	assert.Equal(t, int64(3+10+entryOverhead), s.Stats().UsedMemory)
+
+	s.Del("key")
+	assert.Equal(t, int64(0), s.Stats().UsedMemory)
+}
+
+func TestKVStore_NoEviction(t *testing.T) {
+	s := NewKVStore()
+	s.SetMaxMemory(5*entryOverhead, NoEviction)
+
+	for i := 0; i < 10; i++ {
+		s.Set("key"+strconv.Itoa(i), "value")
+	}
+
+	assert.ErrorIs(t, s.FreeMemory(), ErrOOM)
+	assert.Equal(t, 10, s.Stats().Keys, "noeviction must not delete anything")
+}
+
+func TestKVStore_AllKeysLRU(t *testing.T) {
+	s := NewKVStore()
+	s.SetEvictionSamples(1000)
+
+	for i := 0; i < 100; i++ {
+		s.Set("key"+strconv.Itoa(i), "value")
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// Touch the first ten keys so they are the most recently used
+	for i := 0; i < 10; i++ {
+		s.Get("key" + strconv.Itoa(i))
+	}
+
+	var evicted []string
+	s.SetEvictHook(func(keys []string) { evicted = append(evicted, keys...) })
+	s.SetMaxMemory(s.Stats().UsedMemory/10, AllKeysLRU)
+	require.NoError(t, s.FreeMemory())
+
+	stats := s.Stats()
+	assert.LessOrEqual(t, stats.UsedMemory, stats.MaxMemory)
+	assert.Equal(t, int64(len(evicted)), stats.EvictedKeys)
+	for i := 0; i < 10; i++ {
+		assert.True(t, s.Exists("key"+strconv.Itoa(i)), "recently used key%d should survive", i)
+	}
+}
+
+func TestKVStore_AllKeysLFU(t *testing.T) {
+	s := NewKVStore()
+	s.SetEvictionSamples(1000)
+
+	for i := 0; i < 50; i++ {
+		s.Set("key"+strconv.Itoa(i), "value")
+	}
+
+	// Hot keys are read often, cold keys never
+	for n := 0; n < 200; n++ {
+		for i := 0; i < 5; i++ {
+			s.Get("key" + strconv.Itoa(i))
+		}
+	}
+
+	s.SetMaxMemory(s.Stats().UsedMemory/5, AllKeysLFU)
+	require.NoError(t, s.FreeMemory())
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, s.Exists("key"+strconv.Itoa(i)), "frequently used key%d should survive", i)
+	}
+}
+
+func TestKVStore_VolatileTTL(t *testing.T) {
+	s := NewKVStore()
+	s.SetEvictionSamples(1000)
+
+	s.Set("persistent", "value")
+	for i := 1; i <= 10; i++ {
+		setWithTTL(s, "ttl"+strconv.Itoa(i), time.Duration(i)*time.Hour)
+	}
+
+	s.SetMaxMemory(s.Stats().UsedMemory-1, VolatileTTL)
+	require.NoError(t, s.FreeMemory())
+
+	assert.False(t, s.Exists("ttl1"), "key closest to expiry should be evicted first")
+	assert.True(t, s.Exists("ttl10"))
+	assert.True(t, s.Exists("persistent"))
+}
+
+func TestKVStore_VolatileLRUOnlyEvictsVolatileKeys(t *testing.T) {
+	s := NewKVStore()
+
+	for i := 0; i < 10; i++ {
+		s.Set("persistent"+strconv.Itoa(i), "value")
+	}
+	setWithTTL(s, "volatile", time.Hour)
+
+	s.SetMaxMemory(5*entryOverhead, VolatileLRU)
+	assert.ErrorIs(t, s.FreeMemory(), ErrOOM)
+
+	assert.False(t, s.Exists("volatile"))
+	assert.Equal(t, 10, s.Stats().Keys)
+}
+
+func TestKVStore_EvictionCandidate(t *testing.T) {
+	s := NewKVStore()
+	for i := 0; i < 10; i++ {
+		s.Set("key"+strconv.Itoa(i), "value")
+	}
+
+	key, err := s.EvictionCandidate()
+	require.NoError(t, err)
+	assert.Empty(t, key, "nothing to evict without a limit")
+
+	s.SetMaxMemory(5*entryOverhead, NoEviction)
+	_, err = s.EvictionCandidate()
+	assert.ErrorIs(t, err, ErrOOM)
+
+	// The caller evicts, until there is nothing left to
+	s.SetMaxMemory(5*entryOverhead, AllKeysLRU)
+	for {
+		key, err := s.EvictionCandidate()
+		require.NoError(t, err)
+		if key == "" {
+			break
+		}
+		require.True(t, s.Del(key))
+	}
+	stats := s.Stats()
+	assert.LessOrEqual(t, stats.UsedMemory, stats.MaxMemory)
+	assert.Zero(t, stats.EvictedKeys)
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for _, name := range []string{"noeviction", "allkeys-lru", "allkeys-lfu", "volatile-lru", "volatile-ttl"} {
+		p, err := ParseEvictionPolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, p.Name())
+	}
+
+	_, err := ParseEvictionPolicy("allkeys-random")
+	assert.Error(t, err)
+}
+
+func TestKVStore_EvictionUnderConcurrentLoad(t *testing.T) {
+	policies := []EvictionPolicy{AllKeysLRU, AllKeysLFU, VolatileLRU, VolatileTTL}
+
+	for _, policy := range policies {
+		t.Run(policy.Name(), func(t *testing.T) {
+			s := NewKVStore()
+			const limit = 200 * (entryOverhead + 20)
+			s.SetMaxMemory(limit, policy)
+
+			var evicted atomic.Int64
+			s.SetEvictHook(func(keys []string) { evicted.Add(int64(len(keys))) })
+
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 2000; i++ {
+						key := "w" + strconv.Itoa(w) + ":" + strconv.Itoa(i)
+						if err := s.FreeMemory(); err != nil {
+							t.Errorf("FreeMemory: %v", err)
+							return
+						}
+						s.Set(key, "value")
+						s.Expire(key, 3600)
+						s.Get("w" + strconv.Itoa(w) + ":" + strconv.Itoa(i/2))
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			require.NoError(t, s.FreeMemory())
+			stats := s.Stats()
+			assert.LessOrEqual(t, stats.UsedMemory, int64(limit))
+			assert.Equal(t, evicted.Load(), stats.EvictedKeys)
+			assert.Equal(t, 8*2000, stats.Keys+int(stats.EvictedKeys))
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package store
+
+import (
+	"slices"
+	"time"
+)
+
+// Active expiry follows the Redis approach: every cycle samples a few keys
+// that have a TTL and deletes the expired ones, repeating while more than a
+// quarter of each sample turns out to be expired and the time budget lasts.
+// Lazy checks in Get/Exists/Keys still hide expired keys between cycles.
+const (
+	expireSampleSize   = 20
+	expireCycleBudget  = 25 * time.Millisecond
+	expireRepeatFactor = 4 // repeat while expired*4 > sampled
+)
+
+// Stats is a point-in-time summary of the keyspace.
+type Stats struct {
+	Keys        int   // keys held in memory, including expired ones not yet reclaimed
+	Expires     int   // keys with a TTL
+	ExpiredKeys int64 // keys removed by expiry
+	EvictedKeys int64 // keys removed to stay within the memory limit
+	UsedMemory  int64 // estimated bytes held by keys and values
+	MaxMemory   int64 // memory limit, 0 if unlimited
+	Policy      string
+}
+
+// Stats adds up the shards one at a time, so under concurrent writes the
+// counts may not all correspond to the same instant.
+func (s *KVStore) Stats() Stats {
+	cfg := s.settings.Load()
+	st := Stats{
+		ExpiredKeys: s.expiredKeys.Load(),
+		EvictedKeys: s.evictedKeys.Load(),
+		UsedMemory:  s.used.Load(),
+		MaxMemory:   cfg.maxMemory,
+		Policy:      cfg.policy.Name(),
+	}
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		st.Keys += len(sh.data)
+		st.Expires += len(sh.volatile)
+		sh.mu.RUnlock()
+	}
+	return st
+}
+
+// SetExpireHook registers fn to be called with the keys removed by each
+// expiry pass. It runs while the write lock of the keys' shard is held, so
+// anything it logs is ordered before any later write to the same keys.
+func (s *KVStore) SetExpireHook(fn func(keys []string)) {
+	s.configure(func(cfg *settings) { cfg.onExpire = fn })
+}
+
+// SetFollower makes the store leave expiry to the copy it follows, as a
+// replica or a Raft node does. Keys past their TTL are then hidden from
+// reads but never removed, neither by the expiry cycle nor by a write that
+// finds them, and snapshots keep them: a copy that removed keys by its own
+// clock would drift from the others. They go once the DEL the leader logs
+// for them is applied.
+func (s *KVStore) SetFollower(on bool) {
+	s.configure(func(cfg *settings) { cfg.follower = on })
+}
+
+func (s *KVStore) following() bool {
+	return s.settings.Load().follower
+}
+
+// ExpiredKeys returns up to n keys whose TTL has passed, without removing
+// them. It is for the leader of followers kept in step through a
+// replicated log: it deletes the keys through the log instead of running
+// the expiry cycle, so every copy removes the same keys at the same point.
+func (s *KVStore) ExpiredKeys(n int) []string {
+	now := time.Now()
+	var keys []string
+	start := s.nextExpire.Add(1)
+	for i := uint64(0); i < uint64(len(s.shards)) && len(keys) < n; i++ {
+		sh := s.shards[(start+i)&s.mask]
+		sh.mu.RLock()
+		for key := range sh.volatile {
+			if len(keys) == n {
+				break
+			}
+			if it, ok := sh.data[key]; ok && it.expiredAt(now) {
+				keys = append(keys, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return keys
+}
+
+// Expired returns those of keys that have expired but are still held, for
+// the same leader to delete before a write that uses them.
+func (s *KVStore) Expired(keys []string) []string {
+	now := time.Now()
+	var expired []string
+	for _, key := range keys {
+		sh := s.shards[s.shardIndex(key)]
+		sh.mu.RLock()
+		if it, ok := sh.data[key]; ok && it.expiredAt(now) && !slices.Contains(expired, key) {
+			expired = append(expired, key)
+		}
+		sh.mu.RUnlock()
+	}
+	return expired
+}
+
+// StartExpiry runs the active expiry cycle every interval until Close.
+func (s *KVStore) StartExpiry(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+
+	s.wg.Add(1)
+	go func(stop <-chan struct{}) {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.ExpireCycle()
+			}
+		}
+	}(s.stop)
+}
+
+// Close stops the background expiry cycle and waits for it to exit.
+func (s *KVStore) Close() {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	s.wg.Wait()
+}
+
+// ExpireCycle runs one active expiry pass and returns the number of keys it
+// removed. Each shard is sampled in turn, starting where the previous cycle
+// ran out of time. A follower removes nothing.
+func (s *KVStore) ExpireCycle() int {
+	if s.following() {
+		return 0
+	}
+	deadline := time.Now().Add(expireCycleBudget)
+	start := s.nextExpire.Load()
+	total := 0
+
+	for i := range uint64(len(s.shards)) {
+		sh := s.shards[(start+i)&s.mask]
+		for {
+			expired, sampled := s.expireSample(sh, expireSampleSize)
+			total += expired
+			if sampled == 0 || expired*expireRepeatFactor <= sampled {
+				break
+			}
+			if time.Now().After(deadline) {
+				s.nextExpire.Store(start + i)
+				return total
+			}
+		}
+	}
+	return total
+}
+
+func (s *KVStore) expireSample(sh *shard, n int) (expired, sampled int) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+
+	// Map iteration starts at a random position, which gives us the sample
+	for key := range sh.volatile {
+		if sampled == n {
+			break
+		}
+		sampled++
+
+		entry, ok := sh.data[key]
+		if !ok {
+			delete(sh.volatile, key)
+			continue
+		}
+		if entry.expiredAt(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		sh.beforeChange(key)
+		sh.remove(key)
+	}
+
+	if len(keys) > 0 {
+		s.expiredKeys.Add(int64(len(keys)))
+		if onExpire := s.settings.Load().onExpire; onExpire != nil {
+			onExpire(keys)
+		}
+	}
+	return len(keys), sampled
+}
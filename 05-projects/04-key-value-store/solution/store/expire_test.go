@@ -0,0 +1,160 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setWithTTL(s *KVStore, key string, ttl time.Duration) {
+	expires := time.Now().Add(ttl)
+	s.Restore(key, Entry{Value: "value", CreatedAt: time.Now(), UpdatedAt: time.Now(), ExpiresAt: &expires})
+}
+
+func TestKVStore_ExpireCycleReclaimsKeys(t *testing.T) {
+	s := NewKVStore()
+	for i := 0; i < 500; i++ {
+		setWithTTL(s, "short"+strconv.Itoa(i), 5*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		setWithTTL(s, "long"+strconv.Itoa(i), time.Hour)
+	}
+	s.Set("persistent", "value")
+
+	time.Sleep(10 * time.Millisecond)
+	removed := s.ExpireCycle()
+
+	assert.Equal(t, 500, removed)
+	stats := s.Stats()
+	assert.Equal(t, 11, stats.Keys, "expired keys should be deleted, not just hidden")
+	assert.Equal(t, 10, stats.Expires)
+	assert.Equal(t, int64(500), stats.ExpiredKeys)
+}
+
+func TestKVStore_ExpireHook(t *testing.T) {
+	s := NewKVStore()
+
+	var mu sync.Mutex
+	var expired []string
+	s.SetExpireHook(func(keys []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired = append(expired, keys...)
+	})
+
+	setWithTTL(s, "key1", time.Millisecond)
+	setWithTTL(s, "key2", time.Hour)
+	time.Sleep(5 * time.Millisecond)
+	s.ExpireCycle()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"key1"}, expired)
+}
+
+// A write that finds an expired key removes it and reports it first, so a
+// log sees the removal before the write.
+func TestKVStore_WritesReportExpiredKeys(t *testing.T) {
+	s := NewKVStore()
+
+	var expired []string
+	s.SetExpireHook(func(keys []string) { expired = append(expired, keys...) })
+
+	setWithTTL(s, "key1", time.Millisecond)
+	setWithTTL(s, "key2", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.False(t, s.Exists("key1"))
+	assert.Empty(t, expired, "reads only hide expired keys")
+
+	_, err := s.LPush("key1", "a")
+	require.NoError(t, err)
+	assert.False(t, s.Del("key2"), "an expired key is not there to delete")
+	assert.Equal(t, []string{"key1", "key2"}, expired)
+	assert.Equal(t, int64(2), s.Stats().ExpiredKeys)
+}
+
+func TestKVStore_ReplayDoesNotExpire(t *testing.T) {
+	s := NewKVStore()
+	s.Set("key1", "v1")
+
+	s.Replay(func(tx *Tx) {
+		assert.True(t, tx.ExpireAt("key1", time.Now().Add(-time.Second)))
+		assert.True(t, tx.Exists("key1"), "a past instant doesn't delete the key in Replay")
+		tx.Set("key1", "v2")
+		assert.True(t, tx.Persist("key1"))
+	})
+
+	val, ok := s.Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, "v2", val)
+	assert.Equal(t, -1, s.TTL("key1"))
+}
+
+// A follower hides expired keys from reads but leaves removing them to the
+// copy it follows.
+func TestKVStore_FollowerDoesNotExpire(t *testing.T) {
+	s := NewKVStore()
+	var expired []string
+	s.SetExpireHook(func(keys []string) { expired = append(expired, keys...) })
+	s.SetFollower(true)
+
+	setWithTTL(s, "key1", time.Millisecond)
+	setWithTTL(s, "key2", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.False(t, s.Exists("key1"))
+	assert.Equal(t, 0, s.ExpireCycle())
+	assert.True(t, s.Del("key2"), "writes see expired keys")
+	assert.Empty(t, expired)
+	assert.Equal(t, 1, s.Stats().Keys)
+
+	export := s.Export()
+	count := 0
+	for _, _, ok := export.Next(); ok; _, _, ok = export.Next() {
+		count++
+	}
+	export.Close()
+	assert.Equal(t, 1, count, "snapshots keep expired keys")
+
+	s.SetFollower(false)
+	assert.Equal(t, 1, s.ExpireCycle())
+}
+
+func TestKVStore_StartExpiryAndClose(t *testing.T) {
+	s := NewKVStore()
+	s.StartExpiry(5 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		setWithTTL(s, "key"+strconv.Itoa(i), time.Millisecond)
+	}
+
+	require.Eventually(t, func() bool {
+		return s.Stats().Keys == 0
+	}, time.Second, 5*time.Millisecond)
+
+	s.Close()
+	s.Close()
+
+	// No cycle runs after Close
+	setWithTTL(s, "late", time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, s.Stats().Keys)
+}
+
+func TestKVStore_SetAfterExpiry(t *testing.T) {
+	s := NewKVStore()
+	setWithTTL(s, "key1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// Writing an expired key starts a fresh entry without the old TTL
+	s.Set("key1", "value2")
+	val, ok := s.Get("key1")
+	require.True(t, ok)
+	assert.Equal(t, "value2", val)
+	assert.Equal(t, -1, s.TTL("key1"))
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const exportBatchSize = 256
+
+// Export is a consistent, point-in-time view of the store. It does not copy
+// values up front: the key list is captured when the export starts, and
+// writers save the previous version of any key they change while an export
+// is open (copy-on-write). Iteration only holds one shard's read lock for
+// one small batch at a time, so writers keep running.
+type Export struct {
+	s      *KVStore
+	at     time.Time
+	keys   [][]string          // per shard
+	frozen []map[string]*Entry // per shard: pre-export version of keys changed since; nil if absent
+	shard  int
+	pos    int
+	batch  []exportItem
+	once   sync.Once
+	keep   bool // expired entries are returned too, as the store follows another
+}
+
+type exportItem struct {
+	key   string
+	entry Entry
+}
+
+// Export starts a point-in-time view of the store. Callers must Close it,
+// otherwise writers keep saving old versions for it.
+func (s *KVStore) Export() *Export {
+	tx := s.lockAll(true)
+	defer tx.unlock()
+
+	e := &Export{
+		s:      s,
+		at:     tx.now,
+		keys:   make([][]string, len(s.shards)),
+		frozen: make([]map[string]*Entry, len(s.shards)),
+		keep:   s.following(),
+	}
+	for i, sh := range s.shards {
+		e.keys[i] = slices.Collect(maps.Keys(sh.data))
+		e.frozen[i] = make(map[string]*Entry)
+		sh.exports[e] = struct{}{}
+	}
+	return e
+}
+
+// Time returns the instant the view was taken. Entries that had expired by
+// then are not returned, unless the store is a follower (see SetFollower).
+func (e *Export) Time() time.Time {
+	return e.at
+}
+
+// Len returns the number of keys present when the export started, including
+// ones that had already expired.
+func (e *Export) Len() int {
+	n := 0
+	for _, keys := range e.keys {
+		n += len(keys)
+	}
+	return n
+}
+
+// Next returns the next entry in the view. The entry is a copy and may be
+// kept by the caller. ok is false once the view is exhausted.
+func (e *Export) Next() (key string, entry Entry, ok bool) {
+	for len(e.batch) == 0 && e.shard < len(e.keys) {
+		e.fill()
+	}
+	if len(e.batch) == 0 {
+		return "", Entry{}, false
+	}
+
+	item := e.batch[0]
+	e.batch = e.batch[1:]
+	return item.key, item.entry, true
+}
+
+// fill reads the next batch from the current shard, moving on to the next
+// shard once it is done.
+func (e *Export) fill() {
+	sh := e.s.shards[e.shard]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	keys, frozen := e.keys[e.shard], e.frozen[e.shard]
+	e.batch = e.batch[:0]
+	for e.pos < len(keys) && len(e.batch) < exportBatchSize {
+		key := keys[e.pos]
+		e.pos++
+
+		entry, changed := frozen[key]
+		if !changed {
+			if it, ok := sh.data[key]; ok {
+				entry = &it.Entry
+			}
+		}
+		if entry == nil || !e.keep && entry.expiredAt(e.at) {
+			continue
+		}
+		e.batch = append(e.batch, exportItem{key: key, entry: entry.clone()})
+	}
+	if e.pos == len(keys) {
+		e.shard, e.pos = e.shard+1, 0
+	}
+}
+
+// Close releases the view. It is safe to call more than once.
+func (e *Export) Close() {
+	e.once.Do(func() {
+		for i, sh := range e.s.shards {
+			sh.mu.Lock()
+			delete(sh.exports, e)
+			e.frozen[i] = nil
+			sh.mu.Unlock()
+		}
+		e.keys, e.batch = nil, nil
+		e.shard = len(e.frozen)
+	})
+}
+
+// preserve saves the current version of key for every open export before a
+// writer changes it. Callers must hold the write lock.
+func (sh *shard) preserve(key string) {
+	for e := range sh.exports {
+		frozen := e.frozen[sh.index]
+		if _, saved := frozen[key]; saved {
+			continue
+		}
+		if entry, ok := sh.data[key]; ok {
+			c := entry.clone()
+			frozen[key] = &c
+		} else {
+			frozen[key] = nil
+		}
+	}
+}
+
+// Restore inserts an entry exactly as given, including its timestamps and
+// expiry instant. It is used to load snapshots. Entries that have already
+// expired are ignored, unless the store is a follower.
+func (s *KVStore) Restore(key string, entry Entry) {
+	if !s.following() && entry.expiredAt(time.Now()) {
+		return
+	}
+
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	tx.Restore(key, entry)
+}
+
+// Restore replaces key with an entry exactly as given, as DUMP returned it.
+// An entry that has already expired only removes the key, unless nothing
+// expires in the Tx.
+func (tx *Tx) Restore(key string, entry Entry) {
+	sh := tx.shard(key)
+	sh.beforeChange(key)
+	sh.remove(key)
+	if !tx.expired(&entry) {
+		sh.insert(key, newItem(entry.clone(), tx.now))
+	}
+}
+
+// Dump returns a copy of the entry at key, for Restore to recreate it
+// elsewhere.
+func (tx *Tx) Dump(key string) (Entry, bool) {
+	it := tx.live(key)
+	if it == nil {
+		return Entry{}, false
+	}
+	return it.Entry.clone(), true
+}
+
+// clone returns a deep copy, so collections can be modified in place without
+// affecting it.
+func (e *Entry) clone() Entry {
+	c := *e
+	if e.ExpiresAt != nil {
+		t := *e.ExpiresAt
+		c.ExpiresAt = &t
+	}
+	c.List = slices.Clone(e.List)
+	c.Hash = maps.Clone(e.Hash)
+	c.Set = maps.Clone(e.Set)
+	c.ZSet = e.ZSet.clone()
+	return c
+}
+
+func (e *Entry) expiredAt(t time.Time) bool {
+	return e.ExpiresAt != nil && t.After(*e.ExpiresAt)
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collect(e *Export) map[string]Entry {
+	out := make(map[string]Entry)
+	for {
+		key, entry, ok := e.Next()
+		if !ok {
+			return out
+		}
+		out[key] = entry
+	}
+}
+
+func TestExport_PointInTime(t *testing.T) {
+	s := NewKVStore()
+	s.Set("keep", "v1")
+	s.Set("update", "v1")
+	s.Set("delete", "v1")
+	s.Set("expire", "v1")
+
+	e := s.Export()
+	defer e.Close()
+
+	// Changes after the export started must not be visible
+	s.Set("update", "v2")
+	s.Del("delete")
+	s.Expire("expire", 0)
+	s.Set("new", "v1")
+
+	got := collect(e)
+	assert.Len(t, got, 4)
+	assert.Equal(t, "v1", got["update"].Value)
+	assert.Equal(t, "v1", got["delete"].Value)
+	assert.Nil(t, got["expire"].ExpiresAt)
+	assert.NotContains(t, got, "new")
+}
+
+func TestExport_PreservesEntryMetadata(t *testing.T) {
+	s := NewKVStore()
+	expires := time.Now().Add(1500 * time.Millisecond)
+	created := time.Now().Add(-time.Minute)
+	want := Entry{Value: "value1", CreatedAt: created, UpdatedAt: time.Now(), ExpiresAt: &expires}
+	s.Restore("key1", want)
+
+	e := s.Export()
+	defer e.Close()
+
+	got := collect(e)["key1"]
+	assert.Equal(t, want.CreatedAt, got.CreatedAt)
+	assert.Equal(t, want.UpdatedAt, got.UpdatedAt)
+	require.NotNil(t, got.ExpiresAt)
+	assert.Equal(t, *want.ExpiresAt, *got.ExpiresAt)
+}
+
+func TestExport_SkipsExpiredEntries(t *testing.T) {
+	s := NewKVStore()
+	expires := time.Now().Add(time.Millisecond)
+	s.Restore("key1", Entry{Value: "value1", ExpiresAt: &expires})
+	s.Set("key2", "value2")
+	time.Sleep(5 * time.Millisecond)
+
+	e := s.Export()
+	defer e.Close()
+
+	got := collect(e)
+	assert.NotContains(t, got, "key1")
+	assert.Contains(t, got, "key2")
+}
+
+func TestExport_ConcurrentWriters(t *testing.T) {
+	s := NewKVStore()
+	for i := 0; i < 2000; i++ {
+		s.Set("key"+strconv.Itoa(i), "0")
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 1; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := "key" + strconv.Itoa((n*7+w)%2000)
+				if n%5 == 0 {
+					s.Del(key)
+				} else {
+					s.Set(key, strconv.Itoa(n))
+				}
+				s.Set("extra"+strconv.Itoa(w*100000+n), "x")
+			}
+		}(w)
+	}
+
+	e := s.Export()
+	got := collect(e)
+	e.Close()
+	close(stop)
+	wg.Wait()
+
+	// Every key that existed at the start is seen with its original value
+	assert.Len(t, got, 2000)
+	for key, entry := range got {
+		assert.Equal(t, "0", entry.Value, "key %s", key)
+	}
+}
+
+func TestExport_CloseStopsCopyOnWrite(t *testing.T) {
+	s := NewKVStore()
+	s.Set("key1", "value1")
+
+	e := s.Export()
+	e.Close()
+	e.Close()
+
+	s.Set("key1", "value2")
+	for _, sh := range s.shards {
+		assert.Empty(t, sh.exports)
+	}
+}
+
+func TestKVStore_Restore(t *testing.T) {
+	s := NewKVStore()
+
+	created := time.Now().Add(-time.Hour)
+	expires := time.Now().Add(2500 * time.Millisecond)
+	s.Restore("key1", Entry{Value: "value1", CreatedAt: created, UpdatedAt: created, ExpiresAt: &expires})
+
+	past := time.Now().Add(-time.Second)
+	s.Restore("key2", Entry{Value: "value2", ExpiresAt: &past})
+
+	val, ok := s.Get("key1")
+	require.True(t, ok)
+	assert.Equal(t, "value1", val)
+	assert.Equal(t, 2, s.TTL("key1"))
+
+	_, ok = s.Get("key2")
+	assert.False(t, ok, "already expired entries are not restored")
+}
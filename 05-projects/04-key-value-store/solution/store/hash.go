@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"maps"
+)
+
+// HSet sets field/value pairs in the hash at key, creating it if needed. It
+// returns the number of fields that were added rather than updated.
+func (s *KVStore) HSet(key string, pairs ...string) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.HSet(key, pairs...)
+}
+
+func (tx *Tx) HSet(key string, pairs ...string) (int, error) {
+	if len(pairs)%2 != 0 {
+		return 0, fmt.Errorf("HSet: odd number of arguments")
+	}
+
+	it, err := tx.writable(key, KindHash, true)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for i := 0; i < len(pairs); i += 2 {
+		field, value := pairs[i], pairs[i+1]
+		if old, ok := it.Hash[field]; ok {
+			tx.s.used.Add(int64(len(value) - len(old)))
+		} else {
+			tx.s.used.Add(int64(len(field)+len(value)) + hashElemOverhead)
+			added++
+		}
+		it.Hash[field] = value
+	}
+	return added, nil
+}
+
+// HGet returns the value of field in the hash at key.
+func (s *KVStore) HGet(key, field string) (string, bool, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.HGet(key, field)
+}
+
+func (tx *Tx) HGet(key, field string) (string, bool, error) {
+	it, err := tx.lookup(key, KindHash)
+	if it == nil || err != nil {
+		return "", false, err
+	}
+	it.touch(tx.now)
+
+	value, ok := it.Hash[field]
+	return value, ok, nil
+}
+
+// HGetAll returns a copy of the hash at key, or nil if it does not exist.
+func (s *KVStore) HGetAll(key string) (map[string]string, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.HGetAll(key)
+}
+
+func (tx *Tx) HGetAll(key string) (map[string]string, error) {
+	it, err := tx.lookup(key, KindHash)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	it.touch(tx.now)
+
+	return maps.Clone(it.Hash), nil
+}
+
+// HDel removes fields from the hash at key and returns how many existed.
+func (s *KVStore) HDel(key string, fields ...string) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.HDel(key, fields...)
+}
+
+func (tx *Tx) HDel(key string, fields ...string) (int, error) {
+	it, err := tx.writable(key, KindHash, false)
+	if it == nil || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, field := range fields {
+		if value, ok := it.Hash[field]; ok {
+			tx.s.used.Add(-(int64(len(field)+len(value)) + hashElemOverhead))
+			delete(it.Hash, field)
+			removed++
+		}
+	}
+
+	tx.dropIfEmpty(key, it)
+	return removed, nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// The LFU counter follows Redis: an 8-bit logarithmic access counter packed
+// with the time (in minutes, mod 2^16) it was last decayed. The counter grows
+// with probability 1/((counter-lfuInitVal)*lfuLogFactor+1), so it takes about
+// a million hits to saturate, and loses one point per lfuDecayMinutes idle.
+const (
+	lfuInitVal      = 5
+	lfuLogFactor    = 10
+	lfuDecayMinutes = 1
+)
+
+func lfuMinutes(now time.Time) uint32 {
+	return uint32(now.Unix()/60) & 0xffff
+}
+
+func lfuInit(now time.Time) uint32 {
+	return lfuMinutes(now)<<8 | lfuInitVal
+}
+
+// lfuCounter returns the decayed counter for a packed value.
+func lfuCounter(v uint32, now time.Time) uint8 {
+	counter := v & 0xff
+	last := v >> 8
+	elapsed := (lfuMinutes(now) - last) & 0xffff
+
+	periods := elapsed / lfuDecayMinutes
+	if periods >= counter {
+		return 0
+	}
+	return uint8(counter - periods)
+}
+
+func lfuIncr(v *atomic.Uint32, now time.Time) {
+	counter := uint32(lfuCounter(v.Load(), now))
+
+	if counter < 255 {
+		base := float64(0)
+		if counter > lfuInitVal {
+			base = float64(counter - lfuInitVal)
+		}
+		if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+
+	// Concurrent readers may race here and lose an increment, which only
+	// makes the estimate slightly lower, as in Redis.
+	v.Store(lfuMinutes(now)<<8 | counter)
+}
@@ -0,0 +1,136 @@
+package store
+
+import "slices"
+
+// LPush inserts values at the head of the list at key, creating it if
+// needed. Each value is pushed in turn, so the last one ends up first. It
+// returns the length of the list.
+func (s *KVStore) LPush(key string, values ...string) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.LPush(key, values...)
+}
+
+func (tx *Tx) LPush(key string, values ...string) (int, error) {
+	it, err := tx.writable(key, KindList, true)
+	if err != nil {
+		return 0, err
+	}
+
+	head := make([]string, len(values), len(values)+len(it.List))
+	for i, v := range values {
+		head[len(values)-1-i] = v
+		tx.s.used.Add(int64(len(v)) + listElemOverhead)
+	}
+	it.List = append(head, it.List...)
+	return len(it.List), nil
+}
+
+// RPush appends values to the tail of the list at key, creating it if
+// needed. It returns the length of the list.
+func (s *KVStore) RPush(key string, values ...string) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.RPush(key, values...)
+}
+
+func (tx *Tx) RPush(key string, values ...string) (int, error) {
+	it, err := tx.writable(key, KindList, true)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, v := range values {
+		tx.s.used.Add(int64(len(v)) + listElemOverhead)
+	}
+	it.List = append(it.List, values...)
+	return len(it.List), nil
+}
+
+// LPop removes and returns up to count values from the head of the list at
+// key. It returns nil if the key does not exist.
+func (s *KVStore) LPop(key string, count int) ([]string, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.LPop(key, count)
+}
+
+func (tx *Tx) LPop(key string, count int) ([]string, error) {
+	return tx.pop(key, count, true)
+}
+
+// RPop removes and returns up to count values from the tail of the list at
+// key, last one first. It returns nil if the key does not exist.
+func (s *KVStore) RPop(key string, count int) ([]string, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.RPop(key, count)
+}
+
+func (tx *Tx) RPop(key string, count int) ([]string, error) {
+	return tx.pop(key, count, false)
+}
+
+func (tx *Tx) pop(key string, count int, head bool) ([]string, error) {
+	it, err := tx.writable(key, KindList, false)
+	if it == nil || err != nil {
+		return nil, err
+	}
+
+	count = min(count, len(it.List))
+	var popped []string
+	if head {
+		popped = slices.Clone(it.List[:count])
+		clear(it.List[:count])
+		it.List = it.List[count:]
+	} else {
+		tail := it.List[len(it.List)-count:]
+		popped = slices.Clone(tail)
+		slices.Reverse(popped)
+		clear(tail)
+		it.List = it.List[:len(it.List)-count]
+	}
+	for _, v := range popped {
+		tx.s.used.Add(-(int64(len(v)) + listElemOverhead))
+	}
+
+	tx.dropIfEmpty(key, it)
+	return popped, nil
+}
+
+// LLen returns the length of the list at key, 0 if it does not exist.
+func (s *KVStore) LLen(key string) (int, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.LLen(key)
+}
+
+func (tx *Tx) LLen(key string) (int, error) {
+	it, err := tx.lookup(key, KindList)
+	if it == nil || err != nil {
+		return 0, err
+	}
+	return len(it.List), nil
+}
+
+// LRange returns the elements of the list at key between start and stop
+// inclusive. Negative indexes count from the end of the list.
+func (s *KVStore) LRange(key string, start, stop int) ([]string, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.LRange(key, start, stop)
+}
+
+func (tx *Tx) LRange(key string, start, stop int) ([]string, error) {
+	it, err := tx.lookup(key, KindList)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	it.touch(tx.now)
+
+	from, to, ok := normalizeRange(start, stop, len(it.List))
+	if !ok {
+		return nil, nil
+	}
+	return slices.Clone(it.List[from:to]), nil
+}
@@ -0,0 +1,92 @@
+package store
+
+// MatchPattern reports whether key matches a Redis glob pattern: * matches
+// any run of bytes, ? any single byte, [abc], [a-z] and [^a] a byte class,
+// and a backslash escapes the next byte.
+func MatchPattern(key, pattern string) bool {
+	px, sx := 0, 0
+	// Where to resume if the bytes after the last * stop matching
+	starPx, starSx := -1, 0
+
+	for px < len(pattern) || sx < len(key) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				starPx, starSx = px, sx+1
+				px++
+				continue
+			case '?':
+				if sx < len(key) {
+					px++
+					sx++
+					continue
+				}
+			case '[':
+				if sx < len(key) {
+					if ok, width := matchClass(pattern[px:], key[sx]); ok {
+						px += width
+						sx++
+						continue
+					}
+				}
+			default:
+				width := 1
+				if c == '\\' && px+1 < len(pattern) {
+					c = pattern[px+1]
+					width = 2
+				}
+				if sx < len(key) && key[sx] == c {
+					px += width
+					sx++
+					continue
+				}
+			}
+		}
+
+		// Let the last * swallow one more byte and try again
+		if starPx >= 0 && starSx <= len(key) {
+			px, sx = starPx+1, starSx
+			starSx++
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// matchClass matches c against the class at the start of pattern, which
+// begins with '['. It returns the class length in bytes; an unterminated
+// class runs to the end of the pattern.
+func matchClass(pattern string, c byte) (bool, int) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= c && c <= hi {
+				matched = true
+			}
+			i += 2
+		case pattern[i] == c:
+			matched = true
+		}
+	}
+	if i < len(pattern) {
+		i++ // closing ']'
+	}
+	return matched != negate, i
+}
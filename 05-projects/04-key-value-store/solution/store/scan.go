@@ -0,0 +1,92 @@
+package store
+
+import "hash/maphash"
+
+// scanBuckets is the number of buckets keys are spread over for SCAN. It is
+// fixed, so a key never moves to another bucket and cursors stay valid
+// however much the keyspace grows or shrinks.
+const scanBuckets = 1 << 14
+
+const defaultScanCount = 10
+
+// scanIndex groups a shard's keys into buckets by hash. A SCAN cursor is
+// the index of the next bucket to visit, so each call only looks at a few
+// buckets and holds the locks for a short time. Bucket b lives in shard
+// b&mask, at index b>>shift there.
+type scanIndex struct {
+	seed    maphash.Seed
+	shift   uint
+	buckets []map[string]struct{}
+}
+
+func newScanIndex(seed maphash.Seed, shift uint) *scanIndex {
+	return &scanIndex{seed: seed, shift: shift, buckets: make([]map[string]struct{}, scanBuckets>>shift)}
+}
+
+func (x *scanIndex) bucket(key string) uint64 {
+	return (maphash.String(x.seed, key) & (scanBuckets - 1)) >> x.shift
+}
+
+func (x *scanIndex) add(key string) {
+	b := x.bucket(key)
+	if x.buckets[b] == nil {
+		x.buckets[b] = make(map[string]struct{})
+	}
+	x.buckets[b][key] = struct{}{}
+}
+
+func (x *scanIndex) remove(key string) {
+	b := x.bucket(key)
+	delete(x.buckets[b], key)
+	if len(x.buckets[b]) == 0 {
+		x.buckets[b] = nil
+	}
+}
+
+// Scan returns a batch of keys matching pattern and the cursor to pass to
+// the next call; iteration starts at cursor 0 and is over when 0 is
+// returned. count is a hint for how many keys to look at, not how many to
+// return, so a call may return none while more remain.
+//
+// As with Redis, a key that exists for the whole iteration is returned, and
+// exactly once. Keys added or removed meanwhile may or may not be.
+func (s *KVStore) Scan(cursor uint64, pattern string, count int) ([]string, uint64) {
+	tx := s.lockAll(false)
+	defer tx.unlock()
+	return tx.Scan(cursor, pattern, count)
+}
+
+func (tx *Tx) Scan(cursor uint64, pattern string, count int) ([]string, uint64) {
+	if count < 1 {
+		count = defaultScanCount
+	}
+
+	// Buckets are visited whole. Empty ones are cheap but not free, so at
+	// most ten per requested key are skipped, as in Redis.
+	shards := tx.allShards()
+	var keys []string
+	visited, empty := 0, 0
+	b := cursor
+	for ; b < scanBuckets && visited < count && empty < 10*count; b++ {
+		sh := shards[b&tx.s.mask]
+		bucket := sh.scan.buckets[b>>tx.s.shift]
+		if len(bucket) == 0 {
+			empty++
+			continue
+		}
+		for key := range bucket {
+			visited++
+			if tx.expired(&sh.data[key].Entry) {
+				continue
+			}
+			if pattern == "" || MatchPattern(key, pattern) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if b >= scanBuckets {
+		return keys, 0
+	}
+	return keys, b
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scanAll runs a full SCAN iteration and returns every key it produced.
+func scanAll(t *testing.T, s *KVStore, pattern string, count int) []string {
+	t.Helper()
+
+	var keys []string
+	cursor := uint64(0)
+	for calls := 0; ; calls++ {
+		require.Less(t, calls, scanBuckets, "iteration does not terminate")
+		var batch []string
+		batch, cursor = s.Scan(cursor, pattern, count)
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys
+		}
+	}
+}
+
+func TestKVStore_ScanReturnsEveryKeyOnce(t *testing.T) {
+	s := NewKVStore()
+
+	var want []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, "v")
+		want = append(want, key)
+	}
+
+	got := scanAll(t, s, "", 10)
+	sort.Strings(got)
+	sort.Strings(want)
+	assert.Equal(t, want, got)
+}
+
+func TestKVStore_ScanMatch(t *testing.T) {
+	s := NewKVStore()
+	for i := 0; i < 50; i++ {
+		s.Set(fmt.Sprintf("user:%d:session", i), "v")
+		s.Set(fmt.Sprintf("user:%d:profile", i), "v")
+	}
+
+	got := scanAll(t, s, "user:*:session", 100)
+	assert.Len(t, got, 50)
+	for _, key := range got {
+		assert.True(t, MatchPattern(key, "user:*:session"), key)
+	}
+}
+
+func TestKVStore_ScanSkipsExpired(t *testing.T) {
+	s := NewKVStore()
+	s.Set("live", "v")
+	s.Set("dead", "v")
+	s.Expire("dead", -1)
+
+	assert.Equal(t, []string{"live"}, scanAll(t, s, "", 10))
+}
+
+func TestKVStore_ScanStableUnderWrites(t *testing.T) {
+	s := NewKVStore()
+	for i := 0; i < 500; i++ {
+		s.Set(fmt.Sprintf("old%d", i), "v")
+	}
+
+	// Keys that exist for the whole iteration are returned exactly once,
+	// however the keyspace changes in between calls
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for i := 0; ; i++ {
+		var batch []string
+		batch, cursor = s.Scan(cursor, "", 5)
+		for _, key := range batch {
+			seen[key]++
+		}
+		s.Set(fmt.Sprintf("new%d", i), "v")
+		s.Del(fmt.Sprintf("new%d", i-1))
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		assert.Equal(t, 1, seen[fmt.Sprintf("old%d", i)])
+	}
+}
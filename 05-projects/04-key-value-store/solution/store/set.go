@@ -0,0 +1,124 @@
+package store
+
+import "sort"
+
+// SAdd adds members to the set at key, creating it if needed, and returns
+// how many were not already present.
+func (s *KVStore) SAdd(key string, members ...string) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.SAdd(key, members...)
+}
+
+func (tx *Tx) SAdd(key string, members ...string) (int, error) {
+	it, err := tx.writable(key, KindSet, true)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, m := range members {
+		if _, ok := it.Set[m]; !ok {
+			it.Set[m] = struct{}{}
+			tx.s.used.Add(int64(len(m)) + setElemOverhead)
+			added++
+		}
+	}
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many existed.
+func (s *KVStore) SRem(key string, members ...string) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.SRem(key, members...)
+}
+
+func (tx *Tx) SRem(key string, members ...string) (int, error) {
+	it, err := tx.writable(key, KindSet, false)
+	if it == nil || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, m := range members {
+		if _, ok := it.Set[m]; ok {
+			delete(it.Set, m)
+			tx.s.used.Add(-(int64(len(m)) + setElemOverhead))
+			removed++
+		}
+	}
+
+	tx.dropIfEmpty(key, it)
+	return removed, nil
+}
+
+// SMembers returns the members of the set at key in sorted order.
+func (s *KVStore) SMembers(key string) ([]string, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.SMembers(key)
+}
+
+func (tx *Tx) SMembers(key string) ([]string, error) {
+	it, err := tx.lookup(key, KindSet)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	it.touch(tx.now)
+
+	return sortedMembers(it.Set), nil
+}
+
+// SInter returns the members present in every set at keys, in sorted order.
+// A missing key counts as an empty set.
+func (s *KVStore) SInter(keys ...string) ([]string, error) {
+	tx := s.lockKeys(keys, false)
+	defer tx.unlock()
+	return tx.SInter(keys...)
+}
+
+func (tx *Tx) SInter(keys ...string) ([]string, error) {
+	sets := make([]StringSet, 0, len(keys))
+	for _, key := range keys {
+		it, err := tx.lookup(key, KindSet)
+		if err != nil {
+			return nil, err
+		}
+		if it == nil {
+			sets = append(sets, nil)
+			continue
+		}
+		it.touch(tx.now)
+		sets = append(sets, it.Set)
+	}
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	// Walk the smallest set and probe the others
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	result := make(StringSet)
+	for m := range sets[0] {
+		inAll := true
+		for _, other := range sets[1:] {
+			if _, ok := other[m]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			result[m] = struct{}{}
+		}
+	}
+	return sortedMembers(result), nil
+}
+
+func sortedMembers(set StringSet) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultShards is the number of shards NewKVStore splits the keyspace into.
+const DefaultShards = 64
+
+// shard holds the keys whose hash falls into it, under its own lock, so
+// commands on keys in different shards don't contend. A key's shard is the
+// low bits of its hash, the same bits that pick its SCAN bucket, so every
+// bucket lives in exactly one shard.
+type shard struct {
+	mu       sync.RWMutex
+	index    int
+	data     map[string]*item
+	volatile map[string]struct{} // keys with an expiry, sampled by the expiry cycle
+	watches  map[string]*watch   // keys watched by optimistic transactions
+	exports  map[*Export]struct{}
+	scan     *scanIndex
+	used     *atomic.Int64 // the store's memory estimate
+}
+
+func newShard(index int, s *KVStore) *shard {
+	return &shard{
+		index:    index,
+		data:     make(map[string]*item),
+		volatile: make(map[string]struct{}),
+		watches:  make(map[string]*watch),
+		exports:  make(map[*Export]struct{}),
+		scan:     newScanIndex(s.seed, s.shift),
+		used:     &s.used,
+	}
+}
+
+// shardCount rounds n up to a power of two between 1 and the number of
+// SCAN buckets.
+func shardCount(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return min(1<<bits.Len(uint(n-1)), scanBuckets)
+}
+
+func (s *KVStore) shardIndex(key string) int {
+	if s.mask == 0 {
+		return 0
+	}
+	return int(maphash.String(s.seed, key) & s.mask)
+}
+
+func (s *KVStore) shardFor(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (sh *shard) lock(write bool) {
+	if write {
+		sh.mu.Lock()
+	} else {
+		sh.mu.RLock()
+	}
+}
+
+func (sh *shard) unlock(write bool) {
+	if write {
+		sh.mu.Unlock()
+	} else {
+		sh.mu.RUnlock()
+	}
+}
+
+// insert adds a new item. Callers must hold the write lock and must have
+// removed any previous item for key.
+func (sh *shard) insert(key string, it *item) {
+	sh.data[key] = it
+	sh.scan.add(key)
+	sh.used.Add(entrySize(key, &it.Entry))
+	if it.ExpiresAt != nil {
+		sh.volatile[key] = struct{}{}
+	}
+}
+
+// remove deletes key if present. Callers must hold the write lock and have
+// already called beforeChange for it.
+func (sh *shard) remove(key string) bool {
+	it, ok := sh.data[key]
+	if !ok {
+		return false
+	}
+	sh.used.Add(-entrySize(key, &it.Entry))
+	delete(sh.data, key)
+	sh.scan.remove(key)
+	delete(sh.volatile, key)
+	return true
+}
+
+// beforeChange must be called with the write lock held before key is
+// modified or deleted. It saves the current version for open exports and
+// invalidates watches of the key.
+func (sh *shard) beforeChange(key string) {
+	sh.preserve(key)
+	if w, ok := sh.watches[key]; ok {
+		w.version++
+	}
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardCount(t *testing.T) {
+	for n, want := range map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 64: 64, 100: 128, 1 << 20: scanBuckets} {
+		assert.Equal(t, want, shardCount(n), "shardCount(%d)", n)
+	}
+}
+
+func TestKVStore_KeysSpanShards(t *testing.T) {
+	s := NewShardedKVStore(16)
+	for i := 0; i < 1000; i++ {
+		s.Set("key"+strconv.Itoa(i), "value")
+	}
+
+	assert.Len(t, s.Keys("*"), 1000)
+	assert.Equal(t, 1000, s.Stats().Keys)
+
+	used := 0
+	for _, sh := range s.shards {
+		if len(sh.data) > 0 {
+			used++
+		}
+	}
+	assert.Equal(t, len(s.shards), used, "keys should be spread over every shard")
+}
+
+func TestTx_KeyOutsideLockedShardsPanics(t *testing.T) {
+	s := NewShardedKVStore(64)
+
+	// Find two keys in different shards
+	a, b := "a", ""
+	for i := 0; b == ""; i++ {
+		if k := "b" + strconv.Itoa(i); s.shardIndex(k) != s.shardIndex(a) {
+			b = k
+		}
+	}
+
+	assert.Panics(t, func() {
+		s.UpdateKeys([]string{a}, func(tx *Tx) { tx.Set(b, "value") })
+	})
+	assert.Panics(t, func() {
+		s.ViewKeys([]string{a}, func(tx *Tx) { tx.Keys("*") })
+	})
+	assert.NotPanics(t, func() {
+		s.UpdateKeys([]string{b, a}, func(tx *Tx) {
+			tx.Set(a, "1")
+			tx.Set(b, "2")
+		})
+	})
+}
+
+// Transfers between accounts lock them in opposite orders; they must
+// neither deadlock nor let a reader see money in flight.
+func TestKVStore_CrossShardTransactions(t *testing.T) {
+	s := NewShardedKVStore(64)
+	const accounts = 20
+	keys := make([]string, accounts)
+	for i := range keys {
+		keys[i] = "account" + strconv.Itoa(i)
+		s.Set(keys[i], "100")
+	}
+
+	total := func(tx *Tx) int {
+		sum := 0
+		for _, key := range keys {
+			v, _, err := tx.GetString(key)
+			require.NoError(t, err)
+			n, _ := strconv.Atoi(v)
+			sum += n
+		}
+		return sum
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				from, to := keys[(w+i)%accounts], keys[(w*7+i*3+1)%accounts]
+				if from == to {
+					continue
+				}
+				s.UpdateKeys([]string{from, to}, func(tx *Tx) {
+					a, _, _ := tx.GetString(from)
+					b, _, _ := tx.GetString(to)
+					x, _ := strconv.Atoi(a)
+					y, _ := strconv.Atoi(b)
+					tx.Set(from, strconv.Itoa(x-1))
+					tx.Set(to, strconv.Itoa(y+1))
+				})
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				s.ViewKeys(keys, func(tx *Tx) {
+					assert.Equal(t, accounts*100, total(tx))
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.View(func(tx *Tx) {
+		assert.Equal(t, accounts*100, total(tx))
+	})
+}
+
+// The benchmarks compare a single shard, which is the store under one
+// global lock, with the default sharding. Run them with -cpu 1,2,4,8 to see
+// throughput scale with GOMAXPROCS.
+
+const benchKeys = 1 << 16
+
+func benchmarkStore(b *testing.B, op func(s *KVStore, key string, i int)) {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			s := NewShardedKVStore(shards)
+			for _, key := range keys {
+				s.Set(key, "value")
+			}
+
+			var worker atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks the keys from its own offset with a
+				// stride coprime to their number
+				i := int(worker.Add(1) * 7919)
+				for pb.Next() {
+					i += 4099
+					op(s, keys[i&(benchKeys-1)], i)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkKVStore_Set(b *testing.B) {
+	benchmarkStore(b, func(s *KVStore, key string, _ int) {
+		s.Set(key, "value")
+	})
+}
+
+func BenchmarkKVStore_Get(b *testing.B) {
+	benchmarkStore(b, func(s *KVStore, key string, _ int) {
+		s.Get(key)
+	})
+}
+
+// BenchmarkKVStore_Mixed does one write for every four reads.
+func BenchmarkKVStore_Mixed(b *testing.B) {
+	benchmarkStore(b, func(s *KVStore, key string, i int) {
+		if i%5 == 0 {
+			s.Set(key, "value")
+		} else {
+			s.Get(key)
+		}
+	})
+}
@@ -1,107 +1,222 @@
 package store
 
 import (
-	"strings"
+	"hash/maphash"
+	"math/bits"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Entry is a key's value and metadata. Kind says which of the value fields
+// is in use: Value for strings, or one of the collections.
 type Entry struct {
 	Value     string
+	Kind      Kind
+	List      []string
+	Hash      map[string]string
+	Set       StringSet
+	ZSet      *SortedSet
 	ExpiresAt *time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// item is an Entry plus the access metadata used by eviction. The metadata
+// is updated atomically so readers holding only the read lock can touch it.
+type item struct {
+	Entry
+	lastAccess atomic.Int64  // unix nanoseconds
+	lfu        atomic.Uint32 // see lfu.go
+}
+
+// KVStore is the keyspace, split into independently locked shards.
 type KVStore struct {
-	data map[string]*Entry
-	mu   sync.RWMutex
+	seed   maphash.Seed
+	shards []*shard
+	mask   uint64 // len(shards)-1
+	shift  uint   // log2(len(shards))
+
+	used     atomic.Int64 // estimated bytes held by keys and values
+	settings atomic.Pointer[settings]
+
+	expiredKeys atomic.Int64
+	evictedKeys atomic.Int64
+	nextExpire  atomic.Uint64 // shard the next expiry cycle starts at
+	nextEvict   atomic.Uint64 // shard the next eviction samples
+
+	mu   sync.Mutex // serializes changes to settings and the expiry goroutine
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// settings are replaced as a whole, so commands read them without locking.
+type settings struct {
+	maxMemory    int64
+	policy       EvictionPolicy
+	evictSamples int
+	onExpire     func(keys []string)
+	onEvict      func(keys []string)
+	follower     bool
 }
 
 func NewKVStore() *KVStore {
-	return &KVStore{
-		data: make(map[string]*Entry),
+	return NewShardedKVStore(DefaultShards)
+}
+
+// NewShardedKVStore creates a store split into n shards, rounded up to a
+// power of two. A single shard puts the whole keyspace under one lock.
+func NewShardedKVStore(n int) *KVStore {
+	n = shardCount(n)
+	s := &KVStore{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*shard, n),
+		mask:   uint64(n - 1),
+		shift:  uint(bits.TrailingZeros(uint(n))),
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard(i, s)
 	}
+	s.settings.Store(&settings{policy: NoEviction, evictSamples: defaultEvictSamples})
+	return s
 }
 
-func (s *KVStore) Set(key, value string) {
+// configure changes the settings.
+func (s *KVStore) configure(fn func(cfg *settings)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	now := time.Now()
-	if entry, exists := s.data[key]; exists {
+	cfg := *s.settings.Load()
+	fn(&cfg)
+	s.settings.Store(&cfg)
+}
+
+func newItem(entry Entry, now time.Time) *item {
+	it := &item{Entry: entry}
+	it.lastAccess.Store(now.UnixNano())
+	it.lfu.Store(lfuInit(now))
+	return it
+}
+
+// touch records an access for the eviction policies.
+func (it *item) touch(now time.Time) {
+	it.lastAccess.Store(now.UnixNano())
+	lfuIncr(&it.lfu, now)
+}
+
+func (s *KVStore) Set(key, value string) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	tx.Set(key, value)
+}
+
+// Set stores a string value, replacing a value of any type. A live string
+// keeps its TTL and creation time.
+func (tx *Tx) Set(key, value string) {
+	entry := tx.live(key)
+	sh := tx.shard(key)
+	sh.beforeChange(key)
+
+	now := tx.now
+	if entry != nil && entry.Kind == KindString {
+		tx.s.used.Add(int64(len(value) - len(entry.Value)))
 		entry.Value = value
 		entry.UpdatedAt = now
+		entry.touch(now)
 	} else {
-		s.data[key] = &Entry{
+		sh.remove(key)
+		sh.insert(key, newItem(Entry{
 			Value:     value,
 			CreatedAt: now,
 			UpdatedAt: now,
-		}
+		}, now))
 	}
 }
 
 func (s *KVStore) Get(key string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	value, ok, _ := s.GetString(key)
+	return value, ok
+}
 
-	entry, exists := s.data[key]
-	if !exists {
-		return "", false
-	}
+// GetString is Get that reports ErrWrongType for a key holding another type.
+func (s *KVStore) GetString(key string) (string, bool, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.GetString(key)
+}
 
-	// Check if key has expired
-	if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
-		return "", false
+func (tx *Tx) GetString(key string) (string, bool, error) {
+	entry, err := tx.lookup(key, KindString)
+	if entry == nil || err != nil {
+		return "", false, err
 	}
 
-	return entry.Value, true
+	entry.touch(tx.now)
+	return entry.Value, true, nil
 }
 
 func (s *KVStore) Del(key string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.Del(key)
+}
 
-	if _, exists := s.data[key]; !exists {
+func (tx *Tx) Del(key string) bool {
+	if tx.live(key) == nil {
 		return false
 	}
 
-	delete(s.data, key)
+	sh := tx.shard(key)
+	sh.beforeChange(key)
+	sh.remove(key)
 	return true
 }
 
-func (s *KVStore) Exists(key string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// FlushAll deletes every key.
+func (s *KVStore) FlushAll() {
+	tx := s.lockAll(true)
+	defer tx.unlock()
+	tx.FlushAll()
+}
 
-	entry, exists := s.data[key]
-	if !exists {
-		return false
+func (tx *Tx) FlushAll() {
+	for _, sh := range tx.allShards() {
+		for key := range sh.data {
+			sh.beforeChange(key)
+			sh.remove(key)
+		}
 	}
+}
 
-	// Check if key has expired
-	if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
-		return false
-	}
+func (s *KVStore) Exists(key string) bool {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.Exists(key)
+}
 
-	return true
+func (tx *Tx) Exists(key string) bool {
+	return tx.live(key) != nil
 }
 
 func (s *KVStore) Keys(pattern string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	tx := s.lockAll(false)
+	defer tx.unlock()
+	return tx.Keys(pattern)
+}
 
+func (tx *Tx) Keys(pattern string) []string {
 	var keys []string
-	now := time.Now()
 
-	for key, entry := range s.data {
-		// Skip expired keys
-		if entry.ExpiresAt != nil && now.After(*entry.ExpiresAt) {
-			continue
-		}
+	for _, sh := range tx.allShards() {
+		for key, entry := range sh.data {
+			// Skip expired keys
+			if tx.expired(&entry.Entry) {
+				continue
+			}
 
-		if matchPattern(key, pattern) {
-			keys = append(keys, key)
+			if MatchPattern(key, pattern) {
+				keys = append(keys, key)
+			}
 		}
 	}
 
@@ -109,64 +224,90 @@ func (s *KVStore) Keys(pattern string) []string {
 }
 
 func (s *KVStore) Expire(key string, seconds int) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.Expire(key, seconds)
+}
 
-	entry, exists := s.data[key]
-	if !exists {
-		return false
-	}
+func (tx *Tx) Expire(key string, seconds int) bool {
+	return tx.ExpireAt(key, tx.now.Add(time.Duration(seconds)*time.Second))
+}
+
+// ExpireAt makes a live key expire at an absolute instant. A key whose
+// instant has already passed is deleted right away, except in Replay.
+func (s *KVStore) ExpireAt(key string, at time.Time) bool {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.ExpireAt(key, at)
+}
 
-	// Check if already expired
-	if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
+func (tx *Tx) ExpireAt(key string, at time.Time) bool {
+	entry := tx.live(key)
+	if entry == nil {
 		return false
 	}
 
-	expiresAt := time.Now().Add(time.Duration(seconds) * time.Second)
-	entry.ExpiresAt = &expiresAt
+	sh := tx.shard(key)
+	sh.beforeChange(key)
+	if !tx.replay && !at.After(tx.now) {
+		sh.remove(key)
+		return true
+	}
+	entry.ExpiresAt = &at
+	sh.volatile[key] = struct{}{}
 	return true
 }
 
-func (s *KVStore) TTL(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// Persist removes the expiry of a live key. It reports whether the key had
+// one.
+func (s *KVStore) Persist(key string) bool {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.Persist(key)
+}
 
-	entry, exists := s.data[key]
-	if !exists {
-		return -2
+func (tx *Tx) Persist(key string) bool {
+	entry := tx.live(key)
+	if entry == nil || entry.ExpiresAt == nil {
+		return false
 	}
 
-	// Check if already expired
-	if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
-		return -2
-	}
+	sh := tx.shard(key)
+	sh.beforeChange(key)
+	entry.ExpiresAt = nil
+	delete(sh.volatile, key)
+	return true
+}
 
-	if entry.ExpiresAt == nil {
-		return -1
-	}
+func (s *KVStore) TTL(key string) int {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.TTL(key)
+}
 
-	ttl := time.Until(*entry.ExpiresAt).Seconds()
+func (tx *Tx) TTL(key string) int {
+	ttl := tx.PTTL(key)
 	if ttl < 0 {
-		return -2
+		return int(ttl)
 	}
-
-	return int(ttl)
+	return int(ttl / 1000)
 }
 
-func matchPattern(key, pattern string) bool {
-	// Simple glob matching (* only)
-	if pattern == "*" {
-		return true
-	}
+// PTTL returns the remaining time to live of key in milliseconds, -1 if it
+// has no expiry or -2 if it doesn't exist.
+func (s *KVStore) PTTL(key string) int64 {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.PTTL(key)
+}
 
-	if !strings.Contains(pattern, "*") {
-		return key == pattern
+func (tx *Tx) PTTL(key string) int64 {
+	entry := tx.live(key)
+	if entry == nil {
+		return -2
 	}
-
-	parts := strings.Split(pattern, "*")
-	if len(parts) == 2 {
-		return strings.HasPrefix(key, parts[0]) && strings.HasSuffix(key, parts[1])
+	if entry.ExpiresAt == nil {
+		return -1
 	}
-
-	return false
+	return entry.ExpiresAt.Sub(tx.now).Milliseconds()
 }
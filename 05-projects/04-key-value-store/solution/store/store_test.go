@@ -240,6 +240,36 @@ func TestKVStore_ExpireUpdatesExisting(t *testing.T) {
 	assert.LessOrEqual(t, ttl, 20)
 }
 
+func TestKVStore_ExpireAt(t *testing.T) {
+	s := NewKVStore()
+	s.Set("key1", "value1")
+
+	assert.True(t, s.ExpireAt("key1", time.Now().Add(1500*time.Millisecond)))
+	pttl := s.PTTL("key1")
+	assert.Greater(t, pttl, int64(1400))
+	assert.LessOrEqual(t, pttl, int64(1500))
+	assert.Equal(t, 1, s.TTL("key1"))
+
+	// An instant in the past deletes the key at once
+	assert.True(t, s.ExpireAt("key1", time.Now().Add(-time.Second)))
+	assert.Equal(t, 0, s.Stats().Keys)
+	assert.Equal(t, int64(-2), s.PTTL("key1"))
+	assert.False(t, s.ExpireAt("key1", time.Now().Add(time.Second)))
+}
+
+func TestKVStore_Persist(t *testing.T) {
+	s := NewKVStore()
+	s.Set("key1", "value1")
+
+	assert.False(t, s.Persist("key1"), "no expiry to remove")
+	assert.False(t, s.Persist("missing"))
+
+	s.Expire("key1", 10)
+	assert.True(t, s.Persist("key1"))
+	assert.Equal(t, int64(-1), s.PTTL("key1"))
+	assert.NotContains(t, s.shardFor("key1").volatile, "key1", "the key is no longer volatile")
+}
+
 func TestMatchPattern(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -255,12 +285,56 @@ func TestMatchPattern(t *testing.T) {
 		{"suffix match", "123:user", "*:user", true},
 		{"suffix no match", "123:post", "*:user", false},
 		{"both ends match", "pre:middle:suf", "pre:*:suf", true},
+		{"empty key", "", "*", true},
+		{"several stars", "user:42:session:abc", "user:*:session:*", true},
+		{"several stars no match", "user:42:profile", "user:*:session:*", false},
+		{"backtracking star", "xaybzb", "*a*b", true},
+		{"backtracking star no match", "xaybzc", "*a*b", false},
+		{"question mark", "hello", "h?llo", true},
+		{"question mark needs a byte", "hllo", "h?llo", false},
+		{"class", "hallo", "h[ae]llo", true},
+		{"class no match", "hillo", "h[ae]llo", false},
+		{"negated class", "hallo", "h[^e]llo", true},
+		{"negated class no match", "hello", "h[^e]llo", false},
+		{"range", "hbllo", "h[a-c]llo", true},
+		{"reversed range", "hbllo", "h[c-a]llo", true},
+		{"range no match", "hdllo", "h[a-c]llo", false},
+		{"escaped star", "h*llo", `h\*llo`, true},
+		{"escaped star is literal", "hello", `h\*llo`, false},
+		{"escaped bracket in class", "h]llo", `h[\]]llo`, true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := matchPattern(tt.key, tt.pattern)
+			result := MatchPattern(tt.key, tt.pattern)
 			assert.Equal(t, tt.match, result)
 		})
 	}
 }
+
+func TestKVStore_WatchVersion(t *testing.T) {
+	s := NewKVStore()
+	s.Set("key1", "value1")
+
+	version := s.Watch("key1")
+	s.Update(func(tx *Tx) {
+		assert.Equal(t, version, tx.Version("key1"))
+	})
+
+	// Writes to other keys leave the version alone
+	s.Set("key2", "value2")
+	s.View(func(tx *Tx) {
+		assert.Equal(t, version, tx.Version("key1"))
+	})
+
+	s.Update(func(tx *Tx) {
+		tx.Set("key1", "value3")
+		tx.Del("key2")
+	})
+	s.View(func(tx *Tx) {
+		assert.NotEqual(t, version, tx.Version("key1"))
+	})
+
+	s.Unwatch("key1")
+	assert.Empty(t, s.shardFor("key1").watches)
+}
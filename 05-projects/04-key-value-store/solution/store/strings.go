@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrOverflow   = errors.New("ERR increment or decrement would overflow")
+)
+
+// SetCondition makes SetWith depend on whether the key exists, like the NX
+// and XX options of SET.
+type SetCondition int
+
+const (
+	SetAlways    SetCondition = iota
+	SetIfAbsent               // NX
+	SetIfPresent              // XX
+)
+
+// SetWith is Set with a condition and an optional expiry instant, as for
+// ExpireAt. A zero expiresAt leaves the expiry as Set does. It reports
+// whether the value was set.
+func (s *KVStore) SetWith(key, value string, cond SetCondition, expiresAt time.Time) bool {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.SetWith(key, value, cond, expiresAt)
+}
+
+func (tx *Tx) SetWith(key, value string, cond SetCondition, expiresAt time.Time) bool {
+	switch cond {
+	case SetIfAbsent:
+		if tx.Exists(key) {
+			return false
+		}
+	case SetIfPresent:
+		if !tx.Exists(key) {
+			return false
+		}
+	}
+
+	tx.Set(key, value)
+	if !expiresAt.IsZero() {
+		tx.ExpireAt(key, expiresAt)
+	}
+	return true
+}
+
+// SetNX sets key only if it does not exist, whatever its type.
+func (s *KVStore) SetNX(key, value string) bool {
+	return s.SetWith(key, value, SetIfAbsent, time.Time{})
+}
+
+func (tx *Tx) SetNX(key, value string) bool {
+	return tx.SetWith(key, value, SetIfAbsent, time.Time{})
+}
+
+// GetSet sets a string value and returns the previous one. A key holding
+// another type is left alone and reported as ErrWrongType.
+func (s *KVStore) GetSet(key, value string) (string, bool, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.GetSet(key, value)
+}
+
+func (tx *Tx) GetSet(key, value string) (string, bool, error) {
+	old, ok, err := tx.GetString(key)
+	if err != nil {
+		return "", false, err
+	}
+	tx.Set(key, value)
+	return old, ok, nil
+}
+
+// IncrBy adds delta to the integer stored at key, starting from 0 if the key
+// does not exist, and returns the new value. The key keeps its TTL.
+func (s *KVStore) IncrBy(key string, delta int64) (int64, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.IncrBy(key, delta)
+}
+
+func (tx *Tx) IncrBy(key string, delta int64) (int64, error) {
+	it, err := tx.lookup(key, KindString)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if it != nil {
+		var ok bool
+		if n, ok = parseInt(it.Value); !ok {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+
+	n += delta
+	tx.Set(key, strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+// parseInt parses a value the way Redis does for INCR: a base-10 int64 with
+// an optional minus sign and nothing else, so no plus sign, leading zeros
+// or spaces.
+func parseInt(s string) (int64, bool) {
+	if s == "" || s[0] == '+' || s == "-0" {
+		return 0, false
+	}
+	digits := s
+	if digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_IncrBy(t *testing.T) {
+	s := NewKVStore()
+
+	n, err := s.IncrBy("counter", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	n, err = s.IncrBy("counter", -11)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-10), n)
+
+	val, _ := s.Get("counter")
+	assert.Equal(t, "-10", val)
+
+	// Like Redis, only canonical integers count
+	for _, v := range []string{"abc", "1.5", " 1", "+1", "01", "-0", "", "99999999999999999999"} {
+		s.Set("bad", v)
+		_, err := s.IncrBy("bad", 1)
+		assert.ErrorIs(t, err, ErrNotInteger, "value %q", v)
+	}
+
+	s.Set("max", strconv.FormatInt(math.MaxInt64, 10))
+	_, err = s.IncrBy("max", 1)
+	assert.ErrorIs(t, err, ErrOverflow)
+	s.Set("min", strconv.FormatInt(math.MinInt64, 10))
+	_, err = s.IncrBy("min", -1)
+	assert.ErrorIs(t, err, ErrOverflow)
+
+	s.RPush("list", "a")
+	_, err = s.IncrBy("list", 1)
+	assert.ErrorIs(t, err, ErrWrongType)
+}
+
+func TestKVStore_IncrByKeepsTTL(t *testing.T) {
+	s := NewKVStore()
+	s.Set("counter", "5")
+	s.Expire("counter", 100)
+
+	_, err := s.IncrBy("counter", 1)
+	require.NoError(t, err)
+	assert.Greater(t, s.TTL("counter"), 0)
+}
+
+func TestKVStore_IncrByIsAtomic(t *testing.T) {
+	s := NewKVStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := s.IncrBy("counter", 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, _ := s.Get("counter")
+	assert.Equal(t, "1000", val)
+}
+
+func TestKVStore_SetWith(t *testing.T) {
+	s := NewKVStore()
+
+	assert.False(t, s.SetWith("key", "v1", SetIfPresent, time.Time{}), "XX needs the key to exist")
+	assert.False(t, s.Exists("key"))
+
+	assert.True(t, s.SetNX("key", "v1"))
+	assert.False(t, s.SetNX("key", "v2"))
+	val, _ := s.Get("key")
+	assert.Equal(t, "v1", val)
+
+	assert.True(t, s.SetWith("key", "v3", SetIfPresent, time.Now().Add(50*time.Millisecond)))
+	val, _ = s.Get("key")
+	assert.Equal(t, "v3", val)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, s.Exists("key"), "the TTL should have expired the key")
+	assert.True(t, s.SetNX("key", "v4"), "an expired key doesn't exist for NX")
+
+	// NX and XX look at keys of any type
+	s.SAdd("set", "m")
+	assert.False(t, s.SetNX("set", "v"))
+	assert.True(t, s.SetWith("set", "v", SetIfPresent, time.Time{}))
+}
+
+func TestKVStore_GetSet(t *testing.T) {
+	s := NewKVStore()
+
+	_, ok, err := s.GetSet("key", "v1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	old, ok, err := s.GetSet("key", "v2")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "v1", old)
+
+	s.RPush("list", "a")
+	_, _, err = s.GetSet("list", "v")
+	assert.ErrorIs(t, err, ErrWrongType)
+	kind, _ := s.Type("list")
+	assert.Equal(t, KindList, kind, "a failed GETSET must not change the key")
+}
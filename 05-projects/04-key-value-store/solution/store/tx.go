@@ -0,0 +1,216 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Tx runs commands against the store while the locks of the shards they
+// touch are held, so several of them can be applied atomically. The KVStore
+// methods of the same name each lock the shard of their key and run a
+// single command through a Tx.
+//
+// A Tx is only valid inside the call that created it. All commands in it
+// see the same clock reading. A Tx created for a set of keys may only use
+// those keys; using another one panics.
+type Tx struct {
+	s      *KVStore
+	now    time.Time
+	write  bool
+	all    bool  // every shard is locked
+	one    int   // the only locked shard, or -1
+	held   []int // locked shards, ascending, when there are several
+	replay bool  // applying logged writes, or writing to a follower; nothing expires
+}
+
+// lockAll locks every shard, in ascending order like lockKeys, so that a
+// Tx that may touch any key sees a consistent store.
+func (s *KVStore) lockAll(write bool) Tx {
+	for _, sh := range s.shards {
+		sh.lock(write)
+	}
+	return Tx{s: s, now: time.Now(), write: write, replay: write && s.following(), all: true, one: -1}
+}
+
+// lockKey locks the shard of a single key.
+func (s *KVStore) lockKey(key string, write bool) Tx {
+	i := s.shardIndex(key)
+	s.shards[i].lock(write)
+	return Tx{s: s, now: time.Now(), write: write, replay: write && s.following(), one: i}
+}
+
+// lockKeys locks the shards of keys. Shards are always locked in ascending
+// order, so Txs over overlapping keys can't deadlock.
+func (s *KVStore) lockKeys(keys []string, write bool) Tx {
+	held := make([]int, len(keys))
+	for i, key := range keys {
+		held[i] = s.shardIndex(key)
+	}
+	slices.Sort(held)
+	held = slices.Compact(held)
+
+	for _, i := range held {
+		s.shards[i].lock(write)
+	}
+	return Tx{s: s, now: time.Now(), write: write, replay: write && s.following(), one: -1, held: held}
+}
+
+func (tx *Tx) unlock() {
+	switch {
+	case tx.all:
+		for _, sh := range tx.s.shards {
+			sh.unlock(tx.write)
+		}
+	case tx.one >= 0:
+		tx.s.shards[tx.one].unlock(tx.write)
+	default:
+		for _, i := range tx.held {
+			tx.s.shards[i].unlock(tx.write)
+		}
+	}
+}
+
+// Now returns the clock reading the commands in the Tx see, for callers
+// that turn a relative TTL into an expiry instant.
+func (tx *Tx) Now() time.Time {
+	return tx.now
+}
+
+// live returns the item for key, or nil if it is missing or has expired.
+// A write Tx removes an expired item it finds and reports it to the expire
+// hook, as the expiry cycle does, so the removal is logged before the
+// write that found it.
+func (tx *Tx) live(key string) *item {
+	sh := tx.shard(key)
+	it, ok := sh.data[key]
+	if !ok {
+		return nil
+	}
+	if !tx.expired(&it.Entry) {
+		return it
+	}
+
+	if tx.write {
+		sh.beforeChange(key)
+		sh.remove(key)
+		tx.s.expiredKeys.Add(1)
+		if onExpire := tx.s.settings.Load().onExpire; onExpire != nil {
+			onExpire([]string{key})
+		}
+	}
+	return nil
+}
+
+// expired reports whether e has expired at the Tx's clock reading.
+func (tx *Tx) expired(e *Entry) bool {
+	return !tx.replay && e.expiredAt(tx.now)
+}
+
+// shard returns the shard holding key, which the Tx must have locked.
+func (tx *Tx) shard(key string) *shard {
+	i := tx.s.shardIndex(key)
+	if !tx.all && i != tx.one && !slices.Contains(tx.held, i) {
+		panic("store: key " + strconv.Quote(key) + " used outside the keys locked by the Tx")
+	}
+	return tx.s.shards[i]
+}
+
+// allShards returns every shard for a command over the whole keyspace,
+// which needs a Tx from Update or View.
+func (tx *Tx) allShards() []*shard {
+	if !tx.all {
+		panic("store: command over the whole keyspace needs a Tx from Update or View")
+	}
+	return tx.s.shards
+}
+
+// Update calls fn with every shard write-locked. Readers and other writers
+// wait until fn returns, so they see either none or all of its changes.
+func (s *KVStore) Update(fn func(tx *Tx)) {
+	tx := s.lockAll(true)
+	defer tx.unlock()
+	fn(&tx)
+}
+
+// Replay is Update for applying writes read back from a log. Keys don't
+// expire inside it: every expiry the writes observed was logged as a
+// delete in between them, so replaying those deletes reproduces the
+// store, while expiring keys by the current clock could drop one that a
+// later write kept alive. Keys whose time has passed expire as usual once
+// fn returns.
+func (s *KVStore) Replay(fn func(tx *Tx)) {
+	tx := s.lockAll(true)
+	tx.replay = true
+	defer tx.unlock()
+	fn(&tx)
+}
+
+// View calls fn with every shard read-locked. fn must only call read
+// commands on the Tx.
+func (s *KVStore) View(fn func(tx *Tx)) {
+	tx := s.lockAll(false)
+	defer tx.unlock()
+	fn(&tx)
+}
+
+// UpdateKeys is Update for commands that only use keys. Only their shards
+// are locked, so transactions on unrelated keys run in parallel.
+func (s *KVStore) UpdateKeys(keys []string, fn func(tx *Tx)) {
+	tx := s.lockKeys(keys, true)
+	defer tx.unlock()
+	fn(&tx)
+}
+
+// ViewKeys is View for commands that only read keys.
+func (s *KVStore) ViewKeys(keys []string, fn func(tx *Tx)) {
+	tx := s.lockKeys(keys, false)
+	defer tx.unlock()
+	fn(&tx)
+}
+
+// watch tracks changes to a key for WATCH. The version is bumped by every
+// change to the key, including expiry and eviction, for as long as anyone
+// watches it.
+type watch struct {
+	refs    int
+	version uint64
+}
+
+// Watch starts tracking changes to key and returns its current version.
+// Each call must be paired with a call to Unwatch.
+func (s *KVStore) Watch(key string) uint64 {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	w, ok := sh.watches[key]
+	if !ok {
+		w = &watch{}
+		sh.watches[key] = w
+	}
+	w.refs++
+	return w.version
+}
+
+// Unwatch releases a Watch of key.
+func (s *KVStore) Unwatch(key string) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if w, ok := sh.watches[key]; ok {
+		if w.refs--; w.refs <= 0 {
+			delete(sh.watches, key)
+		}
+	}
+}
+
+// Version returns the current version of a watched key. It is compared with
+// the result of Watch to find out whether the key changed in between.
+func (tx *Tx) Version(key string) uint64 {
+	if w, ok := tx.shard(key).watches[key]; ok {
+		return w.version
+	}
+	return 0
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Kind is the data type held by a key. The zero value is a string, so
+// entries written before other types existed load unchanged.
+type Kind uint8
+
+const (
+	KindString Kind = iota
+	KindList
+	KindHash
+	KindSet
+	KindZSet
+)
+
+// String returns the name reported by the TYPE command.
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindList:
+		return "list"
+	case KindHash:
+		return "hash"
+	case KindSet:
+		return "set"
+	case KindZSet:
+		return "zset"
+	default:
+		return "unknown"
+	}
+}
+
+// Approximate per-element cost of each collection beyond the element bytes,
+// used for memory accounting.
+const (
+	listElemOverhead = 16
+	hashElemOverhead = 64
+	setElemOverhead  = 48
+	zsetElemOverhead = 80
+)
+
+// StringSet is the value of a set key.
+type StringSet map[string]struct{}
+
+// GobEncode encodes the set as a list of members; gob can't encode empty
+// structs.
+func (s StringSet) GobEncode() ([]byte, error) {
+	members := make([]string, 0, len(s))
+	for m := range s {
+		members = append(members, m)
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(members)
+	return buf.Bytes(), err
+}
+
+func (s *StringSet) GobDecode(data []byte) error {
+	var members []string
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&members); err != nil {
+		return err
+	}
+	*s = make(StringSet, len(members))
+	for _, m := range members {
+		(*s)[m] = struct{}{}
+	}
+	return nil
+}
+
+// Type returns the kind of value held by key.
+func (s *KVStore) Type(key string) (Kind, bool) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.Type(key)
+}
+
+func (tx *Tx) Type(key string) (Kind, bool) {
+	it := tx.live(key)
+	if it == nil {
+		return 0, false
+	}
+	return it.Kind, true
+}
+
+// lookup returns the live item for key, or nil if there is none. An item of
+// a different kind is an ErrWrongType.
+func (tx *Tx) lookup(key string, kind Kind) (*item, error) {
+	it := tx.live(key)
+	if it == nil {
+		return nil, nil
+	}
+	if it.Kind != kind {
+		return nil, ErrWrongType
+	}
+	return it, nil
+}
+
+// writable returns the item for key ready to be modified, creating an empty
+// one of the given kind if create is set. The current version is preserved
+// for open exports and watches first.
+func (tx *Tx) writable(key string, kind Kind, create bool) (*item, error) {
+	it, err := tx.lookup(key, kind)
+	if err != nil || (it == nil && !create) {
+		return nil, err
+	}
+
+	sh, now := tx.shard(key), tx.now
+	sh.beforeChange(key)
+	if it == nil {
+		// Drop an expired item that may still be in the map
+		sh.remove(key)
+		entry := Entry{Kind: kind, CreatedAt: now, UpdatedAt: now}
+		switch kind {
+		case KindHash:
+			entry.Hash = make(map[string]string)
+		case KindSet:
+			entry.Set = make(StringSet)
+		case KindZSet:
+			entry.ZSet = NewSortedSet()
+		}
+		it = newItem(entry, now)
+		sh.insert(key, it)
+	}
+	it.UpdatedAt = now
+	it.touch(now)
+	return it, nil
+}
+
+// dropIfEmpty deletes a collection left without elements, as Redis does.
+func (tx *Tx) dropIfEmpty(key string, it *item) {
+	if it.len() == 0 {
+		tx.shard(key).remove(key)
+	}
+}
+
+// len returns the number of elements in a collection.
+func (e *Entry) len() int {
+	switch e.Kind {
+	case KindList:
+		return len(e.List)
+	case KindHash:
+		return len(e.Hash)
+	case KindSet:
+		return len(e.Set)
+	case KindZSet:
+		return e.ZSet.Len()
+	default:
+		return 1
+	}
+}
+
+// valueSize returns the approximate memory held by the entry's value.
+func (e *Entry) valueSize() int64 {
+	switch e.Kind {
+	case KindList:
+		var n int64
+		for _, v := range e.List {
+			n += int64(len(v)) + listElemOverhead
+		}
+		return n
+	case KindHash:
+		var n int64
+		for f, v := range e.Hash {
+			n += int64(len(f)+len(v)) + hashElemOverhead
+		}
+		return n
+	case KindSet:
+		var n int64
+		for m := range e.Set {
+			n += int64(len(m)) + setElemOverhead
+		}
+		return n
+	case KindZSet:
+		var n int64
+		for _, m := range e.ZSet.Members() {
+			n += int64(len(m.Member)) + zsetElemOverhead
+		}
+		return n
+	default:
+		return int64(len(e.Value))
+	}
+}
+
+// normalizeRange converts inclusive start/stop indexes, which may be
+// negative to count from the end, into a slice range over n elements.
+func normalizeRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop + 1, true
+}
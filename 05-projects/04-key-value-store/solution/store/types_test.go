@@ -0,0 +1,212 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_List(t *testing.T) {
+	s := NewKVStore()
+
+	n, err := s.RPush("list", "b", "c")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = s.LPush("list", "a", "z")
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	values, err := s.LRange("list", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"z", "a", "b", "c"}, values)
+
+	values, err = s.LRange("list", -2, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, values)
+
+	values, err = s.LRange("list", 3, 1)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+
+	popped, err := s.RPop("list", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "b"}, popped)
+	s.RPush("list", "b", "c")
+
+	popped, err = s.LPop("list", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"z", "a", "b"}, popped)
+
+	// Popping the last element removes the key
+	popped, err = s.LPop("list", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, popped)
+	assert.False(t, s.Exists("list"))
+
+	popped, err = s.LPop("list", 1)
+	require.NoError(t, err)
+	assert.Nil(t, popped)
+}
+
+func TestKVStore_Hash(t *testing.T) {
+	s := NewKVStore()
+
+	added, err := s.HSet("hash", "f1", "v1", "f2", "v2")
+	require.NoError(t, err)
+	assert.Equal(t, 2, added)
+
+	added, err = s.HSet("hash", "f1", "updated", "f3", "v3")
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+
+	value, ok, err := s.HGet("hash", "f1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "updated", value)
+
+	_, ok, err = s.HGet("hash", "missing")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	all, err := s.HGetAll("hash")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f1": "updated", "f2": "v2", "f3": "v3"}, all)
+
+	removed, err := s.HDel("hash", "f1", "f2", "f3", "missing")
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.False(t, s.Exists("hash"))
+}
+
+func TestKVStore_Set(t *testing.T) {
+	s := NewKVStore()
+
+	added, err := s.SAdd("s1", "a", "b", "c", "a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, added)
+	_, err = s.SAdd("s2", "b", "c", "d")
+	require.NoError(t, err)
+	_, err = s.SAdd("s3", "c", "b", "x")
+	require.NoError(t, err)
+
+	members, err := s.SMembers("s1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, members)
+
+	inter, err := s.SInter("s1", "s2", "s3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, inter)
+
+	inter, err = s.SInter("s1", "missing")
+	require.NoError(t, err)
+	assert.Empty(t, inter)
+
+	removed, err := s.SRem("s1", "a", "b", "c", "z")
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.False(t, s.Exists("s1"))
+}
+
+func TestKVStore_SortedSet(t *testing.T) {
+	s := NewKVStore()
+
+	added, err := s.ZAdd("z",
+		ScoredMember{Member: "c", Score: 3},
+		ScoredMember{Member: "a", Score: 1},
+		ScoredMember{Member: "b", Score: 2},
+		ScoredMember{Member: "bb", Score: 2},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 4, added)
+
+	// Updating a score moves the member
+	added, err = s.ZAdd("z", ScoredMember{Member: "a", Score: 10})
+	require.NoError(t, err)
+	assert.Equal(t, 0, added)
+
+	all, err := s.ZRange("z", 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []ScoredMember{{"b", 2}, {"bb", 2}, {"c", 3}, {"a", 10}}, all)
+
+	rank, ok, err := s.ZRank("z", "c")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, rank)
+
+	_, ok, err = s.ZRank("z", "missing")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	byScore, err := s.ZRangeByScore("z", ScoreBound{Value: 2, Exclusive: true}, ScoreBound{Value: 10}, 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []ScoredMember{{"c", 3}, {"a", 10}}, byScore)
+
+	byScore, err = s.ZRangeByScore("z", ScoreBound{Value: 0}, ScoreBound{Value: 100}, 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []ScoredMember{{"bb", 2}, {"c", 3}}, byScore)
+}
+
+func TestKVStore_WrongType(t *testing.T) {
+	s := NewKVStore()
+	s.Set("string", "value")
+	_, err := s.RPush("list", "a")
+	require.NoError(t, err)
+
+	_, err = s.LPush("string", "a")
+	assert.ErrorIs(t, err, ErrWrongType)
+	_, _, err = s.HGet("list", "f")
+	assert.ErrorIs(t, err, ErrWrongType)
+	_, err = s.SInter("list")
+	assert.ErrorIs(t, err, ErrWrongType)
+	_, err = s.ZAdd("list", ScoredMember{Member: "m", Score: 1})
+	assert.ErrorIs(t, err, ErrWrongType)
+	_, _, err = s.GetString("list")
+	assert.ErrorIs(t, err, ErrWrongType)
+
+	// SET replaces a value of any type
+	s.Set("list", "now a string")
+	kind, ok := s.Type("list")
+	require.True(t, ok)
+	assert.Equal(t, KindString, kind)
+}
+
+func TestKVStore_CollectionMemoryAccounting(t *testing.T) {
+	s := NewKVStore()
+
+	s.RPush("list", "a", "bb")
+	s.HSet("hash", "f", "v")
+	s.SAdd("set", "m")
+	s.ZAdd("zset", ScoredMember{Member: "m", Score: 1})
+	assert.Greater(t, s.Stats().UsedMemory, int64(0))
+
+	s.LPop("list", 2)
+	s.HDel("hash", "f")
+	s.SRem("set", "m")
+	s.Del("zset")
+	assert.Equal(t, int64(0), s.Stats().UsedMemory)
+}
+
+func TestExport_CollectionsAreCopied(t *testing.T) {
+	s := NewKVStore()
+	s.RPush("list", "a")
+	s.HSet("hash", "f", "v1")
+	s.ZAdd("zset", ScoredMember{Member: "m", Score: 1})
+
+	e := s.Export()
+	defer e.Close()
+
+	// In-place changes after the export started must not leak into it
+	s.RPush("list", "b")
+	s.HSet("hash", "f", "v2")
+	s.ZAdd("zset", ScoredMember{Member: "m", Score: 2})
+
+	got := collect(e)
+	assert.Equal(t, []string{"a"}, got["list"].List)
+	assert.Equal(t, "v1", got["hash"].Hash["f"])
+	assert.Equal(t, 1, got["zset"].ZSet.Len())
+	rank, _ := got["zset"].ZSet.Rank("m")
+	assert.Equal(t, 0, rank)
+	assert.Equal(t, []ScoredMember{{"m", 1}}, got["zset"].ZSet.Members())
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/gob"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// ScoredMember is an element of a sorted set.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+func compareScored(a, b ScoredMember) int {
+	if c := cmp.Compare(a.Score, b.Score); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Member, b.Member)
+}
+
+// ScoreBound is one end of a score range; Exclusive excludes the value
+// itself, like "(1.5" in ZRANGEBYSCORE.
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+func (b ScoreBound) above(score float64) bool {
+	return score > b.Value || (!b.Exclusive && score == b.Value)
+}
+
+func (b ScoreBound) below(score float64) bool {
+	return score < b.Value || (!b.Exclusive && score == b.Value)
+}
+
+// SortedSet is the value of a zset key: members ordered by score, then by
+// member. The order is kept in a sorted slice next to a member index, so
+// rank and range queries are binary searches; inserts shift the slice.
+type SortedSet struct {
+	scores map[string]float64
+	order  []ScoredMember
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{scores: make(map[string]float64)}
+}
+
+// Len returns the number of members; a nil set is empty.
+func (z *SortedSet) Len() int {
+	if z == nil {
+		return 0
+	}
+	return len(z.order)
+}
+
+// Members returns the members in score order. The slice must not be
+// modified.
+func (z *SortedSet) Members() []ScoredMember {
+	if z == nil {
+		return nil
+	}
+	return z.order
+}
+
+// Add sets the score of member and reports whether it was new.
+func (z *SortedSet) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		i := z.index(member, old)
+		z.order = slices.Delete(z.order, i, i+1)
+	}
+
+	z.scores[member] = score
+	sm := ScoredMember{Member: member, Score: score}
+	i, _ := slices.BinarySearchFunc(z.order, sm, compareScored)
+	z.order = slices.Insert(z.order, i, sm)
+	return !exists
+}
+
+// Rank returns the 0-based position of member in score order.
+func (z *SortedSet) Rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	return z.index(member, score), true
+}
+
+func (z *SortedSet) index(member string, score float64) int {
+	i, _ := slices.BinarySearchFunc(z.order, ScoredMember{Member: member, Score: score}, compareScored)
+	return i
+}
+
+func (z *SortedSet) clone() *SortedSet {
+	if z == nil {
+		return nil
+	}
+	return &SortedSet{scores: maps.Clone(z.scores), order: slices.Clone(z.order)}
+}
+
+// GobEncode encodes the members in score order.
+func (z *SortedSet) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(z.order)
+	return buf.Bytes(), err
+}
+
+func (z *SortedSet) GobDecode(data []byte) error {
+	var order []ScoredMember
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&order); err != nil {
+		return err
+	}
+	z.scores = make(map[string]float64, len(order))
+	for _, sm := range order {
+		z.scores[sm.Member] = sm.Score
+	}
+	slices.SortFunc(order, compareScored)
+	z.order = order
+	return nil
+}
+
+// ZAdd sets the scores of members in the sorted set at key, creating it if
+// needed, and returns how many members were added rather than updated.
+func (s *KVStore) ZAdd(key string, members ...ScoredMember) (int, error) {
+	tx := s.lockKey(key, true)
+	defer tx.unlock()
+	return tx.ZAdd(key, members...)
+}
+
+func (tx *Tx) ZAdd(key string, members ...ScoredMember) (int, error) {
+	it, err := tx.writable(key, KindZSet, true)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, sm := range members {
+		if it.ZSet.Add(sm.Member, sm.Score) {
+			tx.s.used.Add(int64(len(sm.Member)) + zsetElemOverhead)
+			added++
+		}
+	}
+	return added, nil
+}
+
+// ZRange returns the members of the sorted set at key between ranks start
+// and stop inclusive. Negative ranks count from the highest score.
+func (s *KVStore) ZRange(key string, start, stop int) ([]ScoredMember, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.ZRange(key, start, stop)
+}
+
+func (tx *Tx) ZRange(key string, start, stop int) ([]ScoredMember, error) {
+	it, err := tx.lookup(key, KindZSet)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	it.touch(tx.now)
+
+	from, to, ok := normalizeRange(start, stop, it.ZSet.Len())
+	if !ok {
+		return nil, nil
+	}
+	return slices.Clone(it.ZSet.Members()[from:to]), nil
+}
+
+// ZRangeByScore returns the members of the sorted set at key whose score
+// lies between minScore and maxScore, skipping the first offset matches and
+// returning at most count of them (count < 0 means no limit).
+func (s *KVStore) ZRangeByScore(key string, minScore, maxScore ScoreBound, offset, count int) ([]ScoredMember, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.ZRangeByScore(key, minScore, maxScore, offset, count)
+}
+
+func (tx *Tx) ZRangeByScore(key string, minScore, maxScore ScoreBound, offset, count int) ([]ScoredMember, error) {
+	it, err := tx.lookup(key, KindZSet)
+	if it == nil || err != nil {
+		return nil, err
+	}
+	it.touch(tx.now)
+
+	order := it.ZSet.Members()
+	from := sort.Search(len(order), func(i int) bool { return minScore.above(order[i].Score) })
+	to := sort.Search(len(order), func(i int) bool { return !maxScore.below(order[i].Score) })
+	if offset < 0 {
+		return nil, nil
+	}
+	from += offset
+	if count >= 0 && from+count < to {
+		to = from + count
+	}
+	if from >= to {
+		return nil, nil
+	}
+	return slices.Clone(order[from:to]), nil
+}
+
+// ZRank returns the rank of member in the sorted set at key.
+func (s *KVStore) ZRank(key, member string) (int, bool, error) {
+	tx := s.lockKey(key, false)
+	defer tx.unlock()
+	return tx.ZRank(key, member)
+}
+
+func (tx *Tx) ZRank(key, member string) (int, bool, error) {
+	it, err := tx.lookup(key, KindZSet)
+	if it == nil || err != nil {
+		return 0, false, err
+	}
+	it.touch(tx.now)
+
+	rank, ok := it.ZSet.Rank(member)
+	return rank, ok, nil
+}
@@ -13,8 +13,9 @@ import (
 )
 
 var (
-	workers = flag.Int("workers", 5, "Number of workers")
-	mode    = flag.String("mode", "worker", "Mode: worker or producer")
+	workers  = flag.Int("workers", 5, "Number of workers")
+	mode     = flag.String("mode", "worker", "Mode: worker or producer")
+	dataFile = flag.String("data-file", "", "Log file that keeps tasks across restarts (in memory if empty)")
 )
 
 func main() {
@@ -22,6 +23,14 @@ func main() {
 
 	// Create queue
 	q := queue.NewPriorityQueue()
+	if *dataFile != "" {
+		storage, err := queue.OpenFileStorage(*dataFile)
+		if err != nil {
+			log.Fatalf("Failed to open task log: %v", err)
+		}
+		q = queue.NewPriorityQueueWithStorage(storage)
+	}
+	defer q.Close()
 
 	// Setup context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -9,6 +13,7 @@ import (
 	"github.com/alyxpink/go-training/taskqueue/queue"
 	"github.com/alyxpink/go-training/taskqueue/worker"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIntegration_WorkerPoolWithQueue(t *testing.T) {
@@ -366,6 +371,350 @@ func TestIntegration_MixedWorkload(t *testing.T) {
 	assert.GreaterOrEqual(t, errorCount.Load(), int32(10), "error tasks should be attempted")
 }
 
+// openFileQueue opens a queue kept in the log at path.
+func openFileQueue(t *testing.T, path string) *queue.PriorityQueue {
+	t.Helper()
+	storage, err := queue.OpenFileStorage(path)
+	require.NoError(t, err)
+	return queue.NewPriorityQueueWithStorage(storage)
+}
+
+func TestIntegration_FileStorageRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	q := openFileQueue(t, path)
+	for i, id := range []string{"done", "running", "retried", "waiting"} {
+		require.NoError(t, q.Enqueue(&queue.Task{ID: id, Type: "process", Priority: 5 - i, Payload: []byte(id)}))
+	}
+
+	task, err := q.Dequeue(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "done", task.ID)
+	require.NoError(t, q.Ack(task.ID, task.Lease))
+
+	running, err := q.Dequeue(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "running", running.ID)
+
+	retried, err := q.Dequeue(time.Second)
+	require.NoError(t, err)
+	retried.Attempts++
+	retried.Error = "boom"
+	require.NoError(t, q.Nack(retried.ID, retried.Lease, 300*time.Millisecond))
+	q.Close()
+
+	// The running task is ready again, and the retry comes back when due
+	q = openFileQueue(t, path)
+	defer q.Close()
+	assert.Equal(t, int64(2), q.GetStats().QueueLength)
+
+	var ids []string
+	for range 2 {
+		task, err := q.Dequeue(time.Second)
+		require.NoError(t, err)
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []string{"running", "waiting"}, ids)
+
+	task, err = q.Dequeue(2 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "retried", task.ID)
+	assert.Equal(t, 1, task.Attempts)
+	assert.Equal(t, "boom", task.Error)
+	assert.Equal(t, []byte("retried"), task.Payload)
+
+	_, err = q.Dequeue(50 * time.Millisecond)
+	assert.ErrorIs(t, err, queue.ErrQueueEmpty, "the completed task is gone")
+}
+
+// logRecords returns the number of records in the log at path.
+func logRecords(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestIntegration_FileStorageCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	q := openFileQueue(t, path)
+	const live = 50
+	for i := range live {
+		require.NoError(t, q.Enqueue(&queue.Task{ID: fmt.Sprintf("kept-%d", i), Type: "process"}))
+	}
+
+	// Completed tasks are dropped from the log along the way: it never
+	// grows much past the 1000 records that trigger a compaction, however
+	// many tasks went through it
+	for i := range 2500 {
+		require.NoError(t, q.Enqueue(&queue.Task{ID: fmt.Sprintf("task-%d", i), Type: "process", Priority: 5}))
+		task, err := q.Dequeue(time.Second)
+		require.NoError(t, err)
+		require.NoError(t, q.Ack(task.ID, task.Lease))
+		if i%100 == 0 {
+			require.LessOrEqual(t, logRecords(t, path), 1000+2, "after %d tasks", i)
+		}
+	}
+	q.Close()
+	assert.Greater(t, logRecords(t, path), live)
+
+	// A record torn by a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"push","task":{"ID":"torn"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Opening compacts the log down to one record per live task
+	storage, err := queue.OpenFileStorage(path)
+	require.NoError(t, err)
+	assert.Equal(t, live, storage.Len())
+	assert.Equal(t, live, logRecords(t, path))
+	task, err := storage.Pop(0)
+	require.NoError(t, err)
+	require.NoError(t, storage.Complete(task.ID))
+	require.NoError(t, storage.Compact())
+	assert.Equal(t, live-1, logRecords(t, path))
+	require.NoError(t, storage.Close())
+
+	require.NoError(t, os.WriteFile(path, []byte("{}\n{\"op\":\"push\"}\n"), 0644))
+	_, err = queue.OpenFileStorage(path)
+	assert.ErrorContains(t, err, "tasks.log:1")
+}
+
+func TestIntegration_WorkerPoolRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	q := openFileQueue(t, path)
+	pool := worker.NewWorkerPool(q, 2)
+
+	var attempts atomic.Int32
+	pool.RegisterHandler("flaky", func(payload []byte) ([]byte, error) {
+		if attempts.Add(1) == 1 {
+			return nil, assert.AnError
+		}
+		return []byte("ok"), nil
+	})
+	pool.Start(context.Background())
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "flaky", Type: "flaky"}))
+
+	// Stop while the first retry waits out its backoff
+	assert.Eventually(t, func() bool { return attempts.Load() == 1 }, time.Second, time.Millisecond)
+	q.Close()
+	pool.Stop()
+
+	q = openFileQueue(t, path)
+	defer q.Close()
+	pool = worker.NewWorkerPool(q, 2)
+	pool.RegisterHandler("flaky", func(payload []byte) ([]byte, error) {
+		attempts.Add(1)
+		return []byte("ok"), nil
+	})
+	pool.Start(context.Background())
+	defer pool.Stop()
+	assert.Eventually(t, func() bool { return attempts.Load() == 2 }, 2*time.Second, 10*time.Millisecond, "the retry runs after the restart")
+}
+
+func TestIntegration_Leases(t *testing.T) {
+	q := queue.NewPriorityQueue()
+	defer q.Close()
+	q.SetVisibilityTimeout(100 * time.Millisecond)
+	for _, id := range []string{"lost", "kept"} {
+		require.NoError(t, q.Enqueue(&queue.Task{ID: id, Type: "process"}))
+	}
+
+	lost, err := q.Dequeue(time.Second)
+	require.NoError(t, err)
+	kept, err := q.Dequeue(time.Second)
+	require.NoError(t, err)
+	assert.ErrorIs(t, q.Ack("missing", 1), queue.ErrUnknownLease)
+
+	// Only the task kept alive by heartbeats stays leased
+	for range 4 {
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, q.Heartbeat(kept.ID, kept.Lease))
+	}
+	assert.ErrorIs(t, q.Heartbeat(lost.ID, lost.Lease), queue.ErrLeaseExpired)
+	assert.ErrorIs(t, q.Ack(lost.ID, lost.Lease), queue.ErrLeaseExpired)
+	assert.ErrorIs(t, q.Nack(lost.ID, lost.Lease, 0), queue.ErrLeaseExpired)
+
+	again, err := q.Dequeue(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "lost", again.ID)
+	assert.Equal(t, 1, again.Attempts, "the lost attempt counts")
+	assert.Equal(t, "lease expired", again.Error)
+
+	// The worker that lost the lease can't touch the new one
+	assert.ErrorIs(t, q.Heartbeat(lost.ID, lost.Lease), queue.ErrLeaseExpired)
+	assert.ErrorIs(t, q.Fail(lost.ID, lost.Lease), queue.ErrLeaseExpired)
+
+	require.NoError(t, q.Ack(kept.ID, kept.Lease))
+	assert.ErrorIs(t, q.Ack(kept.ID, kept.Lease), queue.ErrUnknownLease)
+	require.NoError(t, q.Nack(again.ID, again.Lease, 0))
+	assert.ErrorIs(t, q.Fail(again.ID, again.Lease), queue.ErrUnknownLease)
+}
+
+func TestIntegration_WorkerHeartbeats(t *testing.T) {
+	q := queue.NewPriorityQueue()
+	defer q.Close()
+	q.SetVisibilityTimeout(60 * time.Millisecond)
+	pool := worker.NewWorkerPool(q, 2)
+
+	var runs, done atomic.Int32
+	pool.RegisterHandler("slow", func(payload []byte) ([]byte, error) {
+		runs.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		done.Add(1)
+		return []byte("done"), nil
+	})
+	pool.Start(context.Background())
+	defer pool.Stop()
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "slow", Type: "slow"}))
+
+	// The lease outlives the timeout while the handler runs
+	assert.Eventually(t, func() bool { return done.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), runs.Load())
+
+	// A timeout too short to divide into heartbeats doesn't stop the worker
+	q.SetVisibilityTimeout(2 * time.Nanosecond)
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "brief", Type: "slow"}))
+	assert.Eventually(t, func() bool { return runs.Load() >= 2 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestIntegration_DeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	q := openFileQueue(t, path)
+	pool := worker.NewWorkerPool(q, 2)
+
+	pool.RegisterHandler("flaky", func(payload []byte) ([]byte, error) {
+		return nil, fmt.Errorf("%s is down", payload)
+	})
+	pool.Start(context.Background())
+	for i := range 4 {
+		require.NoError(t, q.Enqueue(&queue.Task{
+			ID:         fmt.Sprintf("flaky-%d", i),
+			Type:       "flaky",
+			Payload:    []byte([]string{"db", "smtp"}[i%2]),
+			MaxRetries: 2,
+		}))
+	}
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "orphan", Type: "unknown"}))
+
+	assert.Eventually(t, func() bool { return len(q.DeadLetters(queue.DeadLetterFilter{})) == 5 }, 3*time.Second, 10*time.Millisecond)
+	pool.Stop()
+	q.Close()
+
+	// Dead letters survive a restart with their whole history
+	q = openFileQueue(t, path)
+	defer q.Close()
+	d, err := q.DeadLetter("flaky-0")
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Task.Attempts)
+	assert.Equal(t, "db is down", d.Task.Error)
+	require.Len(t, d.Task.History, 2)
+	for _, a := range d.Task.History {
+		assert.Equal(t, "db is down", a.Error)
+		assert.False(t, a.FinishedAt.Before(a.StartedAt))
+	}
+	assert.False(t, d.FailedAt.IsZero())
+	_, err = q.DeadLetter("missing")
+	assert.ErrorIs(t, err, queue.ErrNoDeadLetter)
+
+	smtp := queue.DeadLetterFilter{Type: "flaky", ErrorContains: "smtp"}
+	assert.Len(t, q.DeadLetters(smtp), 2)
+	assert.Empty(t, q.DeadLetters(queue.DeadLetterFilter{FailedAfter: time.Now()}))
+
+	// Purge one by one or by filter
+	require.NoError(t, q.PurgeDeadLetter("orphan"))
+	assert.ErrorIs(t, q.PurgeDeadLetter("orphan"), queue.ErrNoDeadLetter)
+	n, err := q.PurgeDeadLetters(smtp)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// Requeued tasks get their retries back and run again
+	var healed atomic.Int32
+	pool = worker.NewWorkerPool(q, 2)
+	pool.RegisterHandler("flaky", func(payload []byte) ([]byte, error) {
+		healed.Add(1)
+		return []byte("ok"), nil
+	})
+	pool.Start(context.Background())
+	defer pool.Stop()
+	require.NoError(t, q.RequeueDeadLetter("flaky-0"))
+	assert.ErrorIs(t, q.RequeueDeadLetter("flaky-0"), queue.ErrNoDeadLetter)
+	n, err = q.RequeueDeadLetters(queue.DeadLetterFilter{Type: "flaky"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, q.DeadLetters(queue.DeadLetterFilter{}))
+	assert.Eventually(t, func() bool { return healed.Load() == 2 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestIntegration_PoisonTasks(t *testing.T) {
+	// A task whose worker keeps losing its lease runs out of attempts
+	q := queue.NewPriorityQueue()
+	defer q.Close()
+	q.SetVisibilityTimeout(50 * time.Millisecond)
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "hang", Type: "process", MaxRetries: 2}))
+	for range 2 {
+		_, err := q.Dequeue(time.Second)
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool { return len(q.DeadLetters(queue.DeadLetterFilter{})) == 1 }, time.Second, 10*time.Millisecond)
+	d, err := q.DeadLetter("hang")
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Task.Attempts)
+	assert.Len(t, d.Task.History, 2)
+	_, err = q.Dequeue(100 * time.Millisecond)
+	assert.ErrorIs(t, err, queue.ErrQueueEmpty)
+
+	// A panicking handler fails the attempt like an error and leaves the
+	// worker be
+	pool := worker.NewWorkerPool(q, 1)
+	var ran, panics atomic.Int32
+	pool.RegisterHandler("panic", func(payload []byte) ([]byte, error) {
+		panics.Add(1)
+		panic("boom")
+	})
+	pool.RegisterHandler("ok", func(payload []byte) ([]byte, error) {
+		ran.Add(1)
+		return nil, nil
+	})
+	pool.Start(context.Background())
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "panic", Type: "panic", Priority: 5, MaxRetries: 2}))
+	require.NoError(t, q.Enqueue(&queue.Task{ID: "ok", Type: "ok"}))
+	assert.Eventually(t, func() bool { return ran.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(q.DeadLetters(queue.DeadLetterFilter{})) == 2 }, 2*time.Second, 10*time.Millisecond)
+	pool.Stop()
+	assert.Equal(t, int32(2), panics.Load(), "the panic is retried")
+	d, err = q.DeadLetter("panic")
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Task.Attempts)
+	assert.Equal(t, "handler panicked: boom", d.Task.Error)
+
+	// Tasks running at a restart count the lost attempt too
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	fq := openFileQueue(t, path)
+	require.NoError(t, fq.Enqueue(&queue.Task{ID: "last", Type: "process", MaxRetries: 1, Priority: 5}))
+	require.NoError(t, fq.Enqueue(&queue.Task{ID: "again", Type: "process"}))
+	for range 2 {
+		_, err := fq.Dequeue(time.Second)
+		require.NoError(t, err)
+	}
+	fq.Close()
+
+	fq = openFileQueue(t, path)
+	defer fq.Close()
+	task, err := fq.Dequeue(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "again", task.ID)
+	assert.Equal(t, 1, task.Attempts)
+	assert.Equal(t, "lease lost in restart", task.Error)
+	require.Len(t, task.History, 1)
+	assert.False(t, task.History[0].StartedAt.IsZero())
+	d, err = fq.DeadLetter("last")
+	require.NoError(t, err)
+	assert.Equal(t, 1, d.Task.Attempts)
+}
+
 func TestTaskHandlers(t *testing.T) {
 	// Test the default handlers
 	result, err := processTaskHandler([]byte("test data"))
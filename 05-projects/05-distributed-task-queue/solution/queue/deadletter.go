@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNoDeadLetter = errors.New("no dead letter for task")
+
+// DeadLetter is a task that failed for good, as it was when it last failed:
+// its Error and History tell why.
+type DeadLetter struct {
+	Task     *Task
+	FailedAt time.Time
+}
+
+// DeadLetterFilter selects dead letters. The zero filter selects them all.
+type DeadLetterFilter struct {
+	Type          string    // Of this type, if set
+	ErrorContains string    // Whose last error contains this, if set
+	FailedAfter   time.Time // Failed after this time, if set
+	FailedBefore  time.Time // Failed before this time, if set
+}
+
+// Match reports whether f selects d.
+func (f DeadLetterFilter) Match(d DeadLetter) bool {
+	switch {
+	case f.Type != "" && d.Task.Type != f.Type:
+		return false
+	case f.ErrorContains != "" && !strings.Contains(d.Task.Error, f.ErrorContains):
+		return false
+	case !f.FailedAfter.IsZero() && !d.FailedAt.After(f.FailedAfter):
+		return false
+	case !f.FailedBefore.IsZero() && !d.FailedAt.Before(f.FailedBefore):
+		return false
+	}
+	return true
+}
+
+// sortDeadLetters puts dead letters oldest first.
+func sortDeadLetters(dead []DeadLetter) {
+	sort.Slice(dead, func(i, j int) bool {
+		if !dead[i].FailedAt.Equal(dead[j].FailedAt) {
+			return dead[i].FailedAt.Before(dead[j].FailedAt)
+		}
+		return dead[i].Task.ID < dead[j].Task.ID
+	})
+}
+
+// DeadLetters returns the dead letters that filter selects, oldest first.
+func (pq *PriorityQueue) DeadLetters(filter DeadLetterFilter) []DeadLetter {
+	var dead []DeadLetter
+	for _, d := range pq.storage.DeadLetters() {
+		if filter.Match(d) {
+			dead = append(dead, DeadLetter{Task: d.Task.clone(), FailedAt: d.FailedAt})
+		}
+	}
+	return dead
+}
+
+// DeadLetter returns the dead letter for a task.
+func (pq *PriorityQueue) DeadLetter(taskID string) (DeadLetter, error) {
+	for _, d := range pq.storage.DeadLetters() {
+		if d.Task.ID == taskID {
+			return DeadLetter{Task: d.Task.clone(), FailedAt: d.FailedAt}, nil
+		}
+	}
+	return DeadLetter{}, ErrNoDeadLetter
+}
+
+// PurgeDeadLetter deletes the dead letter for a task.
+func (pq *PriorityQueue) PurgeDeadLetter(taskID string) error {
+	pq.deadMu.Lock()
+	defer pq.deadMu.Unlock()
+	if _, err := pq.DeadLetter(taskID); err != nil {
+		return err
+	}
+	return pq.storage.Purge(taskID)
+}
+
+// PurgeDeadLetters deletes the dead letters that filter selects, and
+// returns how many it deleted.
+func (pq *PriorityQueue) PurgeDeadLetters(filter DeadLetterFilter) (int, error) {
+	pq.deadMu.Lock()
+	defer pq.deadMu.Unlock()
+	n := 0
+	for _, d := range pq.DeadLetters(filter) {
+		if err := pq.storage.Purge(d.Task.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// RequeueDeadLetter enqueues the task of a dead letter again, with its
+// attempts reset; its history is kept.
+func (pq *PriorityQueue) RequeueDeadLetter(taskID string) error {
+	pq.deadMu.Lock()
+	defer pq.deadMu.Unlock()
+	d, err := pq.DeadLetter(taskID)
+	if err != nil {
+		return err
+	}
+	return pq.requeue(d.Task)
+}
+
+// RequeueDeadLetters enqueues the tasks of the dead letters that filter
+// selects again, like RequeueDeadLetter, and returns how many it enqueued.
+func (pq *PriorityQueue) RequeueDeadLetters(filter DeadLetterFilter) (int, error) {
+	pq.deadMu.Lock()
+	defer pq.deadMu.Unlock()
+	n := 0
+	for _, d := range pq.DeadLetters(filter) {
+		if err := pq.requeue(d.Task); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// requeue enqueues a dead task, which replaces its dead letter.
+func (pq *PriorityQueue) requeue(task *Task) error {
+	task.Status = StatusPending
+	task.Attempts = 0
+	task.Error = ""
+	task.StartedAt = nil
+	task.CompletedAt = nil
+	return pq.Enqueue(task)
+}
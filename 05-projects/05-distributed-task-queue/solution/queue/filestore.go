@@ -0,0 +1,493 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// compactMin is how many records the log must hold before FileStorage
+// compacts it on its own; it then does so once fewer than half of them
+// describe tasks it still holds.
+const compactMin = 1000
+
+// Operations written to the log
+const (
+	opPush     = "push"
+	opPop      = "pop"
+	opComplete = "complete"
+	opRetry    = "retry"
+	opFail     = "fail"
+	opPurge    = "purge"
+)
+
+// logRecord is one line of the log. Push, retry and fail carry the whole
+// task, the others only its ID. Pop, retry and fail also carry a time.
+type logRecord struct {
+	Op   string    `json:"op"`
+	ID   string    `json:"id,omitempty"`
+	Task *Task     `json:"task,omitempty"`
+	At   time.Time `json:"at,omitzero"`
+}
+
+type taskState int
+
+const (
+	statePending taskState = iota
+	stateRunning
+	stateScheduled
+	stateDead
+)
+
+// storedTask is a task FileStorage holds, with the order it was pushed in.
+// For a running task at is when it was popped, for a scheduled retry when it
+// is due, and for a dead letter when it failed.
+type storedTask struct {
+	task  Task
+	state taskState
+	at    time.Time
+	seq   int64
+}
+
+// FileStorage keeps tasks in an append-only log of JSON records, one per
+// line, synced to disk before each call returns. Opening it replays the
+// log: tasks that were running when the process stopped count a lost
+// attempt and are ready to run again, ahead of the others of their
+// priority, unless they have none left and become dead letters. Scheduled
+// retries are
+// handed to the queue. Tasks that completed and purged dead letters are
+// dropped from the log when it is compacted.
+//
+// Only one process may use a log at a time.
+type FileStorage struct {
+	mu      sync.Mutex
+	path    string
+	file    logFile
+	size    int64 // Of the records written in full
+	broken  error // Set if a failed record could not be taken back
+	tasks   map[string]*storedTask
+	pending [MaxPriority + 1][]*storedTask // front first, see queued
+	seq     int64
+	records int
+	retries []ScheduledTask
+	closed  bool
+}
+
+// OpenFileStorage opens the log at path, creating it if needed, and
+// recovers the tasks it holds. A record torn by a crash at the end of the
+// log is discarded.
+func OpenFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{path: path, tasks: make(map[string]*storedTask)}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	// Running tasks will never be acked now. The lost run counts as an
+	// attempt, like an expired lease; tasks with attempts left run again
+	// first, the others are dead letters
+	now := time.Now()
+	var running []*storedTask
+	for _, st := range s.tasks {
+		switch st.state {
+		case stateRunning:
+			st.task.Attempts++
+			st.task.Error = "lease lost in restart"
+			st.task.History = append(st.task.History, Attempt{StartedAt: st.at, FinishedAt: now, Error: st.task.Error})
+			if st.task.exhausted() {
+				st.state, st.at = stateDead, now
+				st.task.Status = StatusFailed
+				continue
+			}
+			running = append(running, st)
+		case stateScheduled:
+			task := st.task
+			s.retries = append(s.retries, ScheduledTask{Task: &task, At: st.at})
+		}
+	}
+	// The pops left entries behind for these tasks, which are let go before
+	// the tasks are pending again
+	for p := range s.pending {
+		s.pending[p] = s.queue(p)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].seq < running[j].seq })
+	var first [MaxPriority + 1][]*storedTask
+	for _, st := range running {
+		st.state, st.at = statePending, time.Time{}
+		st.task.Status = StatusPending
+		first[st.task.Priority] = append(first[st.task.Priority], st)
+	}
+	for p := range s.pending {
+		s.pending[p] = append(first[p], s.pending[p]...)
+	}
+	sort.Slice(s.retries, func(i, j int) bool { return s.retries[i].At.Before(s.retries[j].At) })
+
+	// Starting from a compacted log also makes the recovery durable
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the records of the log.
+func (s *FileStorage) replay() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything after the last newline is a torn write
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("queue: %w", err)
+		}
+		var rec logRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			if _, peek := r.Peek(1); peek == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("queue: %s:%d: %w", s.path, line, err)
+		}
+		if err := s.apply(&rec); err != nil {
+			return fmt.Errorf("queue: %s:%d: %w", s.path, line, err)
+		}
+		s.records++
+	}
+}
+
+// apply changes the tasks held as rec records.
+func (s *FileStorage) apply(rec *logRecord) error {
+	switch rec.Op {
+	case opPush:
+		if rec.Task == nil {
+			return errors.New("push record without a task")
+		}
+		if rec.Task.Priority < 0 || rec.Task.Priority > MaxPriority {
+			return fmt.Errorf("task %q has priority %d", rec.Task.ID, rec.Task.Priority)
+		}
+		s.seq++
+		// A pending task pushed again at its priority keeps its place
+		if st := s.tasks[rec.Task.ID]; st != nil && s.queued(st) && st.task.Priority == rec.Task.Priority {
+			st.task, st.seq = *rec.Task, s.seq
+			break
+		}
+		st := &storedTask{task: *rec.Task, state: statePending, seq: s.seq}
+		s.tasks[rec.Task.ID] = st
+		s.pending[st.task.Priority] = append(s.pending[st.task.Priority], st)
+	case opPop:
+		st := s.tasks[rec.ID]
+		if st == nil || st.state != statePending {
+			return fmt.Errorf("pop of task %q, which is not pending", rec.ID)
+		}
+		st.state, st.at = stateRunning, rec.At
+		st.task.Status = StatusRunning
+	case opRetry:
+		if rec.Task == nil {
+			return errors.New("retry record without a task")
+		}
+		s.tasks[rec.Task.ID] = &storedTask{task: *rec.Task, state: stateScheduled, at: rec.At}
+	case opFail:
+		if rec.Task == nil {
+			return errors.New("fail record without a task")
+		}
+		s.tasks[rec.Task.ID] = &storedTask{task: *rec.Task, state: stateDead, at: rec.At}
+	case opComplete, opPurge:
+		delete(s.tasks, rec.ID)
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	return nil
+}
+
+// queued reports whether an entry of pending is for a task that is still
+// pending. Records that take a task out of pending leave its entry behind,
+// rather than search for it; Pop skips such entries at the front, and
+// compaction drops the others.
+func (s *FileStorage) queued(st *storedTask) bool {
+	return s.tasks[st.task.ID] == st && st.state == statePending
+}
+
+// queue returns the tasks pending at priority, front first.
+func (s *FileStorage) queue(priority int) []*storedTask {
+	var sts []*storedTask
+	for _, st := range s.pending[priority] {
+		if s.queued(st) {
+			sts = append(sts, st)
+		}
+	}
+	return sts
+}
+
+// logFile is the part of *os.File the log is appended through.
+type logFile interface {
+	Write(p []byte) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// write appends rec to the log and syncs it, then applies it.
+func (s *FileStorage) write(rec *logRecord) error {
+	if s.closed {
+		return errors.New("queue: storage is closed")
+	}
+	if s.broken != nil {
+		return fmt.Errorf("queue: log is broken: %w", s.broken)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	line := append(data, '\n')
+	if _, err := s.file.Write(line); err != nil {
+		s.rollback()
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		s.rollback()
+		return fmt.Errorf("queue: %w", err)
+	}
+	s.size += int64(len(line))
+	s.records++
+	return s.apply(rec)
+}
+
+// rollback drops whatever part of a failed record made it to the log, so
+// the next one does not land behind garbage. If that fails too, the log
+// takes no more records until it is compacted.
+func (s *FileStorage) rollback() {
+	if err := s.file.Truncate(s.size); err != nil {
+		s.broken = err
+	}
+}
+
+// validate checks a task before a record of it is written. Replay rejects
+// a record it can't apply, and with it every later open of the log.
+func validate(task *Task) error {
+	if task.ID == "" {
+		return errors.New("queue: task has no ID")
+	}
+	if task.Priority < 0 || task.Priority > MaxPriority {
+		return fmt.Errorf("queue: task %q has priority %d", task.ID, task.Priority)
+	}
+	return nil
+}
+
+func (s *FileStorage) Push(task *Task) error {
+	if err := validate(task); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(&logRecord{Op: opPush, Task: task.clone()})
+}
+
+func (s *FileStorage) Pop(priority int) (*Task, error) {
+	if priority < 0 || priority > MaxPriority {
+		return nil, fmt.Errorf("queue: no priority %d", priority)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.pending[priority]
+	for len(q) > 0 && !s.queued(q[0]) {
+		q[0], q = nil, q[1:]
+	}
+	s.pending[priority] = q
+	if len(q) == 0 {
+		return nil, nil
+	}
+	st := q[0]
+	if err := s.write(&logRecord{Op: opPop, ID: st.task.ID, At: time.Now()}); err != nil {
+		return nil, err
+	}
+	q[0], s.pending[priority] = nil, q[1:]
+	return st.task.clone(), nil
+}
+
+func (s *FileStorage) Complete(id string) error {
+	return s.remove(&logRecord{Op: opComplete, ID: id})
+}
+
+func (s *FileStorage) Retry(task *Task, at time.Time) error {
+	if err := validate(task); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(&logRecord{Op: opRetry, Task: task.clone(), At: at})
+}
+
+func (s *FileStorage) Fail(task *Task) error {
+	if err := validate(task); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(&logRecord{Op: opFail, Task: task.clone(), At: time.Now()})
+}
+
+func (s *FileStorage) DeadLetters() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dead []DeadLetter
+	for _, st := range s.tasks {
+		if st.state == stateDead {
+			dead = append(dead, DeadLetter{Task: st.task.clone(), FailedAt: st.at})
+		}
+	}
+	sortDeadLetters(dead)
+	return dead
+}
+
+func (s *FileStorage) Purge(id string) error {
+	return s.remove(&logRecord{Op: opPurge, ID: id})
+}
+
+// remove writes a record that drops a task, and compacts the log once it
+// is mostly made of dropped ones.
+func (s *FileStorage) remove(rec *logRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	if s.records >= compactMin && s.records > 2*len(s.tasks) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStorage) Scheduled() []ScheduledTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retries
+}
+
+func (s *FileStorage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, st := range s.tasks {
+		if st.state == statePending {
+			n++
+		}
+	}
+	return n
+}
+
+// Compact rewrites the log with only the tasks it still holds.
+func (s *FileStorage) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("queue: storage is closed")
+	}
+	return s.compact()
+}
+
+// compact writes the tasks held to a new log, in the order they run, and
+// puts it in place of the old one.
+func (s *FileStorage) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	records := 0
+	add := func(rec *logRecord) {
+		enc.Encode(rec)
+		records++
+	}
+
+	var others []*storedTask
+	for _, st := range s.tasks {
+		if st.state != statePending {
+			others = append(others, st)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].task.ID < others[j].task.ID })
+	for _, st := range others {
+		t := st.task
+		switch st.state {
+		case stateScheduled:
+			add(&logRecord{Op: opRetry, Task: &t, At: st.at})
+		case stateDead:
+			add(&logRecord{Op: opFail, Task: &t, At: st.at})
+		default:
+			add(&logRecord{Op: opPush, Task: &t})
+			add(&logRecord{Op: opPop, ID: t.ID, At: st.at})
+		}
+	}
+	for p := range s.pending {
+		s.pending[p] = s.queue(p)
+		for _, st := range s.pending[p] {
+			t := st.task
+			add(&logRecord{Op: opPush, Task: &t})
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("queue: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	s.size = int64(buf.Len())
+	s.records = records
+	s.broken = nil
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
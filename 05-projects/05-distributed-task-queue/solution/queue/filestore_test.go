@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultyFile fails the next write after writing half of it, or the next
+// sync, or every truncate, as set.
+type faultyFile struct {
+	logFile
+	failWrite, failSync, failTruncate bool
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		n, _ := f.logFile.Write(p[:len(p)/2])
+		return n, errInjected
+	}
+	return f.logFile.Write(p)
+}
+
+func (f *faultyFile) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errInjected
+	}
+	return f.logFile.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errInjected
+	}
+	return f.logFile.Truncate(size)
+}
+
+func TestFileStorage_FailedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	s, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	faulty := &faultyFile{logFile: s.file}
+	s.file = faulty
+
+	require.NoError(t, s.Push(&Task{ID: "a"}))
+	faulty.failWrite = true
+	assert.ErrorIs(t, s.Push(&Task{ID: "torn"}), errInjected)
+	faulty.failSync = true
+	assert.ErrorIs(t, s.Push(&Task{ID: "unsynced"}), errInjected)
+	require.NoError(t, s.Push(&Task{ID: "b"}))
+	assert.Equal(t, 2, s.Len())
+
+	// A record that cannot be taken back stops the log until it is
+	// compacted
+	faulty.failWrite, faulty.failTruncate = true, true
+	assert.ErrorIs(t, s.Push(&Task{ID: "torn"}), errInjected)
+	assert.ErrorContains(t, s.Push(&Task{ID: "c"}), "log is broken")
+	require.NoError(t, s.Compact())
+	require.NoError(t, s.Push(&Task{ID: "c"}))
+	require.NoError(t, s.Close())
+
+	// The failed records left nothing behind
+	s, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer s.Close()
+	var ids []string
+	for {
+		task, err := s.Pop(0)
+		require.NoError(t, err)
+		if task == nil {
+			break
+		}
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+}
+
+func TestFileStorage_RejectsInvalidTasks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	s, err := OpenFileStorage(path)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push(&Task{ID: "a", Priority: MaxPriority}))
+	assert.Error(t, s.Push(&Task{ID: "high", Priority: MaxPriority + 1}))
+	assert.Error(t, s.Push(&Task{ID: "low", Priority: -1}))
+	assert.Error(t, s.Retry(&Task{Priority: 1}, time.Now()))
+	assert.Error(t, s.Fail(&Task{ID: "b", Priority: 9}))
+	_, err = s.Pop(MaxPriority + 1)
+	assert.Error(t, err)
+	_, err = s.Pop(-1)
+	assert.Error(t, err)
+	require.NoError(t, s.Close())
+
+	// Nothing was written that keeps the log from opening
+	s, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestFileStorage_Order(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.log")
+	s, err := OpenFileStorage(path)
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		require.NoError(t, s.Push(&Task{ID: id}))
+	}
+	// Pushed again at its priority a task keeps its place; at another one,
+	// or once failed, it leaves it
+	require.NoError(t, s.Push(&Task{ID: "b", Type: "again"}))
+	require.NoError(t, s.Push(&Task{ID: "c", Priority: 1}))
+	require.NoError(t, s.Fail(&Task{ID: "d"}))
+	for _, want := range []string{"a", "b"} {
+		task, err := s.Pop(0)
+		require.NoError(t, err)
+		assert.Equal(t, want, task.ID)
+	}
+	assert.Equal(t, 3, s.Len())
+	require.NoError(t, s.Close())
+
+	// Tasks that were running come first, in the order they were pushed
+	s, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer s.Close()
+	var ids []string
+	for {
+		task, err := s.Pop(0)
+		require.NoError(t, err)
+		if task == nil {
+			break
+		}
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []string{"a", "b", "e", "f"}, ids)
+	task, err := s.Pop(1)
+	require.NoError(t, err)
+	assert.Equal(t, "c", task.ID)
+}
@@ -2,13 +2,28 @@ package queue
 
 import (
 	"errors"
+	"log"
+	"slices"
 	"sync"
 	"time"
 )
 
+// MaxPriority is the highest priority; tasks run from MaxPriority down to 0.
+const MaxPriority = 5
+
+// DefaultMaxRetries is how many attempts a task gets when its MaxRetries is
+// not set.
+const DefaultMaxRetries = 3
+
+// DefaultVisibilityTimeout is how long a dequeued task stays leased to its
+// worker, unless changed with SetVisibilityTimeout.
+const DefaultVisibilityTimeout = 30 * time.Second
+
 var (
-	ErrQueueEmpty = errors.New("queue is empty")
-	ErrQueueFull  = errors.New("queue is full")
+	ErrQueueEmpty   = errors.New("queue is empty")
+	ErrQueueFull    = errors.New("queue is full")
+	ErrUnknownLease = errors.New("no lease on task")
+	ErrLeaseExpired = errors.New("lease on task expired")
 )
 
 type TaskStatus int
@@ -34,14 +49,66 @@ type Task struct {
 	CompletedAt *time.Time
 	Error       string
 	Result      []byte
+	History     []Attempt
+	// Lease identifies the lease of the Dequeue that returned the task.
+	// Ack, Nack, Fail and Heartbeat take it along with the ID, so a worker
+	// whose lease ran out can't end or extend the lease of the next one.
+	Lease uint64
+}
+
+// Attempt is one run of a task.
+type Attempt struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Error      string // Empty if the run succeeded
+}
+
+// exhausted reports whether t has used up its attempts.
+func (t *Task) exhausted() bool {
+	maxRetries := t.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	return t.Attempts >= maxRetries
+}
+
+// clone returns a copy of t that shares no history with it.
+func (t *Task) clone() *Task {
+	c := *t
+	c.History = slices.Clone(t.History)
+	return &c
 }
 
 type PriorityQueue struct {
-	queues     map[int]chan *Task
+	storage    Storage
 	priorities []int
 	mu         sync.RWMutex
 	stats      *Stats
 	closed     bool
+
+	// inflight holds the leases on dequeued tasks not yet acked, nacked or
+	// failed, expired the tasks whose lease ran out since they were last
+	// dequeued, and retries the timers of nacked tasks waiting to be
+	// enqueued again
+	taskMu            sync.Mutex
+	visibilityTimeout time.Duration
+	inflight          map[string]*lease
+	lastLease         uint64
+	expired           map[string]bool
+	retries           map[string]*time.Timer
+
+	// deadMu serializes the changes to dead letters
+	deadMu sync.Mutex
+}
+
+// lease is a dequeued task held by a worker until its deadline.
+type lease struct {
+	id       uint64
+	task     *Task
+	dequeued Task // as dequeued, to put back if the lease expires
+	since    time.Time
+	deadline time.Time
+	timer    *time.Timer
 }
 
 type Stats struct {
@@ -52,17 +119,29 @@ type Stats struct {
 	mu             sync.RWMutex
 }
 
-// NewPriorityQueue creates a new priority queue with support for priorities 0-5
+// NewPriorityQueue creates a new priority queue with support for priorities 0-5,
+// kept in memory
 func NewPriorityQueue() *PriorityQueue {
+	return NewPriorityQueueWithStorage(NewMemoryStorage())
+}
+
+// NewPriorityQueueWithStorage creates a priority queue that keeps its tasks
+// in storage, picking up those it already holds. Retries that were scheduled
+// are enqueued again when due. The queue closes storage when it is closed.
+func NewPriorityQueueWithStorage(storage Storage) *PriorityQueue {
 	pq := &PriorityQueue{
-		queues:     make(map[int]chan *Task),
+		storage:    storage,
 		priorities: []int{5, 4, 3, 2, 1, 0}, // Descending order for priority selection
-		stats:      &Stats{},
+		stats:      &Stats{QueueLength: int64(storage.Len())},
+		inflight:   make(map[string]*lease),
+		expired:    make(map[string]bool),
+		retries:    make(map[string]*time.Timer),
+
+		visibilityTimeout: DefaultVisibilityTimeout,
 	}
 
-	// Initialize channels for each priority level
-	for _, p := range pq.priorities {
-		pq.queues[p] = make(chan *Task, 1000)
+	for _, s := range storage.Scheduled() {
+		pq.scheduleRetry(s.Task, time.Until(s.At))
 	}
 
 	return pq
@@ -71,8 +150,8 @@ func NewPriorityQueue() *PriorityQueue {
 // Enqueue adds a task to the appropriate priority queue
 func (pq *PriorityQueue) Enqueue(task *Task) error {
 	pq.mu.RLock()
+	defer pq.mu.RUnlock()
 	if pq.closed {
-		pq.mu.RUnlock()
 		return errors.New("queue is closed")
 	}
 
@@ -88,25 +167,15 @@ func (pq *PriorityQueue) Enqueue(task *Task) error {
 	if task.Priority < 0 {
 		task.Priority = 0
 	}
-	if task.Priority > 5 {
-		task.Priority = 5
-	}
-
-	ch, ok := pq.queues[task.Priority]
-	pq.mu.RUnlock()
-
-	if !ok {
-		return errors.New("invalid priority")
+	if task.Priority > MaxPriority {
+		task.Priority = MaxPriority
 	}
 
-	// Non-blocking send with timeout
-	select {
-	case ch <- task:
-		pq.stats.IncrementQueueLength()
-		return nil
-	case <-time.After(100 * time.Millisecond):
-		return ErrQueueFull
+	if err := pq.storage.Push(task); err != nil {
+		return err
 	}
+	pq.stats.IncrementQueueLength()
+	return nil
 }
 
 // Dequeue retrieves a task from the highest priority non-empty queue
@@ -142,29 +211,13 @@ func (pq *PriorityQueue) Dequeue(timeout time.Duration) (*Task, error) {
 			for _, priority := range priorities {
 				// Skip high priorities during starvation prevention cycles
 				if starvePrevent || priority <= 2 {
-					pq.mu.RLock()
-					ch := pq.queues[priority]
-					pq.mu.RUnlock()
-
-					select {
-					case task := <-ch:
-						pq.stats.DecrementQueueLength()
-						return task, nil
-					default:
-						continue
+					if task, err := pq.pop(priority); task != nil || err != nil {
+						return task, err
 					}
 				} else {
 					// Normal priority-based dequeue
-					pq.mu.RLock()
-					ch := pq.queues[priority]
-					pq.mu.RUnlock()
-
-					select {
-					case task := <-ch:
-						pq.stats.DecrementQueueLength()
-						return task, nil
-					default:
-						continue
+					if task, err := pq.pop(priority); task != nil || err != nil {
+						return task, err
 					}
 				}
 			}
@@ -175,19 +228,203 @@ func (pq *PriorityQueue) Dequeue(timeout time.Duration) (*Task, error) {
 	}
 }
 
+// pop takes a task of priority from the storage and leases it.
+func (pq *PriorityQueue) pop(priority int) (*Task, error) {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	if pq.closed {
+		return nil, errors.New("queue is closed")
+	}
+
+	task, err := pq.storage.Pop(priority)
+	if task == nil || err != nil {
+		return nil, err
+	}
+	pq.stats.DecrementQueueLength()
+
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	now := time.Now()
+	pq.lastLease++
+	task.Lease = pq.lastLease
+	l := &lease{
+		id:       task.Lease,
+		task:     task,
+		dequeued: *task.clone(),
+		since:    now,
+		deadline: now.Add(pq.visibilityTimeout),
+	}
+	l.timer = time.AfterFunc(pq.visibilityTimeout, func() { pq.expire(l) })
+	pq.inflight[task.ID] = l
+	delete(pq.expired, task.ID)
+	return task, nil
+}
+
+// expire puts the task of l back in the queue if l is still in flight and
+// past its deadline. The lost attempt counts toward the task's attempts, so
+// a task that keeps crashing or hanging its worker ends up a dead letter.
+func (pq *PriorityQueue) expire(l *lease) {
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	id := l.dequeued.ID
+	if pq.inflight[id] != l || time.Now().Before(l.deadline) {
+		return
+	}
+	delete(pq.inflight, id)
+	pq.expired[id] = true
+
+	task := l.dequeued
+	task.Attempts++
+	task.Error = "lease expired"
+	task.History = append(task.History, Attempt{StartedAt: l.since, FinishedAt: time.Now(), Error: task.Error})
+	if task.exhausted() {
+		task.Status = StatusFailed
+		pq.stats.IncrementFailed()
+		if err := pq.storage.Fail(&task); err != nil {
+			log.Printf("Failed to fail task %s: %v", id, err)
+		}
+		return
+	}
+	pq.scheduleRetryLocked(&task, 0)
+}
+
+// leased returns the lease on a task if it is in flight under the lease
+// given. A task leased again since is reported as ErrLeaseExpired. Callers
+// must hold taskMu.
+func (pq *PriorityQueue) leased(taskID string, lease uint64) (*lease, error) {
+	l, ok := pq.inflight[taskID]
+	switch {
+	case ok && l.id == lease:
+		return l, nil
+	case ok || pq.expired[taskID]:
+		return nil, ErrLeaseExpired
+	}
+	return nil, ErrUnknownLease
+}
+
+// finish ends the lease on a task and returns the task, or an error if it
+// is not in flight under that lease.
+func (pq *PriorityQueue) finish(taskID string, lease uint64) (*Task, error) {
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	l, err := pq.leased(taskID, lease)
+	if err != nil {
+		return nil, err
+	}
+	l.timer.Stop()
+	delete(pq.inflight, taskID)
+	return l.task, nil
+}
+
+// SetVisibilityTimeout sets how long tasks dequeued from now on are leased
+// for before they are put back in the queue. A timeout that is not positive
+// restores DefaultVisibilityTimeout.
+func (pq *PriorityQueue) SetVisibilityTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultVisibilityTimeout
+	}
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	pq.visibilityTimeout = timeout
+}
+
+// VisibilityTimeout returns how long dequeued tasks are leased for.
+func (pq *PriorityQueue) VisibilityTimeout() time.Duration {
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	return pq.visibilityTimeout
+}
+
+// Heartbeat extends the lease on a dequeued task by the visibility timeout,
+// from now.
+func (pq *PriorityQueue) Heartbeat(taskID string, lease uint64) error {
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	l, err := pq.leased(taskID, lease)
+	if err != nil {
+		return err
+	}
+	l.deadline = time.Now().Add(pq.visibilityTimeout)
+	// A timer that already fired finds the new deadline and lets it be
+	l.timer.Stop()
+	l.timer = time.AfterFunc(pq.visibilityTimeout, func() { pq.expire(l) })
+	return nil
+}
+
 // Ack marks a task as completed
-func (pq *PriorityQueue) Ack(taskID string) error {
+func (pq *PriorityQueue) Ack(taskID string, lease uint64) error {
+	if _, err := pq.finish(taskID, lease); err != nil {
+		return err
+	}
 	pq.stats.IncrementCompleted()
-	return nil
+	return pq.storage.Complete(taskID)
 }
 
 // Nack re-queues a task for retry after a delay
-func (pq *PriorityQueue) Nack(taskID string, retryDelay time.Duration) error {
+func (pq *PriorityQueue) Nack(taskID string, lease uint64, retryDelay time.Duration) error {
+	task, err := pq.finish(taskID, lease)
+	if err != nil {
+		return err
+	}
 	pq.stats.IncrementFailed()
+
+	if err := pq.storage.Retry(task, time.Now().Add(retryDelay)); err != nil {
+		return err
+	}
+	pq.scheduleRetry(task, retryDelay)
 	return nil
 }
 
-// Close closes all priority queues
+// Fail marks a task as failed for good; it is not retried, but moved to the
+// dead-letter queue
+func (pq *PriorityQueue) Fail(taskID string, lease uint64) error {
+	task, err := pq.finish(taskID, lease)
+	if err != nil {
+		return err
+	}
+	pq.stats.IncrementFailed()
+	return pq.storage.Fail(task)
+}
+
+// scheduleRetry enqueues a copy of task again after delay, unless the queue
+// is closed by then; a durable storage still holds it for the next start.
+func (pq *PriorityQueue) scheduleRetry(task *Task, delay time.Duration) {
+	pq.taskMu.Lock()
+	defer pq.taskMu.Unlock()
+	pq.scheduleRetryLocked(task, delay)
+}
+
+func (pq *PriorityQueue) scheduleRetryLocked(task *Task, delay time.Duration) {
+	retry := *task.clone()
+	retry.Status = StatusPending
+
+	if old, ok := pq.retries[retry.ID]; ok {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		pq.taskMu.Lock()
+		if pq.retries[retry.ID] == timer {
+			delete(pq.retries, retry.ID)
+		}
+		pq.taskMu.Unlock()
+
+		pq.mu.RLock()
+		closed := pq.closed
+		pq.mu.RUnlock()
+		if closed {
+			return
+		}
+		if err := pq.Enqueue(&retry); err != nil {
+			log.Printf("Failed to re-enqueue task %s: %v", retry.ID, err)
+		}
+	})
+	pq.retries[retry.ID] = timer
+}
+
+// Close drops the leases, stops the pending retries and closes the storage.
+// Leased tasks stay running in a durable storage, and run again on the next
+// start.
 func (pq *PriorityQueue) Close() {
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
@@ -197,8 +434,18 @@ func (pq *PriorityQueue) Close() {
 	}
 
 	pq.closed = true
-	for _, ch := range pq.queues {
-		close(ch)
+	pq.taskMu.Lock()
+	for _, l := range pq.inflight {
+		l.timer.Stop()
+	}
+	for id, timer := range pq.retries {
+		timer.Stop()
+		delete(pq.retries, id)
+	}
+	pq.taskMu.Unlock()
+
+	if err := pq.storage.Close(); err != nil {
+		log.Printf("Failed to close queue storage: %v", err)
 	}
 }
 
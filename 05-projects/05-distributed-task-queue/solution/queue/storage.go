@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// Storage holds the tasks of a PriorityQueue: those ready to run, by
+// priority, and for durable implementations also those being run and those
+// waiting to be retried, so that a restarted queue can pick them up again.
+//
+// The queue serializes calls that change a task, but Pop may be called for
+// different priorities at once.
+type Storage interface {
+	// Push stores a task that is ready to run, at the back of its
+	// priority. A task with the ID of one already stored, dead letters
+	// included, replaces it. Push returns ErrQueueFull if there is no room
+	// for it.
+	Push(task *Task) error
+	// Pop takes the task at the front of priority, or returns nil if
+	// there is none, and stores it as running.
+	Pop(priority int) (*Task, error)
+	// Complete forgets a task that ran successfully.
+	Complete(id string) error
+	// Retry stores a task that failed, to be pushed again at at.
+	Retry(task *Task, at time.Time) error
+	// Fail stores a task that failed for good as a dead letter.
+	Fail(task *Task) error
+	// DeadLetters returns the dead letters, oldest first.
+	DeadLetters() []DeadLetter
+	// Purge forgets a dead letter.
+	Purge(id string) error
+
+	// Scheduled returns the retries stored before the queue started, which
+	// the queue pushes again when they are due.
+	Scheduled() []ScheduledTask
+	// Len returns the number of tasks ready to run.
+	Len() int
+	// Close releases the storage. Tasks stored are kept if it is durable.
+	Close() error
+}
+
+// ScheduledTask is a task waiting to be retried.
+type ScheduledTask struct {
+	Task *Task
+	At   time.Time
+}
+
+// MemoryStorage keeps ready tasks in a buffered channel per priority, and
+// dead letters in a map. It keeps nothing else, so a restart loses every
+// task.
+type MemoryStorage struct {
+	queues    map[int]chan *Task
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	dead map[string]DeadLetter
+}
+
+// NewMemoryStorage creates a storage with room for 1000 ready tasks per
+// priority.
+func NewMemoryStorage() *MemoryStorage {
+	s := &MemoryStorage{
+		queues: make(map[int]chan *Task),
+		dead:   make(map[string]DeadLetter),
+	}
+	for p := 0; p <= MaxPriority; p++ {
+		s.queues[p] = make(chan *Task, 1000)
+	}
+	return s
+}
+
+// Push waits up to 100ms for room in the task's priority.
+func (s *MemoryStorage) Push(task *Task) error {
+	select {
+	case s.queues[task.Priority] <- task:
+		s.mu.Lock()
+		delete(s.dead, task.ID)
+		s.mu.Unlock()
+		return nil
+	case <-time.After(100 * time.Millisecond):
+		return ErrQueueFull
+	}
+}
+
+func (s *MemoryStorage) Pop(priority int) (*Task, error) {
+	select {
+	case task := <-s.queues[priority]:
+		return task, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (s *MemoryStorage) Complete(id string) error             { return nil }
+func (s *MemoryStorage) Retry(task *Task, at time.Time) error { return nil }
+func (s *MemoryStorage) Scheduled() []ScheduledTask           { return nil }
+
+func (s *MemoryStorage) Fail(task *Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dead[task.ID] = DeadLetter{Task: task.clone(), FailedAt: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) DeadLetters() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dead := make([]DeadLetter, 0, len(s.dead))
+	for _, d := range s.dead {
+		dead = append(dead, d)
+	}
+	sortDeadLetters(dead)
+	return dead
+}
+
+func (s *MemoryStorage) Purge(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.dead, id)
+	return nil
+}
+
+func (s *MemoryStorage) Len() int {
+	n := 0
+	for _, ch := range s.queues {
+		n += len(ch)
+	}
+	return n
+}
+
+func (s *MemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		for _, ch := range s.queues {
+			close(ch)
+		}
+	})
+	return nil
+}
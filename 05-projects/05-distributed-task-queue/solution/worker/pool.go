@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -119,21 +120,32 @@ func (wp *WorkerPool) processTask(task *queue.Task) {
 		// No handler registered for this task type
 		task.Status = queue.StatusFailed
 		task.Error = "no handler registered for task type: " + task.Type
-		wp.queue.Nack(task.ID, 0)
+		task.History = append(task.History, queue.Attempt{StartedAt: now, FinishedAt: time.Now(), Error: task.Error})
+		if err := wp.queue.Fail(task.ID, task.Lease); err != nil {
+			log.Printf("Failed to fail task %s: %v", task.ID, err)
+		}
 		return
 	}
 
-	// Execute the handler
-	result, err := handler(task.Payload)
+	// Execute the handler, keeping the task leased while it runs
+	stopHeartbeat := wp.heartbeat(task.ID, task.Lease)
+	result, err := run(handler, task.Payload)
+	stopHeartbeat()
+	attempt := queue.Attempt{StartedAt: now, FinishedAt: time.Now()}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	task.History = append(task.History, attempt)
 
 	if err != nil {
 		// Task failed
 		task.Error = err.Error()
 		task.Status = queue.StatusFailed
 
-		// Check if we should retry
+		// Check if we should retry; a handler that panicked is retried
+		// like one that returned an error
 		if task.MaxRetries == 0 {
-			task.MaxRetries = 3 // Default max retries
+			task.MaxRetries = queue.DefaultMaxRetries
 		}
 
 		if task.Attempts < task.MaxRetries {
@@ -141,20 +153,15 @@ func (wp *WorkerPool) processTask(task *queue.Task) {
 			task.Status = queue.StatusRetrying
 			backoff := calculateBackoff(task.Attempts)
 
-			// Schedule retry
-			go func(t *queue.Task, delay time.Duration) {
-				time.Sleep(delay)
-				// Re-enqueue the task
-				t.Status = queue.StatusPending
-				if err := wp.queue.Enqueue(t); err != nil {
-					log.Printf("Failed to re-enqueue task %s: %v", t.ID, err)
-				}
-			}(task, backoff)
-
-			wp.queue.Nack(task.ID, backoff)
+			// The queue re-enqueues the task once the backoff is over
+			if err := wp.queue.Nack(task.ID, task.Lease, backoff); err != nil {
+				log.Printf("Failed to schedule retry of task %s: %v", task.ID, err)
+			}
 		} else {
-			// Max retries exceeded
-			wp.queue.Nack(task.ID, 0)
+			// Max retries exceeded; the queue keeps it as a dead letter
+			if err := wp.queue.Fail(task.ID, task.Lease); err != nil {
+				log.Printf("Failed to fail task %s: %v", task.ID, err)
+			}
 		}
 	} else {
 		// Task succeeded
@@ -162,10 +169,59 @@ func (wp *WorkerPool) processTask(task *queue.Task) {
 		task.CompletedAt = &completed
 		task.Status = queue.StatusCompleted
 		task.Result = result
-		wp.queue.Ack(task.ID)
+		if err := wp.queue.Ack(task.ID, task.Lease); err != nil {
+			// The lease ran out, so the task runs again
+			log.Printf("Failed to ack task %s: %v", task.ID, err)
+		}
 	}
 }
 
+// panicError is the error of a handler that panicked.
+type panicError struct {
+	value any
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.value)
+}
+
+// run calls handler, turning a panic into a *panicError so that it fails
+// the attempt instead of taking the worker down.
+func run(handler TaskHandler, payload []byte) (result []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			result, err = nil, &panicError{value: v}
+		}
+	}()
+	return handler(payload)
+}
+
+// minHeartbeat is the shortest interval between heartbeats, however short
+// the visibility timeout.
+const minHeartbeat = time.Millisecond
+
+// heartbeat extends the lease on a task three times per visibility timeout
+// until the returned function is called.
+func (wp *WorkerPool) heartbeat(taskID string, lease uint64) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(max(wp.queue.VisibilityTimeout()/3, minHeartbeat))
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := wp.queue.Heartbeat(taskID, lease); err != nil {
+					log.Printf("Failed to extend lease on task %s: %v", taskID, err)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
 // calculateBackoff calculates exponential backoff delay
 func calculateBackoff(attempts int) time.Duration {
 	// Exponential backoff: 2^(attempts-1) * 100ms for faster retries in tests